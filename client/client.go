@@ -0,0 +1,420 @@
+/*
+Copyright © 2020 Jody Scott <jody@thescottsweb.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package client is the Go client for TokenMachine. It performs the nonce
+// exchange required to obtain shared secrets and keytabs:
+//
+//  1. Get a token from the TokenSource
+//  2. Get a nonce from TokenMachine with the token
+//  3. Get a new token from the TokenSource with the audience set to the nonce
+//  4. Get the shared secret or keytab from TokenMachine with the new token
+//
+// Results are cached until they expire and transient errors are retried.
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jodydadescott/libtokenmachine"
+)
+
+const (
+	defaultTimeout   = 30 * time.Second
+	defaultRetries   = 3
+	defaultRetryWait = 250 * time.Millisecond
+	maxRetryWait     = 5 * time.Second
+
+	// Max size of a response. Keytabs are the largest response.
+	maxResponseSize = 1024 * 1024
+)
+
+// TokenSource returns bearer tokens from the identity provider. If audience is
+// not empty the token must have its aud claim set to audience.
+type TokenSource interface {
+	Token(ctx context.Context, audience string) (string, error)
+}
+
+// TokenSourceFunc is an adapter to allow the use of ordinary functions as a
+// TokenSource
+type TokenSourceFunc func(ctx context.Context, audience string) (string, error)
+
+// Token calls f(ctx, audience)
+func (f TokenSourceFunc) Token(ctx context.Context, audience string) (string, error) {
+	return f(ctx, audience)
+}
+
+// Config Config
+type Config struct {
+	URL          string         // TokenMachine URL such as https://tokenmachine.example.com:8443
+	TokenSource  TokenSource    // Required
+	RootCAs      *x509.CertPool // Optional CAs used to verify the server; default is the system CAs
+	HTTPClient   *http.Client   // Optional; if set RootCAs and Timeout are ignored
+	Timeout      time.Duration  // Timeout of each HTTP request; default is 30 seconds. Negative disables the timeout
+	Retries      int            // Retries of transient errors; default is 3. Negative disables retries
+	RetryWait    time.Duration  // Initial wait between retries which is doubled on each retry; default is 250ms
+	DisableCache bool           // Do not cache secrets and keytabs
+	Challenge    bool           // Get the nonce from the server challenge instead of GetNonce; requires nonceChallenge on the server
+}
+
+// Client TokenMachine client
+type Client struct {
+	url         string
+	tokenSource TokenSource
+	httpClient  *http.Client
+	retries     int
+	retryWait   time.Duration
+	cache       bool
+	challenge   bool
+	mutex       sync.Mutex
+	secrets     map[string]*libtokenmachine.SharedSecret
+	keytabs     map[string]*libtokenmachine.Keytab
+}
+
+// Build Returns a new Client
+func (config *Config) Build() (*Client, error) {
+
+	if config.URL == "" {
+		return nil, fmt.Errorf("URL is required")
+	}
+
+	serverURL, err := url.Parse(config.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	if serverURL.Scheme != "https" && serverURL.Scheme != "http" {
+		return nil, fmt.Errorf("URL scheme must be https or http")
+	}
+
+	if config.TokenSource == nil {
+		return nil, fmt.Errorf("TokenSource is required")
+	}
+
+	t := &Client{
+		url:         strings.TrimSuffix(config.URL, "/"),
+		tokenSource: config.TokenSource,
+		httpClient:  config.HTTPClient,
+		retries:     defaultRetries,
+		retryWait:   defaultRetryWait,
+		cache:       !config.DisableCache,
+		challenge:   config.Challenge,
+		secrets:     make(map[string]*libtokenmachine.SharedSecret),
+		keytabs:     make(map[string]*libtokenmachine.Keytab),
+	}
+
+	if config.Retries > 0 {
+		t.retries = config.Retries
+	}
+
+	if config.Retries < 0 {
+		t.retries = 0
+	}
+
+	if config.RetryWait > 0 {
+		t.retryWait = config.RetryWait
+	}
+
+	if t.httpClient == nil {
+
+		timeout := defaultTimeout
+		if config.Timeout > 0 {
+			timeout = config.Timeout
+		}
+
+		if config.Timeout < 0 {
+			timeout = 0
+		}
+
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{RootCAs: config.RootCAs}
+
+		t.httpClient = &http.Client{
+			Timeout:   timeout,
+			Transport: transport,
+		}
+	}
+
+	return t, nil
+}
+
+// GetNonce returns a new nonce
+func (t *Client) GetNonce(ctx context.Context) (*libtokenmachine.Nonce, error) {
+
+	var nonce *libtokenmachine.Nonce
+
+	err := t.retry(ctx, func() error {
+		var err error
+		nonce, err = t.getNonce(ctx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return nonce, nil
+}
+
+func (t *Client) getNonce(ctx context.Context) (*libtokenmachine.Nonce, error) {
+
+	token, err := t.tokenSource.Token(ctx, "")
+	if err != nil {
+		return nil, fmt.Errorf("Unable to get token; err->%w", err)
+	}
+
+	nonce := &libtokenmachine.Nonce{}
+	err = t.doOnce(ctx, http.MethodPost, "/v1/nonce", token, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	return nonce, nil
+}
+
+// GetSecret returns the shared secret with name. The secret is cached until
+// it expires.
+func (t *Client) GetSecret(ctx context.Context, name string) (*libtokenmachine.SharedSecret, error) {
+
+	if name == "" {
+		return nil, fmt.Errorf("name is required")
+	}
+
+	t.mutex.Lock()
+	cached, ok := t.secrets[name]
+	t.mutex.Unlock()
+
+	if ok && !expired(SecretExp(cached)) {
+		return cached.Copy(), nil
+	}
+
+	secret := &libtokenmachine.SharedSecret{}
+	err := t.getWithNonce(ctx, "/v1/secrets/"+url.PathEscape(name), secret)
+	if err != nil {
+		return nil, err
+	}
+
+	if t.cache {
+		t.mutex.Lock()
+		t.secrets[name] = secret.Copy()
+		t.mutex.Unlock()
+	}
+
+	return secret, nil
+}
+
+// GetKeytab returns the keytab with name. The keytab is cached until it
+// expires.
+func (t *Client) GetKeytab(ctx context.Context, name string) (*libtokenmachine.Keytab, error) {
+
+	if name == "" {
+		return nil, fmt.Errorf("name is required")
+	}
+
+	t.mutex.Lock()
+	cached, ok := t.keytabs[name]
+	t.mutex.Unlock()
+
+	if ok && !expired(cached.Exp) {
+		return cached.Copy(), nil
+	}
+
+	keytab := &libtokenmachine.Keytab{}
+	err := t.getWithNonce(ctx, "/v1/keytabs/"+url.PathEscape(name), keytab)
+	if err != nil {
+		return nil, err
+	}
+
+	if t.cache {
+		t.mutex.Lock()
+		t.keytabs[name] = keytab.Copy()
+		t.mutex.Unlock()
+	}
+
+	return keytab, nil
+}
+
+// getWithNonce gets a nonce, a token with the nonce as the audience and then
+// path with the token. The token may be consumed by a request that fails so
+// the whole exchange is repeated with a new nonce on a transient error.
+func (t *Client) getWithNonce(ctx context.Context, path string, result interface{}) error {
+
+	if t.challenge {
+		return t.retry(ctx, func() error {
+			return t.getWithChallenge(ctx, path, result)
+		})
+	}
+
+	return t.retry(ctx, func() error {
+
+		nonce, err := t.getNonce(ctx)
+		if err != nil {
+			return err
+		}
+
+		token, err := t.tokenSource.Token(ctx, nonce.Value)
+		if err != nil {
+			return fmt.Errorf("Unable to get token with nonce audience; err->%w", err)
+		}
+
+		return t.doOnce(ctx, http.MethodPost, path, token, result)
+	})
+}
+
+// getWithChallenge gets path with a token without a nonce. If the server
+// answers with a nonce challenge the request is repeated with a token with
+// the nonce as the audience.
+func (t *Client) getWithChallenge(ctx context.Context, path string, result interface{}) error {
+
+	token, err := t.tokenSource.Token(ctx, "")
+	if err != nil {
+		return fmt.Errorf("Unable to get token; err->%w", err)
+	}
+
+	err = t.doOnce(ctx, http.MethodPost, path, token, result)
+
+	var e *Error
+	if !errors.As(err, &e) || e.Code != ErrCodeNonceRequired || e.Nonce == "" {
+		return err
+	}
+
+	token, err = t.tokenSource.Token(ctx, e.Nonce)
+	if err != nil {
+		return fmt.Errorf("Unable to get token with nonce audience; err->%w", err)
+	}
+
+	return t.doOnce(ctx, http.MethodPost, path, token, result)
+}
+
+// retry calls fn until it returns nil, an error that is not transient or the
+// retries are exhausted
+func (t *Client) retry(ctx context.Context, fn func() error) error {
+
+	wait := t.retryWait
+
+	for attempt := 0; ; attempt++ {
+
+		err := fn()
+		if err == nil || attempt >= t.retries || !isTransient(err) {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+
+		wait *= 2
+		if wait > maxRetryWait {
+			wait = maxRetryWait
+		}
+	}
+}
+
+func (t *Client) doOnce(ctx context.Context, method, path, token string, result interface{}) error {
+
+	// The token is sent in the body rather than the header so that it is
+	// less likely to be logged by proxies
+	body, err := json.Marshal(map[string]string{"token": token})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, t.url+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := t.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return newError(resp, data)
+	}
+
+	err = json.Unmarshal(data, result)
+	if err != nil {
+		return fmt.Errorf("Unable to decode response; err->%s", err)
+	}
+
+	return nil
+}
+
+// isTransient returns true if the request may succeed if retried
+func isTransient(err error) bool {
+
+	var e *Error
+	if errors.As(err, &e) {
+		switch e.StatusCode {
+		case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+
+	// Connection refused, reset, timeouts and similar. TLS verification
+	// errors are not network errors and are not retried.
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return true
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return netErr.Timeout()
+	}
+
+	return false
+}
+
+// SecretExp returns the time in UNIX epoch seconds when the secret (not the
+// next secret) of secret is no longer valid. The server returns the start of
+// the period of the secret as exp and the length of the period as lifetime.
+// If lifetime is not set exp is returned.
+func SecretExp(secret *libtokenmachine.SharedSecret) int64 {
+	if secret.Lifetime > 0 {
+		return secret.Exp + int64(secret.Lifetime.Seconds())
+	}
+	return secret.Exp
+}
+
+func expired(exp int64) bool {
+	return time.Now().Unix() >= exp
+}
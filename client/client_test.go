@@ -0,0 +1,339 @@
+/*
+Copyright © 2020 Jody Scott <jody@thescottsweb.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jodydadescott/libtokenmachine"
+)
+
+// testServer is a TokenMachine that issues single use nonces. The tokens of
+// the testTokenSource are "token" and "token:<audience>".
+type testServer struct {
+	*httptest.Server
+	mutex     sync.Mutex
+	issued    int
+	used      map[string]bool
+	requests  []string
+	failures  int  // Number of secret requests to answer with 503 after consuming the nonce
+	challenge bool // Answer secret requests without a nonce with a challenge
+}
+
+func newTestServer(t *testing.T) *testServer {
+
+	server := &testServer{used: make(map[string]bool)}
+	server.Server = httptest.NewServer(http.HandlerFunc(server.serve))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func (t *testServer) serve(w http.ResponseWriter, r *http.Request) {
+
+	var body struct {
+		Token string `json:"token"`
+	}
+	json.NewDecoder(r.Body).Decode(&body)
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.requests = append(t.requests, r.URL.Path+" "+body.Token)
+
+	writeError := func(status int, code string) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		fmt.Fprintf(w, `{"code":%q,"error":%q,"requestId":"r"}`, code, code)
+	}
+
+	if r.URL.Path == "/v1/nonce" {
+		t.issued++
+		json.NewEncoder(w).Encode(&libtokenmachine.Nonce{
+			Value: fmt.Sprintf("n%d", t.issued),
+			Exp:   time.Now().Add(time.Minute).Unix(),
+		})
+		return
+	}
+
+	nonce := strings.TrimPrefix(body.Token, "token:")
+
+	if nonce == body.Token {
+		if !t.challenge {
+			writeError(http.StatusForbidden, ErrCodeDenied)
+			return
+		}
+		t.issued++
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="nonce_required", nonce="n%d"`, t.issued))
+		writeError(http.StatusUnauthorized, ErrCodeNonceRequired)
+		return
+	}
+
+	if t.used[nonce] {
+		writeError(http.StatusUnauthorized, ErrCodeNonceUsed)
+		return
+	}
+	t.used[nonce] = true
+
+	if t.failures > 0 {
+		t.failures--
+		writeError(http.StatusServiceUnavailable, ErrCodeInternal)
+		return
+	}
+
+	// Exp is the start of the period of the secret
+	json.NewEncoder(w).Encode(&libtokenmachine.SharedSecret{
+		Name:     strings.TrimPrefix(r.URL.Path, "/v1/secrets/"),
+		Secret:   "secret-" + nonce,
+		Exp:      time.Now().Add(-time.Minute).Unix(),
+		Lifetime: 2 * time.Minute,
+	})
+}
+
+func (t *testServer) getRequests() []string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return append([]string(nil), t.requests...)
+}
+
+var testTokenSource = TokenSourceFunc(func(ctx context.Context, audience string) (string, error) {
+	if audience == "" {
+		return "token", nil
+	}
+	return "token:" + audience, nil
+})
+
+func newTestClient(t *testing.T, server *testServer, modify func(config *Config)) *Client {
+
+	config := &Config{
+		URL:         server.URL,
+		TokenSource: testTokenSource,
+		RetryWait:   time.Millisecond,
+	}
+
+	if modify != nil {
+		modify(config)
+	}
+
+	client, err := config.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return client
+}
+
+func TestBuildInvalid(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		config *Config
+	}{
+		{"no url", &Config{TokenSource: testTokenSource}},
+		{"scheme", &Config{URL: "ftp://example.com", TokenSource: testTokenSource}},
+		{"no token source", &Config{URL: "https://example.com"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := test.config.Build(); err == nil {
+				t.Errorf("expected error")
+			}
+		})
+	}
+}
+
+func TestBuildTimeout(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		want    time.Duration
+	}{
+		{"default", 0, defaultTimeout},
+		{"set", 5 * time.Second, 5 * time.Second},
+		{"disabled", -1, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := &Config{URL: "https://example.com", TokenSource: testTokenSource, Timeout: test.timeout}
+			client, err := config.Build()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if client.httpClient.Timeout != test.want {
+				t.Errorf("expected timeout %s, got %s", test.want, client.httpClient.Timeout)
+			}
+		})
+	}
+}
+
+func TestGetSecret(t *testing.T) {
+
+	tests := []struct {
+		name      string
+		modify    func(config *Config)
+		failures  int
+		challenge bool
+		err       bool
+		secret    string
+		requests  []string
+	}{
+		{"nonce exchange", nil, 0, false, false, "secret-n1", []string{
+			"/v1/nonce token",
+			"/v1/secrets/a token:n1",
+		}},
+		{"retry with new nonce", nil, 1, false, false, "secret-n2", []string{
+			"/v1/nonce token",
+			"/v1/secrets/a token:n1",
+			"/v1/nonce token",
+			"/v1/secrets/a token:n2",
+		}},
+		{"retries exhausted", func(c *Config) { c.Retries = 1 }, 2, false, true, "", []string{
+			"/v1/nonce token",
+			"/v1/secrets/a token:n1",
+			"/v1/nonce token",
+			"/v1/secrets/a token:n2",
+		}},
+		{"retries disabled", func(c *Config) { c.Retries = -1 }, 1, false, true, "", []string{
+			"/v1/nonce token",
+			"/v1/secrets/a token:n1",
+		}},
+		{"challenge", func(c *Config) { c.Challenge = true }, 0, true, false, "secret-n1", []string{
+			"/v1/secrets/a token",
+			"/v1/secrets/a token:n1",
+		}},
+		{"challenge retry with new nonce", func(c *Config) { c.Challenge = true }, 1, true, false, "secret-n2", []string{
+			"/v1/secrets/a token",
+			"/v1/secrets/a token:n1",
+			"/v1/secrets/a token",
+			"/v1/secrets/a token:n2",
+		}},
+		{"challenge not enabled on server", func(c *Config) { c.Challenge = true }, 0, false, true, "", []string{
+			"/v1/secrets/a token",
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			server := newTestServer(t)
+			server.failures = test.failures
+			server.challenge = test.challenge
+
+			client := newTestClient(t, server, test.modify)
+
+			secret, err := client.GetSecret(context.Background(), "a")
+
+			if test.err != (err != nil) {
+				t.Fatalf("err is %v; want error %t", err, test.err)
+			}
+
+			if err == nil && secret.Secret != test.secret {
+				t.Errorf("secret is %s; want %s", secret.Secret, test.secret)
+			}
+
+			if requests := server.getRequests(); strings.Join(requests, "\n") != strings.Join(test.requests, "\n") {
+				t.Errorf("requests are\n%s\nwant\n%s", strings.Join(requests, "\n"), strings.Join(test.requests, "\n"))
+			}
+		})
+	}
+}
+
+func TestGetSecretCache(t *testing.T) {
+
+	tests := []struct {
+		disableCache bool
+		requests     int
+	}{
+		{false, 2},
+		{true, 4},
+	}
+
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("disableCache=%t", test.disableCache), func(t *testing.T) {
+
+			server := newTestServer(t)
+			client := newTestClient(t, server, func(c *Config) { c.DisableCache = test.disableCache })
+
+			for i := 0; i < 2; i++ {
+				if _, err := client.GetSecret(context.Background(), "a"); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if requests := len(server.getRequests()); requests != test.requests {
+				t.Errorf("server received %d requests; want %d", requests, test.requests)
+			}
+		})
+	}
+}
+
+func TestSecretExp(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		secret *libtokenmachine.SharedSecret
+		exp    int64
+	}{
+		{"lifetime", &libtokenmachine.SharedSecret{Exp: 3600, Lifetime: time.Hour}, 7200},
+		{"no lifetime", &libtokenmachine.SharedSecret{Exp: 3600}, 3600},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if exp := SecretExp(test.secret); exp != test.exp {
+				t.Errorf("exp is %d; want %d", exp, test.exp)
+			}
+		})
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+
+	tests := []struct {
+		name      string
+		err       error
+		transient bool
+	}{
+		{"service unavailable", &Error{StatusCode: http.StatusServiceUnavailable}, true},
+		{"too many requests", &Error{StatusCode: http.StatusTooManyRequests}, true},
+		{"bad gateway", fmt.Errorf("wrapped; err->%w", &Error{StatusCode: http.StatusBadGateway}), true},
+		{"internal error", &Error{StatusCode: http.StatusInternalServerError}, false},
+		{"denied", &Error{StatusCode: http.StatusForbidden}, false},
+		{"connection refused", &net.OpError{Op: "dial", Err: errors.New("connection refused")}, true},
+		{"other", errors.New("other"), false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if transient := isTransient(test.err); transient != test.transient {
+				t.Errorf("isTransient is %t; want %t", transient, test.transient)
+			}
+		})
+	}
+}
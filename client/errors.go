@@ -0,0 +1,112 @@
+/*
+Copyright © 2020 Jody Scott <jody@thescottsweb.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"github.com/jodydadescott/libtokenmachine"
+)
+
+// Error codes returned by TokenMachine. These match the codes in the server
+// error response.
+const (
+	ErrCodeBadRequest       = "bad_request"
+	ErrCodeTokenRequired    = "token_required"
+	ErrCodeTokenInvalid     = "token_invalid"
+	ErrCodeTokenExpired     = "token_expired"
+	ErrCodeNonceUsed        = "nonce_used"
+	ErrCodeNonceRequired    = "nonce_required"
+	ErrCodeDenied           = "denied"
+	ErrCodeNotFound         = "not_found"
+	ErrCodeMethodNotAllowed = "method_not_allowed"
+	ErrCodeInternal         = "internal_error"
+)
+
+var challengeNonceRegex = regexp.MustCompile(`nonce="([^"]*)"`)
+
+// Error is returned when TokenMachine responds with a non 2xx status. Use
+// errors.Is with the libtokenmachine errors (ErrDenied, ErrNotFound, ...) to
+// check the cause.
+type Error struct {
+	StatusCode int    `json:"-"`
+	Code       string `json:"code"`
+	Message    string `json:"error"`
+	RequestID  string `json:"requestId,omitempty"`
+	Nonce      string `json:"-"` // Nonce from the WWW-Authenticate challenge with code nonce_required
+}
+
+func newError(resp *http.Response, data []byte) *Error {
+
+	e := &Error{}
+	if json.Unmarshal(data, e) != nil || e.Message == "" {
+		e.Message = http.StatusText(resp.StatusCode)
+	}
+
+	e.StatusCode = resp.StatusCode
+
+	if e.Code == ErrCodeNonceRequired {
+		e.Nonce = getChallengeNonce(resp.Header.Get("WWW-Authenticate"))
+	}
+
+	return e
+}
+
+func (t *Error) Error() string {
+	if t.RequestID == "" {
+		return fmt.Sprintf("%s (status=%d, code=%s)", t.Message, t.StatusCode, t.Code)
+	}
+	return fmt.Sprintf("%s (status=%d, code=%s, requestId=%s)", t.Message, t.StatusCode, t.Code, t.RequestID)
+}
+
+// Is maps the error code to the libtokenmachine errors
+func (t *Error) Is(target error) bool {
+
+	switch target {
+
+	case libtokenmachine.ErrDenied:
+		return t.Code == ErrCodeDenied
+
+	case libtokenmachine.ErrNotFound:
+		return t.Code == ErrCodeNotFound
+
+	case libtokenmachine.ErrExpired:
+		return t.Code == ErrCodeTokenExpired
+
+	case libtokenmachine.ErrTokenInvalid:
+		return t.Code == ErrCodeTokenInvalid || t.Code == ErrCodeTokenRequired
+
+	case libtokenmachine.ErrServerFail:
+		return t.StatusCode >= http.StatusInternalServerError
+
+	}
+
+	return false
+}
+
+// getChallengeNonce returns the nonce parameter of a WWW-Authenticate header
+// such as 'Bearer error="nonce_required", nonce="..."'
+func getChallengeNonce(header string) string {
+	match := challengeNonceRegex.FindStringSubmatch(header)
+	if match == nil {
+		return ""
+	}
+	return match[1]
+}
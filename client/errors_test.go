@@ -0,0 +1,70 @@
+/*
+Copyright © 2020 Jody Scott <jody@thescottsweb.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/jodydadescott/libtokenmachine"
+)
+
+func TestNewError(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		status  int
+		header  string
+		body    string
+		message string
+		code    string
+		nonce   string
+		is      error
+	}{
+		{"denied", http.StatusForbidden, "", `{"code":"denied","error":"Denied"}`, "Denied", ErrCodeDenied, "", libtokenmachine.ErrDenied},
+		{"not found", http.StatusNotFound, "", `{"code":"not_found","error":"Not found"}`, "Not found", ErrCodeNotFound, "", libtokenmachine.ErrNotFound},
+		{"expired", http.StatusUnauthorized, "", `{"code":"token_expired","error":"Expired"}`, "Expired", ErrCodeTokenExpired, "", libtokenmachine.ErrExpired},
+		{"token required", http.StatusUnauthorized, "", `{"code":"token_required","error":"Token required"}`, "Token required", ErrCodeTokenRequired, "", libtokenmachine.ErrTokenInvalid},
+		{"server", http.StatusInternalServerError, "", `{"code":"internal_error","error":"Failed"}`, "Failed", ErrCodeInternal, "", libtokenmachine.ErrServerFail},
+		{"not json", http.StatusBadGateway, "", `<html>`, "Bad Gateway", "", "", libtokenmachine.ErrServerFail},
+		{"challenge", http.StatusUnauthorized, `Bearer error="nonce_required", nonce="abc"`, `{"code":"nonce_required","error":"Nonce required"}`, "Nonce required", ErrCodeNonceRequired, "abc", nil},
+		{"challenge without nonce", http.StatusUnauthorized, `Bearer error="nonce_required"`, `{"code":"nonce_required","error":"Nonce required"}`, "Nonce required", ErrCodeNonceRequired, "", nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			resp := &http.Response{StatusCode: test.status, Header: http.Header{}}
+			resp.Header.Set("WWW-Authenticate", test.header)
+
+			e := newError(resp, []byte(test.body))
+
+			if e.StatusCode != test.status || e.Message != test.message || e.Code != test.code || e.Nonce != test.nonce {
+				t.Errorf("error is %+v", e)
+			}
+
+			if test.is != nil && !errors.Is(e, test.is) {
+				t.Errorf("error is not %s", test.is)
+			}
+
+			if test.is != libtokenmachine.ErrDenied && errors.Is(e, libtokenmachine.ErrDenied) {
+				t.Errorf("error is %s", libtokenmachine.ErrDenied)
+			}
+		})
+	}
+}
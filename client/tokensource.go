@@ -0,0 +1,173 @@
+/*
+Copyright © 2020 Jody Scott <jody@thescottsweb.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// AudienceEnv is the environment variable that holds the audience when a
+// CommandTokenSource runs its command
+const AudienceEnv = "TOKENMACHINE_AUDIENCE"
+
+// CommandTokenSource gets tokens by running Command with the shell (sh -c or
+// cmd /C on Windows). The audience is provided in the environment variable
+// TOKENMACHINE_AUDIENCE and is empty for the initial token. The token is read
+// from stdout.
+type CommandTokenSource struct {
+	Command string
+}
+
+// Token implements TokenSource
+func (t *CommandTokenSource) Token(ctx context.Context, audience string) (string, error) {
+
+	if t.Command == "" {
+		return "", fmt.Errorf("Command is required")
+	}
+
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", t.Command)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", t.Command)
+	}
+
+	stdout := &bytes.Buffer{}
+	cmd.Stdout = stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), AudienceEnv+"="+audience)
+
+	err := cmd.Run()
+	if err != nil {
+		return "", fmt.Errorf("Token command failed; err->%s", err)
+	}
+
+	return parseToken(stdout.Bytes())
+}
+
+// URLTokenSource gets tokens with a GET request to URL with Header. If URL
+// contains {audience} it is replaced with the audience; otherwise the audience
+// is set as the query parameter audience when it is not empty. The response
+// may be the raw token or JSON with the field access_token, id_token or
+// token.
+type URLTokenSource struct {
+	URL        string
+	Header     http.Header
+	HTTPClient *http.Client // Optional
+}
+
+// Token implements TokenSource
+func (t *URLTokenSource) Token(ctx context.Context, audience string) (string, error) {
+
+	if t.URL == "" {
+		return "", fmt.Errorf("URL is required")
+	}
+
+	tokenURL := t.URL
+
+	if strings.Contains(tokenURL, "{audience}") {
+		tokenURL = strings.ReplaceAll(tokenURL, "{audience}", url.QueryEscape(audience))
+	} else if audience != "" {
+		u, err := url.Parse(tokenURL)
+		if err != nil {
+			return "", err
+		}
+		query := u.Query()
+		query.Set("audience", audience)
+		u.RawQuery = query.Encode()
+		tokenURL = u.String()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, tokenURL, nil)
+	if err != nil {
+		return "", err
+	}
+
+	for key, values := range t.Header {
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
+
+	httpClient := t.HTTPClient
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: defaultTimeout}
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return "", err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Token URL returned status %d", resp.StatusCode)
+	}
+
+	return parseToken(data)
+}
+
+// parseToken returns the token from data which is either the raw token or a
+// JSON object with the token in one of the common fields
+func parseToken(data []byte) (string, error) {
+
+	data = bytes.TrimSpace(data)
+
+	if len(data) > 0 && data[0] == '{' {
+
+		var response struct {
+			AccessToken string `json:"access_token"`
+			IDToken     string `json:"id_token"`
+			Token       string `json:"token"`
+		}
+
+		err := json.Unmarshal(data, &response)
+		if err != nil {
+			return "", fmt.Errorf("Token response is not valid JSON")
+		}
+
+		for _, token := range []string{response.AccessToken, response.IDToken, response.Token} {
+			if token != "" {
+				return token, nil
+			}
+		}
+
+		return "", fmt.Errorf("Token response does not contain a token")
+	}
+
+	if len(data) == 0 {
+		return "", fmt.Errorf("Token is empty")
+	}
+
+	return string(data), nil
+}
@@ -0,0 +1,113 @@
+/*
+Copyright © 2020 Jody Scott <jody@thescottsweb.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+)
+
+func TestParseToken(t *testing.T) {
+
+	tests := []struct {
+		data  string
+		token string
+		err   bool
+	}{
+		{"abc\n", "abc", false},
+		{`{"access_token":"abc"}`, "abc", false},
+		{`{"id_token":"abc"}`, "abc", false},
+		{`{"token":"abc"}`, "abc", false},
+		{`{"other":"abc"}`, "", true},
+		{`{"token":`, "", true},
+		{"  \n", "", true},
+	}
+
+	for _, test := range tests {
+		token, err := parseToken([]byte(test.data))
+		if test.err != (err != nil) || token != test.token {
+			t.Errorf("parseToken(%q) is %q, %v", test.data, token, err)
+		}
+	}
+}
+
+func TestURLTokenSource(t *testing.T) {
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata") != "true" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprintf(w, `{"access_token":%q}`, r.URL.Path+"?"+r.URL.RawQuery)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name     string
+		url      string
+		header   string
+		audience string
+		token    string
+		err      bool
+	}{
+		{"no audience", "/token", "true", "", "/token?", false},
+		{"audience query", "/token?resource=x", "true", "a b", "/token?audience=a+b&resource=x", false},
+		{"audience placeholder", "/token/{audience}", "true", "abc", "/token/abc?", false},
+		{"status", "/token", "", "", "", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			source := &URLTokenSource{URL: server.URL + test.url, Header: http.Header{}}
+			if test.header != "" {
+				source.Header.Set("Metadata", test.header)
+			}
+
+			token, err := source.Token(context.Background(), test.audience)
+			if test.err != (err != nil) || token != test.token {
+				t.Errorf("token is %q, %v; want %q", token, err, test.token)
+			}
+		})
+	}
+}
+
+func TestCommandTokenSource(t *testing.T) {
+
+	if runtime.GOOS == "windows" {
+		t.Skip("command uses sh syntax")
+	}
+
+	source := &CommandTokenSource{Command: "echo token:$" + AudienceEnv}
+
+	token, err := source.Token(context.Background(), "abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if token != "token:abc" {
+		t.Errorf("token is %s", token)
+	}
+
+	if _, err := (&CommandTokenSource{Command: "exit 1"}).Token(context.Background(), ""); err == nil {
+		t.Errorf("expected error")
+	}
+}
@@ -0,0 +1,251 @@
+/*
+Copyright © 2020 Jody Scott <jody@thescottsweb.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/jodydadescott/tokenmachine/config"
+	"github.com/jodydadescott/tokenmachine/internal"
+	"github.com/jodydadescott/tokenmachine/internal/agent"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+var agentCmd = &cobra.Command{
+	Use:   "agent",
+	Short: "run agent that keeps secrets and keytabs fresh on disk",
+	Args:  cobra.NoArgs,
+
+	SilenceUsage: true,
+
+	RunE: func(cmd *cobra.Command, args []string) error {
+
+		if viper.GetString("config") == "" {
+			return fmt.Errorf("config is required")
+		}
+
+		agentConfig, err := config.NewAgentFromFile(viper.GetString("config"))
+		if err != nil {
+			return err
+		}
+
+		// The agent uses the same logging config as the server
+		configLoader := internal.NewLoader()
+		if agentConfig.Logging != nil {
+			configLoader.Config.Logging = agentConfig.Logging
+		}
+
+		zapConfig, err := configLoader.ZapConfig()
+		if err != nil {
+			return err
+		}
+
+		logger, err := zapConfig.Build()
+		if err != nil {
+			return err
+		}
+
+		zap.ReplaceGlobals(logger)
+
+		tokenMachine, err := buildClient(agentConfig.Server, true)
+		if err != nil {
+			return err
+		}
+
+		runtimeConfig := &agent.Config{
+			Client: tokenMachine,
+		}
+
+		for _, s := range agentConfig.Secrets {
+			output, err := newAgentOutput(s)
+			if err != nil {
+				return err
+			}
+			runtimeConfig.Secrets = append(runtimeConfig.Secrets, output)
+		}
+
+		for _, s := range agentConfig.Keytabs {
+			output, err := newAgentOutput(s)
+			if err != nil {
+				return err
+			}
+			runtimeConfig.Keytabs = append(runtimeConfig.Keytabs, output)
+		}
+
+		for _, s := range agentConfig.Templates {
+			template, err := newAgentTemplate(s)
+			if err != nil {
+				return err
+			}
+			runtimeConfig.Templates = append(runtimeConfig.Templates, template)
+		}
+
+		sig := make(chan os.Signal, 2)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+
+		runningAgent, err := runtimeConfig.Build()
+		if err != nil {
+			return err
+		}
+
+		zap.L().Debug("Started successfully")
+		<-sig
+
+		zap.L().Debug("Shutting down on signal")
+		runningAgent.Shutdown()
+
+		return nil
+	},
+}
+
+var agentExampleCmd = &cobra.Command{
+	Use:   "example",
+	Short: "example agent configuration",
+	RunE: func(cmd *cobra.Command, args []string) error {
+
+		newConfig := config.NewV1ExampleAgent()
+
+		configString := ""
+		switch strings.ToLower(viper.GetString("format")) {
+
+		case "", "yaml":
+			configString = newConfig.YAML()
+			break
+
+		case "json":
+			configString = newConfig.JSON()
+			break
+
+		default:
+			return fmt.Errorf(fmt.Sprintf("Output format %s is unknown. Must be yaml or json", viper.GetString("format")))
+		}
+
+		fmt.Print(configString)
+		return nil
+
+	},
+}
+
+// newAgentOutput maps the agent config file output to the agent runtime
+// output
+func newAgentOutput(s *config.AgentOutput) (*agent.Output, error) {
+
+	output := &agent.Output{
+		Name:   s.Name,
+		Path:   s.Path,
+		Format: s.Format,
+	}
+
+	var err error
+
+	output.Mode, err = parseMode(s.Mode, s.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	output.UID, output.GID, err = agent.LookupOwner(s.Owner, s.Group)
+	if err != nil {
+		return nil, err
+	}
+
+	output.Notify, err = newAgentNotify(s.Notify)
+	if err != nil {
+		return nil, err
+	}
+
+	return output, nil
+}
+
+// newAgentTemplate maps the agent config file template to the agent runtime
+// template
+func newAgentTemplate(s *config.AgentTemplate) (*agent.Template, error) {
+
+	template := &agent.Template{
+		Source:  s.Source,
+		Text:    s.Text,
+		Path:    s.Path,
+		Secrets: s.Secrets,
+		Keytabs: s.Keytabs,
+	}
+
+	var err error
+
+	template.Mode, err = parseMode(s.Mode, s.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	template.UID, template.GID, err = agent.LookupOwner(s.Owner, s.Group)
+	if err != nil {
+		return nil, err
+	}
+
+	template.Notify, err = newAgentNotify(s.Notify)
+	if err != nil {
+		return nil, err
+	}
+
+	return template, nil
+}
+
+func parseMode(s, name string) (os.FileMode, error) {
+
+	if s == "" {
+		return 0, nil
+	}
+
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("Mode %s of %s is not valid octal", s, name)
+	}
+
+	return os.FileMode(mode), nil
+}
+
+func newAgentNotify(s *config.AgentNotify) (*agent.Notify, error) {
+
+	if s == nil {
+		return nil, nil
+	}
+
+	notify := &agent.Notify{
+		Command: s.Command,
+		PID:     s.PID,
+		PIDFile: s.PIDFile,
+	}
+
+	if s.Signal != "" {
+		var err error
+		notify.Signal, err = agent.ParseSignal(s.Signal)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return notify, nil
+}
+
+func init() {
+	agentCmd.AddCommand(agentExampleCmd)
+}
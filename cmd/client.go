@@ -0,0 +1,265 @@
+/*
+Copyright © 2020 Jody Scott <jody@thescottsweb.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jodydadescott/tokenmachine/client"
+	"github.com/jodydadescott/tokenmachine/config"
+	"github.com/jodydadescott/tokenmachine/internal/agent"
+	"github.com/spf13/cobra"
+)
+
+var clientCmd = &cobra.Command{
+	Use:   "client",
+	Short: "get nonces, secrets and keytabs from a server",
+}
+
+var clientGetNonceCmd = &cobra.Command{
+	Use:   "get-nonce",
+	Short: "get nonce",
+	Args:  cobra.NoArgs,
+
+	SilenceUsage: true,
+
+	RunE: func(cmd *cobra.Command, args []string) error {
+
+		tokenMachine, err := newClient(cmd)
+		if err != nil {
+			return err
+		}
+
+		ctx, cancel := clientContext(cmd)
+		defer cancel()
+
+		nonce, err := tokenMachine.GetNonce(ctx)
+		if err != nil {
+			return err
+		}
+
+		return printResult(cmd, nonce, nonce.Value)
+	},
+}
+
+var clientGetSecretCmd = &cobra.Command{
+	Use:   "get-secret NAME",
+	Short: "get shared secret",
+	Args:  cobra.ExactArgs(1),
+
+	SilenceUsage: true,
+
+	RunE: func(cmd *cobra.Command, args []string) error {
+
+		tokenMachine, err := newClient(cmd)
+		if err != nil {
+			return err
+		}
+
+		ctx, cancel := clientContext(cmd)
+		defer cancel()
+
+		secret, err := tokenMachine.GetSecret(ctx, args[0])
+		if err != nil {
+			return err
+		}
+
+		return printResult(cmd, secret, secret.Secret)
+	},
+}
+
+var clientGetKeytabCmd = &cobra.Command{
+	Use:   "get-keytab NAME",
+	Short: "get keytab",
+	Args:  cobra.ExactArgs(1),
+
+	SilenceUsage: true,
+
+	RunE: func(cmd *cobra.Command, args []string) error {
+
+		tokenMachine, err := newClient(cmd)
+		if err != nil {
+			return err
+		}
+
+		ctx, cancel := clientContext(cmd)
+		defer cancel()
+
+		keytab, err := tokenMachine.GetKeytab(ctx, args[0])
+		if err != nil {
+			return err
+		}
+
+		out, _ := cmd.Flags().GetString("out")
+		if out == "" {
+			return printResult(cmd, keytab, keytab.Base64File)
+		}
+
+		data, err := base64.StdEncoding.DecodeString(keytab.Base64File)
+		if err != nil {
+			return fmt.Errorf("Keytab is not valid base64; err->%s", err)
+		}
+
+		return agent.WriteFile(out, data, 0600, -1, -1)
+	},
+}
+
+// newClient returns a client from the command flags
+func newClient(cmd *cobra.Command) (*client.Client, error) {
+
+	server, _ := cmd.Flags().GetString("server")
+	caBundle, _ := cmd.Flags().GetString("cacert")
+	tokenCommand, _ := cmd.Flags().GetString("token-cmd")
+	tokenURL, _ := cmd.Flags().GetString("token-url")
+	tokenHeaders, _ := cmd.Flags().GetStringArray("token-header")
+	challenge, _ := cmd.Flags().GetBool("challenge")
+
+	if server == "" {
+		server = os.Getenv("TOKENMACHINE_SERVER")
+	}
+
+	return buildClient(&config.AgentServer{
+		URL:          server,
+		CACert:       caBundle,
+		TokenCommand: tokenCommand,
+		TokenURL:     tokenURL,
+		TokenHeaders: tokenHeaders,
+		Timeout:      requestTimeout(clientTimeout(cmd)),
+		Challenge:    challenge,
+	}, false)
+}
+
+// buildClient returns a client for server
+func buildClient(server *config.AgentServer, disableCache bool) (*client.Client, error) {
+
+	if server == nil || server.URL == "" {
+		return nil, fmt.Errorf("server is required")
+	}
+
+	clientConfig := &client.Config{
+		URL:          server.URL,
+		Timeout:      server.Timeout,
+		DisableCache: disableCache,
+		Challenge:    server.Challenge,
+	}
+
+	if server.CACert != "" {
+		pem, err := ioutil.ReadFile(server.CACert)
+		if err != nil {
+			return nil, err
+		}
+		clientConfig.RootCAs = x509.NewCertPool()
+		if !clientConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("CA bundle %s does not contain any PEM certificates", server.CACert)
+		}
+	}
+
+	switch {
+
+	case server.TokenCommand != "" && server.TokenURL != "":
+		return nil, fmt.Errorf("token command and token URL are mutually exclusive")
+
+	case server.TokenCommand != "":
+		clientConfig.TokenSource = &client.CommandTokenSource{Command: server.TokenCommand}
+
+	case server.TokenURL != "":
+		header := http.Header{}
+		for _, s := range server.TokenHeaders {
+			kv := strings.SplitN(s, ":", 2)
+			if len(kv) != 2 {
+				return nil, fmt.Errorf("Token header %s must be in the format 'Name: Value'", s)
+			}
+			header.Add(strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1]))
+		}
+		clientConfig.TokenSource = &client.URLTokenSource{URL: server.TokenURL, Header: header}
+
+	default:
+		return nil, fmt.Errorf("token command or token URL is required")
+	}
+
+	return clientConfig.Build()
+}
+
+func clientTimeout(cmd *cobra.Command) time.Duration {
+	timeout, _ := cmd.Flags().GetDuration("timeout")
+	return timeout
+}
+
+// requestTimeout returns the client timeout of each request for the timeout
+// flag. A flag of 0 or less disables the timeout instead of using the client
+// default.
+func requestTimeout(timeout time.Duration) time.Duration {
+	if timeout <= 0 {
+		return -1
+	}
+	return timeout
+}
+
+// clientContext returns a context with the timeout flag as the deadline. A
+// timeout of 0 or less is no timeout.
+func clientContext(cmd *cobra.Command) (context.Context, context.CancelFunc) {
+
+	timeout := clientTimeout(cmd)
+	if timeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+
+	return context.WithTimeout(context.Background(), timeout)
+}
+
+// printResult prints result as JSON or raw if the output flag is raw
+func printResult(cmd *cobra.Command, result interface{}, raw string) error {
+
+	output, _ := cmd.Flags().GetString("output")
+
+	switch output {
+
+	case "", "json":
+		j, err := json.MarshalIndent(result, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(j))
+
+	case "raw":
+		fmt.Println(raw)
+
+	default:
+		return fmt.Errorf("output must be json (default) or raw")
+	}
+
+	return nil
+}
+
+func init() {
+
+	addClientFlags(clientCmd.PersistentFlags())
+	clientCmd.PersistentFlags().StringP("output", "o", "json", "output format json or raw")
+
+	clientGetKeytabCmd.Flags().StringP("out", "", "", "write the keytab file to this path (mode 0600) instead of printing it")
+
+	clientCmd.AddCommand(clientGetNonceCmd, clientGetSecretCmd, clientGetKeytabCmd)
+}
@@ -0,0 +1,43 @@
+/*
+Copyright © 2020 Jody Scott <jody@thescottsweb.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRequestTimeout(t *testing.T) {
+
+	tests := []struct {
+		name string
+		flag time.Duration
+		want time.Duration
+	}{
+		{"set", 5 * time.Second, 5 * time.Second},
+		{"zero", 0, -1},
+		{"negative", -time.Second, -1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := requestTimeout(test.flag); got != test.want {
+				t.Errorf("expected timeout %s, got %s", test.want, got)
+			}
+		})
+	}
+}
@@ -182,6 +182,11 @@ var configMakeCmd = &cobra.Command{
 			}
 		}
 
+		err := configLoader.ValidatePolicy()
+		if err != nil {
+			return err
+		}
+
 		configString := ""
 		switch strings.ToLower(viper.GetString("format")) {
 
@@ -259,10 +264,19 @@ var windowsRunDebugCmd = &cobra.Command{
 		}
 
 		zap.L().Debug("Started successfully")
-		<-sig
 
-		zap.L().Debug("Shutting down on signal")
-		server.Shutdown()
+		select {
+
+		case <-sig:
+			zap.L().Debug("Shutting down on signal")
+			server.Shutdown()
+
+		case err = <-server.Err():
+			zap.L().Error(fmt.Sprintf("Shutting down on error; err->%s", err))
+			server.Shutdown()
+			return err
+
+		}
 
 		return nil
 	},
@@ -277,19 +291,16 @@ var serverCmd = &cobra.Command{
 		var err error
 		configLoader := internal.NewLoader()
 
-		if viper.GetString("config") == "" {
+		source := viper.GetString("config")
 
-			config, err := GetRuntimeConfigString()
+		if source == "" {
+			source, err = GetRuntimeConfigString()
 			if err != nil {
 				return err
 			}
-
-			err = configLoader.LoadFrom(config)
-
-		} else {
-			err = configLoader.LoadFrom(viper.GetString("config"))
 		}
 
+		err = configLoader.LoadFrom(source)
 		if err != nil {
 			return err
 		}
@@ -315,21 +326,101 @@ var serverCmd = &cobra.Command{
 		sig := make(chan os.Signal, 2)
 		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
 
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+
 		server, err := serverConfig.Build()
 		if err != nil {
 			return err
 		}
 
+		changed := make(chan struct{}, 1)
+
+		if viper.GetBool("watch") {
+
+			fileWatcherConfig := &internal.FileWatcherConfig{
+				Files: getLocalFiles(source),
+				OnChange: func() {
+					select {
+					case changed <- struct{}{}:
+					default:
+					}
+				},
+			}
+
+			fileWatcher, err := fileWatcherConfig.Build()
+			if err != nil {
+				server.Shutdown()
+				return err
+			}
+			defer fileWatcher.Shutdown()
+		}
+
 		zap.L().Debug("Started successfully")
-		<-sig
 
-		zap.L().Debug("Shutting down on signal")
-		server.Shutdown()
+		for {
+			select {
 
-		return nil
+			case <-sig:
+				zap.L().Debug("Shutting down on signal")
+				server.Shutdown()
+				return nil
+
+			case err = <-server.Err():
+				zap.L().Error(fmt.Sprintf("Shutting down on error; err->%s", err))
+				server.Shutdown()
+				return err
+
+			case <-hup:
+				zap.L().Info("Reloading on signal")
+				reloadServer(server, source)
+
+			case <-changed:
+				zap.L().Info("Reloading on config change")
+				reloadServer(server, source)
+
+			}
+		}
 	},
 }
 
+// reloadServer loads the config from source and applies it to server. On
+// failure the server continues to run with the existing config.
+func reloadServer(server *internal.Server, source string) {
+
+	configLoader := internal.NewLoader()
+
+	err := configLoader.LoadFrom(source)
+	if err != nil {
+		zap.L().Error(fmt.Sprintf("Reload failed, continuing with existing config; err->%s", err))
+		return
+	}
+
+	serverConfig, err := configLoader.ServerConfig()
+	if err != nil {
+		zap.L().Error(fmt.Sprintf("Reload failed, continuing with existing config; err->%s", err))
+		return
+	}
+
+	err = server.Reload(serverConfig)
+	if err != nil {
+		zap.L().Error(fmt.Sprintf("Reload failed, continuing with existing config; err->%s", err))
+	}
+}
+
+// getLocalFiles returns the files in the comma delimited config source. URLs
+// are ignored.
+func getLocalFiles(source string) []string {
+	var files []string
+	for _, s := range strings.Split(source, ",") {
+		if s == "" || strings.HasPrefix(s, "https://") || strings.HasPrefix(s, "http://") {
+			continue
+		}
+		files = append(files, s)
+	}
+	return files
+}
+
 // Execute ...
 func Execute() {
 
@@ -359,12 +450,12 @@ func init() {
 
 		serviceCmd.AddCommand(serviceInstallCmd, serviceRemoveCmd, serviceStartCmd, serviceStopCmd, servicePauseCmd, serviceContinueCmd, serviceConfigSetCmd, serviceConfigShowCmd)
 		configCmd.AddCommand(configExampleCmd, configMakeCmd)
-		rootCmd.AddCommand(serviceCmd, configCmd, windowsRunDebugCmd)
+		rootCmd.AddCommand(serviceCmd, configCmd, windowsRunDebugCmd, clientCmd, agentCmd, execCmd, policyCmd)
 
 	} else {
 
 		configCmd.AddCommand(configMakeCmd, configExampleCmd)
-		rootCmd.AddCommand(configCmd, serverCmd)
+		rootCmd.AddCommand(configCmd, serverCmd, clientCmd, agentCmd, execCmd, policyCmd)
 
 	}
 
@@ -373,6 +464,9 @@ func init() {
 	rootCmd.PersistentFlags().StringP("config", "", "", "configuration file")
 	viper.BindPFlag("config", rootCmd.PersistentFlags().Lookup("config"))
 
+	serverCmd.Flags().BoolP("watch", "", false, "reload when the config file changes")
+	viper.BindPFlag("watch", serverCmd.Flags().Lookup("watch"))
+
 	// Config
 	rootCmd.PersistentFlags().StringP("format", "", "", "output format in yaml or json; default is yaml")
 	viper.BindPFlag("format", rootCmd.PersistentFlags().Lookup("format"))
@@ -1,3 +1,6 @@
+//go:build windows
+// +build windows
+
 /*
 Copyright © 2020 Jody Scott <jody@thescottsweb.com>
 
@@ -14,8 +17,6 @@ See the License for the specific language governing permissions and
 limitations under the License.
 */
 
-// +build windows
-
 package cmd
 
 import (
@@ -294,6 +295,11 @@ loop:
 			default:
 				elog.Error(1, fmt.Sprintf("unexpected control request #%d", c))
 			}
+		case err = <-server.Err():
+			zap.L().Error(fmt.Sprintf("Shutting down on error; err->%s", err))
+			server.Shutdown()
+			ssec, errno = true, 1
+			break loop
 		}
 	}
 	changes <- svc.Status{State: svc.StopPending}
@@ -0,0 +1,217 @@
+/*
+Copyright © 2020 Jody Scott <jody@thescottsweb.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jodydadescott/tokenmachine/client"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+var envNameRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+var execCmd = &cobra.Command{
+	Use:   "exec [flags] -- COMMAND [ARGS...]",
+	Short: "run command with secrets in its environment and keytabs in KRB5_KTNAME",
+	Args:  cobra.MinimumNArgs(1),
+
+	SilenceUsage: true,
+
+	RunE: func(cmd *cobra.Command, args []string) error {
+
+		code, err := runExec(cmd, args)
+		if err != nil {
+			return err
+		}
+
+		os.Exit(code)
+		return nil
+	},
+}
+
+// runExec fetches the secrets and keytabs and runs the command with them. It
+// returns the exit code of the command. Nothing is written to disk except
+// the keytab file which is removed when the command exits.
+func runExec(cmd *cobra.Command, args []string) (int, error) {
+
+	secretFlags, _ := cmd.Flags().GetStringArray("secret")
+	keytabNames, _ := cmd.Flags().GetStringArray("keytab")
+
+	if len(secretFlags) == 0 && len(keytabNames) == 0 {
+		return 0, fmt.Errorf("at least one secret or keytab is required")
+	}
+
+	// Map of environment variable to secret name
+	secretNames := make(map[string]string)
+
+	for _, s := range secretFlags {
+		kv := strings.SplitN(s, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || !envNameRegex.MatchString(kv[1]) {
+			return 0, fmt.Errorf("secret %s must be in the format NAME=ENVVAR", s)
+		}
+		if _, exist := secretNames[kv[1]]; exist {
+			return 0, fmt.Errorf("environment variable %s is used more than once", kv[1])
+		}
+		secretNames[kv[1]] = kv[0]
+	}
+
+	tokenMachine, err := newClient(cmd)
+	if err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := clientContext(cmd)
+	defer cancel()
+
+	env := make(map[string]string)
+
+	for envName, name := range secretNames {
+		secret, err := tokenMachine.GetSecret(ctx, name)
+		if err != nil {
+			return 0, err
+		}
+		env[envName] = secret.Secret
+	}
+
+	if len(keytabNames) > 0 {
+
+		data, err := getKeytabs(ctx, tokenMachine, keytabNames)
+		if err != nil {
+			return 0, err
+		}
+
+		// The directory is only accessible by us
+		dir, err := ioutil.TempDir("", "tokenmachine")
+		if err != nil {
+			return 0, err
+		}
+		defer os.RemoveAll(dir)
+
+		filename := filepath.Join(dir, "krb5.keytab")
+		err = ioutil.WriteFile(filename, data, 0600)
+		if err != nil {
+			return 0, err
+		}
+
+		env["KRB5_KTNAME"] = "FILE:" + filename
+	}
+
+	child := exec.Command(args[0], args[1:]...)
+	child.Stdin = os.Stdin
+	child.Stdout = os.Stdout
+	child.Stderr = os.Stderr
+	child.Env = os.Environ()
+	for k, v := range env {
+		child.Env = append(child.Env, k+"="+v)
+	}
+
+	// Signals are caught before the command is started so that we do not
+	// exit and leave the keytab behind
+	sig := make(chan os.Signal, 4)
+	signal.Notify(sig, forwardSignals...)
+	defer signal.Stop(sig)
+
+	err = child.Start()
+	if err != nil {
+		return 0, err
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		for {
+			select {
+			case s := <-sig:
+				// Errors are ignored as the command may have already exited
+				child.Process.Signal(s)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	err = child.Wait()
+	if err != nil {
+		if _, ok := err.(*exec.ExitError); !ok {
+			return 0, err
+		}
+	}
+
+	return exitCode(child.ProcessState), nil
+}
+
+// getKeytabs returns the keytab files of names as one keytab file. Keytab
+// files start with a two byte version followed by the entries so the entries
+// of each keytab after the first are appended without the version.
+func getKeytabs(ctx context.Context, tokenMachine *client.Client, names []string) ([]byte, error) {
+
+	var data []byte
+
+	for _, name := range names {
+
+		keytab, err := tokenMachine.GetKeytab(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+
+		file, err := base64.StdEncoding.DecodeString(keytab.Base64File)
+		if err != nil {
+			return nil, fmt.Errorf("keytab %s is not valid base64; err->%s", name, err)
+		}
+
+		if len(file) < 2 {
+			return nil, fmt.Errorf("keytab %s is not valid", name)
+		}
+
+		if data == nil {
+			data = file
+		} else {
+			data = append(data, file[2:]...)
+		}
+	}
+
+	return data, nil
+}
+
+func addClientFlags(flags *pflag.FlagSet) {
+	flags.StringP("server", "", "", "server URL such as https://tokenmachine.example.com:8443 (default $TOKENMACHINE_SERVER)")
+	flags.StringP("cacert", "", "", "CA bundle used to verify the server (default is the system CAs)")
+	flags.StringP("token-cmd", "", "", "command that prints a token; the audience is in $"+client.AudienceEnv)
+	flags.StringP("token-url", "", "", "URL that returns a token; {audience} is replaced with the audience")
+	flags.StringArrayP("token-header", "", nil, "header sent to token-url in the format 'Name: Value'")
+	flags.DurationP("timeout", "", 60*time.Second, "timeout of the whole operation; 0 for no timeout")
+	flags.BoolP("challenge", "", false, "get the nonce from the server challenge (requires nonceChallenge on the server)")
+}
+
+func init() {
+	addClientFlags(execCmd.Flags())
+	execCmd.Flags().StringArrayP("secret", "", nil, "shared secret to put in the environment in the format NAME=ENVVAR")
+	execCmd.Flags().StringArrayP("keytab", "", nil, "keytab to write to a temp file set in KRB5_KTNAME; may be repeated")
+}
@@ -0,0 +1,113 @@
+/*
+Copyright © 2020 Jody Scott <jody@thescottsweb.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jodydadescott/libtokenmachine"
+	"github.com/jodydadescott/tokenmachine/client"
+)
+
+func TestGetKeytabs(t *testing.T) {
+
+	// Each keytab is the two byte version followed by its name as the entries
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		if r.URL.Path == "/v1/nonce" {
+			json.NewEncoder(w).Encode(&libtokenmachine.Nonce{Value: "nonce"})
+			return
+		}
+
+		name := strings.TrimPrefix(r.URL.Path, "/v1/keytabs/")
+
+		file := append([]byte{5, 2}, name...)
+		if name == "short" {
+			file = []byte{5}
+		}
+
+		json.NewEncoder(w).Encode(&libtokenmachine.Keytab{
+			Name:       name,
+			Base64File: base64.StdEncoding.EncodeToString(file),
+			Exp:        1 << 40,
+		})
+	}))
+	defer server.Close()
+
+	tokenMachine, err := (&client.Config{
+		URL: server.URL,
+		TokenSource: client.TokenSourceFunc(func(ctx context.Context, audience string) (string, error) {
+			return "token", nil
+		}),
+	}).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		names []string
+		data  []byte
+		err   bool
+	}{
+		{[]string{"a"}, []byte("\x05\x02a"), false},
+		{[]string{"a", "bb", "c"}, []byte("\x05\x02abbc"), false},
+		{[]string{"a", "short"}, nil, true},
+	}
+
+	for _, test := range tests {
+		t.Run(strings.Join(test.names, ","), func(t *testing.T) {
+
+			data, err := getKeytabs(context.Background(), tokenMachine, test.names)
+			if test.err != (err != nil) {
+				t.Fatalf("err is %v; want error %t", err, test.err)
+			}
+
+			if !bytes.Equal(data, test.data) {
+				t.Errorf("keytab is %q; want %q", data, test.data)
+			}
+		})
+	}
+}
+
+func TestEnvNameRegex(t *testing.T) {
+
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{"DB_PASSWORD", true},
+		{"_A1", true},
+		{"a", true},
+		{"1A", false},
+		{"A-B", false},
+		{"A=B", false},
+		{"", false},
+	}
+
+	for _, test := range tests {
+		if valid := envNameRegex.MatchString(test.name); valid != test.valid {
+			t.Errorf("%q valid is %t; want %t", test.name, valid, test.valid)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+// +build windows
+
+/*
+Copyright © 2020 Jody Scott <jody@thescottsweb.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"os"
+)
+
+// forwardSignals are the signals passed to the command run by exec. The
+// console also sends Ctrl-C to the command; we catch it so that we wait for
+// the command and remove the keytab.
+var forwardSignals = []os.Signal{os.Interrupt}
+
+// exitCode returns the exit code of the process
+func exitCode(state *os.ProcessState) int {
+	return state.ExitCode()
+}
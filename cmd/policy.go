@@ -0,0 +1,374 @@
+/*
+Copyright © 2020 Jody Scott <jody@thescottsweb.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/jodydadescott/libtokenmachine"
+	"github.com/jodydadescott/tokenmachine/internal"
+	"github.com/jodydadescott/tokenmachine/internal/engine"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var policyCmd = &cobra.Command{
+	Use:   "policy",
+	Short: "test and debug the policy",
+}
+
+var policyTestCmd = &cobra.Command{
+	Use:   "test [FIXTURE FILES...]",
+	Short: "run the test_ rules of the policy and the fixtures",
+	Long: `Runs the rules prefixed with test_ in the policy modules as opa test does and
+ the table driven fixtures in FIXTURE FILES. The policy is loaded from --config.
+ A fixture file is YAML or JSON with a list of fixtures each with the action
+ (get_nonce, get_keytab or get_secret), the entity name, the token claims, the
+ valid nonces and the expected decision (allow). Exits non zero if a test fails.`,
+
+	SilenceUsage: true,
+
+	RunE: func(cmd *cobra.Command, args []string) error {
+
+		policyConfig, err := loadPolicyConfig()
+		if err != nil {
+			return err
+		}
+
+		var fixtures []*engine.PolicyFixture
+
+		for _, s := range args {
+
+			data, err := ioutil.ReadFile(s)
+			if err != nil {
+				return err
+			}
+
+			f, err := engine.ParsePolicyFixtures(s, data)
+			if err != nil {
+				return err
+			}
+
+			fixtures = append(fixtures, f...)
+		}
+
+		coverage, _ := cmd.Flags().GetBool("coverage")
+		verbose, _ := cmd.Flags().GetBool("verbose")
+
+		report, err := policyConfig.Test(context.Background(), fixtures, coverage)
+		if err != nil {
+			return err
+		}
+
+		printPolicyTestReport(report, verbose)
+
+		if failed := report.Failed(); failed > 0 {
+			return fmt.Errorf("%d of %d tests failed", failed, len(report.Results))
+		}
+
+		return nil
+	},
+}
+
+var policyEvalCmd = &cobra.Command{
+	Use:   "eval",
+	Short: "explain the decision of the policy for a token or claims",
+	Long: `Evaluates the rule of --action for the entity --name with the input the server
+ would build for the token in --token or --token-file or the claims in the JSON
+ file --claims and prints the decision and the trace of the evaluation. The
+ signature of the token is not verified. Stateless nonces are valid if the
+ config has a nonce key; other nonces may be given with --nonce and are treated
+ as issued to the subject of the token. The policy is loaded from --config.`,
+
+	SilenceUsage: true,
+
+	RunE: func(cmd *cobra.Command, args []string) error {
+
+		action, _ := cmd.Flags().GetString("action")
+		name, _ := cmd.Flags().GetString("name")
+		nonces, _ := cmd.Flags().GetStringArray("nonce")
+		explain, _ := cmd.Flags().GetString("explain")
+		output, _ := cmd.Flags().GetString("output")
+
+		if output != "text" && output != "json" {
+			return fmt.Errorf("Output %s is not valid; must be text or json", output)
+		}
+
+		token, err := getPolicyEvalToken(cmd)
+		if err != nil {
+			return err
+		}
+
+		serverConfig, err := loadServerConfig()
+		if err != nil {
+			return err
+		}
+
+		policyConfig, err := serverConfig.PolicyConfig()
+		if err != nil {
+			return err
+		}
+
+		explainer, err := (&engine.ExplainConfig{
+			Policy:                   policyConfig,
+			NonceKey:                 serverConfig.NonceKey,
+			Nonces:                   nonces,
+			DisableNonceSubjectCheck: serverConfig.DisableNonceSubjectCheck,
+			NonceChallenge:           serverConfig.NonceChallenge,
+		}).Build()
+		if err != nil {
+			return err
+		}
+		defer explainer.Shutdown()
+
+		explanation, err := explainer.Explain(context.Background(), token, action, name, explain)
+		if err != nil {
+			return err
+		}
+
+		if output == "json" {
+			fmt.Println(explanation.JSON())
+			return nil
+		}
+
+		printExplanation(explanation)
+		return nil
+	},
+}
+
+// getPolicyEvalToken returns the token from --token, --token-file or --claims
+func getPolicyEvalToken(cmd *cobra.Command) (*libtokenmachine.Token, error) {
+
+	tokenString, _ := cmd.Flags().GetString("token")
+	tokenFile, _ := cmd.Flags().GetString("token-file")
+	claimsFile, _ := cmd.Flags().GetString("claims")
+
+	count := 0
+	for _, s := range []string{tokenString, tokenFile, claimsFile} {
+		if s != "" {
+			count++
+		}
+	}
+
+	if count != 1 {
+		return nil, fmt.Errorf("Exactly one of token, token-file or claims is required")
+	}
+
+	if claimsFile != "" {
+
+		data, err := ioutil.ReadFile(claimsFile)
+		if err != nil {
+			return nil, err
+		}
+
+		var claims map[string]interface{}
+		err = json.Unmarshal(data, &claims)
+		if err != nil {
+			return nil, fmt.Errorf("Claims file %s is not a JSON object; err->%s", claimsFile, err)
+		}
+
+		return engine.ClaimsToken(claims), nil
+	}
+
+	if tokenFile != "" {
+		data, err := ioutil.ReadFile(tokenFile)
+		if err != nil {
+			return nil, err
+		}
+		tokenString = string(data)
+	}
+
+	tokenString = strings.TrimSpace(tokenString)
+
+	// The signature is optional
+	if strings.Count(tokenString, ".") == 1 {
+		tokenString += "."
+	}
+
+	token, err := libtokenmachine.ParseToken(tokenString)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse token; err->%s", err)
+	}
+
+	return token, nil
+}
+
+func printExplanation(explanation *engine.Explanation) {
+
+	decision := "DENY"
+	if explanation.Allow {
+		decision = "ALLOW"
+	}
+
+	fmt.Printf("Action: %s (%s)\n", explanation.Action, explanation.Rule)
+	if explanation.Name != "" {
+		fmt.Printf("Name: %s\n", explanation.Name)
+	}
+	fmt.Printf("Decision: %s\n", decision)
+
+	if explanation.Error != "" {
+		fmt.Printf("Error: %s\n", explanation.Error)
+	}
+
+	if explanation.NonceRequired {
+		fmt.Println("Nonce required: the token has no nonce and the server would answer with a nonce challenge")
+	}
+
+	if explanation.Input != nil {
+		input, _ := json.MarshalIndent(explanation.Input, "", "  ")
+		fmt.Println(strings.Repeat("-", 80))
+		fmt.Printf("Input:\n%s\n", input)
+	}
+
+	if len(explanation.Trace) > 0 {
+		fmt.Println(strings.Repeat("-", 80))
+		fmt.Println("Trace:")
+		for _, line := range explanation.Trace {
+			fmt.Println(line)
+		}
+	}
+}
+
+// loadPolicyConfig returns the policy config from the config source
+func loadPolicyConfig() (*engine.PolicyConfig, error) {
+
+	serverConfig, err := loadServerConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	return serverConfig.PolicyConfig()
+}
+
+// loadServerConfig returns the server config from the config source
+func loadServerConfig() (*internal.Config, error) {
+
+	var err error
+	configLoader := internal.NewLoader()
+
+	source := viper.GetString("config")
+
+	if source == "" {
+		source, err = GetRuntimeConfigString()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = configLoader.LoadFrom(source)
+	if err != nil {
+		return nil, err
+	}
+
+	return configLoader.ServerConfig()
+}
+
+func printPolicyTestReport(report *engine.PolicyTestReport, verbose bool) {
+
+	passed, failed, errored := 0, 0, 0
+
+	for _, result := range report.Results {
+
+		switch {
+
+		case result.Err != nil:
+			errored++
+			fmt.Printf("ERROR: %s (%s)\n  %s\n", result.Name, result.Location, result.Err)
+
+		case result.Fail:
+			failed++
+			fmt.Printf("FAIL: %s (%s) %s\n", result.Name, result.Location, result.Duration)
+
+		default:
+			passed++
+			if verbose {
+				fmt.Printf("PASS: %s (%s) %s\n", result.Name, result.Location, result.Duration)
+			}
+		}
+	}
+
+	total := len(report.Results)
+
+	fmt.Println(strings.Repeat("-", 80))
+
+	if total == 0 {
+		fmt.Println("No tests found")
+	}
+
+	if passed > 0 {
+		fmt.Printf("PASS: %d/%d\n", passed, total)
+	}
+
+	if failed > 0 {
+		fmt.Printf("FAIL: %d/%d\n", failed, total)
+	}
+
+	if errored > 0 {
+		fmt.Printf("ERROR: %d/%d\n", errored, total)
+	}
+
+	if report.Coverage == nil {
+		return
+	}
+
+	var files []string
+	for file := range report.Coverage.Files {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+
+	for _, file := range files {
+
+		fileReport := report.Coverage.Files[file]
+		fmt.Printf("Coverage: %s %.2f%%\n", file, fileReport.Coverage)
+
+		if verbose && len(fileReport.NotCovered) > 0 {
+			var lines []string
+			for _, r := range fileReport.NotCovered {
+				if r.Start.Row == r.End.Row {
+					lines = append(lines, fmt.Sprintf("%d", r.Start.Row))
+				} else {
+					lines = append(lines, fmt.Sprintf("%d-%d", r.Start.Row, r.End.Row))
+				}
+			}
+			fmt.Printf("  not covered: %s\n", strings.Join(lines, ", "))
+		}
+	}
+
+	fmt.Printf("Coverage: %.2f%%\n", report.Coverage.Coverage)
+}
+
+func init() {
+	policyTestCmd.Flags().BoolP("coverage", "", false, "report the coverage of the policy")
+	policyTestCmd.Flags().BoolP("verbose", "v", false, "show passed tests and the lines not covered")
+	policyCmd.AddCommand(policyTestCmd)
+
+	policyEvalCmd.Flags().StringP("action", "", engine.ActionGetSecret, "action to evaluate; get_nonce, get_keytab or get_secret")
+	policyEvalCmd.Flags().StringP("name", "", "", "name of the keytab or secret")
+	policyEvalCmd.Flags().StringP("token", "", "", "token (JWT) of the client; the signature is optional")
+	policyEvalCmd.Flags().StringP("token-file", "", "", "file with the token (JWT) of the client")
+	policyEvalCmd.Flags().StringP("claims", "", "", "JSON file with the claims of the token")
+	policyEvalCmd.Flags().StringArrayP("nonce", "", nil, "nonce issued to the subject of the token; may be repeated")
+	policyEvalCmd.Flags().StringP("explain", "", engine.ExplainFails, "trace to print; fails, notes or full")
+	policyEvalCmd.Flags().StringP("output", "o", "text", "output format text or json")
+	policyCmd.AddCommand(policyEvalCmd)
+}
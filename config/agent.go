@@ -0,0 +1,166 @@
+/*
+Copyright © 2020 Jody Scott <jody@thescottsweb.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Agent Config for tokenmachine agent
+type Agent struct {
+	APIVersion string           `json:"apiVersion,omitempty" yaml:"apiVersion,omitempty"`
+	Server     *AgentServer     `json:"server,omitempty" yaml:"server,omitempty"`
+	Logging    *Logging         `json:"logging,omitempty" yaml:"logging,omitempty"`
+	Secrets    []*AgentOutput   `json:"secrets,omitempty" yaml:"secrets,omitempty"`
+	Keytabs    []*AgentOutput   `json:"keytabs,omitempty" yaml:"keytabs,omitempty"`
+	Templates  []*AgentTemplate `json:"templates,omitempty" yaml:"templates,omitempty"`
+}
+
+// AgentServer is the TokenMachine server and the source of tokens
+type AgentServer struct {
+	URL          string        `json:"url,omitempty" yaml:"url,omitempty"`
+	CACert       string        `json:"caCert,omitempty" yaml:"caCert,omitempty"`
+	TokenCommand string        `json:"tokenCommand,omitempty" yaml:"tokenCommand,omitempty"`
+	TokenURL     string        `json:"tokenURL,omitempty" yaml:"tokenURL,omitempty"`
+	TokenHeaders []string      `json:"tokenHeaders,omitempty" yaml:"tokenHeaders,omitempty"`
+	Timeout      time.Duration `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+	Challenge    bool          `json:"challenge,omitempty" yaml:"challenge,omitempty"`
+}
+
+// AgentOutput is a secret or keytab and the file it is written to
+type AgentOutput struct {
+	Name   string       `json:"name,omitempty" yaml:"name,omitempty"`
+	Path   string       `json:"path,omitempty" yaml:"path,omitempty"`
+	Format string       `json:"format,omitempty" yaml:"format,omitempty"`
+	Owner  string       `json:"owner,omitempty" yaml:"owner,omitempty"`
+	Group  string       `json:"group,omitempty" yaml:"group,omitempty"`
+	Mode   string       `json:"mode,omitempty" yaml:"mode,omitempty"`
+	Notify *AgentNotify `json:"notify,omitempty" yaml:"notify,omitempty"`
+}
+
+// AgentTemplate is a Go text/template rendered with the named secrets and
+// keytabs and written to Path
+type AgentTemplate struct {
+	Source  string       `json:"source,omitempty" yaml:"source,omitempty"`
+	Text    string       `json:"text,omitempty" yaml:"text,omitempty"`
+	Path    string       `json:"path,omitempty" yaml:"path,omitempty"`
+	Secrets []string     `json:"secrets,omitempty" yaml:"secrets,omitempty"`
+	Keytabs []string     `json:"keytabs,omitempty" yaml:"keytabs,omitempty"`
+	Owner   string       `json:"owner,omitempty" yaml:"owner,omitempty"`
+	Group   string       `json:"group,omitempty" yaml:"group,omitempty"`
+	Mode    string       `json:"mode,omitempty" yaml:"mode,omitempty"`
+	Notify  *AgentNotify `json:"notify,omitempty" yaml:"notify,omitempty"`
+}
+
+// AgentNotify is run after a file is updated
+type AgentNotify struct {
+	Command string `json:"command,omitempty" yaml:"command,omitempty"`
+	Signal  string `json:"signal,omitempty" yaml:"signal,omitempty"`
+	PID     int    `json:"pid,omitempty" yaml:"pid,omitempty"`
+	PIDFile string `json:"pidFile,omitempty" yaml:"pidFile,omitempty"`
+}
+
+// NewAgentFromFile Returns Agent config read from YAML or JSON file
+func NewAgentFromFile(filename string) (*Agent, error) {
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	agent := &Agent{}
+
+	// YAML is a superset of JSON
+	err = yaml.UnmarshalStrict(data, agent)
+	if err != nil {
+		return nil, fmt.Errorf("Agent config %s is not valid YAML or JSON; err->%s", filename, err)
+	}
+
+	if agent.APIVersion == "" {
+		return nil, fmt.Errorf("Missing APIVersion")
+	}
+
+	if agent.APIVersion != "V1" {
+		return nil, fmt.Errorf(fmt.Sprintf("APIVersion %s not supported", agent.APIVersion))
+	}
+
+	return agent, nil
+}
+
+// NewV1ExampleAgent Returns example Agent config
+func NewV1ExampleAgent() *Agent {
+	return &Agent{
+		APIVersion: "V1",
+		Server: &AgentServer{
+			URL:          "https://tokenmachine.example.com:8443",
+			CACert:       "/etc/tokenmachine/ca.pem",
+			TokenURL:     "http://169.254.254.1/token?type=OAUTH&audience={audience}",
+			TokenHeaders: []string{"X-Aporeto-Metadata: secrets"},
+		},
+		Logging: &Logging{
+			LogLevel:  "info",
+			LogFormat: "json",
+		},
+		Secrets: []*AgentOutput{
+			&AgentOutput{
+				Name:  "secret1",
+				Path:  "/run/secrets/secret1",
+				Owner: "www-data",
+				Mode:  "0400",
+				Notify: &AgentNotify{
+					Signal:  "SIGHUP",
+					PIDFile: "/run/nginx.pid",
+				},
+			},
+		},
+		Keytabs: []*AgentOutput{
+			&AgentOutput{
+				Name: "superman",
+				Path: "/run/secrets/superman.keytab",
+				Mode: "0600",
+				Notify: &AgentNotify{
+					Command: "kinit -k -t /run/secrets/superman.keytab HTTP/superman@EXAMPLE.COM",
+				},
+			},
+		},
+		Templates: []*AgentTemplate{
+			&AgentTemplate{
+				Text:    "DB_PASSWORD={{ .secrets.secret1.secret }}\nDB_NEXT_PASSWORD={{ .secrets.secret1.nextSecret }}\n",
+				Path:    "/run/secrets/app.env",
+				Secrets: []string{"secret1"},
+				Mode:    "0400",
+			},
+		},
+	}
+}
+
+// JSON Return JSON String representation
+func (t *Agent) JSON() string {
+	j, _ := json.Marshal(t)
+	return string(j)
+}
+
+// YAML Return YAML String representation
+func (t *Agent) YAML() string {
+	j, _ := yaml.Marshal(t)
+	return string(j)
+}
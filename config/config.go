@@ -31,23 +31,77 @@ type Config struct {
 	Policy     *Policy  `json:"policy,omitempty" yaml:"policy,omitempty"`
 	Logging    *Logging `json:"logging,omitempty" yaml:"logging,omitempty"`
 	Data       *Data    `json:"data,omitempty" yaml:"data,omitempty"`
+	Audit      *Audit   `json:"audit,omitempty" yaml:"audit,omitempty"`
+	Trust      *Trust   `json:"trust,omitempty" yaml:"trust,omitempty"`
 }
 
 // Network Config
 type Network struct {
-	Listen    string `json:"listen,omitempty" yaml:"listen,omitempty"`
-	HTTPPort  int    `json:"httpPort,omitempty" yaml:"httpPort,omitempty"`
-	HTTPSPort int    `json:"httpsPort,omitempty" yaml:"httpsPort,omitempty"`
-	TLSCert   string `json:"tlscert,omitempty" yaml:"tlscert,omitempty"`
-	TLSKey    string `json:"tlsKey,omitempty" yaml:"tlsKey,omitempty"`
+	Listen            string        `json:"listen,omitempty" yaml:"listen,omitempty"`
+	HTTPPort          int           `json:"httpPort,omitempty" yaml:"httpPort,omitempty"`
+	HTTPSPort         int           `json:"httpsPort,omitempty" yaml:"httpsPort,omitempty"`
+	TLSCert           string        `json:"tlscert,omitempty" yaml:"tlscert,omitempty"`
+	TLSKey            string        `json:"tlsKey,omitempty" yaml:"tlsKey,omitempty"`
+	DisableQueryToken bool          `json:"disableQueryToken,omitempty" yaml:"disableQueryToken,omitempty"`
+	MetricsPort       int           `json:"metricsPort,omitempty" yaml:"metricsPort,omitempty"`
+	ShutdownTimeout   time.Duration `json:"shutdownTimeout,omitempty" yaml:"shutdownTimeout,omitempty"`
+	PreStopDelay      time.Duration `json:"preStopDelay,omitempty" yaml:"preStopDelay,omitempty"`
+	ClientCA          string        `json:"clientCA,omitempty" yaml:"clientCA,omitempty"`
+	ClientAuth        string        `json:"clientAuth,omitempty" yaml:"clientAuth,omitempty"`
+	TLSMinVersion     string        `json:"tlsMinVersion,omitempty" yaml:"tlsMinVersion,omitempty"`
+	TLSCipherSuites   []string      `json:"tlsCipherSuites,omitempty" yaml:"tlsCipherSuites,omitempty"`
+	TLSCertFile       string        `json:"tlsCertFile,omitempty" yaml:"tlsCertFile,omitempty"`
+	TLSKeyFile        string        `json:"tlsKeyFile,omitempty" yaml:"tlsKeyFile,omitempty"`
+	ClientCAFile      string        `json:"clientCAFile,omitempty" yaml:"clientCAFile,omitempty"`
+	AdminToken        string        `json:"adminToken,omitempty" yaml:"adminToken,omitempty"`
+	AdminPort         int           `json:"adminPort,omitempty" yaml:"adminPort,omitempty"`
 }
 
 // Policy Config
 type Policy struct {
-	Policy               string        `json:"policy,omitempty" yaml:"policy,omitempty"`
-	NonceLifetime        time.Duration `json:"nonceLifetime,omitempty" yaml:"nonceLifetime,omitempty"`
-	SharedSecretLifetime time.Duration `json:"sharedSecretLifetime,omitempty" yaml:"sharedSecretLifetime,omitempty"`
-	KeytabLifetime       time.Duration `json:"keytabLifetime,omitempty" yaml:"keytabLifetime,omitempty"`
+	Policy                   string          `json:"policy,omitempty" yaml:"policy,omitempty"`
+	NonceLifetime            time.Duration   `json:"nonceLifetime,omitempty" yaml:"nonceLifetime,omitempty"`
+	NonceKey                 string          `json:"nonceKey,omitempty" yaml:"nonceKey,omitempty"`
+	SingleUseNonce           bool            `json:"singleUseNonce,omitempty" yaml:"singleUseNonce,omitempty"`
+	ReplayCacheSize          int             `json:"replayCacheSize,omitempty" yaml:"replayCacheSize,omitempty"`
+	SharedSecretLifetime     time.Duration   `json:"sharedSecretLifetime,omitempty" yaml:"sharedSecretLifetime,omitempty"`
+	KeytabLifetime           time.Duration   `json:"keytabLifetime,omitempty" yaml:"keytabLifetime,omitempty"`
+	DisableNonceSubjectCheck bool            `json:"disableNonceSubjectCheck,omitempty" yaml:"disableNonceSubjectCheck,omitempty"`
+	NonceChallenge           bool            `json:"nonceChallenge,omitempty" yaml:"nonceChallenge,omitempty"`
+	Modules                  []*PolicyModule `json:"modules,omitempty" yaml:"modules,omitempty"`
+	Bundle                   *Bundle         `json:"bundle,omitempty" yaml:"bundle,omitempty"`
+	Data                     []*PolicyData   `json:"data,omitempty" yaml:"data,omitempty"`
+}
+
+// PolicyModule Config. Additional Rego modules such as a shared library that
+// are compiled with the policy. Name is the file name used in errors.
+type PolicyModule struct {
+	Name string `json:"name,omitempty" yaml:"name,omitempty"`
+	Rego string `json:"rego,omitempty" yaml:"rego,omitempty"`
+}
+
+// PolicyData Config. A document provided to the policy as data.<path> such as
+// a lookup table. The document is YAML or JSON provided inline, in a file or
+// at a URL and is read again when the config is reloaded. If path is empty the
+// document must be an object and its members are provided at the root of data.
+type PolicyData struct {
+	Path   string `json:"path,omitempty" yaml:"path,omitempty"`
+	Inline string `json:"inline,omitempty" yaml:"inline,omitempty"`
+	File   string `json:"file,omitempty" yaml:"file,omitempty"`
+	URL    string `json:"url,omitempty" yaml:"url,omitempty"`
+}
+
+// Bundle Config. Source is the path of an OPA bundle file (.tar.gz) or
+// directory, or a http(s) URL that is polled for new revisions. If publicKey
+// is set the bundle must be signed with it.
+type Bundle struct {
+	Source       string        `json:"source,omitempty" yaml:"source,omitempty"`
+	PublicKey    string        `json:"publicKey,omitempty" yaml:"publicKey,omitempty"`
+	KeyID        string        `json:"keyId,omitempty" yaml:"keyId,omitempty"`
+	Algorithm    string        `json:"algorithm,omitempty" yaml:"algorithm,omitempty"`
+	Scope        string        `json:"scope,omitempty" yaml:"scope,omitempty"`
+	PollInterval time.Duration `json:"pollInterval,omitempty" yaml:"pollInterval,omitempty"`
+	CACert       string        `json:"caCert,omitempty" yaml:"caCert,omitempty"`
 }
 
 // Logging Config
@@ -58,6 +112,33 @@ type Logging struct {
 	ErrorOutputPaths []string `json:"errorOutputPaths,omitempty" yaml:"errorOutputPaths,omitempty"`
 }
 
+// Audit Config. Audit events are written to their own output paths and are
+// not affected by the log level.
+type Audit struct {
+	OutputPaths []string `json:"outputPaths,omitempty" yaml:"outputPaths,omitempty"`
+}
+
+// Trust Config. If issuers are listed tokens from other issuers are rejected
+// and tokens are verified with the keys of the issuer rather than by following
+// the token iss.
+type Trust struct {
+	Issuers []*Issuer `json:"issuers,omitempty" yaml:"issuers,omitempty"`
+}
+
+// Issuer Config. Keys are provided with one or more of jwks, publicKeys and
+// jwksURL.
+type Issuer struct {
+	Issuer          string        `json:"issuer,omitempty" yaml:"issuer,omitempty"`
+	JWKS            string        `json:"jwks,omitempty" yaml:"jwks,omitempty"`
+	PublicKeys      []string      `json:"publicKeys,omitempty" yaml:"publicKeys,omitempty"`
+	JWKSURL         string        `json:"jwksURL,omitempty" yaml:"jwksURL,omitempty"`
+	RefreshInterval time.Duration `json:"refreshInterval,omitempty" yaml:"refreshInterval,omitempty"`
+	CACert          string        `json:"caCert,omitempty" yaml:"caCert,omitempty"`
+	Algorithms      []string      `json:"algorithms,omitempty" yaml:"algorithms,omitempty"`
+	Audiences       []string      `json:"audiences,omitempty" yaml:"audiences,omitempty"`
+	ClockSkew       time.Duration `json:"clockSkew,omitempty" yaml:"clockSkew,omitempty"`
+}
+
 // Data Config
 type Data struct {
 	SharedSecrets []*SharedSecret `json:"sharedSecrets,omitempty" yaml:"sharedSecrets,omitempty"`
@@ -79,6 +160,45 @@ type Keytab struct {
 	Lifetime  time.Duration `json:"lifetime,omitempty" yaml:"lifetime,omitempty"`
 }
 
+// addModule adds module or replaces the module with the same name
+func (t *Policy) addModule(module *PolicyModule) {
+
+	for i, v := range t.Modules {
+		if v.Name == module.Name {
+			t.Modules[i] = module
+			return
+		}
+	}
+
+	t.Modules = append(t.Modules, module)
+}
+
+// addData adds data or replaces the data with the same path
+func (t *Policy) addData(data *PolicyData) {
+
+	for i, v := range t.Data {
+		if v.Path == data.Path {
+			t.Data[i] = data
+			return
+		}
+	}
+
+	t.Data = append(t.Data, data)
+}
+
+// addIssuer adds issuer or replaces the issuer with the same name
+func (t *Trust) addIssuer(issuer *Issuer) {
+
+	for i, v := range t.Issuers {
+		if v.Issuer == issuer.Issuer {
+			t.Issuers[i] = issuer
+			return
+		}
+	}
+
+	t.Issuers = append(t.Issuers, issuer)
+}
+
 func (t *Data) addSharedSecret(sharedSecret *SharedSecret) {
 
 	var existing *SharedSecret
@@ -141,6 +261,8 @@ func NewConfig() *Config {
 		Policy:  &Policy{},
 		Logging: &Logging{},
 		Data:    &Data{},
+		Audit:   &Audit{},
+		Trust:   &Trust{},
 	}
 }
 
@@ -194,6 +316,58 @@ func (t *Config) Merge(config *Config) {
 			t.Network.TLSCert = config.Network.TLSCert
 		}
 
+		if config.Network.DisableQueryToken {
+			t.Network.DisableQueryToken = true
+		}
+
+		if config.Network.MetricsPort > 0 {
+			t.Network.MetricsPort = config.Network.MetricsPort
+		}
+
+		if config.Network.ShutdownTimeout > 0 {
+			t.Network.ShutdownTimeout = config.Network.ShutdownTimeout
+		}
+
+		if config.Network.PreStopDelay > 0 {
+			t.Network.PreStopDelay = config.Network.PreStopDelay
+		}
+
+		if config.Network.ClientCA != "" {
+			t.Network.ClientCA = config.Network.ClientCA
+		}
+
+		if config.Network.ClientAuth != "" {
+			t.Network.ClientAuth = config.Network.ClientAuth
+		}
+
+		if config.Network.TLSMinVersion != "" {
+			t.Network.TLSMinVersion = config.Network.TLSMinVersion
+		}
+
+		if config.Network.TLSCipherSuites != nil {
+			t.Network.TLSCipherSuites = config.Network.TLSCipherSuites
+		}
+
+		if config.Network.TLSCertFile != "" {
+			t.Network.TLSCertFile = config.Network.TLSCertFile
+		}
+
+		if config.Network.TLSKeyFile != "" {
+			t.Network.TLSKeyFile = config.Network.TLSKeyFile
+		}
+
+		if config.Network.ClientCAFile != "" {
+			t.Network.ClientCAFile = config.Network.ClientCAFile
+		}
+
+		if config.Network.AdminToken != "" {
+			t.Network.AdminToken = config.Network.AdminToken
+		}
+
+		if config.Network.AdminPort > 0 {
+			t.Network.AdminPort = config.Network.AdminPort
+		}
+
 	}
 
 	if config.Policy != nil {
@@ -210,6 +384,42 @@ func (t *Config) Merge(config *Config) {
 			t.Policy.NonceLifetime = config.Policy.NonceLifetime
 		}
 
+		if config.Policy.NonceKey != "" {
+			t.Policy.NonceKey = config.Policy.NonceKey
+		}
+
+		if config.Policy.SingleUseNonce {
+			t.Policy.SingleUseNonce = true
+		}
+
+		if config.Policy.ReplayCacheSize > 0 {
+			t.Policy.ReplayCacheSize = config.Policy.ReplayCacheSize
+		}
+
+		if config.Policy.DisableNonceSubjectCheck {
+			t.Policy.DisableNonceSubjectCheck = true
+		}
+
+		if config.Policy.NonceChallenge {
+			t.Policy.NonceChallenge = true
+		}
+
+		if config.Policy.Modules != nil {
+			for _, module := range config.Policy.Modules {
+				t.Policy.addModule(module)
+			}
+		}
+
+		if config.Policy.Bundle != nil {
+			t.Policy.Bundle = config.Policy.Bundle
+		}
+
+		if config.Policy.Data != nil {
+			for _, data := range config.Policy.Data {
+				t.Policy.addData(data)
+			}
+		}
+
 		if config.Policy.KeytabLifetime > 0 {
 			t.Policy.KeytabLifetime = config.Policy.KeytabLifetime
 		}
@@ -252,6 +462,36 @@ func (t *Config) Merge(config *Config) {
 
 	}
 
+	if config.Audit != nil {
+
+		if t.Audit == nil {
+			t.Audit = &Audit{}
+		}
+
+		if config.Audit.OutputPaths != nil {
+			for _, s := range config.Audit.OutputPaths {
+				if s != "" {
+					t.Audit.OutputPaths = append(t.Audit.OutputPaths, s)
+				}
+			}
+		}
+
+	}
+
+	if config.Trust != nil {
+
+		if t.Trust == nil {
+			t.Trust = &Trust{}
+		}
+
+		if config.Trust.Issuers != nil {
+			for _, issuer := range config.Trust.Issuers {
+				t.Trust.addIssuer(issuer)
+			}
+		}
+
+	}
+
 	if config.Data != nil {
 
 		if t.Data == nil {
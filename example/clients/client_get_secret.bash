@@ -53,7 +53,7 @@ function run() {
   err
 
   log "${YELLOW}Get nonce with token from above->${NC}\n"
-  nonce=$(httpGet -H "Authorization: Bearer $token" "${SERVER}/getnonce") || {
+  nonce=$(httpGet -X POST -H "Authorization: Bearer $token" "${SERVER}/v1/nonce") || {
     log_fail
     return 3
   }
@@ -70,7 +70,7 @@ function run() {
   print_token "$token"
 
   log "${YELLOW}Get Secret using token from above and secret name ${PURPLE}${SECRET_NAME}${YELLOW}->${NC}\n"
-  secret=$(httpGet -H "Authorization: Bearer $token" "${SERVER}"/getsecret\?name="${SECRET_NAME}") || {
+  secret=$(httpGet -H "Authorization: Bearer $token" "${SERVER}/v1/secrets/${SECRET_NAME}") || {
     log_fail
     return 3
   }
@@ -63,7 +63,7 @@ function run() {
   err
 
   log "${YELLOW}Get nonce with token from above->${NC}\n"
-  nonce=$(httpGet -H "Authorization: Bearer $token" "${SERVER}/getnonce") || {
+  nonce=$(httpGet -X POST -H "Authorization: Bearer $token" "${SERVER}/v1/nonce") || {
     log_fail
     return 3
   }
@@ -80,7 +80,7 @@ function run() {
   print_token "$token"
 
   log "${YELLOW}Get keytab with token from above and NAME ${PURPLE}${NAME}${YELLOW}->${NC}\n"
-  keytab=$(httpGet -H "Authorization: Bearer $token" "${SERVER}"/getkeytab\?name="${NAME}") || {
+  keytab=$(httpGet -H "Authorization: Bearer $token" "${SERVER}/v1/keytabs/${NAME}") || {
     log_fail
     return 3
   }
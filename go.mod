@@ -3,13 +3,18 @@ module github.com/jodydadescott/tokenmachine
 go 1.14
 
 require (
+	github.com/dgrijalva/jwt-go v3.2.0+incompatible
+	github.com/fsnotify/fsnotify v1.4.7
 	github.com/jinzhu/copier v0.0.0-20201025035756-632e723a6687
 	github.com/jodydadescott/libtokenmachine v1.0.14
 	github.com/open-policy-agent/opa v0.24.0
+	github.com/pquerna/otp v1.2.0
+	github.com/prometheus/client_golang v1.7.1
 	github.com/spf13/cobra v0.0.0-20181021141114-fe5e611709b0
+	github.com/spf13/pflag v1.0.3
 	github.com/spf13/viper v1.7.1
 	go.uber.org/zap v1.16.0
-	golang.org/x/sys v0.0.0-20200323222414-85ca7c5b95cd
-	gopkg.in/yaml.v2 v2.2.4
+	golang.org/x/sys v0.0.0-20200615200032-f1bc736245b1 // minimum required by prometheus/client_golang v1.7.1
+	gopkg.in/yaml.v2 v2.2.5 // minimum required by prometheus/client_golang v1.7.1
 	honnef.co/go/tools v0.0.1-2019.2.3
 )
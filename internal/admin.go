@@ -0,0 +1,153 @@
+/*
+Copyright © 2020 Jody Scott <jody@thescottsweb.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/jodydadescott/tokenmachine/internal/engine"
+	"go.uber.org/zap"
+)
+
+const (
+	pathAdminPolicyEval = "/admin/policy/eval"
+
+	// Action of admin policy eval calls in the audit log
+	actionAdminPolicyEval = "admin_policy_eval"
+)
+
+// AdminPolicyEvalRequest is the JSON body of POST /admin/policy/eval. Either
+// the token of the client or its claims must be provided. The token is
+// validated as it would be for the client; the claims are not. Explain is the
+// explain mode and defaults to fails.
+type AdminPolicyEvalRequest struct {
+	Action  string                 `json:"action,omitempty"`
+	Name    string                 `json:"name,omitempty"`
+	Token   string                 `json:"token,omitempty"`
+	Claims  map[string]interface{} `json:"claims,omitempty"`
+	Explain string                 `json:"explain,omitempty"`
+}
+
+// serveAdmin handles the admin endpoints on the admin listener. The admin
+// token is required as the bearer token and requests that did not arrive over
+// TLS are refused. Every call is written to the audit log.
+func (t *Server) serveAdmin(w http.ResponseWriter, r *http.Request) {
+
+	requestID := getRequestID(r)
+	w.Header().Set(requestIDHeader, requestID)
+
+	t.stateMutex.RLock()
+	adminToken := t.adminToken
+	t.stateMutex.RUnlock()
+
+	if adminToken == "" || r.URL.Path != pathAdminPolicyEval {
+		writeError(w, requestID, newNotFoundError("Path "+r.URL.Path+" not mapped"))
+		return
+	}
+
+	request, explanation, err := t.serveAdminPolicyEval(w, r, adminToken)
+	t.audit.record(newAdminAuditEvent(r, requestID, request, err))
+
+	if err != nil {
+		writeError(w, requestID, err)
+		return
+	}
+
+	zap.L().Info(fmt.Sprintf("Policy decision for action=%s name=%s explained to %s", request.Action, request.Name, r.RemoteAddr))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	fmt.Fprintln(w, explanation.JSON())
+}
+
+// serveAdminPolicyEval authenticates and parses the request and explains the
+// decision. The request is returned once it is parsed for the audit log.
+func (t *Server) serveAdminPolicyEval(w http.ResponseWriter, r *http.Request, adminToken string) (*AdminPolicyEvalRequest, *engine.Explanation, error) {
+
+	if r.TLS == nil {
+		return nil, nil, newHTTPError(http.StatusForbidden, ErrCodeDenied, "Admin endpoints require TLS")
+	}
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		return nil, nil, newMethodNotAllowedError(r.Method)
+	}
+
+	token := getAuthorizationToken(r)
+	if token == "" {
+		return nil, nil, newHTTPError(http.StatusUnauthorized, ErrCodeTokenRequired, "Admin token required")
+	}
+
+	if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+		zap.L().Warn(fmt.Sprintf("Invalid admin token from %s", r.RemoteAddr))
+		return nil, nil, newHTTPError(http.StatusUnauthorized, ErrCodeTokenInvalid, "Admin token invalid")
+	}
+
+	request, err := parseAdminPolicyEvalRequest(r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	explanation, err := t.explain(r, request)
+	if err != nil {
+		return request, nil, newBadRequestError(err.Error())
+	}
+
+	return request, explanation, nil
+}
+
+func (t *Server) explain(r *http.Request, request *AdminPolicyEvalRequest) (*engine.Explanation, error) {
+
+	// The certificate of the admin is not that of the client
+	ctx := r.Context()
+
+	if request.Token != "" {
+		return t.tokenMachine.Explain(ctx, request.Token, request.Action, request.Name, request.Explain)
+	}
+
+	return t.tokenMachine.ExplainClaims(ctx, request.Claims, request.Action, request.Name, request.Explain)
+}
+
+func parseAdminPolicyEvalRequest(r *http.Request) (*AdminPolicyEvalRequest, error) {
+
+	contentType := r.Header.Get("Content-Type")
+	if contentType != "" && !strings.HasPrefix(contentType, "application/json") {
+		return nil, newHTTPError(http.StatusUnsupportedMediaType, ErrCodeBadRequest, "Content-Type must be application/json")
+	}
+
+	request := &AdminPolicyEvalRequest{}
+
+	err := json.NewDecoder(io.LimitReader(r.Body, maxRequestBodySize)).Decode(request)
+	if err != nil {
+		return nil, newBadRequestError("Request body is not valid JSON")
+	}
+
+	if (request.Token == "") == (request.Claims == nil) {
+		return nil, newBadRequestError("Either token or claims is required")
+	}
+
+	if request.Explain == "" {
+		request.Explain = engine.ExplainFails
+	}
+
+	return request, nil
+}
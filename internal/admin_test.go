@@ -0,0 +1,332 @@
+/*
+Copyright © 2020 Jody Scott <jody@thescottsweb.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/jodydadescott/libtokenmachine"
+	"github.com/jodydadescott/tokenmachine/internal/engine"
+)
+
+const testAdminToken = "admin-token"
+
+func TestAdmin(t *testing.T) {
+
+	ca := newTestCertificate(t, "ca", nil, 0)
+	certificate := newTestCertificate(t, "localhost", ca, x509.ExtKeyUsageServerAuth)
+
+	auditPath := filepath.Join(t.TempDir(), "audit.log")
+
+	config := newTestConfig(t)
+	config.HTTPSPort = freePort(t)
+	config.AdminPort = freePort(t)
+	config.AdminToken = testAdminToken
+	config.TLSCert = certificate.certPEM
+	config.TLSKey = certificate.keyPEM
+	config.AuditOutputPaths = []string{auditPath}
+
+	server := newTestServer(t, config)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: roots, ServerName: "localhost"},
+		},
+	}
+
+	adminURL := "https://" + getListenAddr(config.Listen, config.AdminPort) + pathAdminPolicyEval
+	httpsURL := "https://" + getListenAddr(config.Listen, config.HTTPSPort) + pathAdminPolicyEval
+	httpURL := "http://" + getListenAddr(config.Listen, config.HTTPPort) + pathAdminPolicyEval
+	body := `{"action":"get_nonce","claims":{"iss":"https://issuer","sub":"bob"}}`
+
+	tests := []struct {
+		name    string
+		method  string
+		url     string
+		token   string
+		body    string
+		status  int
+		audited bool
+	}{
+		{"explain", http.MethodPost, adminURL, testAdminToken, body, http.StatusOK, true},
+		{"no token", http.MethodPost, adminURL, "", body, http.StatusUnauthorized, true},
+		{"invalid token", http.MethodPost, adminURL, "other", body, http.StatusUnauthorized, true},
+		{"get", http.MethodGet, adminURL, testAdminToken, "", http.StatusMethodNotAllowed, true},
+		{"invalid body", http.MethodPost, adminURL, testAdminToken, "{", http.StatusBadRequest, true},
+		{"invalid action", http.MethodPost, adminURL, testAdminToken, `{"action":"other","claims":{}}`, http.StatusBadRequest, true},
+		{"other path", http.MethodPost, strings.TrimSuffix(adminURL, pathAdminPolicyEval) + "/admin/other", testAdminToken, body, http.StatusNotFound, false},
+		{"client api path", http.MethodPost, strings.TrimSuffix(adminURL, pathAdminPolicyEval) + "/v1/nonce", testAdminToken, body, http.StatusNotFound, false},
+		{"https listener", http.MethodPost, httpsURL, testAdminToken, body, http.StatusNotFound, false},
+		{"http listener", http.MethodPost, httpURL, testAdminToken, body, http.StatusNotFound, false},
+		{"plain http to the admin listener", http.MethodPost, "http://" + getListenAddr(config.Listen, config.AdminPort) + pathAdminPolicyEval, testAdminToken, body, http.StatusBadRequest, false},
+	}
+
+	audited := 0
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			req, err := http.NewRequest(test.method, test.url, strings.NewReader(test.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if test.token != "" {
+				req.Header.Set("Authorization", "Bearer "+test.token)
+			}
+
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != test.status {
+				t.Errorf("status is %d; want %d", resp.StatusCode, test.status)
+			}
+
+			if test.audited {
+				audited++
+			}
+
+			if resp.StatusCode != http.StatusOK {
+				return
+			}
+
+			explanation := &engine.Explanation{}
+			if err := json.NewDecoder(resp.Body).Decode(explanation); err != nil {
+				t.Fatal(err)
+			}
+
+			if !explanation.Allow || explanation.Rule != engine.RuleGetNonce {
+				t.Errorf("unexpected explanation %s", explanation.JSON())
+			}
+		})
+	}
+
+	// Shutdown flushes the audit log
+	server.Shutdown()
+
+	b, err := ioutil.ReadFile(auditPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != audited {
+		t.Fatalf("audit log has %d events; want %d\n%s", len(lines), audited, b)
+	}
+
+	decisions := map[string]int{}
+	for _, line := range lines {
+		event := &AuditEvent{}
+		if err := json.Unmarshal([]byte(line), event); err != nil {
+			t.Fatalf("line %s is not an event; err->%s", line, err)
+		}
+		if event.Action != actionAdminPolicyEval {
+			t.Errorf("action is %s; want %s", event.Action, actionAdminPolicyEval)
+		}
+		if strings.Contains(line, testAdminToken) {
+			t.Errorf("admin token was written to the audit log")
+		}
+		decisions[event.Decision]++
+	}
+
+	if decisions[outcomeGranted] != 1 || decisions[outcomeDenied] != 2 || decisions[outcomeError] != 3 {
+		t.Errorf("decisions are %v", decisions)
+	}
+}
+
+func TestAdminExplainNonces(t *testing.T) {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newToken := func(claims jwt.MapClaims) string {
+		claims["iss"] = "https://issuer"
+		claims["exp"] = time.Now().Unix() + 60
+		token, err := jwt.NewWithClaims(jwt.SigningMethodES256, claims).SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	ca := newTestCertificate(t, "ca", nil, 0)
+	certificate := newTestCertificate(t, "localhost", ca, x509.ExtKeyUsageServerAuth)
+
+	config := newTestConfig(t)
+	config.AdminPort = freePort(t)
+	config.AdminToken = testAdminToken
+	config.TLSCert = certificate.certPEM
+	config.TLSKey = certificate.keyPEM
+	config.Issuers = []*engine.Issuer{{
+		Issuer:     "https://issuer",
+		PublicKeys: []string{string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))},
+	}}
+
+	newTestServer(t, config)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: roots, ServerName: "localhost"},
+		},
+	}
+
+	post := func(url, token string, body interface{}) []byte {
+
+		b, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		b, err = ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("status is %d; body %s", resp.StatusCode, b)
+		}
+
+		return b
+	}
+
+	nonceURL := "http://" + getListenAddr(config.Listen, config.HTTPPort) + "/v1/nonce"
+
+	nonce := &libtokenmachine.Nonce{}
+	if err := json.Unmarshal(post(nonceURL, newToken(jwt.MapClaims{"sub": "alice"}), nil), nonce); err != nil {
+		t.Fatal(err)
+	}
+
+	if nonce.Value == "" {
+		t.Fatalf("nonce was not issued")
+	}
+
+	adminURL := "https://" + getListenAddr(config.Listen, config.AdminPort) + pathAdminPolicyEval
+
+	b := post(adminURL, testAdminToken, &AdminPolicyEvalRequest{
+		Action:  engine.ActionGetSecret,
+		Name:    "db",
+		Token:   newToken(jwt.MapClaims{"sub": "bob", "aud": "api"}),
+		Explain: engine.ExplainFull,
+	})
+
+	if strings.Contains(string(b), nonce.Value) {
+		t.Errorf("live nonce of another client is in the response %s", b)
+	}
+}
+
+func TestAdminRequiresTLS(t *testing.T) {
+
+	server := &Server{adminToken: testAdminToken}
+
+	req := httptest.NewRequest(http.MethodPost, pathAdminPolicyEval, strings.NewReader(`{"action":"get_nonce","claims":{}}`))
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+
+	w := httptest.NewRecorder()
+	server.serveAdmin(w, req)
+
+	if w.Code != http.StatusForbidden {
+		t.Errorf("status is %d; want %d", w.Code, http.StatusForbidden)
+	}
+}
+
+func TestAdminConfigInvalid(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		modify func(config *Config)
+		err    string
+	}{
+		{"negative admin port", func(c *Config) { c.AdminPort = -1 }, "AdminPort"},
+		{"admin token without port", func(c *Config) { c.AdminToken = testAdminToken }, "AdminToken and AdminPort"},
+		{"admin port without token", func(c *Config) { c.AdminPort = freePort(t) }, "AdminToken and AdminPort"},
+		{"admin port without certificate", func(c *Config) { c.AdminPort = freePort(t); c.AdminToken = testAdminToken }, "TLS"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			config := newTestConfig(t)
+			test.modify(config)
+
+			server, err := config.Build()
+			if err == nil {
+				server.Shutdown()
+				t.Fatalf("expected error")
+			}
+
+			if !strings.Contains(err.Error(), test.err) {
+				t.Errorf("err is %s; want %s", err, test.err)
+			}
+		})
+	}
+
+	// Reload checks the admin settings as Build does
+	server := newTestServer(t, newTestConfig(t))
+
+	config := newTestConfig(t)
+	config.AdminToken = testAdminToken
+
+	if err := server.Reload(config); err == nil {
+		t.Errorf("expected error")
+	}
+}
@@ -0,0 +1,288 @@
+/*
+Copyright © 2020 Jody Scott <jody@thescottsweb.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package agent keeps shared secrets and keytabs fetched from TokenMachine
+// fresh on disk
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jodydadescott/tokenmachine/client"
+	"go.uber.org/zap"
+)
+
+// Output formats of secrets
+const (
+	FormatRaw  = "raw"  // The secret value
+	FormatJSON = "json" // The SharedSecret as JSON
+)
+
+const (
+	minRefreshInterval = 5 * time.Second
+	minRetryInterval   = 5 * time.Second
+	maxRetryInterval   = 5 * time.Minute
+)
+
+// Config Config
+type Config struct {
+	Client    *client.Client // Required; should be built with DisableCache
+	Secrets   []*Output
+	Keytabs   []*Output
+	Templates []*Template
+}
+
+// Output is a secret or keytab and the file it is written to
+type Output struct {
+	Name   string
+	Path   string
+	Format string      // Secrets only; raw (default) or json
+	Mode   os.FileMode // Default is 0600
+	UID    int         // -1 to leave unchanged
+	GID    int         // -1 to leave unchanged
+	Notify *Notify     // Optional
+}
+
+// Agent fetches each secret and keytab and writes it to its file. Each is
+// refreshed before it expires. A secret or keytab used by more than one file
+// is fetched once for all of them.
+type Agent struct {
+	cache  *cache
+	closed chan struct{}
+	wg     sync.WaitGroup
+}
+
+type fetchFunc func(ctx context.Context) (data []byte, exp int64, err error)
+
+// Build Returns a new running Agent
+func (config *Config) Build() (*Agent, error) {
+
+	if config.Client == nil {
+		return nil, fmt.Errorf("Client is required")
+	}
+
+	if len(config.Secrets) == 0 && len(config.Keytabs) == 0 && len(config.Templates) == 0 {
+		return nil, fmt.Errorf("At least one secret, keytab or template is required")
+	}
+
+	t := &Agent{
+		cache:  newCache(config.Client),
+		closed: make(chan struct{}),
+	}
+
+	paths := make(map[string]bool)
+
+	validatePath := func(path string) error {
+		if paths[path] {
+			return fmt.Errorf("Path %s is used more than once", path)
+		}
+		paths[path] = true
+		return nil
+	}
+
+	validate := func(output *Output) error {
+
+		if output.Name == "" {
+			return fmt.Errorf("Name is required")
+		}
+
+		if output.Path == "" {
+			return fmt.Errorf("Path is required for %s", output.Name)
+		}
+
+		err := validatePath(output.Path)
+		if err != nil {
+			return err
+		}
+
+		if output.Mode == 0 {
+			output.Mode = 0600
+		}
+
+		return output.Notify.validate()
+	}
+
+	for _, output := range config.Secrets {
+
+		err := validate(output)
+		if err != nil {
+			return nil, err
+		}
+
+		switch output.Format {
+		case "", FormatRaw, FormatJSON:
+		default:
+			return nil, fmt.Errorf("Format for secret %s must be raw (default) or json", output.Name)
+		}
+	}
+
+	for _, output := range config.Keytabs {
+		err := validate(output)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	renderers := []*renderer{}
+
+	for _, template := range config.Templates {
+
+		renderer, err := template.newRenderer(t.cache)
+		if err != nil {
+			return nil, err
+		}
+
+		err = validatePath(template.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		renderers = append(renderers, renderer)
+	}
+
+	for _, output := range config.Secrets {
+		t.wg.Add(1)
+		go t.run("secret", output, t.fetchSecret(output))
+	}
+
+	for _, output := range config.Keytabs {
+		t.wg.Add(1)
+		go t.run("keytab", output, t.fetchKeytab(output))
+	}
+
+	for _, renderer := range renderers {
+		t.wg.Add(1)
+		go t.run("template", renderer.output, renderer.render)
+	}
+
+	return t, nil
+}
+
+func (t *Agent) fetchSecret(output *Output) fetchFunc {
+	return func(ctx context.Context) ([]byte, int64, error) {
+
+		secret, err := t.cache.getSecret(ctx, output.Name)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		if output.Format == FormatJSON {
+			return []byte(secret.JSON() + "\n"), client.SecretExp(secret), nil
+		}
+
+		return []byte(secret.Secret), client.SecretExp(secret), nil
+	}
+}
+
+func (t *Agent) fetchKeytab(output *Output) fetchFunc {
+	return func(ctx context.Context) ([]byte, int64, error) {
+
+		keytab, err := t.cache.getKeytab(ctx, output.Name)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		data, err := base64.StdEncoding.DecodeString(keytab.Base64File)
+		if err != nil {
+			return nil, 0, fmt.Errorf("Keytab is not valid base64; err->%s", err)
+		}
+
+		return data, keytab.Exp, nil
+	}
+}
+
+// run fetches and writes output until the agent is shutdown. The file is
+// only written (and Notify run) when the content changes.
+func (t *Agent) run(kind string, output *Output, fetch fetchFunc) {
+
+	defer t.wg.Done()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		<-t.closed
+		cancel()
+	}()
+
+	var last []byte
+	retry := minRetryInterval
+
+	for {
+
+		var wait time.Duration
+
+		data, exp, err := fetch(ctx)
+
+		if err == nil {
+
+			if !bytes.Equal(data, last) {
+				err = WriteFile(output.Path, data, output.Mode, output.UID, output.GID)
+				if err == nil {
+					last = data
+					zap.L().Info(fmt.Sprintf("Wrote %s %s to %s with exp %d", kind, output.Name, output.Path, exp))
+					output.Notify.run()
+				}
+			}
+		}
+
+		if err == nil {
+			retry = minRetryInterval
+			wait = getRefreshInterval(time.Now(), exp)
+			zap.L().Debug(fmt.Sprintf("Next refresh of %s %s in %s", kind, output.Name, wait))
+		} else {
+			zap.L().Error(fmt.Sprintf("Unable to refresh %s %s, retrying in %s; err->%s", kind, output.Name, retry, err))
+			wait = retry
+			retry *= 2
+			if retry > maxRetryInterval {
+				retry = maxRetryInterval
+			}
+		}
+
+		timer := time.NewTimer(wait)
+
+		select {
+		case <-t.closed:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// getRefreshInterval returns the time to wait before refreshing something
+// that expires at exp. We refresh when two thirds of the remaining lifetime
+// has passed so that there is time to retry before exp.
+func getRefreshInterval(now time.Time, exp int64) time.Duration {
+	wait := time.Unix(exp, 0).Sub(now) * 2 / 3
+	if wait < minRefreshInterval {
+		return minRefreshInterval
+	}
+	return wait
+}
+
+// Shutdown stops the agent and waits for all refreshes to stop
+func (t *Agent) Shutdown() {
+	zap.L().Debug("Stopping")
+	close(t.closed)
+	t.wg.Wait()
+}
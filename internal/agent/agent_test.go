@@ -0,0 +1,293 @@
+/*
+Copyright © 2020 Jody Scott <jody@thescottsweb.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jodydadescott/libtokenmachine"
+	"github.com/jodydadescott/tokenmachine/client"
+)
+
+// testServer is a TokenMachine that returns the secret "secret-<name>" and a
+// keytab with the principal "<name>@EXAMPLE.COM". Nonces are not checked.
+type testServer struct {
+	*httptest.Server
+	mutex    sync.Mutex
+	requests map[string]int
+	exp      time.Duration
+}
+
+func newTestServer(t *testing.T) *testServer {
+
+	server := &testServer{
+		requests: make(map[string]int),
+		exp:      time.Hour,
+	}
+
+	server.Server = httptest.NewServer(http.HandlerFunc(server.serve))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func (t *testServer) serve(w http.ResponseWriter, r *http.Request) {
+
+	t.mutex.Lock()
+	t.requests[r.URL.Path]++
+	t.mutex.Unlock()
+
+	exp := time.Now().Add(t.exp).Unix()
+
+	switch {
+
+	case r.URL.Path == "/v1/nonce":
+		json.NewEncoder(w).Encode(&libtokenmachine.Nonce{Value: "nonce", Exp: exp})
+
+	case strings.HasPrefix(r.URL.Path, "/v1/secrets/"):
+		name := strings.TrimPrefix(r.URL.Path, "/v1/secrets/")
+		json.NewEncoder(w).Encode(&libtokenmachine.SharedSecret{Name: name, Secret: "secret-" + name, Exp: exp})
+
+	case strings.HasPrefix(r.URL.Path, "/v1/keytabs/"):
+		name := strings.TrimPrefix(r.URL.Path, "/v1/keytabs/")
+		json.NewEncoder(w).Encode(&libtokenmachine.Keytab{
+			Name:       name,
+			Principal:  name + "@EXAMPLE.COM",
+			Base64File: base64.StdEncoding.EncodeToString([]byte("keytab-" + name)),
+			Exp:        exp,
+		})
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// count returns the number of requests for path
+func (t *testServer) count(path string) int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.requests[path]
+}
+
+func newTestClient(t *testing.T, server *testServer) *client.Client {
+
+	tokenMachine, err := (&client.Config{
+		URL: server.URL,
+		TokenSource: client.TokenSourceFunc(func(ctx context.Context, audience string) (string, error) {
+			return "token", nil
+		}),
+		DisableCache: true,
+	}).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tokenMachine
+}
+
+// waitForFile waits for the file at path to contain data
+func waitForFile(t *testing.T, path, data string) {
+
+	deadline := time.Now().Add(5 * time.Second)
+
+	for {
+		content, err := ioutil.ReadFile(path)
+		if err == nil && string(content) == data {
+			return
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("%s is %q; want %q", path, content, data)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestBuildInvalid(t *testing.T) {
+
+	server := newTestServer(t)
+	tokenMachine := newTestClient(t, server)
+
+	tests := []struct {
+		name   string
+		config *Config
+		err    string
+	}{
+		{"no client", &Config{Secrets: []*Output{{Name: "a", Path: "a"}}}, "Client is required"},
+		{"nothing to fetch", &Config{Client: tokenMachine}, "At least one"},
+		{"no name", &Config{Client: tokenMachine, Secrets: []*Output{{Path: "a"}}}, "Name is required"},
+		{"no path", &Config{Client: tokenMachine, Keytabs: []*Output{{Name: "a"}}}, "Path is required"},
+		{"format", &Config{Client: tokenMachine, Secrets: []*Output{{Name: "a", Path: "a", Format: "yaml"}}}, "Format"},
+		{"duplicate path", &Config{Client: tokenMachine,
+			Secrets: []*Output{{Name: "a", Path: "a"}},
+			Keytabs: []*Output{{Name: "b", Path: "a"}},
+		}, "more than once"},
+		{"notify", &Config{Client: tokenMachine, Secrets: []*Output{{Name: "a", Path: "a", Notify: &Notify{PID: 1}}}}, "Signal is required"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			agent, err := test.config.Build()
+			if err == nil {
+				agent.Shutdown()
+				t.Fatalf("expected error")
+			}
+
+			if !strings.Contains(err.Error(), test.err) {
+				t.Errorf("err is %s; want %s", err, test.err)
+			}
+		})
+	}
+}
+
+func TestAgent(t *testing.T) {
+
+	server := newTestServer(t)
+	dir := t.TempDir()
+
+	agent, err := (&Config{
+		Client: newTestClient(t, server),
+		Secrets: []*Output{
+			{Name: "db", Path: filepath.Join(dir, "db")},
+			{Name: "api", Path: filepath.Join(dir, "api.json"), Format: FormatJSON, Mode: 0640, UID: -1, GID: -1},
+		},
+		Keytabs: []*Output{
+			{Name: "superman", Path: filepath.Join(dir, "superman.keytab"), UID: -1, GID: -1,
+				Notify: &Notify{Command: "echo notified > " + filepath.Join(dir, "notified")}},
+		},
+	}).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer agent.Shutdown()
+
+	waitForFile(t, filepath.Join(dir, "db"), "secret-db")
+	waitForFile(t, filepath.Join(dir, "superman.keytab"), "keytab-superman")
+	waitForFile(t, filepath.Join(dir, "notified"), "notified\n")
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "api.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secret := &libtokenmachine.SharedSecret{}
+	if err := json.Unmarshal(data, secret); err != nil || secret.Secret != "secret-api" {
+		t.Errorf("api.json is %s", data)
+	}
+
+	info, err := os.Stat(filepath.Join(dir, "api.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Mode().Perm() != 0640 {
+		t.Errorf("mode is %s; want 0640", info.Mode())
+	}
+}
+
+func TestGetRefreshInterval(t *testing.T) {
+
+	now := time.Unix(1000000, 0)
+
+	tests := []struct {
+		exp  time.Duration
+		wait time.Duration
+	}{
+		{time.Hour, 40 * time.Minute},
+		{30 * time.Second, 20 * time.Second},
+		{6 * time.Second, minRefreshInterval},
+		{0, minRefreshInterval},
+		{-time.Hour, minRefreshInterval},
+	}
+
+	for _, test := range tests {
+		if wait := getRefreshInterval(now, now.Add(test.exp).Unix()); wait != test.wait {
+			t.Errorf("getRefreshInterval for exp in %s is %s; want %s", test.exp, wait, test.wait)
+		}
+	}
+}
+
+func writeTestFile(t *testing.T, name, data string) {
+	if err := ioutil.WriteFile(name, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWriteFile(t *testing.T) {
+
+	dir := t.TempDir()
+	name := filepath.Join(dir, "secret")
+
+	for i, data := range []string{"first", "second"} {
+
+		err := WriteFile(name, []byte(data), 0600, -1, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		content, err := ioutil.ReadFile(name)
+		if err != nil || string(content) != data {
+			t.Errorf("write %d; content is %q, %v", i, content, err)
+		}
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(files) != 1 {
+		t.Errorf("temp files were not removed; %d files in %s", len(files), dir)
+	}
+
+	if err := WriteFile(filepath.Join(dir, "missing", "secret"), []byte("a"), 0600, -1, -1); err == nil {
+		t.Errorf("expected error writing to a missing directory")
+	}
+}
+
+func TestNotifyValidate(t *testing.T) {
+
+	tests := []struct {
+		notify *Notify
+		err    bool
+	}{
+		{nil, false},
+		{&Notify{Command: "true"}, false},
+		{&Notify{Signal: os.Interrupt, PID: 1}, false},
+		{&Notify{Signal: os.Interrupt, PIDFile: "pid"}, false},
+		{&Notify{Signal: os.Interrupt}, true},
+		{&Notify{PIDFile: "pid"}, true},
+	}
+
+	for _, test := range tests {
+		if err := test.notify.validate(); test.err != (err != nil) {
+			t.Errorf("validate(%+v) is %v; want error %t", test.notify, err, test.err)
+		}
+	}
+}
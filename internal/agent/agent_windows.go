@@ -0,0 +1,39 @@
+// +build windows
+
+/*
+Copyright © 2020 Jody Scott <jody@thescottsweb.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"fmt"
+	"os"
+)
+
+// ParseSignal returns the signal with name. Signals are not supported on
+// Windows.
+func ParseSignal(name string) (os.Signal, error) {
+	return nil, fmt.Errorf("Signals are not supported on Windows")
+}
+
+// LookupOwner returns -1 for the uid and gid. File ownership is not supported
+// on Windows.
+func LookupOwner(owner, group string) (int, int, error) {
+	if owner != "" || group != "" {
+		return -1, -1, fmt.Errorf("Owner and group are not supported on Windows")
+	}
+	return -1, -1, nil
+}
@@ -0,0 +1,113 @@
+/*
+Copyright © 2020 Jody Scott <jody@thescottsweb.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/jodydadescott/libtokenmachine"
+	"github.com/jodydadescott/tokenmachine/client"
+)
+
+// cache shares the secrets and keytabs fetched by the agent between its
+// outputs and templates so that each is fetched with one nonce exchange per
+// refresh rather than once per file. A value is reused until it is due for
+// refresh (see getRefreshInterval).
+type cache struct {
+	client  *client.Client
+	mutex   sync.Mutex
+	entries map[string]*cacheEntry
+}
+
+type cacheEntry struct {
+	mutex   sync.Mutex
+	value   interface{}
+	refresh time.Time
+}
+
+func newCache(tokenMachine *client.Client) *cache {
+	return &cache{
+		client:  tokenMachine,
+		entries: make(map[string]*cacheEntry),
+	}
+}
+
+// get returns the value of key or calls fetch if it is due for refresh.
+// Concurrent calls for the same key wait for a single fetch.
+func (t *cache) get(key string, fetch func() (interface{}, int64, error)) (interface{}, error) {
+
+	t.mutex.Lock()
+	entry, ok := t.entries[key]
+	if !ok {
+		entry = &cacheEntry{}
+		t.entries[key] = entry
+	}
+	t.mutex.Unlock()
+
+	entry.mutex.Lock()
+	defer entry.mutex.Unlock()
+
+	now := time.Now()
+
+	if entry.value != nil && now.Before(entry.refresh) {
+		return entry.value, nil
+	}
+
+	value, exp, err := fetch()
+	if err != nil {
+		return nil, err
+	}
+
+	entry.value = value
+	entry.refresh = now.Add(getRefreshInterval(now, exp))
+
+	return value, nil
+}
+
+func (t *cache) getSecret(ctx context.Context, name string) (*libtokenmachine.SharedSecret, error) {
+
+	value, err := t.get("secret/"+name, func() (interface{}, int64, error) {
+		secret, err := t.client.GetSecret(ctx, name)
+		if err != nil {
+			return nil, 0, err
+		}
+		return secret, client.SecretExp(secret), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return value.(*libtokenmachine.SharedSecret).Copy(), nil
+}
+
+func (t *cache) getKeytab(ctx context.Context, name string) (*libtokenmachine.Keytab, error) {
+
+	value, err := t.get("keytab/"+name, func() (interface{}, int64, error) {
+		keytab, err := t.client.GetKeytab(ctx, name)
+		if err != nil {
+			return nil, 0, err
+		}
+		return keytab, keytab.Exp, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return value.(*libtokenmachine.Keytab).Copy(), nil
+}
@@ -0,0 +1,112 @@
+/*
+Copyright © 2020 Jody Scott <jody@thescottsweb.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// Notify is run after a file is updated. Command is run with the shell and/or
+// Signal is sent to the process PID or the process with the PID in PIDFile.
+type Notify struct {
+	Command string
+	Signal  os.Signal
+	PID     int
+	PIDFile string
+}
+
+func (t *Notify) validate() error {
+
+	if t == nil {
+		return nil
+	}
+
+	if t.Signal != nil && t.PID == 0 && t.PIDFile == "" {
+		return fmt.Errorf("PID or PIDFile is required with Signal")
+	}
+
+	if t.Signal == nil && (t.PID != 0 || t.PIDFile != "") {
+		return fmt.Errorf("Signal is required with PID or PIDFile")
+	}
+
+	return nil
+}
+
+// run runs the command and sends the signal. Errors are logged.
+func (t *Notify) run() {
+
+	if t == nil {
+		return
+	}
+
+	if t.Command != "" {
+
+		var cmd *exec.Cmd
+		if runtime.GOOS == "windows" {
+			cmd = exec.Command("cmd", "/C", t.Command)
+		} else {
+			cmd = exec.Command("sh", "-c", t.Command)
+		}
+
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			zap.L().Error(fmt.Sprintf("Notify command %s failed; err->%s, output->%s", t.Command, err, strings.TrimSpace(string(output))))
+		} else {
+			zap.L().Debug(fmt.Sprintf("Notify command %s completed", t.Command))
+		}
+	}
+
+	if t.Signal != nil {
+
+		pid := t.PID
+
+		if t.PIDFile != "" {
+			data, err := ioutil.ReadFile(t.PIDFile)
+			if err != nil {
+				zap.L().Error(fmt.Sprintf("Unable to read PID file %s; err->%s", t.PIDFile, err))
+				return
+			}
+			pid, err = strconv.Atoi(strings.TrimSpace(string(data)))
+			if err != nil {
+				zap.L().Error(fmt.Sprintf("PID file %s does not contain a PID", t.PIDFile))
+				return
+			}
+		}
+
+		process, err := os.FindProcess(pid)
+		if err != nil {
+			zap.L().Error(fmt.Sprintf("Unable to find process %d; err->%s", pid, err))
+			return
+		}
+
+		err = process.Signal(t.Signal)
+		if err != nil {
+			zap.L().Error(fmt.Sprintf("Unable to signal process %d with %s; err->%s", pid, t.Signal, err))
+			return
+		}
+
+		zap.L().Debug(fmt.Sprintf("Sent %s to process %d", t.Signal, pid))
+	}
+}
@@ -0,0 +1,204 @@
+/*
+Copyright © 2020 Jody Scott <jody@thescottsweb.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"text/template"
+
+	"github.com/jodydadescott/tokenmachine/client"
+)
+
+// Template is a text/template rendered with the secrets and keytabs it names
+// and written to Path. Secrets and keytabs are referenced by name in the
+// template, for example
+//
+//	password={{ .secrets.db.secret }}
+//	next={{ .secrets.db.nextSecret }}
+//	principal={{ .keytabs.superman.principal }}
+//
+// Secrets have the fields secret, exp, nextSecret and nextExp. Keytabs have
+// the fields principal, base64File and exp. Names that are not identifiers
+// must use index, for example {{ (index .secrets "my-db").secret }}.
+type Template struct {
+	Source  string   // Template file; one of Source or Text is required
+	Text    string   // Inline template
+	Path    string   // Destination
+	Secrets []string // Names of the secrets used by the template
+	Keytabs []string // Names of the keytabs used by the template
+	Mode    os.FileMode
+	UID     int
+	GID     int
+	Notify  *Notify
+}
+
+// renderer fetches the inputs of a template and renders it. The template is
+// only executed when an input changes.
+type renderer struct {
+	cache     *cache
+	template  *template.Template
+	secrets   []string
+	keytabs   []string
+	output    *Output
+	lastInput []byte
+	lastData  []byte
+}
+
+func (t *Template) newRenderer(cache *cache) (*renderer, error) {
+
+	if t.Path == "" {
+		return nil, fmt.Errorf("Path is required for template")
+	}
+
+	if len(t.Secrets) == 0 && len(t.Keytabs) == 0 {
+		return nil, fmt.Errorf("Template %s must use at least one secret or keytab", t.Path)
+	}
+
+	name := t.Source
+	text := t.Text
+
+	switch {
+
+	case t.Source != "" && t.Text != "":
+		return nil, fmt.Errorf("Template %s must have Source or Text, not both", t.Path)
+
+	case t.Source != "":
+		data, err := ioutil.ReadFile(t.Source)
+		if err != nil {
+			return nil, err
+		}
+		text = string(data)
+		name = filepath.Base(t.Source)
+
+	case t.Text != "":
+		name = filepath.Base(t.Path)
+
+	default:
+		return nil, fmt.Errorf("Template %s must have Source or Text", t.Path)
+	}
+
+	// Referencing a secret or keytab that is not listed is an error rather
+	// than an empty string
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("Template %s is not valid; err->%s", name, err)
+	}
+
+	err = t.Notify.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	mode := t.Mode
+	if mode == 0 {
+		mode = 0600
+	}
+
+	return &renderer{
+		cache:    cache,
+		template: tmpl,
+		secrets:  t.Secrets,
+		keytabs:  t.Keytabs,
+		output: &Output{
+			Name:   name,
+			Path:   t.Path,
+			Mode:   mode,
+			UID:    t.UID,
+			GID:    t.GID,
+			Notify: t.Notify,
+		},
+	}, nil
+}
+
+// render implements fetchFunc. The returned exp is the earliest exp of the
+// inputs.
+func (t *renderer) render(ctx context.Context) ([]byte, int64, error) {
+
+	var exp int64 = math.MaxInt64
+
+	secrets := make(map[string]interface{})
+	for _, name := range t.secrets {
+
+		secret, err := t.cache.getSecret(ctx, name)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		secrets[name] = map[string]interface{}{
+			"secret":     secret.Secret,
+			"exp":        secret.Exp,
+			"nextSecret": secret.NextSecret,
+			"nextExp":    secret.NextExp,
+		}
+
+		if secretExp := client.SecretExp(secret); secretExp < exp {
+			exp = secretExp
+		}
+	}
+
+	keytabs := make(map[string]interface{})
+	for _, name := range t.keytabs {
+
+		keytab, err := t.cache.getKeytab(ctx, name)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		keytabs[name] = map[string]interface{}{
+			"principal":  keytab.Principal,
+			"base64File": keytab.Base64File,
+			"exp":        keytab.Exp,
+		}
+
+		if keytab.Exp < exp {
+			exp = keytab.Exp
+		}
+	}
+
+	input := map[string]interface{}{
+		"secrets": secrets,
+		"keytabs": keytabs,
+	}
+
+	// Templates may reference exp so it is compared along with the values
+	key, err := json.Marshal(input)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if t.lastData != nil && bytes.Equal(key, t.lastInput) {
+		return t.lastData, exp, nil
+	}
+
+	var buf bytes.Buffer
+	err = t.template.Execute(&buf, input)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Unable to render template %s; err->%s", t.output.Name, err)
+	}
+
+	t.lastInput = key
+	t.lastData = buf.Bytes()
+
+	return t.lastData, exp, nil
+}
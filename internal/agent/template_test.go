@@ -0,0 +1,216 @@
+/*
+Copyright © 2020 Jody Scott <jody@thescottsweb.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package agent
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNewRenderer(t *testing.T) {
+
+	dir := t.TempDir()
+	source := filepath.Join(dir, "app.tmpl")
+	writeTestFile(t, source, "{{ .secrets.db.secret }}")
+
+	tests := []struct {
+		name     string
+		template *Template
+		err      string
+	}{
+		{"source", &Template{Source: source, Path: "app.conf", Secrets: []string{"db"}}, ""},
+		{"text", &Template{Text: "{{ .keytabs.k.principal }}", Path: "app.conf", Keytabs: []string{"k"}}, ""},
+		{"no path", &Template{Text: "a", Secrets: []string{"db"}}, "Path is required"},
+		{"no inputs", &Template{Text: "a", Path: "app.conf"}, "at least one"},
+		{"source and text", &Template{Source: source, Text: "a", Path: "app.conf", Secrets: []string{"db"}}, "not both"},
+		{"no template", &Template{Path: "app.conf", Secrets: []string{"db"}}, "must have Source or Text"},
+		{"missing source", &Template{Source: filepath.Join(dir, "missing"), Path: "app.conf", Secrets: []string{"db"}}, "no such file"},
+		{"invalid", &Template{Text: "{{ .secrets", Path: "app.conf", Secrets: []string{"db"}}, "not valid"},
+		{"notify", &Template{Text: "a", Path: "app.conf", Secrets: []string{"db"}, Notify: &Notify{PID: 1}}, "Signal is required"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			renderer, err := test.template.newRenderer(nil)
+
+			if test.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if renderer.output.Mode != 0600 {
+					t.Errorf("mode is %s; want 0600", renderer.output.Mode)
+				}
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("err is %v; want %s", err, test.err)
+			}
+		})
+	}
+}
+
+func TestRender(t *testing.T) {
+
+	server := newTestServer(t)
+	cache := newCache(newTestClient(t, server))
+
+	tests := []struct {
+		name     string
+		template *Template
+		data     string
+		err      bool
+	}{
+		{"secret", &Template{Text: "password={{ .secrets.db.secret }}", Secrets: []string{"db"}}, "password=secret-db", false},
+		{"index", &Template{Text: `{{ (index .secrets "my-db").secret }}`, Secrets: []string{"my-db"}}, "secret-my-db", false},
+		{"keytab", &Template{Text: "{{ .keytabs.superman.principal }}", Keytabs: []string{"superman"}}, "superman@EXAMPLE.COM", false},
+		{"not listed", &Template{Text: "{{ .secrets.other.secret }}", Secrets: []string{"db"}}, "", true},
+		{"not found", &Template{Text: "{{ .secrets.db.secret }}", Secrets: []string{"db/x"}}, "", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			test.template.Path = "app.conf"
+
+			renderer, err := test.template.newRenderer(cache)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			data, exp, err := renderer.render(context.Background())
+			if test.err != (err != nil) {
+				t.Fatalf("err is %v; want error %t", err, test.err)
+			}
+
+			if err != nil {
+				return
+			}
+
+			if string(data) != test.data {
+				t.Errorf("data is %q; want %q", data, test.data)
+			}
+
+			if exp <= time.Now().Unix() {
+				t.Errorf("exp %d is not the exp of the inputs", exp)
+			}
+		})
+	}
+}
+
+func TestAgentSharesFetches(t *testing.T) {
+
+	server := newTestServer(t)
+	dir := t.TempDir()
+
+	agent, err := (&Config{
+		Client: newTestClient(t, server),
+		Secrets: []*Output{
+			{Name: "db", Path: filepath.Join(dir, "db"), UID: -1, GID: -1},
+			{Name: "db", Path: filepath.Join(dir, "db.json"), Format: FormatJSON, UID: -1, GID: -1},
+		},
+		Keytabs: []*Output{
+			{Name: "superman", Path: filepath.Join(dir, "superman.keytab"), UID: -1, GID: -1},
+		},
+		Templates: []*Template{
+			{Text: "{{ .secrets.db.secret }}", Path: filepath.Join(dir, "a.conf"), Secrets: []string{"db"}, UID: -1, GID: -1},
+			{Text: "{{ .secrets.db.secret }} {{ .keytabs.superman.principal }}", Path: filepath.Join(dir, "b.conf"),
+				Secrets: []string{"db"}, Keytabs: []string{"superman"}, UID: -1, GID: -1},
+		},
+	}).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer agent.Shutdown()
+
+	waitForFile(t, filepath.Join(dir, "db"), "secret-db")
+	waitForFile(t, filepath.Join(dir, "a.conf"), "secret-db")
+	waitForFile(t, filepath.Join(dir, "b.conf"), "secret-db superman@EXAMPLE.COM")
+	waitForFile(t, filepath.Join(dir, "superman.keytab"), "keytab-superman")
+
+	if count := server.count("/v1/secrets/db"); count != 1 {
+		t.Errorf("secret db was fetched %d times; want 1", count)
+	}
+
+	if count := server.count("/v1/keytabs/superman"); count != 1 {
+		t.Errorf("keytab superman was fetched %d times; want 1", count)
+	}
+
+	if count := server.count("/v1/nonce"); count != 2 {
+		t.Errorf("%d nonces were requested; want 2", count)
+	}
+}
+
+func TestCacheGet(t *testing.T) {
+
+	cache := newCache(nil)
+
+	var mutex sync.Mutex
+	fetches := 0
+
+	fetch := func() (interface{}, int64, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		fetches++
+		time.Sleep(10 * time.Millisecond)
+		return fetches, time.Now().Add(time.Hour).Unix(), nil
+	}
+
+	// Concurrent calls wait for a single fetch
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := cache.get("a", fetch); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if fetches != 1 {
+		t.Fatalf("fetched %d times; want 1", fetches)
+	}
+
+	// A value that is due for refresh is not returned if the fetch fails
+	cache.entries["a"].refresh = time.Now()
+	if _, err := cache.get("a", func() (interface{}, int64, error) { return nil, 0, fmt.Errorf("failed") }); err == nil {
+		t.Errorf("expected error")
+	}
+
+	// A value that is due for refresh is fetched again
+	value, err := cache.get("a", fetch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if value != 2 {
+		t.Errorf("value is %v; want 2", value)
+	}
+
+	// Keys are independent
+	if value, _ := cache.get("b", fetch); value != 3 {
+		t.Errorf("value is %v; want 3", value)
+	}
+}
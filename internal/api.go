@@ -0,0 +1,316 @@
+/*
+Copyright © 2020 Jody Scott <jody@thescottsweb.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jodydadescott/libtokenmachine"
+	"github.com/jodydadescott/tokenmachine/internal/engine"
+	"go.uber.org/zap"
+)
+
+const (
+	actionNonce  = "nonce"
+	actionSecret = "secret"
+	actionKeytab = "keytab"
+
+	// Max size of a JSON request body. Requests only carry a token and a name
+	maxRequestBodySize = 64 * 1024
+)
+
+// APIRequest is the optional JSON body accepted by the /v1/ API. It allows
+// the bearer token to be sent in the body instead of the Authorization header
+type APIRequest struct {
+	Token string `json:"token,omitempty"`
+}
+
+// apiRequest is a parsed and validated request
+type apiRequest struct {
+	requestID, action, token, name string
+}
+
+// ServeHTTP HTTP/HTTPS Handler
+func (t *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	zap.L().Debug(fmt.Sprintf("Entering ServeHTTP path=%s method=%s", r.URL.Path, r.Method))
+
+	defer zap.L().Debug(fmt.Sprintf("Exiting ServeHTTP path=%s method=%s", r.URL.Path, r.Method))
+
+	requestID := getRequestID(r)
+	w.Header().Set(requestIDHeader, requestID)
+
+	if t.serveUnauthenticated(w, r, requestID) {
+		return
+	}
+
+	var request *apiRequest
+	var err error
+
+	if strings.HasPrefix(r.URL.Path, "/v1/") {
+		request, err = t.parseV1Request(r)
+	} else {
+		request, err = t.parseLegacyRequest(w, r)
+	}
+
+	if err != nil {
+		if request != nil {
+			request.requestID = requestID
+			t.record(r, request, nil, err)
+		}
+		if e, ok := err.(*httpError); ok && e.status == http.StatusMethodNotAllowed {
+			w.Header().Set("Allow", allowedMethods(r.URL.Path))
+		}
+		writeError(w, requestID, err)
+		return
+	}
+
+	request.requestID = requestID
+	t.process(w, r, request)
+}
+
+func (t *Server) process(w http.ResponseWriter, r *http.Request, request *apiRequest) {
+
+	var result interface{ JSON() string }
+	var err error
+
+	ctx := engine.WithClientCertificate(r.Context(), t.getClientCertificate(r))
+
+	start := time.Now()
+
+	switch request.action {
+
+	case actionNonce:
+		result, err = t.tokenMachine.GetNonce(ctx, request.token)
+
+	case actionKeytab:
+		result, err = t.tokenMachine.GetKeytab(ctx, request.token, request.name)
+
+	case actionSecret:
+		result, err = t.tokenMachine.GetSecret(ctx, request.token, request.name)
+
+	}
+
+	t.metrics.observeOperation(request.action, time.Since(start))
+
+	issued, _ := result.(*libtokenmachine.Nonce)
+	t.record(r, request, issued, err)
+
+	if err != nil {
+		writeError(w, request.requestID, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	fmt.Fprintln(w, result.JSON())
+}
+
+// record counts the request and writes the decision to the audit log. issued
+// is the nonce returned to the client if any.
+func (t *Server) record(r *http.Request, request *apiRequest, issued *libtokenmachine.Nonce, err error) {
+	t.metrics.countRequest(request.action, err)
+	if t.audit != nil {
+		t.audit.record(newAuditEvent(r, request, t.tokenMachine.TokenNonce, issued, err))
+	}
+}
+
+// parseV1Request parses requests for the versioned API. Routes are
+//
+//	POST /v1/nonce
+//	GET|POST /v1/secrets/{name}
+//	GET|POST /v1/keytabs/{name}
+//
+// The token must be in the Authorization header or in the JSON body. Query
+// string tokens are never accepted.
+func (t *Server) parseV1Request(r *http.Request) (*apiRequest, error) {
+
+	request := &apiRequest{}
+
+	path := strings.TrimPrefix(r.URL.Path, "/v1/")
+
+	switch {
+
+	case path == "nonce":
+		request.action = actionNonce
+		if r.Method != http.MethodPost {
+			return request, newMethodNotAllowedError(r.Method)
+		}
+
+	case strings.HasPrefix(path, "secrets/"):
+		request.action = actionSecret
+		request.name = strings.TrimPrefix(path, "secrets/")
+		if r.Method != http.MethodGet && r.Method != http.MethodPost {
+			return request, newMethodNotAllowedError(r.Method)
+		}
+
+	case strings.HasPrefix(path, "keytabs/"):
+		request.action = actionKeytab
+		request.name = strings.TrimPrefix(path, "keytabs/")
+		if r.Method != http.MethodGet && r.Method != http.MethodPost {
+			return request, newMethodNotAllowedError(r.Method)
+		}
+
+	default:
+		return nil, newNotFoundError("Path " + r.URL.Path + " not mapped")
+	}
+
+	if request.action != actionNonce {
+		if request.name == "" || strings.Contains(request.name, "/") {
+			return request, newBadRequestError("Entity name is missing or invalid")
+		}
+	}
+
+	if r.Method == http.MethodPost {
+		body, err := parseRequestBody(r)
+		if err != nil {
+			return request, err
+		}
+		request.token = body.Token
+	}
+
+	if request.token == "" {
+		request.token = getAuthorizationToken(r)
+	}
+
+	if request.token == "" {
+		return request, newHTTPError(http.StatusUnauthorized, ErrCodeTokenRequired, "Token required")
+	}
+
+	return request, nil
+}
+
+// parseLegacyRequest parses requests for the original unversioned paths
+// /getnonce, /getsecret and /getkeytab. These are deprecated in favor of the
+// /v1/ API.
+func (t *Server) parseLegacyRequest(w http.ResponseWriter, r *http.Request) (*apiRequest, error) {
+
+	request := &apiRequest{}
+	successor := ""
+
+	switch r.URL.Path {
+
+	case "/getnonce":
+		request.action = actionNonce
+		successor = "/v1/nonce"
+
+	case "/getsecret":
+		request.action = actionSecret
+		successor = "/v1/secrets/{name}"
+
+	case "/getkeytab":
+		request.action = actionKeytab
+		successor = "/v1/keytabs/{name}"
+
+	default:
+		return nil, newNotFoundError("Path " + r.URL.Path + " not mapped")
+	}
+
+	zap.L().Warn(fmt.Sprintf("Deprecated path %s used by %s; use %s", r.URL.Path, r.RemoteAddr, successor))
+	w.Header().Set("Deprecation", "true")
+	w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"successor-version\"", successor))
+
+	if r.Method != http.MethodGet {
+		return request, newMethodNotAllowedError(r.Method)
+	}
+
+	request.token = getAuthorizationToken(r)
+	t.stateMutex.RLock()
+	disableQueryToken := t.disableQueryToken
+	t.stateMutex.RUnlock()
+
+	if request.token == "" && !disableQueryToken {
+		request.token = getKey(r, "bearertoken")
+	}
+
+	if request.token == "" {
+		return request, newHTTPError(http.StatusUnauthorized, ErrCodeTokenRequired, "Token required")
+	}
+
+	if request.action != actionNonce {
+		request.name = getKey(r, "name")
+		if request.name == "" {
+			return request, newBadRequestError("Parameter 'name' required")
+		}
+	}
+
+	return request, nil
+}
+
+func allowedMethods(path string) string {
+	switch {
+	case path == "/v1/nonce":
+		return http.MethodPost
+	case strings.HasPrefix(path, "/v1/"):
+		return http.MethodGet + ", " + http.MethodPost
+	}
+	return http.MethodGet
+}
+
+func parseRequestBody(r *http.Request) (*APIRequest, error) {
+
+	body := &APIRequest{}
+
+	if r.Body == nil {
+		return body, nil
+	}
+
+	contentType := r.Header.Get("Content-Type")
+	if contentType != "" && !strings.HasPrefix(contentType, "application/json") {
+		return nil, newHTTPError(http.StatusUnsupportedMediaType, ErrCodeBadRequest, "Content-Type must be application/json")
+	}
+
+	decoder := json.NewDecoder(io.LimitReader(r.Body, maxRequestBodySize))
+	err := decoder.Decode(body)
+	if err == io.EOF {
+		// Empty body is permitted; token may be in the header
+		return body, nil
+	}
+
+	if err != nil {
+		return nil, newBadRequestError("Request body is not valid JSON")
+	}
+
+	return body, nil
+}
+
+func getAuthorizationToken(r *http.Request) string {
+	// If the Bearer token is present it must be in the format 'Authorization: Bearer TOKEN'
+	token := r.Header.Get("Authorization")
+	if token != "" {
+		tokenSlice := strings.Split(token, " ")
+		if len(tokenSlice) > 1 {
+			if strings.ToLower(tokenSlice[0]) == "bearer" {
+				return tokenSlice[1]
+			}
+		}
+	}
+	return ""
+}
+
+func getKey(r *http.Request, name string) string {
+	keys, ok := r.URL.Query()[name]
+	if !ok || len(keys[0]) < 1 {
+		return ""
+	}
+	return string(keys[0])
+}
@@ -0,0 +1,155 @@
+/*
+Copyright © 2020 Jody Scott <jody@thescottsweb.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseV1Request(t *testing.T) {
+
+	tests := []struct {
+		name, method, path, header, body, contentType string
+		action, entity, token                         string
+		status                                        int // 0 if the request is valid
+	}{
+		{name: "nonce", method: http.MethodPost, path: "/v1/nonce", header: "Bearer abc", action: actionNonce, token: "abc"},
+		{name: "nonce get", method: http.MethodGet, path: "/v1/nonce", header: "Bearer abc", status: http.StatusMethodNotAllowed},
+		{name: "secret get", method: http.MethodGet, path: "/v1/secrets/db", header: "Bearer abc", action: actionSecret, entity: "db", token: "abc"},
+		{name: "secret body", method: http.MethodPost, path: "/v1/secrets/db", body: `{"token":"xyz"}`, contentType: "application/json", action: actionSecret, entity: "db", token: "xyz"},
+		{name: "body before header", method: http.MethodPost, path: "/v1/secrets/db", header: "Bearer abc", body: `{"token":"xyz"}`, action: actionSecret, entity: "db", token: "xyz"},
+		{name: "empty body", method: http.MethodPost, path: "/v1/keytabs/web", header: "bearer abc", action: actionKeytab, entity: "web", token: "abc"},
+		{name: "keytab put", method: http.MethodPut, path: "/v1/keytabs/web", header: "Bearer abc", status: http.StatusMethodNotAllowed},
+		{name: "missing name", method: http.MethodGet, path: "/v1/secrets/", header: "Bearer abc", status: http.StatusBadRequest},
+		{name: "nested name", method: http.MethodGet, path: "/v1/secrets/a/b", header: "Bearer abc", status: http.StatusBadRequest},
+		{name: "missing token", method: http.MethodGet, path: "/v1/secrets/db", status: http.StatusUnauthorized},
+		{name: "query token", method: http.MethodGet, path: "/v1/secrets/db?bearertoken=abc", status: http.StatusUnauthorized},
+		{name: "invalid json", method: http.MethodPost, path: "/v1/secrets/db", body: `{`, status: http.StatusBadRequest},
+		{name: "content type", method: http.MethodPost, path: "/v1/secrets/db", body: `token=abc`, contentType: "application/x-www-form-urlencoded", status: http.StatusUnsupportedMediaType},
+		{name: "unmapped", method: http.MethodGet, path: "/v1/other", header: "Bearer abc", status: http.StatusNotFound},
+	}
+
+	server := &Server{}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			r := httptest.NewRequest(test.method, test.path, strings.NewReader(test.body))
+			if test.header != "" {
+				r.Header.Set("Authorization", test.header)
+			}
+			if test.contentType != "" {
+				r.Header.Set("Content-Type", test.contentType)
+			}
+
+			request, err := server.parseV1Request(r)
+
+			if test.status != 0 {
+				if err == nil {
+					t.Fatalf("expected status %d", test.status)
+				}
+				if status := toHTTPError(err).status; status != test.status {
+					t.Fatalf("status is %d; want %d", status, test.status)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if request.action != test.action || request.name != test.entity || request.token != test.token {
+				t.Errorf("got action=%s name=%s token=%s", request.action, request.name, request.token)
+			}
+		})
+	}
+}
+
+func TestParseLegacyRequest(t *testing.T) {
+
+	tests := []struct {
+		name, method, path, header string
+		disableQueryToken          bool
+		action, entity, token      string
+		status                     int
+	}{
+		{name: "nonce header", method: http.MethodGet, path: "/getnonce", header: "Bearer abc", action: actionNonce, token: "abc"},
+		{name: "nonce query", method: http.MethodGet, path: "/getnonce?bearertoken=abc", action: actionNonce, token: "abc"},
+		{name: "query disabled", method: http.MethodGet, path: "/getnonce?bearertoken=abc", disableQueryToken: true, status: http.StatusUnauthorized},
+		{name: "secret", method: http.MethodGet, path: "/getsecret?name=db", header: "Bearer abc", action: actionSecret, entity: "db", token: "abc"},
+		{name: "keytab missing name", method: http.MethodGet, path: "/getkeytab", header: "Bearer abc", status: http.StatusBadRequest},
+		{name: "post", method: http.MethodPost, path: "/getsecret?name=db", header: "Bearer abc", status: http.StatusMethodNotAllowed},
+		{name: "unmapped", method: http.MethodGet, path: "/other", header: "Bearer abc", status: http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			server := &Server{disableQueryToken: test.disableQueryToken}
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(test.method, test.path, nil)
+			if test.header != "" {
+				r.Header.Set("Authorization", test.header)
+			}
+
+			request, err := server.parseLegacyRequest(w, r)
+
+			if test.status != http.StatusNotFound && w.Header().Get("Deprecation") != "true" {
+				t.Errorf("Deprecation header is missing")
+			}
+
+			if test.status != 0 {
+				if err == nil {
+					t.Fatalf("expected status %d", test.status)
+				}
+				if status := toHTTPError(err).status; status != test.status {
+					t.Fatalf("status is %d; want %d", status, test.status)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if request.action != test.action || request.name != test.entity || request.token != test.token {
+				t.Errorf("got action=%s name=%s token=%s", request.action, request.name, request.token)
+			}
+		})
+	}
+}
+
+func TestAllowedMethods(t *testing.T) {
+
+	tests := []struct {
+		path, allow string
+	}{
+		{"/v1/nonce", "POST"},
+		{"/v1/secrets/db", "GET, POST"},
+		{"/getsecret", "GET"},
+	}
+
+	for _, test := range tests {
+		if got := allowedMethods(test.path); got != test.allow {
+			t.Errorf("allowedMethods(%s) is %q; want %q", test.path, got, test.allow)
+		}
+	}
+}
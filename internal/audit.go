@@ -0,0 +1,216 @@
+/*
+Copyright © 2020 Jody Scott <jody@thescottsweb.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jodydadescott/libtokenmachine"
+	"github.com/jodydadescott/tokenmachine/internal/engine"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// AuditEvent is written to the audit sinks for every grant or denial and
+// every admin call. Tokens and secret material are never written.
+type AuditEvent struct {
+	Time      string   `json:"time"`
+	RequestID string   `json:"requestId,omitempty"`
+	ClientIP  string   `json:"clientIp,omitempty"`
+	Issuer    string   `json:"iss,omitempty"`
+	Subject   string   `json:"sub,omitempty"`
+	JTI       string   `json:"jti,omitempty"`
+	Action    string   `json:"action"`
+	Name      string   `json:"name,omitempty"`
+	Decision  string   `json:"decision"`
+	Reason    string   `json:"reason,omitempty"`
+	Error     string   `json:"error,omitempty"`
+	Audiences []string `json:"aud,omitempty"`
+	Nonce     string   `json:"nonce,omitempty"`
+	Issued    string   `json:"issuedNonce,omitempty"`
+	Explained string   `json:"explainedAction,omitempty"`
+}
+
+// JSON Return JSON String representation
+func (t *AuditEvent) JSON() string {
+	j, _ := json.Marshal(t)
+	return string(j)
+}
+
+// auditor writes one JSON line per decision to its own sinks. It is
+// deliberately independent of the zap logger so that it is not affected by
+// log level, sampling or format.
+type auditor struct {
+	mutex sync.Mutex
+	sink  zapcore.WriteSyncer
+	close func()
+}
+
+// newAuditor returns an auditor that writes to outputPaths. The paths are the
+// same as the zap output paths (stdout, stderr or a file). If no paths are
+// provided auditing is disabled and nil is returned.
+func newAuditor(outputPaths []string) (*auditor, error) {
+
+	if len(outputPaths) == 0 {
+		return nil, nil
+	}
+
+	sink, close, err := zap.Open(outputPaths...)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open audit output paths; err->%s", err)
+	}
+
+	return &auditor{
+		sink:  sink,
+		close: close,
+	}, nil
+}
+
+// record writes event as a single JSON line
+func (t *auditor) record(event *AuditEvent) {
+
+	if t == nil {
+		return
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	_, err := t.sink.Write([]byte(event.JSON() + "\n"))
+	if err != nil {
+		zap.L().Error(fmt.Sprintf("Unable to write audit event; err->%s", err))
+		return
+	}
+	t.sink.Sync()
+}
+
+// newAuditEvent returns the event for request. The token is parsed (without
+// verification) only to extract the identity of the bearer and the audiences
+// it presented. Nonce is the live nonce in the token returned by tokenNonce
+// (the nonce the request was matched to) and Issued is the nonce issued by a
+// grant or a nonce challenge.
+func newAuditEvent(r *http.Request, request *apiRequest, tokenNonce func(*libtokenmachine.Token) string, issued *libtokenmachine.Nonce, err error) *AuditEvent {
+
+	event := &AuditEvent{
+		Time:      time.Now().UTC().Format(time.RFC3339Nano),
+		RequestID: request.requestID,
+		ClientIP:  getClientIP(r),
+		Action:    request.action,
+		Name:      request.name,
+		Decision:  getOutcome(err),
+	}
+
+	if err != nil {
+		event.Reason = toHTTPError(err).code
+		event.Error = err.Error()
+	}
+
+	var nonceRequired *engine.NonceRequiredError
+	if errors.As(err, &nonceRequired) {
+		issued = nonceRequired.Nonce
+	}
+
+	if issued != nil {
+		event.Issued = issued.Value
+	}
+
+	if request.token == "" {
+		return event
+	}
+
+	token, parseErr := libtokenmachine.ParseToken(request.token)
+	if parseErr != nil {
+		return event
+	}
+
+	event.Issuer = token.Iss
+	event.Subject, _ = token.Claims["sub"].(string)
+	event.JTI, _ = token.Claims["jti"].(string)
+
+	if request.action != actionNonce {
+		event.Audiences = engine.GetAudiences(token.Claims)
+		event.Nonce = tokenNonce(token)
+	}
+
+	return event
+}
+
+// newAdminAuditEvent returns the event for an admin policy eval call. request
+// is nil if the call was rejected before it was parsed. Issuer, Subject and
+// JTI are those of the token or claims that the decision was explained for
+// and Explained is the action; the admin token is never written.
+func newAdminAuditEvent(r *http.Request, requestID string, request *AdminPolicyEvalRequest, err error) *AuditEvent {
+
+	event := &AuditEvent{
+		Time:      time.Now().UTC().Format(time.RFC3339Nano),
+		RequestID: requestID,
+		ClientIP:  getClientIP(r),
+		Action:    actionAdminPolicyEval,
+		Decision:  getOutcome(err),
+	}
+
+	if err != nil {
+		event.Reason = toHTTPError(err).code
+		event.Error = err.Error()
+	}
+
+	if request == nil {
+		return event
+	}
+
+	event.Name = request.Name
+	event.Explained = request.Action
+
+	claims := request.Claims
+	if request.Token != "" {
+		token, parseErr := libtokenmachine.ParseToken(request.Token)
+		if parseErr != nil {
+			return event
+		}
+		claims = token.Claims
+	}
+
+	event.Issuer, _ = claims["iss"].(string)
+	event.Subject, _ = claims["sub"].(string)
+	event.JTI, _ = claims["jti"].(string)
+
+	return event
+}
+
+func (t *auditor) shutdown() {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.sink.Sync()
+	t.close()
+}
+
+func getClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
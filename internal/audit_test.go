@@ -0,0 +1,239 @@
+/*
+Copyright © 2020 Jody Scott <jody@thescottsweb.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/jodydadescott/libtokenmachine"
+	"github.com/jodydadescott/tokenmachine/internal/engine"
+)
+
+// unsignedToken returns a JWT with claims and no signature
+func unsignedToken(t *testing.T, claims map[string]interface{}) string {
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encode := base64.RawURLEncoding.EncodeToString
+	return encode([]byte(`{"alg":"none"}`)) + "." + encode(payload) + "."
+}
+
+func TestNewAuditEvent(t *testing.T) {
+
+	token := unsignedToken(t, map[string]interface{}{
+		"iss": "https://issuer",
+		"sub": "bob",
+		"jti": "j1",
+		"aud": []string{"expired", "live"},
+	})
+
+	// The nonce the engine matched; it may be in any claim
+	tokenNonce := func(token *libtokenmachine.Token) string {
+		if nonce, ok := token.Claims["nonce"].(string); ok {
+			return nonce
+		}
+		return "live"
+	}
+
+	claimToken := unsignedToken(t, map[string]interface{}{
+		"iss":   "https://issuer",
+		"sub":   "bob",
+		"aud":   "api",
+		"nonce": "claim",
+	})
+
+	issued := &libtokenmachine.Nonce{Value: "issued"}
+
+	tests := []struct {
+		name     string
+		request  *apiRequest
+		issued   *libtokenmachine.Nonce
+		err      error
+		expected *AuditEvent
+	}{
+		{
+			name:     "nonce granted",
+			request:  &apiRequest{action: actionNonce, token: token},
+			issued:   issued,
+			expected: &AuditEvent{Action: actionNonce, Decision: outcomeGranted, Issuer: "https://issuer", Subject: "bob", JTI: "j1", Issued: "issued"},
+		},
+		{
+			name:     "secret granted",
+			request:  &apiRequest{action: actionSecret, name: "db", token: token},
+			expected: &AuditEvent{Action: actionSecret, Name: "db", Decision: outcomeGranted, Issuer: "https://issuer", Subject: "bob", JTI: "j1", Audiences: []string{"expired", "live"}, Nonce: "live"},
+		},
+		{
+			name:     "nonce in other claim",
+			request:  &apiRequest{action: actionSecret, name: "db", token: claimToken},
+			expected: &AuditEvent{Action: actionSecret, Name: "db", Decision: outcomeGranted, Issuer: "https://issuer", Subject: "bob", Audiences: []string{"api"}, Nonce: "claim"},
+		},
+		{
+			name:     "denied by policy",
+			request:  &apiRequest{action: actionSecret, name: "db", token: token},
+			err:      libtokenmachine.ErrDenied,
+			expected: &AuditEvent{Action: actionSecret, Name: "db", Decision: outcomeDenied, Reason: ErrCodeDenied, Error: libtokenmachine.ErrDenied.Error(), Issuer: "https://issuer", Subject: "bob", JTI: "j1", Audiences: []string{"expired", "live"}, Nonce: "live"},
+		},
+		{
+			name:     "subject mismatch",
+			request:  &apiRequest{action: actionSecret, name: "db", token: token},
+			err:      engine.ErrNonceSubjectMismatch,
+			expected: &AuditEvent{Action: actionSecret, Name: "db", Decision: outcomeDenied, Reason: ErrCodeDenied, Error: engine.ErrNonceSubjectMismatch.Error(), Issuer: "https://issuer", Subject: "bob", JTI: "j1", Audiences: []string{"expired", "live"}, Nonce: "live"},
+		},
+		{
+			name:     "nonce challenge",
+			request:  &apiRequest{action: actionKeytab, name: "web", token: token},
+			err:      &engine.NonceRequiredError{Nonce: issued},
+			expected: &AuditEvent{Action: actionKeytab, Name: "web", Decision: outcomeDenied, Reason: ErrCodeNonceRequired, Error: (&engine.NonceRequiredError{Nonce: issued}).Error(), Issuer: "https://issuer", Subject: "bob", JTI: "j1", Audiences: []string{"expired", "live"}, Nonce: "live", Issued: "issued"},
+		},
+		{
+			name:     "invalid token",
+			request:  &apiRequest{action: actionSecret, name: "db", token: "garbage"},
+			err:      libtokenmachine.ErrTokenInvalid,
+			expected: &AuditEvent{Action: actionSecret, Name: "db", Decision: outcomeDenied, Reason: ErrCodeTokenInvalid, Error: libtokenmachine.ErrTokenInvalid.Error()},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			r := httptest.NewRequest(http.MethodPost, "/v1/nonce", nil)
+			r.RemoteAddr = "10.0.0.1:1234"
+			test.request.requestID = "id1"
+
+			event := newAuditEvent(r, test.request, tokenNonce, test.issued, test.err)
+
+			if event.Time == "" {
+				t.Errorf("time is not set")
+			}
+
+			test.expected.Time = event.Time
+			test.expected.RequestID = "id1"
+			test.expected.ClientIP = "10.0.0.1"
+
+			if !reflect.DeepEqual(event, test.expected) {
+				t.Errorf("event is\n%s\nwant\n%s", event.JSON(), test.expected.JSON())
+			}
+		})
+	}
+}
+
+func TestNewAdminAuditEvent(t *testing.T) {
+
+	token := unsignedToken(t, map[string]interface{}{
+		"iss": "https://issuer",
+		"sub": "bob",
+		"jti": "j1",
+		"aud": "live",
+	})
+
+	invalidToken := newHTTPError(http.StatusUnauthorized, ErrCodeTokenInvalid, "Admin token invalid")
+
+	tests := []struct {
+		name     string
+		request  *AdminPolicyEvalRequest
+		err      error
+		expected *AuditEvent
+	}{
+		{
+			name:     "token",
+			request:  &AdminPolicyEvalRequest{Action: engine.ActionGetSecret, Name: "db", Token: token},
+			expected: &AuditEvent{Action: actionAdminPolicyEval, Name: "db", Decision: outcomeGranted, Issuer: "https://issuer", Subject: "bob", JTI: "j1", Explained: engine.ActionGetSecret},
+		},
+		{
+			name:     "claims",
+			request:  &AdminPolicyEvalRequest{Action: engine.ActionGetNonce, Claims: map[string]interface{}{"iss": "https://issuer", "sub": "alice"}},
+			expected: &AuditEvent{Action: actionAdminPolicyEval, Decision: outcomeGranted, Issuer: "https://issuer", Subject: "alice", Explained: engine.ActionGetNonce},
+		},
+		{
+			name:     "invalid client token",
+			request:  &AdminPolicyEvalRequest{Action: engine.ActionGetSecret, Name: "db", Token: "garbage"},
+			expected: &AuditEvent{Action: actionAdminPolicyEval, Name: "db", Decision: outcomeGranted, Explained: engine.ActionGetSecret},
+		},
+		{
+			name:     "invalid admin token",
+			err:      invalidToken,
+			expected: &AuditEvent{Action: actionAdminPolicyEval, Decision: outcomeDenied, Reason: ErrCodeTokenInvalid, Error: invalidToken.Error()},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			r := httptest.NewRequest(http.MethodPost, pathAdminPolicyEval, nil)
+			r.RemoteAddr = "10.0.0.1:1234"
+
+			event := newAdminAuditEvent(r, "id1", test.request, test.err)
+
+			test.expected.Time = event.Time
+			test.expected.RequestID = "id1"
+			test.expected.ClientIP = "10.0.0.1"
+
+			if !reflect.DeepEqual(event, test.expected) {
+				t.Errorf("event is\n%s\nwant\n%s", event.JSON(), test.expected.JSON())
+			}
+		})
+	}
+}
+
+func TestAuditor(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	audit, err := newAuditor([]string{path})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	audit.record(&AuditEvent{Action: actionNonce, Decision: outcomeGranted})
+	audit.record(&AuditEvent{Action: actionSecret, Decision: outcomeDenied})
+	audit.shutdown()
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines; want 2", len(lines))
+	}
+
+	for _, line := range lines {
+		event := &AuditEvent{}
+		if err := json.Unmarshal([]byte(line), event); err != nil {
+			t.Errorf("line %s is not an event; err->%s", line, err)
+		}
+	}
+
+	// Auditing is disabled without output paths
+	audit, err = newAuditor(nil)
+	if err != nil || audit != nil {
+		t.Fatalf("expected no auditor")
+	}
+	audit.record(&AuditEvent{})
+}
@@ -0,0 +1,243 @@
+/*
+Copyright © 2020 Jody Scott <jody@thescottsweb.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// A warning is logged when the server certificate has less than this
+	// (or a third of its lifetime if that is less) remaining
+	certificateExpiryWarning       = 30 * 24 * time.Hour
+	certificateExpiryCheckInterval = time.Hour
+)
+
+// certificateManager holds the HTTPS server certificate and the client CAs.
+// If they are loaded from files the files are watched and the certificate and
+// CAs are replaced without a restart when the files change.
+type certificateManager struct {
+	mutex                           sync.RWMutex
+	cert                            *tls.Certificate
+	leaf                            *x509.Certificate
+	clientCAs                       *x509.CertPool
+	tlsCert, tlsKey, clientCA       string
+	certFile, keyFile, clientCAFile string
+	clientAuth                      bool
+	metrics                         *metrics
+	watcher                         *FileWatcher
+	closed                          chan struct{}
+	ticker                          *time.Ticker
+	wg                              sync.WaitGroup
+}
+
+func newCertificateManager(config *Config, metrics *metrics) (*certificateManager, error) {
+
+	if config.TLSCertFile == "" && config.TLSCert == "" {
+		return nil, fmt.Errorf("TLSCert or TLSCertFile is required when HTTPS port is set")
+	}
+
+	if config.TLSKeyFile == "" && config.TLSKey == "" {
+		return nil, fmt.Errorf("TLSKey or TLSKeyFile is required when HTTPS port is set")
+	}
+
+	if (config.TLSCertFile == "") != (config.TLSKeyFile == "") {
+		return nil, fmt.Errorf("TLSCertFile and TLSKeyFile must be set together")
+	}
+
+	t := &certificateManager{
+		tlsCert:      config.TLSCert,
+		tlsKey:       config.TLSKey,
+		clientCA:     config.ClientCA,
+		certFile:     config.TLSCertFile,
+		keyFile:      config.TLSKeyFile,
+		clientCAFile: config.ClientCAFile,
+		clientAuth:   config.ClientAuth != ClientAuthNone,
+		metrics:      metrics,
+		closed:       make(chan struct{}),
+		ticker:       time.NewTicker(certificateExpiryCheckInterval),
+	}
+
+	err := t.load()
+	if err != nil {
+		t.ticker.Stop()
+		return nil, err
+	}
+
+	var files []string
+	for _, file := range []string{t.certFile, t.keyFile, t.clientCAFile} {
+		if file != "" {
+			files = append(files, file)
+		}
+	}
+
+	if len(files) > 0 {
+		t.watcher, err = (&FileWatcherConfig{
+			Files:    files,
+			OnChange: t.reload,
+		}).Build()
+		if err != nil {
+			t.ticker.Stop()
+			return nil, err
+		}
+	}
+
+	t.wg.Add(1)
+	go t.run()
+	return t, nil
+}
+
+func (t *certificateManager) run() {
+	defer t.wg.Done()
+	for {
+		select {
+		case <-t.closed:
+			t.ticker.Stop()
+			return
+		case <-t.ticker.C:
+			t.checkExpiry()
+		}
+	}
+}
+
+// load reads the certificate, key and client CAs. Nothing is replaced unless
+// all of them are valid.
+func (t *certificateManager) load() error {
+
+	tlsCert := []byte(t.tlsCert)
+	tlsKey := []byte(t.tlsKey)
+	clientCA := []byte(t.clientCA)
+
+	var err error
+
+	if t.certFile != "" {
+
+		tlsCert, err = ioutil.ReadFile(t.certFile)
+		if err != nil {
+			return fmt.Errorf("Unable to read TLSCertFile; err->%s", err)
+		}
+
+		tlsKey, err = ioutil.ReadFile(t.keyFile)
+		if err != nil {
+			return fmt.Errorf("Unable to read TLSKeyFile; err->%s", err)
+		}
+	}
+
+	if t.clientCAFile != "" {
+		clientCA, err = ioutil.ReadFile(t.clientCAFile)
+		if err != nil {
+			return fmt.Errorf("Unable to read ClientCAFile; err->%s", err)
+		}
+	}
+
+	cert, err := tls.X509KeyPair(tlsCert, tlsKey)
+	if err != nil {
+		return err
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+	cert.Leaf = leaf
+
+	var clientCAs *x509.CertPool
+
+	if t.clientAuth {
+
+		if len(clientCA) == 0 {
+			return fmt.Errorf("ClientCA or ClientCAFile is required when ClientAuth is set")
+		}
+
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(clientCA) {
+			return fmt.Errorf("ClientCA does not contain any PEM certificates")
+		}
+	}
+
+	t.mutex.Lock()
+	t.cert = &cert
+	t.leaf = leaf
+	t.clientCAs = clientCAs
+	t.mutex.Unlock()
+
+	zap.L().Info(fmt.Sprintf("Loaded TLS certificate %s with expiration %s", leaf.Subject, leaf.NotAfter.UTC().Format(time.RFC3339)))
+
+	t.checkExpiry()
+	return nil
+}
+
+func (t *certificateManager) reload() {
+	err := t.load()
+	if err != nil {
+		zap.L().Error(fmt.Sprintf("Unable to reload TLS certificate, continuing with existing certificate; err->%s", err))
+	}
+}
+
+// checkExpiry logs a warning and sets the metrics if the certificate is close
+// to expiry
+func (t *certificateManager) checkExpiry() {
+
+	t.mutex.RLock()
+	leaf := t.leaf
+	t.mutex.RUnlock()
+
+	warning := certificateExpiryWarning
+	if lifetime := leaf.NotAfter.Sub(leaf.NotBefore) / 3; lifetime < warning {
+		warning = lifetime
+	}
+
+	remaining := time.Until(leaf.NotAfter)
+	expiring := remaining < warning
+
+	if expiring {
+		zap.L().Warn(fmt.Sprintf("TLS certificate %s expires in %s", leaf.Subject, remaining.Round(time.Second)))
+	}
+
+	t.metrics.setCertificateExpiry(leaf, expiring)
+}
+
+// getCertificate implements tls.Config.GetCertificate
+func (t *certificateManager) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	return t.cert, nil
+}
+
+func (t *certificateManager) getClientCAs() *x509.CertPool {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	return t.clientCAs
+}
+
+func (t *certificateManager) shutdown() {
+	if t == nil {
+		return
+	}
+	if t.watcher != nil {
+		t.watcher.Shutdown()
+	}
+	close(t.closed)
+	t.wg.Wait()
+}
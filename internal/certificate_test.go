@@ -0,0 +1,120 @@
+/*
+Copyright © 2020 Jody Scott <jody@thescottsweb.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"crypto/x509"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewCertificateManagerInvalid(t *testing.T) {
+
+	ca := newTestCertificate(t, "ca", nil, 0)
+	server := newTestCertificate(t, "localhost", ca, x509.ExtKeyUsageServerAuth)
+
+	tests := []struct {
+		name   string
+		config *Config
+		err    string
+	}{
+		{"no certificate", &Config{TLSKey: server.keyPEM}, "TLSCert or TLSCertFile"},
+		{"no key", &Config{TLSCert: server.certPEM}, "TLSKey or TLSKeyFile"},
+		{"cert file without key file", &Config{TLSCertFile: "cert.pem", TLSKey: server.keyPEM}, "must be set together"},
+		{"missing cert file", &Config{TLSCertFile: "/does/not/exist/cert.pem", TLSKeyFile: "/does/not/exist/key.pem"}, "Unable to read TLSCertFile"},
+		{"key mismatch", &Config{TLSCert: server.certPEM, TLSKey: ca.keyPEM}, "private key does not match"},
+		{"client auth without CA", &Config{TLSCert: server.certPEM, TLSKey: server.keyPEM, ClientAuth: ClientAuthVerify}, "ClientCA or ClientCAFile"},
+		{"invalid CA", &Config{TLSCert: server.certPEM, TLSKey: server.keyPEM, ClientAuth: ClientAuthVerify, ClientCA: "ca"}, "PEM certificates"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			certificates, err := newCertificateManager(test.config, newMetrics())
+			if err == nil {
+				certificates.shutdown()
+				t.Fatalf("expected error")
+			}
+
+			if !strings.Contains(err.Error(), test.err) {
+				t.Errorf("err is %s; want %s", err, test.err)
+			}
+		})
+	}
+}
+
+func TestCertificateManagerReload(t *testing.T) {
+
+	ca := newTestCertificate(t, "ca", nil, 0)
+	first := newTestCertificate(t, "first", ca, x509.ExtKeyUsageServerAuth)
+	second := newTestCertificate(t, "second", ca, x509.ExtKeyUsageServerAuth)
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "tls.crt")
+	keyFile := filepath.Join(dir, "tls.key")
+	caFile := filepath.Join(dir, "ca.crt")
+
+	writeFile(t, certFile, first.certPEM)
+	writeFile(t, keyFile, first.keyPEM)
+	writeFile(t, caFile, ca.certPEM)
+
+	certificates, err := newCertificateManager(&Config{
+		TLSCertFile:  certFile,
+		TLSKeyFile:   keyFile,
+		ClientCAFile: caFile,
+		ClientAuth:   ClientAuthVerify,
+	}, newMetrics())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer certificates.shutdown()
+
+	commonName := func() string {
+		cert, _ := certificates.getCertificate(nil)
+		return cert.Leaf.Subject.CommonName
+	}
+
+	if name := commonName(); name != "first" {
+		t.Fatalf("certificate is %s; want first", name)
+	}
+
+	if certificates.getClientCAs() == nil {
+		t.Fatalf("client CAs are not loaded")
+	}
+
+	// An invalid certificate is not loaded
+	writeFile(t, certFile, "invalid")
+	time.Sleep(2 * defaultFileWatcherDelay)
+
+	if name := commonName(); name != "first" {
+		t.Fatalf("certificate is %s after invalid update; want first", name)
+	}
+
+	// The key is written after the certificate as it would be by a rotation
+	writeFile(t, certFile, second.certPEM)
+	writeFile(t, keyFile, second.keyPEM)
+
+	deadline := time.Now().Add(5 * defaultFileWatcherDelay)
+	for commonName() != "second" {
+		if time.Now().After(deadline) {
+			t.Fatalf("certificate was not rotated")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -18,18 +18,23 @@ package internal
 
 import (
 	"bufio"
-	"context"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
+	"path/filepath"
 	"strings"
 	"time"
 
 	"github.com/jodydadescott/libtokenmachine"
 	"github.com/jodydadescott/tokenmachine/config"
-	"github.com/open-policy-agent/opa/rego"
+	"github.com/jodydadescott/tokenmachine/internal/engine"
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/util"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 	"gopkg.in/yaml.v2"
@@ -58,7 +63,10 @@ func NewLoader() *Loader {
 // ServerConfig Returns Server Config
 func (t *Loader) ServerConfig() (*Config, error) {
 
-	serverConfig := &Config{}
+	serverConfig := &Config{
+		APIVersion: t.Config.APIVersion,
+		ConfigHash: t.ConfigHash(),
+	}
 
 	if t.Config.Network != nil {
 		serverConfig.Listen = t.Config.Network.Listen
@@ -66,15 +74,77 @@ func (t *Loader) ServerConfig() (*Config, error) {
 		serverConfig.HTTPSPort = t.Config.Network.HTTPSPort
 		serverConfig.TLSCert = t.Config.Network.TLSCert
 		serverConfig.TLSKey = t.Config.Network.TLSKey
+		serverConfig.DisableQueryToken = t.Config.Network.DisableQueryToken
+		serverConfig.MetricsPort = t.Config.Network.MetricsPort
+		serverConfig.ShutdownTimeout = t.Config.Network.ShutdownTimeout
+		serverConfig.PreStopDelay = t.Config.Network.PreStopDelay
+		serverConfig.ClientCA = t.Config.Network.ClientCA
+		serverConfig.ClientAuth = t.Config.Network.ClientAuth
+		serverConfig.TLSMinVersion = t.Config.Network.TLSMinVersion
+		serverConfig.TLSCipherSuites = t.Config.Network.TLSCipherSuites
+		serverConfig.TLSCertFile = t.Config.Network.TLSCertFile
+		serverConfig.TLSKeyFile = t.Config.Network.TLSKeyFile
+		serverConfig.ClientCAFile = t.Config.Network.ClientCAFile
+		serverConfig.AdminToken = t.Config.Network.AdminToken
+		serverConfig.AdminPort = t.Config.Network.AdminPort
 	}
 
 	if t.Config.Policy != nil {
 		serverConfig.Policy = t.Config.Policy.Policy
+		if len(t.Config.Policy.Modules) > 0 {
+			serverConfig.PolicyModules = make(map[string]string)
+			for _, s := range t.Config.Policy.Modules {
+				serverConfig.PolicyModules[s.Name] = s.Rego
+			}
+		}
+		if t.Config.Policy.Bundle != nil {
+			serverConfig.Bundle = &engine.BundleConfig{
+				Source:       t.Config.Policy.Bundle.Source,
+				PublicKey:    t.Config.Policy.Bundle.PublicKey,
+				KeyID:        t.Config.Policy.Bundle.KeyID,
+				Algorithm:    t.Config.Policy.Bundle.Algorithm,
+				Scope:        t.Config.Policy.Bundle.Scope,
+				PollInterval: t.Config.Policy.Bundle.PollInterval,
+				CACert:       t.Config.Policy.Bundle.CACert,
+			}
+		}
+		for _, s := range t.Config.Policy.Data {
+			document, err := getPolicyData(s)
+			if err != nil {
+				return nil, err
+			}
+			serverConfig.PolicyData = append(serverConfig.PolicyData, document)
+		}
 		serverConfig.NonceLifetime = t.Config.Policy.NonceLifetime
+		serverConfig.NonceKey = t.Config.Policy.NonceKey
+		serverConfig.SingleUseNonce = t.Config.Policy.SingleUseNonce
+		serverConfig.ReplayCacheSize = t.Config.Policy.ReplayCacheSize
+		serverConfig.DisableNonceSubjectCheck = t.Config.Policy.DisableNonceSubjectCheck
+		serverConfig.NonceChallenge = t.Config.Policy.NonceChallenge
 		serverConfig.KeytabLifetime = t.Config.Policy.KeytabLifetime
 		serverConfig.SharedSecretLifetime = t.Config.Policy.SharedSecretLifetime
 	}
 
+	if t.Config.Audit != nil {
+		serverConfig.AuditOutputPaths = t.Config.Audit.OutputPaths
+	}
+
+	if t.Config.Trust != nil {
+		for _, s := range t.Config.Trust.Issuers {
+			serverConfig.Issuers = append(serverConfig.Issuers, &engine.Issuer{
+				Issuer:          s.Issuer,
+				JWKS:            s.JWKS,
+				PublicKeys:      s.PublicKeys,
+				JWKSURL:         s.JWKSURL,
+				RefreshInterval: s.RefreshInterval,
+				CACert:          s.CACert,
+				Algorithms:      s.Algorithms,
+				Audiences:       s.Audiences,
+				ClockSkew:       s.ClockSkew,
+			})
+		}
+	}
+
 	if t.Config.Data != nil {
 
 		if t.Config.Data.Keytabs != nil {
@@ -102,6 +172,44 @@ func (t *Loader) ServerConfig() (*Config, error) {
 	return serverConfig, nil
 }
 
+// ConfigHash Returns the SHA256 hash of the effective config. Instances with
+// the same config will have the same hash. Seeds, keys and tokens are replaced
+// by their own hashes before hashing so that the hash can not be used to test
+// a guessed config.
+func (t *Loader) ConfigHash() string {
+
+	// Round trip through JSON for a deep copy
+	redacted := &config.Config{}
+	json.Unmarshal([]byte(t.Config.JSON()), redacted)
+
+	if redacted.Network != nil {
+		redactString(&redacted.Network.TLSKey)
+		redactString(&redacted.Network.AdminToken)
+	}
+
+	if redacted.Policy != nil {
+		redactString(&redacted.Policy.NonceKey)
+	}
+
+	if redacted.Data != nil {
+		for _, s := range redacted.Data.SharedSecrets {
+			redactString(&s.Seed)
+		}
+		for _, s := range redacted.Data.Keytabs {
+			redactString(&s.Seed)
+		}
+	}
+
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(redacted.JSON())))
+}
+
+// redactString replaces a non empty s with its SHA256 hash
+func redactString(s *string) {
+	if *s != "" {
+		*s = fmt.Sprintf("%x", sha256.Sum256([]byte(*s)))
+	}
+}
+
 // ZapConfig Returns Zap Config
 func (t *Loader) ZapConfig() (*zap.Config, error) {
 
@@ -258,8 +366,21 @@ func (t *Loader) ZapConfigWindows() (*zap.Config, error) {
 
 }
 
-// LoadeFromBytes Load data from bytes
+// LoadeFromBytes Load data from bytes. Input may be YAML, JSON or a Rego
+// policy. A Rego policy is set as the main policy.
 func (t *Loader) LoadeFromBytes(input []byte) error {
+	return t.loadFromBytes("", input)
+}
+
+// loadFromBytes loads input read from the file or URL with the base name name.
+// Input from a name ending in .rego is parsed as a Rego module and added to the policy modules
+// under its base name so that a policy may be split over several modules. The
+// policy as a whole is validated when the server is started or reloaded.
+func (t *Loader) loadFromBytes(name string, input []byte) error {
+
+	if strings.HasSuffix(name, ".rego") {
+		return t.loadPolicyModule(name, input)
+	}
 
 	// Input could be JSON, YAML or REGO Policy
 
@@ -270,15 +391,9 @@ func (t *Loader) LoadeFromBytes(input []byte) error {
 		err = json.Unmarshal(input, &config)
 		if err != nil {
 
-			ctx := context.Background()
-
 			policyString := string(input)
 
-			_, err := rego.New(
-				rego.Query("grant_new_nonce = data.kbridge.grant_new_nonce; data.kbridge.get_principals[get_principals]"),
-				rego.Module("kerberos.rego", policyString),
-			).PrepareForEval(ctx)
-
+			_, err := ast.ParseModule("kerberos.rego", policyString)
 			if err == nil {
 				t.Config.Policy.Policy = policyString
 				return nil
@@ -324,47 +439,153 @@ func (t *Loader) LoadFrom(input string) error {
 
 func (t *Loader) loadFromURL(input string) error {
 
-	req, err := http.NewRequest("GET", input, nil)
+	b, err := getURL(input)
 	if err != nil {
 		return err
 	}
 
-	resp, err := getHTTPClient().Do(req)
+	return t.loadFromBytes(getURLBase(input), b)
+
+}
+
+func (t *Loader) loadFromFile(input string) error {
+
+	f, err := os.Open(input)
 	if err != nil {
 		return err
 	}
 
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	b, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+	return t.loadFromBytes(filepath.Base(input), b)
+
+}
+
+// loadPolicyModule parses input as a Rego module and adds it to the policy
+// modules. Parse errors include name and the line number.
+func (t *Loader) loadPolicyModule(name string, input []byte) error {
+
+	_, err := ast.ParseModule(name, string(input))
+	if err != nil {
+		return err
+	}
+
+	t.Config.Merge(&config.Config{
+		Policy: &config.Policy{
+			Modules: []*config.PolicyModule{
+				{
+					Name: name,
+					Rego: string(input),
+				},
+			},
+		},
+	})
+
+	return nil
+}
+
+// ValidatePolicy compiles the policy and modules and verifies that the
+// required rules are implemented as they are when the server is started. If
+// a bundle is configured the policy is not checked here since the bundle may
+// provide the rules; it is checked with the bundle when the server is started.
+func (t *Loader) ValidatePolicy() error {
+
+	policy := t.Config.Policy
+	if policy == nil || policy.Bundle != nil {
+		return nil
+	}
+
+	if policy.Policy == "" && len(policy.Modules) == 0 {
+		return nil
+	}
+
+	policyConfig := &engine.PolicyConfig{
+		Policy:  policy.Policy,
+		Modules: make(map[string]string),
+	}
+
+	for _, s := range policy.Modules {
+		policyConfig.Modules[s.Name] = s.Rego
+	}
+
+	return policyConfig.Validate()
+}
+
+func getURL(input string) ([]byte, error) {
+
+	req, err := http.NewRequest("GET", input, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := getHTTPClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+
 	defer resp.Body.Close()
 
 	b, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf(fmt.Sprintf("%s returned status code %d", input, resp.StatusCode))
+		return nil, fmt.Errorf(fmt.Sprintf("%s returned status code %d", input, resp.StatusCode))
 	}
 
-	return t.LoadeFromBytes(b)
-
+	return b, nil
 }
 
-func (t *Loader) loadFromFile(input string) error {
+// getPolicyData reads the data document from inline, the file or the URL
+func getPolicyData(data *config.PolicyData) (*engine.DataDocument, error) {
+
+	var b []byte
+	var err error
+
+	switch {
+
+	case data.Inline != "" && data.File == "" && data.URL == "":
+		b = []byte(data.Inline)
+
+	case data.File != "" && data.Inline == "" && data.URL == "":
+		b, err = ioutil.ReadFile(data.File)
+
+	case data.URL != "" && data.Inline == "" && data.File == "":
+		b, err = getURL(data.URL)
+
+	default:
+		return nil, fmt.Errorf("Data document %s requires one of inline, file or url", data.Path)
+	}
 
-	f, err := os.Open(input)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	defer f.Close()
+	document := &engine.DataDocument{
+		Path: data.Path,
+	}
 
-	reader := bufio.NewReader(f)
-	b, err := ioutil.ReadAll(reader)
+	err = util.Unmarshal(b, &document.Value)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("Data document %s is not valid YAML or JSON; err->%s", data.Path, err)
 	}
-	return t.LoadeFromBytes(b)
 
+	return document, nil
+}
+
+// getURLBase returns the last element of the path of the URL input
+func getURLBase(input string) string {
+	u, err := url.Parse(input)
+	if err != nil {
+		return ""
+	}
+	return path.Base(u.Path)
 }
 
 func getHTTPClient() *http.Client {
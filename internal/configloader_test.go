@@ -0,0 +1,195 @@
+/*
+Copyright © 2020 Jody Scott <jody@thescottsweb.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/jodydadescott/tokenmachine/config"
+)
+
+const (
+	testPolicyLibrary = `
+package lib
+
+allow {
+   input.claims.iss == "abc123"
+}
+`
+
+	testPolicyMain = `
+package main
+
+import data.lib
+
+auth_get_nonce = lib.allow
+auth_get_keytab = false
+auth_get_secret = false
+`
+)
+
+func TestValidatePolicy(t *testing.T) {
+
+	tests := []struct {
+		name  string
+		files map[string]string
+		err   string
+	}{
+		{"no policy", nil, ""},
+		{"modules", map[string]string{"main.rego": testPolicyMain, "lib.rego": testPolicyLibrary}, ""},
+		{"compile error", map[string]string{"main.rego": "package main\n\nauth_get_nonce { undefined_function(1) }\nauth_get_keytab = true\nauth_get_secret = true\n"}, "undefined_function"},
+		{"missing rule", map[string]string{"main.rego": "package main\n\nauth_get_nonce = true\n"}, "auth_get_keytab"},
+		{"not a boolean", map[string]string{"main.rego": "package main\n\nauth_get_nonce = 1\nauth_get_keytab = true\nauth_get_secret = true\n"}, "boolean"},
+		{"config policy", map[string]string{"config.yaml": "apiVersion: V1\npolicy:\n  policy: |\n    package main\n    auth_get_nonce = true\n"}, "auth_get_keytab"},
+		{"bundle", map[string]string{"config.yaml": "apiVersion: V1\npolicy:\n  policy: |\n    package main\n  bundle:\n    source: bundle.tar.gz\n"}, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			dir := t.TempDir()
+			loader := NewLoader()
+
+			var names []string
+			for name, data := range test.files {
+				writeFile(t, filepath.Join(dir, name), data)
+				names = append(names, filepath.Join(dir, name))
+			}
+
+			if len(names) > 0 {
+				if err := loader.LoadFrom(strings.Join(names, ",")); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := loader.ValidatePolicy()
+
+			if test.err == "" {
+				if err != nil {
+					t.Errorf("unexpected error; err->%s", err)
+				}
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("err is %v; want %s", err, test.err)
+			}
+		})
+	}
+}
+
+func TestValidatePolicyConfig(t *testing.T) {
+
+	loader := NewLoader()
+	loader.Config.Merge(&config.Config{
+		Policy: &config.Policy{
+			Policy: testPolicyMain,
+			Modules: []*config.PolicyModule{
+				{Name: "lib.rego", Rego: testPolicyLibrary},
+			},
+		},
+	})
+
+	if err := loader.ValidatePolicy(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetPolicyData(t *testing.T) {
+
+	file := filepath.Join(t.TempDir(), "users.json")
+	writeFile(t, file, `["bob", "alice"]`)
+
+	tests := []struct {
+		name     string
+		data     *config.PolicyData
+		expected interface{}
+		err      string
+	}{
+		{"inline yaml", &config.PolicyData{Path: "users", Inline: "- bob\n- alice\n"}, []interface{}{"bob", "alice"}, ""},
+		{"inline json", &config.PolicyData{Path: "users", Inline: `{"bob": true}`}, map[string]interface{}{"bob": true}, ""},
+		{"file", &config.PolicyData{Path: "users", File: file}, []interface{}{"bob", "alice"}, ""},
+		{"missing file", &config.PolicyData{Path: "users", File: file + ".missing"}, nil, "no such file"},
+		{"invalid", &config.PolicyData{Path: "users", Inline: "{"}, nil, "not valid YAML or JSON"},
+		{"no source", &config.PolicyData{Path: "users"}, nil, "requires one of"},
+		{"two sources", &config.PolicyData{Path: "users", Inline: "[]", File: file}, nil, "requires one of"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			document, err := getPolicyData(test.data)
+
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("err is %v; want %s", err, test.err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if document.Path != test.data.Path || !reflect.DeepEqual(document.Value, test.expected) {
+				t.Errorf("document is %s %v; want %s %v", document.Path, document.Value, test.data.Path, test.expected)
+			}
+		})
+	}
+}
+
+func TestConfigHash(t *testing.T) {
+
+	newLoader := func(seed string) *Loader {
+		loader := NewLoader()
+		loader.Config.Merge(&config.Config{
+			Network: &config.Network{AdminToken: "admin-token"},
+			Policy:  &config.Policy{NonceKey: "nonce-key"},
+			Data: &config.Data{
+				SharedSecrets: []*config.SharedSecret{{Name: "secret", Seed: seed}},
+				Keytabs:       []*config.Keytab{{Name: "keytab", Principal: "user@EXAMPLE.COM", Seed: seed}},
+			},
+		})
+		return loader
+	}
+
+	loader := newLoader("seed-one")
+	hash := loader.ConfigHash()
+
+	if hash != newLoader("seed-one").ConfigHash() {
+		t.Errorf("hash of the same config is different")
+	}
+
+	if hash == newLoader("seed-two").ConfigHash() {
+		t.Errorf("hash did not change when the seed changed")
+	}
+
+	if hash == fmt.Sprintf("%x", sha256.Sum256([]byte(loader.Config.JSON()))) {
+		t.Errorf("hash is of the config with the seeds")
+	}
+
+	for _, s := range []string{"admin-token", "nonce-key", "seed-one"} {
+		if !strings.Contains(loader.Config.JSON(), s) {
+			t.Errorf("config was modified; %s is missing", s)
+		}
+	}
+}
@@ -0,0 +1,293 @@
+/*
+Copyright © 2020 Jody Scott <jody@thescottsweb.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package engine
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/open-policy-agent/opa/bundle"
+	"go.uber.org/zap"
+)
+
+// BundleConfig config. Source is the path of a bundle file (.tar.gz) or
+// directory, or a http(s) URL that is polled for new revisions. A http URL
+// requires PublicKey.
+type BundleConfig struct {
+	Source       string
+	PublicKey    string        // Optional PEM public key or HMAC secret; if set the bundle must be signed
+	KeyID        string        // Key id of PublicKey (default is default)
+	Algorithm    string        // Signature algorithm (default is RS256)
+	Scope        string        // Optional scope that the signature must have
+	PollInterval time.Duration // Poll interval of a URL (default is 1 minute)
+	CACert       string        // Optional CA of a https URL
+}
+
+// BundleSource loads an OPA bundle. A bundle from a URL is polled with the
+// ETag of the last response so that unchanged bundles are not downloaded.
+type BundleSource struct {
+	source       string
+	url          bool
+	verification *bundle.VerificationConfig
+	pollInterval time.Duration
+	httpClient   *http.Client
+	etag         string
+	mutex        sync.RWMutex
+	bundle       *bundle.Bundle
+	closed       chan struct{}
+	wg           sync.WaitGroup
+}
+
+// Build Returns a new BundleSource with the bundle loaded. If config is nil or
+// has no Source nil is returned.
+func (config *BundleConfig) Build() (*BundleSource, error) {
+
+	if config == nil || config.Source == "" {
+		return nil, nil
+	}
+
+	t := &BundleSource{
+		source:       config.Source,
+		url:          strings.HasPrefix(config.Source, "https://") || strings.HasPrefix(config.Source, "http://"),
+		pollInterval: config.PollInterval,
+		closed:       make(chan struct{}),
+	}
+
+	// A bundle over http could be replaced in transit so it must be signed
+	if strings.HasPrefix(config.Source, "http://") && config.PublicKey == "" {
+		return nil, fmt.Errorf("Bundle %s is not https and requires a PublicKey to verify its signature", config.Source)
+	}
+
+	if config.PublicKey != "" {
+
+		keyID := config.KeyID
+		if keyID == "" {
+			keyID = bundleDefaultKeyID
+		}
+
+		algorithm := config.Algorithm
+		if algorithm == "" {
+			algorithm = bundleDefaultAlgorithm
+		}
+
+		t.verification = bundle.NewVerificationConfig(map[string]*bundle.KeyConfig{
+			keyID: bundle.NewKeyConfig(config.PublicKey, algorithm, config.Scope),
+		}, keyID, config.Scope, nil)
+	}
+
+	if t.url {
+
+		if t.pollInterval <= 0 {
+			t.pollInterval = bundleDefaultPollInterval
+		}
+
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+
+		if config.CACert != "" {
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM([]byte(config.CACert)) {
+				return nil, fmt.Errorf("CA cert of bundle %s does not contain any PEM certificates", t.source)
+			}
+			transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+		}
+
+		t.httpClient = &http.Client{
+			Transport: transport,
+			Timeout:   publicKeyDefaultRequestTimeout,
+		}
+	}
+
+	b, err := t.load()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to load bundle %s; err->%s", t.source, err)
+	}
+
+	t.bundle = b
+	zap.L().Info(fmt.Sprintf("Loaded bundle %s revision %s", t.source, b.Manifest.Revision))
+
+	return t, nil
+}
+
+// Bundle returns the last loaded bundle
+func (t *BundleSource) Bundle() *bundle.Bundle {
+
+	if t == nil {
+		return nil
+	}
+
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	return t.bundle
+}
+
+// Start polls a URL for new revisions and calls onChange with each new
+// bundle. If onChange returns an error the bundle is not used and the error is
+// logged. Bundles loaded from a path are only loaded again on reload.
+func (t *BundleSource) Start(onChange func(*bundle.Bundle) error) {
+
+	if t == nil || !t.url {
+		return
+	}
+
+	t.wg.Add(1)
+	go t.run(onChange)
+}
+
+// Shutdown stops polling
+func (t *BundleSource) Shutdown() {
+
+	if t == nil {
+		return
+	}
+
+	select {
+	case <-t.closed:
+	default:
+		close(t.closed)
+	}
+
+	t.wg.Wait()
+}
+
+func (t *BundleSource) run(onChange func(*bundle.Bundle) error) {
+
+	defer t.wg.Done()
+
+	ticker := time.NewTicker(t.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+
+		case <-t.closed:
+			return
+
+		case <-ticker.C:
+
+			b, err := t.fetch()
+			if err != nil {
+				zap.L().Error(fmt.Sprintf("Unable to fetch bundle %s, using revision %s; err->%s", t.source, t.Bundle().Manifest.Revision, err))
+				continue
+			}
+
+			if b == nil {
+				zap.L().Debug(fmt.Sprintf("Bundle %s is not modified", t.source))
+				continue
+			}
+
+			err = onChange(b)
+			if err != nil {
+				zap.L().Error(fmt.Sprintf("Bundle %s revision %s is not valid, using revision %s; err->%s", t.source, b.Manifest.Revision, t.Bundle().Manifest.Revision, err))
+				continue
+			}
+
+			t.mutex.Lock()
+			t.bundle = b
+			t.mutex.Unlock()
+
+			zap.L().Info(fmt.Sprintf("Activated bundle %s revision %s", t.source, b.Manifest.Revision))
+		}
+	}
+}
+
+func (t *BundleSource) load() (*bundle.Bundle, error) {
+
+	if t.url {
+		return t.fetch()
+	}
+
+	info, err := os.Stat(t.source)
+	if err != nil {
+		return nil, err
+	}
+
+	if info.IsDir() {
+		return t.read(bundle.NewCustomReader(bundle.NewDirectoryLoader(t.source)))
+	}
+
+	f, err := os.Open(t.source)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return t.read(bundle.NewReader(f))
+}
+
+// fetch gets the bundle from the URL. If the bundle has not changed since the
+// last fetch nil is returned.
+func (t *BundleSource) fetch() (*bundle.Bundle, error) {
+
+	req, err := http.NewRequest(http.MethodGet, t.source, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if t.etag != "" {
+		req.Header.Set("If-None-Match", t.etag)
+	}
+
+	resp, err := t.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+
+	case http.StatusOK:
+		break
+
+	case http.StatusNotModified:
+		return nil, nil
+
+	default:
+		return nil, fmt.Errorf("Unexpected status %s", resp.Status)
+	}
+
+	b, err := t.read(bundle.NewReader(io.LimitReader(resp.Body, bundle.BundleLimitBytes)))
+	if err != nil {
+		return nil, err
+	}
+
+	t.etag = resp.Header.Get("ETag")
+	return b, nil
+}
+
+// read reads the bundle and verifies its signature if a key is configured
+func (t *BundleSource) read(reader *bundle.Reader) (*bundle.Bundle, error) {
+
+	if t.verification == nil {
+		reader = reader.WithSkipBundleVerification(true)
+	} else {
+		reader = reader.WithBundleVerificationConfig(t.verification)
+	}
+
+	b, err := reader.Read()
+	if err != nil {
+		return nil, err
+	}
+
+	return &b, nil
+}
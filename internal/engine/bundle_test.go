@@ -0,0 +1,266 @@
+/*
+Copyright © 2020 Jody Scott <jody@thescottsweb.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package engine
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/open-policy-agent/opa/bundle"
+)
+
+const bundlePolicy = `
+package main
+
+default auth_get_nonce = false
+default auth_get_keytab = false
+default auth_get_secret = false
+`
+
+// testBundleKey is a RSA key pair in PEM for signing bundles
+type testBundleKey struct {
+	private string
+	public  string
+}
+
+func newTestBundleKey(t *testing.T) *testBundleKey {
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testBundleKey{
+		private: string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})),
+		public:  string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})),
+	}
+}
+
+// newTestBundle returns the bundle as a .tar.gz. If key is set the bundle is
+// signed with key, algorithm and keyID. If tamper is set the policy is changed
+// after signing.
+func newTestBundle(t *testing.T, revision, key, algorithm, keyID string, tamper bool) []byte {
+
+	b := bundle.Bundle{
+		Manifest: bundle.Manifest{Revision: revision},
+		Data:     map[string]interface{}{"users": []interface{}{"alice"}},
+		Modules: []bundle.ModuleFile{
+			{URL: "/policy.rego", Path: "/policy.rego", Raw: []byte(bundlePolicy)},
+		},
+	}
+
+	if key != "" {
+
+		// OPA reads the signing key from a file if the key is a path that
+		// exists; an inline PEM may be rejected as a file name that is too long
+		keyFile := filepath.Join(t.TempDir(), "signing.key")
+		if err := ioutil.WriteFile(keyFile, []byte(key), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := b.GenerateSignature(bundle.NewSigningConfig(keyFile, algorithm, ""), keyID, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if tamper {
+		b.Modules[0].Raw = []byte(bundlePolicy + "\nauth_get_secret = true\n")
+	}
+
+	var buf bytes.Buffer
+	if err := bundle.NewWriter(&buf).Write(b); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+// writeTestBundle writes data to a file in a temp dir and returns its path
+func writeTestBundle(t *testing.T, data []byte) string {
+	name := filepath.Join(t.TempDir(), "bundle.tar.gz")
+	if err := ioutil.WriteFile(name, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func TestBundleSignature(t *testing.T) {
+
+	key := newTestBundleKey(t)
+	otherKey := newTestBundleKey(t)
+
+	tests := []struct {
+		name   string
+		bundle []byte
+		config BundleConfig
+		ok     bool
+	}{
+		{"unsigned without key", newTestBundle(t, "r1", "", "", "", false), BundleConfig{}, true},
+		{"signed without key", newTestBundle(t, "r1", key.private, "RS256", "default", false), BundleConfig{}, true},
+		{"signed", newTestBundle(t, "r1", key.private, "RS256", "default", false), BundleConfig{PublicKey: key.public}, true},
+		{"signed with key id", newTestBundle(t, "r1", key.private, "RS256", "k1", false), BundleConfig{PublicKey: key.public, KeyID: "k1"}, true},
+		{"hmac", newTestBundle(t, "r1", "secret", "HS256", "default", false), BundleConfig{PublicKey: "secret", Algorithm: "HS256"}, true},
+		{"unsigned", newTestBundle(t, "r1", "", "", "", false), BundleConfig{PublicKey: key.public}, false},
+		{"wrong key", newTestBundle(t, "r1", otherKey.private, "RS256", "default", false), BundleConfig{PublicKey: key.public}, false},
+		// As in OPA the configured key id is used rather than the kid of the signature
+		{"other key id", newTestBundle(t, "r1", key.private, "RS256", "k2", false), BundleConfig{PublicKey: key.public, KeyID: "k1"}, true},
+		{"public key as hmac secret", newTestBundle(t, "r1", key.public, "HS256", "default", false), BundleConfig{PublicKey: key.public}, false},
+		{"wrong hmac secret", newTestBundle(t, "r1", "other", "HS256", "default", false), BundleConfig{PublicKey: "secret", Algorithm: "HS256"}, false},
+		{"tampered", newTestBundle(t, "r1", key.private, "RS256", "default", true), BundleConfig{PublicKey: key.public}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			config := test.config
+			config.Source = writeTestBundle(t, test.bundle)
+
+			source, err := config.Build()
+			if !test.ok {
+				if err == nil {
+					source.Shutdown()
+					t.Fatalf("expected error")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer source.Shutdown()
+
+			if source.Bundle().Manifest.Revision != "r1" {
+				t.Errorf("revision is %s; want r1", source.Bundle().Manifest.Revision)
+			}
+		})
+	}
+}
+
+func TestBundleURL(t *testing.T) {
+
+	key := newTestBundleKey(t)
+	signed := newTestBundle(t, "r1", key.private, "RS256", "default", false)
+	unsigned := newTestBundle(t, "r1", "", "", "", false)
+
+	handler := func(data []byte) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write(data)
+		})
+	}
+
+	httpsServer := httptest.NewTLSServer(handler(unsigned))
+	defer httpsServer.Close()
+
+	httpServer := httptest.NewServer(handler(signed))
+	defer httpServer.Close()
+
+	unsignedHTTPServer := httptest.NewServer(handler(unsigned))
+	defer unsignedHTTPServer.Close()
+
+	ca := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: httpsServer.Certificate().Raw}))
+
+	tests := []struct {
+		name   string
+		config BundleConfig
+		err    string
+	}{
+		{"https", BundleConfig{Source: httpsServer.URL, CACert: ca}, ""},
+		{"https untrusted", BundleConfig{Source: httpsServer.URL}, "certificate"},
+		{"invalid ca", BundleConfig{Source: httpsServer.URL, CACert: "ca"}, "CA cert"},
+		{"http without key", BundleConfig{Source: httpServer.URL}, "requires a PublicKey"},
+		{"http", BundleConfig{Source: httpServer.URL, PublicKey: key.public}, ""},
+		{"http unsigned", BundleConfig{Source: unsignedHTTPServer.URL, PublicKey: key.public}, "signature"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			source, err := test.config.Build()
+
+			if test.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				source.Shutdown()
+				return
+			}
+
+			if err == nil {
+				source.Shutdown()
+				t.Fatalf("expected error")
+			}
+
+			if !strings.Contains(err.Error(), test.err) {
+				t.Errorf("err is %s; want %s", err, test.err)
+			}
+		})
+	}
+}
+
+func TestEngineReloadBundle(t *testing.T) {
+
+	key := newTestBundleKey(t)
+
+	engine, err := (&Config{Bundle: &BundleConfig{
+		Source:    writeTestBundle(t, newTestBundle(t, "r1", key.private, "RS256", "default", false)),
+		PublicKey: key.public,
+	}}).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engine.Shutdown()
+
+	tests := []struct {
+		name     string
+		config   *BundleConfig
+		ok       bool
+		revision string
+	}{
+		{"tampered", &BundleConfig{Source: writeTestBundle(t, newTestBundle(t, "r2", key.private, "RS256", "default", true)), PublicKey: key.public}, false, "r1"},
+		{"http without key", &BundleConfig{Source: "http://bundle.example.com/bundle.tar.gz"}, false, "r1"},
+		{"signed", &BundleConfig{Source: writeTestBundle(t, newTestBundle(t, "r2", key.private, "RS256", "default", false)), PublicKey: key.public}, true, "r2"},
+		{"removed", nil, false, "r2"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			err := engine.Reload(&Config{Bundle: test.config})
+			if (err == nil) != test.ok {
+				t.Errorf("err is %v; want ok %t", err, test.ok)
+			}
+
+			if engine.BundleRevision() != test.revision {
+				t.Errorf("revision is %s; want %s", engine.BundleRevision(), test.revision)
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+/*
+Copyright © 2020 Jody Scott <jody@thescottsweb.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package engine
+
+import (
+	"context"
+	"crypto/x509"
+)
+
+type contextKey int
+
+const clientCertificateKey contextKey = iota
+
+// ClientCertificate is the verified TLS client certificate of the peer. It is
+// provided to the policy as input.certificate.
+type ClientCertificate struct {
+	Subject        string   `json:"subject,omitempty" yaml:"subject,omitempty"`
+	CommonName     string   `json:"commonName,omitempty" yaml:"commonName,omitempty"`
+	Issuer         string   `json:"issuer,omitempty" yaml:"issuer,omitempty"`
+	SerialNumber   string   `json:"serialNumber,omitempty" yaml:"serialNumber,omitempty"`
+	DNSNames       []string `json:"dnsNames,omitempty" yaml:"dnsNames,omitempty"`
+	EmailAddresses []string `json:"emailAddresses,omitempty" yaml:"emailAddresses,omitempty"`
+	IPAddresses    []string `json:"ipAddresses,omitempty" yaml:"ipAddresses,omitempty"`
+	URIs           []string `json:"uris,omitempty" yaml:"uris,omitempty"`
+	SPIFFEID       string   `json:"spiffeId,omitempty" yaml:"spiffeId,omitempty"`
+	NotAfter       int64    `json:"notAfter,omitempty" yaml:"notAfter,omitempty"`
+}
+
+// NewClientCertificate returns the ClientCertificate for cert. The caller is
+// responsible for verifying cert.
+func NewClientCertificate(cert *x509.Certificate) *ClientCertificate {
+
+	t := &ClientCertificate{
+		Subject:        cert.Subject.String(),
+		CommonName:     cert.Subject.CommonName,
+		Issuer:         cert.Issuer.String(),
+		SerialNumber:   cert.SerialNumber.String(),
+		DNSNames:       cert.DNSNames,
+		EmailAddresses: cert.EmailAddresses,
+		NotAfter:       cert.NotAfter.Unix(),
+	}
+
+	for _, ip := range cert.IPAddresses {
+		t.IPAddresses = append(t.IPAddresses, ip.String())
+	}
+
+	for _, uri := range cert.URIs {
+		t.URIs = append(t.URIs, uri.String())
+		// A SPIFFE SVID has exactly one URI SAN with the scheme spiffe
+		if uri.Scheme == "spiffe" && t.SPIFFEID == "" {
+			t.SPIFFEID = uri.String()
+		}
+	}
+
+	return t
+}
+
+// WithClientCertificate returns a copy of ctx that carries cert. The Engine
+// adds the certificate to the policy input of requests made with the
+// returned context.
+func WithClientCertificate(ctx context.Context, cert *ClientCertificate) context.Context {
+	if cert == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, clientCertificateKey, cert)
+}
+
+// ClientCertificateFromContext returns the ClientCertificate in ctx or nil
+func ClientCertificateFromContext(ctx context.Context) *ClientCertificate {
+	cert, _ := ctx.Value(clientCertificateKey).(*ClientCertificate)
+	return cert
+}
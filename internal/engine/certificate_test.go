@@ -0,0 +1,164 @@
+/*
+Copyright © 2020 Jody Scott <jody@thescottsweb.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package engine
+
+import (
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jodydadescott/libtokenmachine"
+)
+
+func mustParseURL(t *testing.T, value string) *url.URL {
+	u, err := url.Parse(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func TestNewClientCertificate(t *testing.T) {
+
+	notAfter := time.Unix(1700000000, 0)
+
+	base := func() *x509.Certificate {
+		return &x509.Certificate{
+			Subject:      pkix.Name{CommonName: "web", Organization: []string{"example"}},
+			Issuer:       pkix.Name{CommonName: "ca"},
+			SerialNumber: big.NewInt(42),
+			NotAfter:     notAfter,
+		}
+	}
+
+	tests := []struct {
+		name     string
+		modify   func(cert *x509.Certificate)
+		expected *ClientCertificate
+	}{
+		{
+			name:     "subject only",
+			modify:   func(cert *x509.Certificate) {},
+			expected: &ClientCertificate{Subject: "CN=web,O=example", CommonName: "web", Issuer: "CN=ca", SerialNumber: "42", NotAfter: notAfter.Unix()},
+		},
+		{
+			name: "sans",
+			modify: func(cert *x509.Certificate) {
+				cert.DNSNames = []string{"web.example.com"}
+				cert.EmailAddresses = []string{"web@example.com"}
+				cert.IPAddresses = []net.IP{net.ParseIP("10.0.0.1")}
+			},
+			expected: &ClientCertificate{Subject: "CN=web,O=example", CommonName: "web", Issuer: "CN=ca", SerialNumber: "42", NotAfter: notAfter.Unix(),
+				DNSNames: []string{"web.example.com"}, EmailAddresses: []string{"web@example.com"}, IPAddresses: []string{"10.0.0.1"}},
+		},
+		{
+			name: "spiffe",
+			modify: func(cert *x509.Certificate) {
+				cert.URIs = []*url.URL{mustParseURL(t, "https://example.com/web"), mustParseURL(t, "spiffe://example.com/web")}
+			},
+			expected: &ClientCertificate{Subject: "CN=web,O=example", CommonName: "web", Issuer: "CN=ca", SerialNumber: "42", NotAfter: notAfter.Unix(),
+				URIs: []string{"https://example.com/web", "spiffe://example.com/web"}, SPIFFEID: "spiffe://example.com/web"},
+		},
+		{
+			name: "first spiffe uri",
+			modify: func(cert *x509.Certificate) {
+				cert.URIs = []*url.URL{mustParseURL(t, "spiffe://example.com/a"), mustParseURL(t, "spiffe://example.com/b")}
+			},
+			expected: &ClientCertificate{Subject: "CN=web,O=example", CommonName: "web", Issuer: "CN=ca", SerialNumber: "42", NotAfter: notAfter.Unix(),
+				URIs: []string{"spiffe://example.com/a", "spiffe://example.com/b"}, SPIFFEID: "spiffe://example.com/a"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			cert := base()
+			test.modify(cert)
+
+			if actual := NewClientCertificate(cert); !reflect.DeepEqual(actual, test.expected) {
+				t.Errorf("certificate is %+v; want %+v", actual, test.expected)
+			}
+		})
+	}
+}
+
+func TestClientCertificateContext(t *testing.T) {
+
+	cert := &ClientCertificate{CommonName: "web"}
+
+	tests := []struct {
+		name     string
+		cert     *ClientCertificate
+		expected *ClientCertificate
+	}{
+		{"certificate", cert, cert},
+		{"no certificate", nil, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := WithClientCertificate(context.Background(), test.cert)
+			if actual := ClientCertificateFromContext(ctx); actual != test.expected {
+				t.Errorf("certificate is %v; want %v", actual, test.expected)
+			}
+		})
+	}
+}
+
+const certificatePolicy = `
+package main
+
+default auth_get_nonce = false
+default auth_get_keytab = false
+default auth_get_secret = false
+
+auth_get_nonce {
+   input.certificate.spiffeId == "spiffe://example.com/web"
+}
+`
+
+func TestClientCertificateInput(t *testing.T) {
+
+	engine := newTestEngine(t, certificatePolicy, true)
+	token := &libtokenmachine.Token{Iss: "https://issuer", Claims: map[string]interface{}{"sub": "bob"}}
+
+	tests := []struct {
+		name string
+		cert *ClientCertificate
+		err  error
+	}{
+		{"spiffe id", &ClientCertificate{SPIFFEID: "spiffe://example.com/web"}, nil},
+		{"other spiffe id", &ClientCertificate{SPIFFEID: "spiffe://example.com/other"}, libtokenmachine.ErrDenied},
+		{"no certificate", nil, libtokenmachine.ErrDenied},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := engine.newNonce(WithClientCertificate(context.Background(), test.cert), token)
+			if !errors.Is(err, test.err) {
+				t.Errorf("err is %v; want %v", err, test.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+/*
+Copyright © 2020 Jody Scott <jody@thescottsweb.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package engine
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DataDocument is a document provided to the policy under data at Path. Path
+// is dot separated such as entitlements.keytabs. If Path is empty Value must
+// be an object and its members are provided at the root of data.
+type DataDocument struct {
+	Path  string
+	Value interface{}
+}
+
+// mergeData returns the data with documents merged in. Objects are merged
+// member by member; any other value that is already set is a conflict. The
+// data is not modified.
+func mergeData(data map[string]interface{}, documents []*DataDocument) (map[string]interface{}, error) {
+
+	var result interface{} = map[string]interface{}{}
+	if data != nil {
+		result = data
+	}
+
+	for _, document := range documents {
+
+		value := document.Value
+
+		if document.Path == "" {
+			if _, ok := value.(map[string]interface{}); !ok {
+				return nil, fmt.Errorf("Data document without a path must be an object")
+			}
+		} else {
+			keys := strings.Split(document.Path, ".")
+			for i := len(keys) - 1; i >= 0; i-- {
+				if keys[i] == "" {
+					return nil, fmt.Errorf("Data document path %s is not valid", document.Path)
+				}
+				value = map[string]interface{}{keys[i]: value}
+			}
+		}
+
+		var err error
+		result, err = mergeValue(document.Path, result, value)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return result.(map[string]interface{}), nil
+}
+
+func mergeValue(path string, a, b interface{}) (interface{}, error) {
+
+	objectA, okA := a.(map[string]interface{})
+	objectB, okB := b.(map[string]interface{})
+
+	if !okA || !okB {
+		return nil, fmt.Errorf("Data document %s conflicts with existing data", path)
+	}
+
+	result := make(map[string]interface{}, len(objectA)+len(objectB))
+	for k, v := range objectA {
+		result[k] = v
+	}
+
+	for k, v := range objectB {
+
+		existing, exist := result[k]
+		if !exist {
+			result[k] = v
+			continue
+		}
+
+		merged, err := mergeValue(path, existing, v)
+		if err != nil {
+			return nil, err
+		}
+		result[k] = merged
+	}
+
+	return result, nil
+}
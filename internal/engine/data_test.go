@@ -0,0 +1,191 @@
+/*
+Copyright © 2020 Jody Scott <jody@thescottsweb.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package engine
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/jodydadescott/libtokenmachine"
+)
+
+func TestMergeData(t *testing.T) {
+
+	tests := []struct {
+		name      string
+		data      map[string]interface{}
+		documents []*DataDocument
+		expected  map[string]interface{}
+		err       string
+	}{
+		{
+			name:     "nothing",
+			expected: map[string]interface{}{},
+		},
+		{
+			name:      "path",
+			documents: []*DataDocument{{Path: "entitlements.keytabs", Value: []interface{}{"user1"}}},
+			expected:  map[string]interface{}{"entitlements": map[string]interface{}{"keytabs": []interface{}{"user1"}}},
+		},
+		{
+			name:      "root",
+			documents: []*DataDocument{{Value: map[string]interface{}{"users": "bob"}}},
+			expected:  map[string]interface{}{"users": "bob"},
+		},
+		{
+			name: "merged with bundle data",
+			data: map[string]interface{}{"entitlements": map[string]interface{}{"secrets": "db"}},
+			documents: []*DataDocument{
+				{Path: "entitlements.keytabs", Value: "user1"},
+				{Path: "teams", Value: "ops"},
+			},
+			expected: map[string]interface{}{
+				"entitlements": map[string]interface{}{"secrets": "db", "keytabs": "user1"},
+				"teams":        "ops",
+			},
+		},
+		{
+			name: "objects merged member by member",
+			documents: []*DataDocument{
+				{Path: "a", Value: map[string]interface{}{"b": 1}},
+				{Path: "a", Value: map[string]interface{}{"c": 2}},
+			},
+			expected: map[string]interface{}{"a": map[string]interface{}{"b": 1, "c": 2}},
+		},
+		{
+			name: "conflict",
+			documents: []*DataDocument{
+				{Path: "a.b", Value: 1},
+				{Path: "a.b", Value: 2},
+			},
+			err: "conflicts",
+		},
+		{
+			name:      "conflict with bundle data",
+			data:      map[string]interface{}{"a": "bundle"},
+			documents: []*DataDocument{{Path: "a.b", Value: 1}},
+			err:       "conflicts",
+		},
+		{
+			name:      "root not an object",
+			documents: []*DataDocument{{Value: []interface{}{1}}},
+			err:       "must be an object",
+		},
+		{
+			name:      "empty path element",
+			documents: []*DataDocument{{Path: "a..b", Value: 1}},
+			err:       "not valid",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			var before map[string]interface{}
+			if test.data != nil {
+				before = map[string]interface{}{}
+				for k, v := range test.data {
+					before[k] = v
+				}
+			}
+
+			result, err := mergeData(test.data, test.documents)
+
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("err is %v; want %s", err, test.err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(result, test.expected) {
+				t.Errorf("data is %v; want %v", result, test.expected)
+			}
+
+			if test.data != nil && !reflect.DeepEqual(test.data, before) {
+				t.Errorf("data was modified")
+			}
+		})
+	}
+}
+
+const dataPolicy = `
+package main
+
+default auth_get_nonce = false
+default auth_get_keytab = false
+default auth_get_secret = false
+
+auth_get_nonce {
+   data.users[_] == input.claims.sub
+}
+
+auth_get_secret {
+   data.entitlements[input.claims.sub][_] == input.name
+}
+`
+
+func TestPolicyData(t *testing.T) {
+
+	policy, err := (&PolicyConfig{
+		Policy: dataPolicy,
+		Data: []*DataDocument{
+			{Path: "users", Value: []interface{}{"bob"}},
+			{Path: "entitlements", Value: map[string]interface{}{"bob": []interface{}{"db"}}},
+		},
+	}).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		rule  string
+		input *Input
+		err   error
+	}{
+		{"user", RuleGetNonce, &Input{Claims: map[string]interface{}{"sub": "bob"}}, nil},
+		{"not a user", RuleGetNonce, &Input{Claims: map[string]interface{}{"sub": "alice"}}, libtokenmachine.ErrDenied},
+		{"entitled", RuleGetSecret, &Input{Claims: map[string]interface{}{"sub": "bob"}, Name: "db"}, nil},
+		{"not entitled", RuleGetSecret, &Input{Claims: map[string]interface{}{"sub": "bob"}, Name: "other"}, libtokenmachine.ErrDenied},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := policy.Eval(context.Background(), test.rule, test.input)
+			if !errors.Is(err, test.err) {
+				t.Errorf("err is %v; want %v", err, test.err)
+			}
+		})
+	}
+
+	// Data may not replace the policy
+	_, err = (&PolicyConfig{
+		Policy: dataPolicy,
+		Data:   []*DataDocument{{Path: "main.auth_get_nonce", Value: true}},
+	}).Build()
+	if err == nil {
+		t.Errorf("expected error for data under %s", policyPackage)
+	}
+}
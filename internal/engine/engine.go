@@ -0,0 +1,772 @@
+/*
+Copyright © 2020 Jody Scott <jody@thescottsweb.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package engine implements the TokenMachine server. It authorizes requests
+// for nonces, shared secrets and keytabs with the Rego policy and implements
+// the libtokenmachine.LibTokenMachine interface.
+package engine
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jodydadescott/libtokenmachine"
+	"github.com/open-policy-agent/opa/bundle"
+	"go.uber.org/zap"
+)
+
+// Observer receives instrumentation events from the Engine. Implementations
+// must be safe for concurrent use.
+type Observer interface {
+	ObservePolicyEvaluation(rule string, duration time.Duration)
+}
+
+// Config ...
+type Config struct {
+	Policy                   string                          // OPA/Rego policy that will be used to authorize request
+	PolicyModules            map[string]string               // Optional additional OPA/Rego modules by file name
+	Bundle                   *BundleConfig                   // Optional OPA bundle with policy modules and data
+	PolicyData               []*DataDocument                 // Optional documents provided to the policy as data
+	NonceLifetime            time.Duration                   // Lifetime of Nonce (default is 1 minute)
+	NonceKey                 string                          // Optional cluster key for stateless nonces
+	SingleUseNonce           bool                            // Nonces and tokens may only be used once
+	ReplayCacheSize          int                             // Max used nonces and tokens remembered (default is 100000)
+	DisableNonceSubjectCheck bool                            // Allow nonces in tokens of a different subject than the nonce was issued to
+	NonceChallenge           bool                            // Answer tokens without a nonce with a NonceRequiredError
+	Issuers                  []*Issuer                       // Optional trusted issuers; if set tokens from other issuers are rejected
+	SecretSecrets            []*libtokenmachine.SharedSecret // Secrets that will be served
+	KeytabKeytabs            []*libtokenmachine.Keytab       // Keytabs that will be served
+	KeytabLifetime           time.Duration                   // Default lifetime
+	SharedSecretLifetime     time.Duration                   // Default lifetime
+	Observer                 Observer                        // Optional
+}
+
+// Engine ...
+type Engine struct {
+	mutex     sync.RWMutex
+	observer  Observer
+	publickey *PublicKeyCache
+	token     *TokenCache
+	keytab    *KeytabCache
+	nonce     *NonceCache
+	replay    *ReplayCache
+	trust     *TrustStore
+	secret    *SecretCache
+	policy    *PolicyEngine
+	bundle    *BundleSource
+
+	policyConfig             *PolicyConfig
+	singleUseNonce           bool
+	disableNonceSubjectCheck bool
+	nonceChallenge           bool
+}
+
+// Build Returns a new Engine
+func (config *Config) Build() (*Engine, error) {
+
+	zap.L().Debug("Starting")
+
+	err := config.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	bundleSource, err := config.Bundle.Build()
+	if err != nil {
+		return nil, err
+	}
+
+	policyConfig := &PolicyConfig{
+		Policy:   config.Policy,
+		Modules:  config.PolicyModules,
+		Bundle:   bundleSource.Bundle(),
+		Data:     config.PolicyData,
+		Observer: config.Observer,
+	}
+
+	policy, err := policyConfig.Build()
+	if err != nil {
+		bundleSource.Shutdown()
+		return nil, err
+	}
+
+	secret, err := (&SecretConfig{
+		Secrets:  config.SecretSecrets,
+		Lifetime: config.SharedSecretLifetime,
+	}).Build()
+	if err != nil {
+		bundleSource.Shutdown()
+		return nil, err
+	}
+
+	keytab, err := (&KeytabConfig{
+		Keytabs:  config.KeytabKeytabs,
+		Lifetime: config.KeytabLifetime,
+	}).Build()
+	if err != nil {
+		bundleSource.Shutdown()
+		secret.Shutdown()
+		return nil, err
+	}
+
+	publickey, err := (&PublicKeyConfig{}).Build()
+	if err != nil {
+		bundleSource.Shutdown()
+		secret.Shutdown()
+		keytab.Shutdown()
+		return nil, err
+	}
+
+	trust, err := (&TrustConfig{
+		Issuers: config.Issuers,
+	}).Build()
+	if err != nil {
+		bundleSource.Shutdown()
+		secret.Shutdown()
+		keytab.Shutdown()
+		publickey.Shutdown()
+		return nil, err
+	}
+
+	token, err := (&TokenConfig{
+		Trust: trust,
+	}).Build(publickey)
+	if err != nil {
+		bundleSource.Shutdown()
+		secret.Shutdown()
+		keytab.Shutdown()
+		publickey.Shutdown()
+		trust.Shutdown()
+		return nil, err
+	}
+
+	nonce, err := (&NonceConfig{
+		Lifetime: config.NonceLifetime,
+		Key:      config.NonceKey,
+	}).Build()
+	if err != nil {
+		bundleSource.Shutdown()
+		secret.Shutdown()
+		keytab.Shutdown()
+		token.Shutdown()
+		publickey.Shutdown()
+		trust.Shutdown()
+		return nil, err
+	}
+
+	replay, err := (&ReplayConfig{
+		Size: config.ReplayCacheSize,
+	}).Build()
+	if err != nil {
+		bundleSource.Shutdown()
+		secret.Shutdown()
+		keytab.Shutdown()
+		nonce.Shutdown()
+		token.Shutdown()
+		publickey.Shutdown()
+		trust.Shutdown()
+		return nil, err
+	}
+
+	t := &Engine{
+		observer:                 config.Observer,
+		publickey:                publickey,
+		token:                    token,
+		keytab:                   keytab,
+		nonce:                    nonce,
+		replay:                   replay,
+		trust:                    trust,
+		secret:                   secret,
+		policy:                   policy,
+		bundle:                   bundleSource,
+		policyConfig:             policyConfig,
+		singleUseNonce:           config.SingleUseNonce,
+		disableNonceSubjectCheck: config.DisableNonceSubjectCheck,
+		nonceChallenge:           config.NonceChallenge,
+	}
+
+	t.startBundle(bundleSource)
+
+	return t, nil
+}
+
+// validate checks the settings that depend on each other
+func (config *Config) validate() error {
+
+	// Used nonces are recorded per instance but stateless nonces are accepted
+	// by every instance with the key so a nonce could be used once on each
+	if config.SingleUseNonce && config.NonceKey != "" {
+		return fmt.Errorf("SingleUseNonce can not be used with NonceKey; used nonces are recorded per instance and stateless nonces are accepted by every instance")
+	}
+
+	return nil
+}
+
+// Shutdown shutdown
+func (t *Engine) Shutdown() {
+	zap.L().Debug("Stopping")
+	t.bundle.Shutdown()
+	t.secret.Shutdown()
+	t.keytab.Shutdown()
+	t.nonce.Shutdown()
+	t.replay.Shutdown()
+	t.token.Shutdown()
+	t.publickey.Shutdown()
+	t.trust.Shutdown()
+}
+
+// Reload replaces the policy, secrets, keytabs and lifetimes with those in
+// config. Everything is validated before anything is changed; if an error is
+// returned the existing configuration remains in use. Outstanding nonces
+// remain valid. The Observer in config is ignored.
+func (t *Engine) Reload(config *Config) error {
+
+	zap.L().Debug("Reloading")
+
+	err := config.validate()
+	if err != nil {
+		return err
+	}
+
+	bundleSource, err := config.Bundle.Build()
+	if err != nil {
+		return err
+	}
+
+	policyConfig := &PolicyConfig{
+		Policy:   config.Policy,
+		Modules:  config.PolicyModules,
+		Bundle:   bundleSource.Bundle(),
+		Data:     config.PolicyData,
+		Observer: t.observer,
+	}
+
+	policy, err := policyConfig.Build()
+	if err != nil {
+		bundleSource.Shutdown()
+		return err
+	}
+
+	secret, err := (&SecretConfig{
+		Secrets:  config.SecretSecrets,
+		Lifetime: config.SharedSecretLifetime,
+	}).Build()
+	if err != nil {
+		bundleSource.Shutdown()
+		return err
+	}
+
+	err = validateNonceKey(config.NonceKey)
+	if err != nil {
+		bundleSource.Shutdown()
+		secret.Shutdown()
+		return err
+	}
+
+	t.mutex.RLock()
+	currentTrust := t.trust
+	t.mutex.RUnlock()
+
+	// Issuers that have not changed keep their keys rather than fetching
+	// the JWKS again
+	trust, err := (&TrustConfig{
+		Issuers: config.Issuers,
+	}).rebuild(currentTrust)
+	if err != nil {
+		bundleSource.Shutdown()
+		secret.Shutdown()
+		return err
+	}
+
+	// Requests hold the read lock for their duration so they see either the
+	// old or the new configuration but never a mix
+	t.mutex.Lock()
+
+	err = t.keytab.Load(config.KeytabKeytabs, config.KeytabLifetime)
+	if err != nil {
+		t.mutex.Unlock()
+		bundleSource.Shutdown()
+		secret.Shutdown()
+		trust.shutdownUnused(t.trust)
+		return err
+	}
+
+	t.secret.Shutdown()
+	t.trust.shutdownUnused(trust)
+
+	previousBundle := t.bundle
+
+	t.policy = policy
+	t.policyConfig = policyConfig
+	t.bundle = bundleSource
+	t.secret = secret
+	t.trust = trust
+	t.token.SetTrust(trust)
+	t.nonce.SetLifetime(config.NonceLifetime)
+	t.nonce.SetKey(config.NonceKey)
+	t.replay.SetSize(config.ReplayCacheSize)
+	t.singleUseNonce = config.SingleUseNonce
+	t.disableNonceSubjectCheck = config.DisableNonceSubjectCheck
+	t.nonceChallenge = config.NonceChallenge
+
+	t.mutex.Unlock()
+
+	// The previous bundle may be waiting for the lock in setBundle so it is
+	// stopped after the lock is released
+	previousBundle.Shutdown()
+	t.startBundle(bundleSource)
+
+	zap.L().Debug("Reloaded")
+	return nil
+}
+
+// BundleRevision returns the revision of the active bundle or an empty string
+// if there is no bundle
+func (t *Engine) BundleRevision() string {
+
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	if t.policyConfig.Bundle == nil {
+		return ""
+	}
+
+	return t.policyConfig.Bundle.Manifest.Revision
+}
+
+// startBundle polls source for new revisions of the bundle
+func (t *Engine) startBundle(source *BundleSource) {
+	source.Start(func(b *bundle.Bundle) error {
+		return t.setBundle(source, b)
+	})
+}
+
+// setBundle compiles the policy with the new revision b of the bundle from
+// source and replaces the policy if it is valid
+func (t *Engine) setBundle(source *BundleSource, b *bundle.Bundle) error {
+
+	t.mutex.RLock()
+	policyConfig := *t.policyConfig
+	t.mutex.RUnlock()
+
+	policyConfig.Bundle = b
+
+	policy, err := policyConfig.Build()
+	if err != nil {
+		return err
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	// The bundle was replaced by a reload
+	if t.bundle != source {
+		return nil
+	}
+
+	t.policy = policy
+	t.policyConfig = &policyConfig
+	return nil
+}
+
+// GetNonce returns Nonce if provided token is authorized
+func (t *Engine) GetNonce(ctx context.Context, tokenString string) (*libtokenmachine.Nonce, error) {
+
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	token, err := t.token.ParseToken(tokenString)
+	if err != nil {
+		zap.L().Debug(fmt.Sprintf("GetNonce()->%s", "Error:"+err.Error()))
+		return nil, err
+	}
+
+	nonce, err := t.newNonce(ctx, token)
+	if err != nil {
+		zap.L().Debug(fmt.Sprintf("GetNonce()->%s", "Error:"+err.Error()))
+		return nil, err
+	}
+
+	zap.L().Debug(fmt.Sprintf("GetNonce()->%s", "Granted"))
+	return nonce, nil
+}
+
+// newNonce returns a new nonce bound to the subject of token if the token is
+// allowed to get a nonce. Unless the subject check is disabled the token must
+// have a sub.
+func (t *Engine) newNonce(ctx context.Context, token *libtokenmachine.Token) (*libtokenmachine.Nonce, error) {
+
+	// Validate that token is allowed to pull nonce
+	err := t.policy.Eval(ctx, RuleGetNonce, nonceInput(ctx, token))
+	if err != nil {
+		return nil, err
+	}
+
+	sub, _ := token.Claims["sub"].(string)
+
+	if sub == "" && !t.disableNonceSubjectCheck {
+		zap.L().Debug(fmt.Sprintf("Token from iss=%s has no sub to bind the nonce to", token.Iss))
+		return nil, ErrNonceSubjectRequired
+	}
+
+	return t.nonce.NewNonce(token.Iss, sub)
+}
+
+// challenge returns a NonceRequiredError with a new nonce if nonce challenges
+// are enabled and the token is allowed to get a nonce, otherwise nil
+func (t *Engine) challenge(ctx context.Context, token *libtokenmachine.Token) error {
+
+	if !t.nonceChallenge {
+		return nil
+	}
+
+	nonce, err := t.newNonce(ctx, token)
+	if err != nil {
+		// The request is evaluated as usual
+		return nil
+	}
+
+	return &NonceRequiredError{Nonce: nonce}
+}
+
+// nonceInput returns the policy input for a nonce request
+func nonceInput(ctx context.Context, token *libtokenmachine.Token) *Input {
+	return &Input{
+		Claims:      token.Claims,
+		Certificate: ClientCertificateFromContext(ctx),
+	}
+}
+
+// entityInput returns the policy input for a keytab or secret request
+func entityInput(ctx context.Context, nonces *NonceCache, token *libtokenmachine.Token, name string, nonce *NonceInfo) *Input {
+	return &Input{
+		Claims:      token.Claims,
+		Nonces:      nonces.GetValidNonceValues(GetAudiences(token.Claims)),
+		Name:        name,
+		Nonce:       nonce,
+		Certificate: ClientCertificateFromContext(ctx),
+	}
+}
+
+// GetKeytab returns Keytab if provided token is authorized
+func (t *Engine) GetKeytab(ctx context.Context, tokenString, name string) (*libtokenmachine.Keytab, error) {
+
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	token, err := t.token.ParseToken(tokenString)
+	if err != nil {
+		zap.L().Debug(fmt.Sprintf("GetKeytab(name=%s)->%s", name, "Error:"+err.Error()))
+		return nil, err
+	}
+
+	nonce, err := t.getNonceInfo(token)
+	if err != nil {
+		zap.L().Debug(fmt.Sprintf("GetKeytab(name=%s)->%s", name, "Error:"+err.Error()))
+		return nil, err
+	}
+
+	if nonce == nil {
+		err = t.challenge(ctx, token)
+		if err != nil {
+			zap.L().Debug(fmt.Sprintf("GetKeytab(name=%s)->%s", name, "Error:"+err.Error()))
+			return nil, err
+		}
+	}
+
+	err = t.policy.Eval(ctx, RuleGetKeytab, entityInput(ctx, t.nonce, token, name, nonce))
+	if err != nil {
+		zap.L().Debug(fmt.Sprintf("GetKeytab(name=%s)->%s", name, "Error:"+err.Error()))
+		return nil, err
+	}
+
+	keytab, err := t.keytab.GetKeytab(name)
+	if err != nil {
+		zap.L().Debug(fmt.Sprintf("GetKeytab(name=%s)->%s", name, "Error:"+err.Error()))
+		return nil, err
+	}
+
+	err = t.useNonce(token)
+	if err != nil {
+		zap.L().Debug(fmt.Sprintf("GetKeytab(name=%s)->%s", name, "Error:"+err.Error()))
+		return nil, err
+	}
+
+	zap.L().Debug(fmt.Sprintf("GetKeytab(name=%s)->%s", name, "Granted"))
+	return keytab, nil
+}
+
+// GetSecret returns Secret if provided token is authorized
+func (t *Engine) GetSecret(ctx context.Context, tokenString, name string) (*libtokenmachine.SharedSecret, error) {
+
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	token, err := t.token.ParseToken(tokenString)
+	if err != nil {
+		zap.L().Debug(fmt.Sprintf("GetSecret(name=%s)->%s", name, "Error:"+err.Error()))
+		return nil, err
+	}
+
+	nonce, err := t.getNonceInfo(token)
+	if err != nil {
+		zap.L().Debug(fmt.Sprintf("GetSecret(name=%s)->%s", name, "Error:"+err.Error()))
+		return nil, err
+	}
+
+	if nonce == nil {
+		err = t.challenge(ctx, token)
+		if err != nil {
+			zap.L().Debug(fmt.Sprintf("GetSecret(name=%s)->%s", name, "Error:"+err.Error()))
+			return nil, err
+		}
+	}
+
+	err = t.policy.Eval(ctx, RuleGetSecret, entityInput(ctx, t.nonce, token, name, nonce))
+	if err != nil {
+		zap.L().Debug(fmt.Sprintf("GetSecret(name=%s)->%s", name, "Error:"+err.Error()))
+		return nil, err
+	}
+
+	secret, err := t.secret.GetSecret(name)
+	if err != nil {
+		zap.L().Debug(fmt.Sprintf("GetSecret(name=%s)->%s", name, "Error:"+err.Error()))
+		return nil, err
+	}
+
+	err = t.useNonce(token)
+	if err != nil {
+		zap.L().Debug(fmt.Sprintf("GetSecret(name=%s)->%s", name, "Error:"+err.Error()))
+		return nil, err
+	}
+
+	zap.L().Debug(fmt.Sprintf("GetSecret(name=%s)->%s", name, "Granted"))
+	return secret, nil
+}
+
+// getNonceInfo returns the NonceInfo of the first valid nonce in token or nil
+// if there is none. The audiences are checked first followed by the other
+// claims. Unless the subject check is disabled ErrNonceSubjectMismatch is
+// returned if any nonce in token was issued to a different subject.
+func (t *Engine) getNonceInfo(token *libtokenmachine.Token) (*NonceInfo, error) {
+	return getNonceInfo(t.nonce, token, t.disableNonceSubjectCheck)
+}
+
+func getNonceInfo(nonces *NonceCache, token *libtokenmachine.Token, disableSubjectCheck bool) (*NonceInfo, error) {
+
+	sub, _ := token.Claims["sub"].(string)
+
+	var first *NonceInfo
+
+	for _, value := range append(GetAudiences(token.Claims), getClaimStrings(token.Claims)...) {
+
+		info := nonces.GetNonceInfo(value, token.Iss, sub)
+		if info == nil {
+			continue
+		}
+
+		if !info.SubjectMatch && !disableSubjectCheck {
+			zap.L().Debug(fmt.Sprintf("Nonce was issued to a different subject than iss=%s sub=%s", token.Iss, sub))
+			return nil, ErrNonceSubjectMismatch
+		}
+
+		if first == nil {
+			first = info
+		}
+	}
+
+	return first, nil
+}
+
+// useNonce records the nonces and id (jti) of token as used if single use
+// nonces are enabled. The nonce may be in any claim so each claim string that
+// is a valid nonce is recorded. Entries are kept until the nonce or token
+// expires, whichever is later.
+func (t *Engine) useNonce(token *libtokenmachine.Token) error {
+
+	if !t.singleUseNonce {
+		return nil
+	}
+
+	var keys []string
+	exp := token.Exp
+
+	for _, value := range getClaimStrings(token.Claims) {
+		nonceExp := t.nonce.GetExp(value)
+		if nonceExp == 0 {
+			continue
+		}
+		keys = append(keys, "nonce:"+value)
+		if nonceExp > exp {
+			exp = nonceExp
+		}
+	}
+
+	if jti, ok := token.Claims["jti"].(string); ok && jti != "" {
+		keys = append(keys, "jti:"+token.Iss+":"+jti)
+	}
+
+	if len(keys) == 0 {
+		zap.L().Debug("Token has no nonce or jti to record as used")
+		return nil
+	}
+
+	if exp == 0 {
+		exp = time.Now().Add(replayDefaultLifetime).Unix()
+	}
+
+	return t.replay.Use(keys, exp)
+}
+
+// getClaimStrings returns the top level string claims and the strings in top
+// level array claims
+func getClaimStrings(claims map[string]interface{}) []string {
+
+	var values []string
+
+	for _, claim := range claims {
+		switch v := claim.(type) {
+
+		case string:
+			values = append(values, v)
+
+		case []interface{}:
+			for _, e := range v {
+				if s, ok := e.(string); ok {
+					values = append(values, s)
+				}
+			}
+
+		}
+	}
+
+	return values
+}
+
+// GetAudiences returns the audiences in claims. The aud claim may be a string
+// or an array of strings.
+func GetAudiences(claims map[string]interface{}) []string {
+
+	switch aud := claims["aud"].(type) {
+
+	case string:
+		return []string{aud}
+
+	case []interface{}:
+		var audiences []string
+		for _, v := range aud {
+			if s, ok := v.(string); ok {
+				audiences = append(audiences, s)
+			}
+		}
+		return audiences
+
+	}
+
+	return nil
+}
+
+// Explain validates tokenString and explains the decision for action and the
+// entity name with the policy and nonces of the engine. See Explainer.Explain.
+// If the token is not valid the explanation holds the error. Input.Nonces only
+// holds the live nonces that are audiences of the token so that the nonces of
+// other clients are not revealed.
+func (t *Engine) Explain(ctx context.Context, tokenString, action, name, mode string) (*Explanation, error) {
+
+	rule, err := GetRule(action)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkExplainMode(mode)
+	if err != nil {
+		return nil, err
+	}
+
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	token, err := t.token.ParseToken(tokenString)
+	if err != nil {
+		return &Explanation{
+			Action: action,
+			Rule:   rule,
+			Name:   name,
+			Error:  err.Error(),
+		}, nil
+	}
+
+	// The nonces of other clients are not shown
+	explainer := t.explainer()
+	explainer.audienceNonces = true
+
+	return explainer.Explain(ctx, token, action, name, mode)
+}
+
+// ExplainClaims explains the decision for action and the entity name for a
+// token with claims. The claims are not validated so the nonces of the engine
+// are not used; a nonce in the claims is treated as unknown so that claims
+// can not be used to find live nonces.
+func (t *Engine) ExplainClaims(ctx context.Context, claims map[string]interface{}, action, name, mode string) (*Explanation, error) {
+
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	explainer := t.explainer()
+	explainer.nonce = &NonceCache{internal: make(map[string]*nonceEntry)}
+
+	return explainer.Explain(ctx, ClaimsToken(claims), action, name, mode)
+}
+
+func (t *Engine) explainer() *Explainer {
+	return &Explainer{
+		policy:                   t.policy,
+		nonce:                    t.nonce,
+		disableNonceSubjectCheck: t.disableNonceSubjectCheck,
+		nonceChallenge:           t.nonceChallenge,
+	}
+}
+
+// NonceCount returns the number of live nonces
+func (t *Engine) NonceCount() int {
+	return t.nonce.Count()
+}
+
+// TokenNonce returns the live nonce in token that a request with token would
+// be matched to or an empty string if there is none. The claims are searched
+// in the same order as authorization: the audiences followed by the other
+// claims.
+func (t *Engine) TokenNonce(token *libtokenmachine.Token) string {
+	info, _ := getNonceInfo(t.nonce, token, true)
+	if info == nil {
+		return ""
+	}
+	return info.Value
+}
+
+// SecretRotations returns the time of the next rotation for each secret
+func (t *Engine) SecretRotations() map[string]time.Time {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	return t.secret.Rotations()
+}
+
+// KeytabRotations returns the time of the next rotation for each keytab
+func (t *Engine) KeytabRotations() map[string]time.Time {
+	return t.keytab.Rotations()
+}
@@ -0,0 +1,429 @@
+/*
+Copyright © 2020 Jody Scott <jody@thescottsweb.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package engine
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/jodydadescott/libtokenmachine"
+)
+
+const allowNoncePolicy = `
+package main
+
+default auth_get_nonce = true
+default auth_get_keytab = false
+default auth_get_secret = false
+`
+
+// newTestEngine returns an Engine with policy and in memory nonces
+func newTestEngine(t *testing.T, policy string, disableSubjectCheck bool) *Engine {
+
+	policyEngine, err := (&PolicyConfig{Policy: policy}).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &Engine{
+		policy:                   policyEngine,
+		nonce:                    newTestNonceCache(t, ""),
+		disableNonceSubjectCheck: disableSubjectCheck,
+	}
+}
+
+func TestNewNonceSubject(t *testing.T) {
+
+	tests := []struct {
+		name                string
+		claims              map[string]interface{}
+		disableSubjectCheck bool
+		err                 error
+	}{
+		{"sub", map[string]interface{}{"sub": "bob"}, false, nil},
+		{"no sub", map[string]interface{}{}, false, ErrNonceSubjectRequired},
+		{"empty sub", map[string]interface{}{"sub": ""}, false, ErrNonceSubjectRequired},
+		{"sub not a string", map[string]interface{}{"sub": 1.0}, false, ErrNonceSubjectRequired},
+		{"no sub with check disabled", map[string]interface{}{}, true, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			engine := newTestEngine(t, allowNoncePolicy, test.disableSubjectCheck)
+			token := &libtokenmachine.Token{Iss: "https://issuer", Claims: test.claims}
+
+			nonce, err := engine.newNonce(context.Background(), token)
+			if err != test.err {
+				t.Fatalf("err is %v; want %v", err, test.err)
+			}
+
+			if err != nil {
+				if !errors.Is(err, libtokenmachine.ErrDenied) {
+					t.Errorf("err %s is not ErrDenied", err)
+				}
+				if engine.nonce.Count() != 0 {
+					t.Errorf("nonce was issued")
+				}
+				return
+			}
+
+			if !engine.nonce.Valid(nonce.Value) {
+				t.Errorf("nonce is not valid")
+			}
+		})
+	}
+}
+
+func TestGetNonceInfo(t *testing.T) {
+
+	nonces := newTestNonceCache(t, "")
+
+	bob, _ := nonces.NewNonce("https://issuer", "bob")
+	alice, _ := nonces.NewNonce("https://issuer", "alice")
+	other, _ := nonces.NewNonce("https://other", "bob")
+
+	token := func(sub string, aud interface{}) *libtokenmachine.Token {
+		return &libtokenmachine.Token{
+			Iss:    "https://issuer",
+			Claims: map[string]interface{}{"iss": "https://issuer", "sub": sub, "aud": aud},
+		}
+	}
+
+	tests := []struct {
+		name                string
+		token               *libtokenmachine.Token
+		disableSubjectCheck bool
+		nonce               string
+		err                 error
+	}{
+		{"match", token("bob", bob.Value), false, bob.Value, nil},
+		{"no nonce", token("bob", "api"), false, "", nil},
+		{"audience list", token("bob", []interface{}{"api", bob.Value}), false, bob.Value, nil},
+		{"other subject", token("bob", alice.Value), false, "", ErrNonceSubjectMismatch},
+		{"other issuer", token("bob", other.Value), false, "", ErrNonceSubjectMismatch},
+		{"one of two mismatch", token("bob", []interface{}{bob.Value, alice.Value}), false, "", ErrNonceSubjectMismatch},
+		{"no sub", token("", bob.Value), false, "", ErrNonceSubjectMismatch},
+		{"other subject with check disabled", token("bob", alice.Value), true, alice.Value, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			info, err := getNonceInfo(nonces, test.token, test.disableSubjectCheck)
+			if err != test.err {
+				t.Fatalf("err is %v; want %v", err, test.err)
+			}
+
+			if err != nil && !errors.Is(err, libtokenmachine.ErrDenied) {
+				t.Errorf("err %s is not ErrDenied", err)
+			}
+
+			value := ""
+			if info != nil {
+				value = info.Value
+			}
+
+			if value != test.nonce {
+				t.Errorf("nonce is %s; want %s", value, test.nonce)
+			}
+		})
+	}
+}
+
+func TestTokenNonce(t *testing.T) {
+
+	engine := newTestEngine(t, allowNoncePolicy, false)
+
+	bob, _ := engine.nonce.NewNonce("https://issuer", "bob")
+	alice, _ := engine.nonce.NewNonce("https://issuer", "alice")
+
+	tests := []struct {
+		name   string
+		claims map[string]interface{}
+		nonce  string
+	}{
+		{"audience", map[string]interface{}{"sub": "bob", "aud": []interface{}{"api", bob.Value}}, bob.Value},
+		{"other claim", map[string]interface{}{"sub": "bob", "aud": "api", "nonce": bob.Value}, bob.Value},
+		{"audience first", map[string]interface{}{"sub": "bob", "aud": bob.Value, "nonce": alice.Value}, bob.Value},
+		{"other subject", map[string]interface{}{"sub": "bob", "aud": alice.Value}, alice.Value},
+		{"no nonce", map[string]interface{}{"sub": "bob", "aud": "api", "nonce": "unknown"}, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			token := &libtokenmachine.Token{Iss: "https://issuer", Claims: test.claims}
+			if nonce := engine.TokenNonce(token); nonce != test.nonce {
+				t.Errorf("nonce is %s; want %s", nonce, test.nonce)
+			}
+		})
+	}
+}
+
+func TestExplainNonceSubject(t *testing.T) {
+
+	tests := []struct {
+		name                string
+		claims              map[string]interface{}
+		disableSubjectCheck bool
+		allow               bool
+		err                 string
+	}{
+		{"sub", map[string]interface{}{"sub": "bob"}, false, true, ""},
+		{"no sub", map[string]interface{}{}, false, false, ErrNonceSubjectRequired.Error()},
+		{"no sub with check disabled", map[string]interface{}{}, true, true, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			engine := newTestEngine(t, allowNoncePolicy, test.disableSubjectCheck)
+
+			explanation, err := engine.ExplainClaims(context.Background(), test.claims, ActionGetNonce, "", ExplainFails)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if explanation.Allow != test.allow || explanation.Error != test.err {
+				t.Errorf("explanation is allow=%t error=%s; want allow=%t error=%s", explanation.Allow, explanation.Error, test.allow, test.err)
+			}
+		})
+	}
+}
+
+const challengePolicy = `
+package main
+
+default auth_get_nonce = false
+default auth_get_keytab = false
+default auth_get_secret = false
+
+auth_get_nonce {
+   input.claims.sub != "nobody"
+}
+
+auth_get_secret {
+   input.nonce.subjectMatch
+   input.name == "db"
+}
+`
+
+// newClaimsToken returns a token with claims signed by key
+func newClaimsToken(t *testing.T, claims jwt.MapClaims, key *ecdsa.PrivateKey) string {
+
+	claims["iss"] = "https://issuer"
+	claims["exp"] = time.Now().Unix() + 60
+
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	token.Header["kid"] = "k1"
+
+	tokenString, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tokenString
+}
+
+func TestGetSecretChallenge(t *testing.T) {
+
+	privateKey, publicKey := generateKeypair(t, "https://issuer", "k1")
+
+	newEngine := func(t *testing.T, nonceChallenge bool) *Engine {
+
+		engine := newTestEngine(t, challengePolicy, false)
+		engine.nonceChallenge = nonceChallenge
+
+		var err error
+		engine.token, err = (&TokenConfig{}).Build(newTestPublicKeyCache(publicKey))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(engine.token.Shutdown)
+
+		engine.secret, err = (&SecretConfig{
+			Secrets: []*libtokenmachine.SharedSecret{{Name: "db", Seed: "seed"}},
+		}).Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(engine.secret.Shutdown)
+
+		return engine
+	}
+
+	tests := []struct {
+		name           string
+		nonceChallenge bool
+		sub            string
+		secret         string
+		challenge      bool
+		err            error
+	}{
+		{"challenge then grant", true, "bob", "db", true, nil},
+		{"challenge for an unknown secret", true, "bob", "other", true, libtokenmachine.ErrDenied},
+		{"challenges disabled", false, "bob", "db", false, libtokenmachine.ErrDenied},
+		{"nonce not allowed", true, "nobody", "db", false, libtokenmachine.ErrDenied},
+		{"no sub", true, "", "db", false, libtokenmachine.ErrDenied},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			engine := newEngine(t, test.nonceChallenge)
+
+			claims := jwt.MapClaims{}
+			if test.sub != "" {
+				claims["sub"] = test.sub
+			}
+
+			_, err := engine.GetSecret(context.Background(), newClaimsToken(t, claims, privateKey), test.secret)
+
+			var challenge *NonceRequiredError
+			if errors.As(err, &challenge) != test.challenge {
+				t.Fatalf("err is %v; want challenge %t", err, test.challenge)
+			}
+
+			if !test.challenge {
+				if !errors.Is(err, test.err) {
+					t.Errorf("err is %v; want %v", err, test.err)
+				}
+				return
+			}
+
+			// The request is repeated with the nonce of the challenge
+			claims = jwt.MapClaims{"sub": test.sub, "aud": challenge.Nonce.Value}
+			secret, err := engine.GetSecret(context.Background(), newClaimsToken(t, claims, privateKey), test.secret)
+
+			if !errors.Is(err, test.err) {
+				t.Fatalf("err is %v; want %v", err, test.err)
+			}
+
+			if err == nil && secret.Name != "db" {
+				t.Errorf("secret is %s", secret.Name)
+			}
+
+			// The nonce of another subject is not accepted
+			claims = jwt.MapClaims{"sub": "alice", "aud": challenge.Nonce.Value}
+			_, err = engine.GetSecret(context.Background(), newClaimsToken(t, claims, privateKey), test.secret)
+
+			if err != ErrNonceSubjectMismatch {
+				t.Errorf("err is %v; want %v", err, ErrNonceSubjectMismatch)
+			}
+		})
+	}
+}
+
+const nonceInputPolicy = `
+package main
+
+default auth_get_nonce = true
+default auth_get_keytab = false
+default auth_get_secret = false
+
+auth_get_secret {
+   input.nonce.subjectMatch
+}
+`
+
+func TestExplainClaimsNonces(t *testing.T) {
+
+	engine := newTestEngine(t, nonceInputPolicy, false)
+
+	nonce, err := engine.nonce.NewNonce("https://issuer", "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		aud  string
+	}{
+		{"live nonce", nonce.Value},
+		{"unknown nonce", "unknown"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			claims := map[string]interface{}{"iss": "https://issuer", "sub": "bob", "aud": test.aud}
+
+			// Claims are not validated so they can not be used to tell
+			// whether a value is a live nonce
+			explanation, err := engine.ExplainClaims(context.Background(), claims, ActionGetSecret, "db", ExplainFails)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if explanation.Allow || explanation.Input.Nonce != nil || len(explanation.Input.Nonces) > 0 {
+				t.Errorf("nonces of the engine were used; %s", explanation.JSON())
+			}
+		})
+	}
+
+	// The nonces of the engine are used for a validated token
+	explanation, err := engine.explainer().Explain(context.Background(), ClaimsToken(map[string]interface{}{"iss": "https://issuer", "sub": "bob", "aud": nonce.Value}), ActionGetSecret, "db", ExplainFails)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !explanation.Allow {
+		t.Errorf("live nonce was not used; %s", explanation.JSON())
+	}
+}
+
+func TestExplainNonces(t *testing.T) {
+
+	privateKey, publicKey := generateKeypair(t, "https://issuer", "k1")
+
+	engine := newTestEngine(t, nonceInputPolicy, false)
+
+	var err error
+	engine.token, err = (&TokenConfig{}).Build(newTestPublicKeyCache(publicKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(engine.token.Shutdown)
+
+	bob, _ := engine.nonce.NewNonce("https://issuer", "bob")
+	alice, _ := engine.nonce.NewNonce("https://issuer", "alice")
+
+	token := newClaimsToken(t, jwt.MapClaims{"sub": "bob", "aud": []string{"api", bob.Value}}, privateKey)
+
+	explanation, err := engine.Explain(context.Background(), token, ActionGetSecret, "db", ExplainFails)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !explanation.Allow {
+		t.Errorf("live nonce was not used; %s", explanation.JSON())
+	}
+
+	// The live nonce of another client is not revealed
+	if len(explanation.Input.Nonces) != 1 || explanation.Input.Nonces[0] != bob.Value {
+		t.Errorf("nonces are %v; want [%s]", explanation.Input.Nonces, bob.Value)
+	}
+
+	if strings.Contains(explanation.JSON(), alice.Value) {
+		t.Errorf("nonce of another client is in the explanation")
+	}
+}
@@ -0,0 +1,257 @@
+/*
+Copyright © 2020 Jody Scott <jody@thescottsweb.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package engine
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jodydadescott/libtokenmachine"
+	"github.com/open-policy-agent/opa/rego"
+	"github.com/open-policy-agent/opa/topdown"
+	"github.com/open-policy-agent/opa/topdown/lineage"
+)
+
+// Explain modes select the events of the evaluation that are in the trace
+const (
+	ExplainFails = "fails" // Expressions that failed and the rules they are in
+	ExplainNotes = "notes" // Calls to trace() in the policy
+	ExplainFull  = "full"  // Every event
+)
+
+// Explanation is a decision of the policy with the input it was evaluated with
+// and the trace of the evaluation. Error is set if the request would be
+// rejected before or while the policy is evaluated. NonceRequired is set if
+// the server would first answer with a nonce challenge.
+type Explanation struct {
+	Action        string   `json:"action" yaml:"action"`
+	Rule          string   `json:"rule" yaml:"rule"`
+	Name          string   `json:"name,omitempty" yaml:"name,omitempty"`
+	Allow         bool     `json:"allow" yaml:"allow"`
+	Error         string   `json:"error,omitempty" yaml:"error,omitempty"`
+	NonceRequired bool     `json:"nonceRequired,omitempty" yaml:"nonceRequired,omitempty"`
+	Input         *Input   `json:"input,omitempty" yaml:"input,omitempty"`
+	Trace         []string `json:"trace,omitempty" yaml:"trace,omitempty"`
+}
+
+// JSON Return JSON String representation
+func (t *Explanation) JSON() string {
+	j, _ := json.Marshal(t)
+	return string(j)
+}
+
+// ExplainConfig config
+type ExplainConfig struct {
+	Policy                   *PolicyConfig
+	NonceKey                 string   // Optional cluster key; stateless nonces in the token are valid
+	Nonces                   []string // Nonces treated as issued by the server to the subject of the token
+	DisableNonceSubjectCheck bool
+	NonceChallenge           bool
+}
+
+// Explainer explains the decisions of the policy. It evaluates the policy with
+// the same input as the server but does not issue or use nonces and does not
+// serve keytabs or secrets.
+type Explainer struct {
+	policy                   *PolicyEngine
+	nonce                    *NonceCache
+	nonces                   []string
+	disableNonceSubjectCheck bool
+	nonceChallenge           bool
+	audienceNonces           bool // Limit input.nonces to the audiences of the token
+}
+
+// Build Returns a new Explainer
+func (config *ExplainConfig) Build() (*Explainer, error) {
+
+	if config.Policy == nil {
+		return nil, fmt.Errorf("Policy is required")
+	}
+
+	policy, err := config.Policy.Build()
+	if err != nil {
+		return nil, err
+	}
+
+	nonce, err := (&NonceConfig{
+		Key: config.NonceKey,
+	}).Build()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Explainer{
+		policy:                   policy,
+		nonce:                    nonce,
+		nonces:                   config.Nonces,
+		disableNonceSubjectCheck: config.DisableNonceSubjectCheck,
+		nonceChallenge:           config.NonceChallenge,
+	}, nil
+}
+
+// Shutdown shutdown
+func (t *Explainer) Shutdown() {
+	t.nonce.Shutdown()
+}
+
+// Explain evaluates the rule of action for token and the entity name as the
+// server would and returns the decision with a trace selected by mode. The
+// token is not validated. An error is returned if action or mode is not
+// valid.
+func (t *Explainer) Explain(ctx context.Context, token *libtokenmachine.Token, action, name, mode string) (*Explanation, error) {
+
+	rule, err := GetRule(action)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkExplainMode(mode)
+	if err != nil {
+		return nil, err
+	}
+
+	explanation := &Explanation{
+		Action: action,
+		Rule:   rule,
+		Name:   name,
+	}
+
+	sub, _ := token.Claims["sub"].(string)
+	for _, value := range t.nonces {
+		t.nonce.put(value, token.Iss, sub)
+	}
+
+	// A nonce is not issued to a token without a sub (see newNonce)
+	subjectRequired := sub == "" && !t.disableNonceSubjectCheck
+
+	if rule == RuleGetNonce {
+		explanation.Input = nonceInput(ctx, token)
+		t.evaluate(ctx, explanation, mode)
+		if explanation.Allow && subjectRequired {
+			explanation.Allow = false
+			explanation.Error = ErrNonceSubjectRequired.Error()
+		}
+		return explanation, nil
+	}
+
+	nonce, err := getNonceInfo(t.nonce, token, t.disableNonceSubjectCheck)
+	if err != nil {
+		explanation.Error = err.Error()
+		return explanation, nil
+	}
+
+	if nonce == nil && t.nonceChallenge && !subjectRequired {
+		// The server answers with a challenge if a nonce may be issued
+		explanation.NonceRequired = t.policy.Eval(ctx, RuleGetNonce, nonceInput(ctx, token)) == nil
+	}
+
+	explanation.Input = entityInput(ctx, t.nonce, token, name, nonce)
+
+	if t.audienceNonces {
+		explanation.Input.Nonces = intersect(explanation.Input.Nonces, GetAudiences(token.Claims))
+	}
+
+	t.evaluate(ctx, explanation, mode)
+	return explanation, nil
+}
+
+// intersect returns the values of a that are also in b
+func intersect(a, b []string) []string {
+
+	var values []string
+
+	for _, v := range a {
+		for _, w := range b {
+			if v == w {
+				values = append(values, v)
+				break
+			}
+		}
+	}
+
+	return values
+}
+
+// ClaimsToken returns a token with claims. The iss and exp claims are copied
+// to the token. Nothing is validated.
+func ClaimsToken(claims map[string]interface{}) *libtokenmachine.Token {
+
+	token := &libtokenmachine.Token{
+		Claims: claims,
+	}
+
+	token.Iss, _ = claims["iss"].(string)
+
+	if exp, ok := claims["exp"].(float64); ok {
+		token.Exp = int64(exp)
+	}
+
+	return token
+}
+
+// evaluate evaluates the rule of explanation with its input and sets the
+// decision and trace
+func (t *Explainer) evaluate(ctx context.Context, explanation *Explanation, mode string) {
+
+	tracer := topdown.NewBufferTracer()
+
+	// Without indexing every rule body is evaluated so that the trace shows
+	// why each failed
+	err := t.policy.eval(ctx, explanation.Rule, explanation.Input, rego.EvalQueryTracer(tracer), rego.EvalRuleIndexing(false))
+
+	explanation.Allow = err == nil
+	if err != nil && !errors.Is(err, libtokenmachine.ErrDenied) {
+		explanation.Error = err.Error()
+	}
+
+	trace := []*topdown.Event(*tracer)
+
+	switch mode {
+
+	case ExplainFails:
+		trace = lineage.Fails(trace)
+
+	case ExplainNotes:
+		trace = lineage.Notes(trace)
+
+	}
+
+	var buf bytes.Buffer
+	topdown.PrettyTraceWithLocation(&buf, trace)
+
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if line != "" {
+			explanation.Trace = append(explanation.Trace, line)
+		}
+	}
+}
+
+func checkExplainMode(mode string) error {
+
+	switch mode {
+
+	case ExplainFails, ExplainNotes, ExplainFull:
+		return nil
+
+	}
+
+	return fmt.Errorf("Explain mode %s is not valid; must be %s, %s or %s", mode, ExplainFails, ExplainNotes, ExplainFull)
+}
@@ -0,0 +1,194 @@
+/*
+Copyright © 2020 Jody Scott <jody@thescottsweb.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package engine
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+const explainPolicy = `
+package main
+
+default auth_get_nonce = false
+default auth_get_keytab = false
+default auth_get_secret = false
+
+auth_get_nonce {
+   input.claims.iss == "abc123"
+}
+
+auth_get_secret {
+   trace("checking nonce")
+   input.nonces[_] == input.claims.aud
+   input.name == "db"
+}
+`
+
+func TestExplainer(t *testing.T) {
+
+	tests := []struct {
+		name           string
+		config         ExplainConfig
+		claims         map[string]interface{}
+		action         string
+		entity         string
+		mode           string
+		allow          bool
+		nonceRequired  bool
+		trace          string
+		err            string
+		explanationErr string
+	}{
+		{
+			name:   "nonce",
+			claims: map[string]interface{}{"iss": "abc123", "sub": "bob"},
+			action: ActionGetNonce,
+			mode:   ExplainFails,
+			allow:  true,
+		},
+		{
+			name:   "nonce denied",
+			claims: map[string]interface{}{"iss": "other", "sub": "bob"},
+			action: ActionGetNonce,
+			mode:   ExplainFails,
+			trace:  "input.claims.iss",
+		},
+		{
+			name:           "nonce without sub",
+			claims:         map[string]interface{}{"iss": "abc123"},
+			action:         ActionGetNonce,
+			mode:           ExplainFails,
+			explanationErr: ErrNonceSubjectRequired.Error(),
+		},
+		{
+			name:   "secret with nonce",
+			config: ExplainConfig{Nonces: []string{"n1"}},
+			claims: map[string]interface{}{"iss": "abc123", "sub": "bob", "aud": "n1"},
+			action: ActionGetSecret,
+			entity: "db",
+			mode:   ExplainNotes,
+			allow:  true,
+			trace:  "checking nonce",
+		},
+		{
+			name:   "secret without nonce",
+			claims: map[string]interface{}{"iss": "abc123", "sub": "bob", "aud": "n1"},
+			action: ActionGetSecret,
+			entity: "db",
+			mode:   ExplainFull,
+			trace:  "input.nonces",
+		},
+		{
+			name:          "nonce challenge",
+			config:        ExplainConfig{NonceChallenge: true},
+			claims:        map[string]interface{}{"iss": "abc123", "sub": "bob"},
+			action:        ActionGetSecret,
+			entity:        "db",
+			mode:          ExplainFails,
+			nonceRequired: true,
+		},
+		{
+			name:   "no nonce challenge if a nonce would be denied",
+			config: ExplainConfig{NonceChallenge: true},
+			claims: map[string]interface{}{"iss": "other", "sub": "bob"},
+			action: ActionGetSecret,
+			entity: "db",
+			mode:   ExplainFails,
+		},
+		{
+			name:   "invalid action",
+			claims: map[string]interface{}{},
+			action: "delete",
+			mode:   ExplainFails,
+			err:    "Action delete is not valid",
+		},
+		{
+			name:   "invalid mode",
+			claims: map[string]interface{}{},
+			action: ActionGetNonce,
+			mode:   "some",
+			err:    "Explain mode some is not valid",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			config := test.config
+			config.Policy = &PolicyConfig{Policy: explainPolicy}
+
+			explainer, err := config.Build()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer explainer.Shutdown()
+
+			explanation, err := explainer.Explain(context.Background(), ClaimsToken(test.claims), test.action, test.entity, test.mode)
+
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("err is %v; want %s", err, test.err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if explanation.Allow != test.allow || explanation.NonceRequired != test.nonceRequired || explanation.Error != test.explanationErr {
+				t.Errorf("explanation is allow=%t nonceRequired=%t error=%s; want allow=%t nonceRequired=%t error=%s",
+					explanation.Allow, explanation.NonceRequired, explanation.Error, test.allow, test.nonceRequired, test.explanationErr)
+			}
+
+			if test.trace != "" && !strings.Contains(strings.Join(explanation.Trace, "\n"), test.trace) {
+				t.Errorf("trace does not contain %s\n%s", test.trace, strings.Join(explanation.Trace, "\n"))
+			}
+		})
+	}
+}
+
+func TestExplainConfigInvalid(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		config ExplainConfig
+	}{
+		{"no policy", ExplainConfig{}},
+		{"invalid policy", ExplainConfig{Policy: &PolicyConfig{Policy: "package main"}}},
+		{"short nonce key", ExplainConfig{Policy: &PolicyConfig{Policy: explainPolicy}, NonceKey: "short"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := test.config.Build(); err == nil {
+				t.Errorf("expected error")
+			}
+		})
+	}
+}
+
+func TestClaimsToken(t *testing.T) {
+
+	token := ClaimsToken(map[string]interface{}{"iss": "abc123", "exp": float64(1600000000), "sub": "bob"})
+
+	if token.Iss != "abc123" || token.Exp != 1600000000 || token.Claims["sub"] != "bob" {
+		t.Errorf("token is %+v", token)
+	}
+}
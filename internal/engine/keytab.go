@@ -0,0 +1,447 @@
+/*
+Copyright © 2020 Jody Scott <jody@thescottsweb.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package engine
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/jodydadescott/libtokenmachine"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+	"go.uber.org/zap"
+)
+
+// KeytabConfig Config
+type KeytabConfig struct {
+	Keytabs  []*libtokenmachine.Keytab
+	TickRate time.Duration
+	Lifetime time.Duration
+}
+
+// KeytabCache holds and manages Kerberos Keytabs. Keytab files are generated using
+// a password derived from the current time period and per Keytab seed. Keytabs
+// are generated at the start of the period. It is possible to have multiple instance
+// of this with no communication required between the instances and no conflict if the
+// seed is configure the same and the clocks are synchronized from an accurate (or same)
+// source.
+type KeytabCache struct {
+	closeTimer chan struct{}
+	wg         sync.WaitGroup
+	ticker     *time.Ticker
+	mutex      sync.RWMutex
+	internal   map[string]*keytabWrapper
+	lifetime   time.Duration
+	tickRate   time.Duration
+}
+
+type keytabWrapper struct {
+	mutex                 sync.RWMutex
+	nextUpdate            time.Time
+	name, principal, seed string
+	keytab                *libtokenmachine.Keytab
+	err                   error
+	timePeriod            *TimePeriod
+}
+
+// Build Returns new instance of Keytabs
+func (config *KeytabConfig) Build() (*KeytabCache, error) {
+
+	zap.L().Debug("Starting")
+
+	tickRate := keytabDefaultTickRate
+	lifetime := keytabDefaultLifetime
+
+	if config.TickRate > 0 {
+		tickRate = config.TickRate
+	}
+
+	if config.Lifetime > 0 {
+		lifetime = config.Lifetime
+	}
+
+	if tickRate > lifetime {
+		return nil, fmt.Errorf("Lifetime may not be less then the tickRate")
+	}
+
+	t := &KeytabCache{
+		closeTimer: make(chan struct{}),
+		ticker:     time.NewTicker(time.Second),
+		internal:   make(map[string]*keytabWrapper),
+		lifetime:   lifetime,
+		tickRate:   tickRate,
+	}
+
+	err := t.init(config)
+	if err != nil {
+		return nil, err
+	}
+
+	t.wg.Add(1)
+	go t.run()
+	return t, nil
+}
+
+func (t *KeytabCache) init(config *KeytabConfig) error {
+
+	wrappers, err := t.newWrappers(config.Keytabs, t.lifetime)
+	if err != nil {
+		return err
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.internal = wrappers
+	return nil
+}
+
+// newWrappers validates keytabs and returns the wrappers for them. Existing
+// wrappers with the same principal, seed and lifetime are reused so that the
+// keytab is not regenerated.
+func (t *KeytabCache) newWrappers(keytabs []*libtokenmachine.Keytab, defaultLifetime time.Duration) (map[string]*keytabWrapper, error) {
+
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	wrappers := make(map[string]*keytabWrapper)
+
+	for _, keytab := range keytabs {
+
+		if keytab.Name == "" {
+			return nil, fmt.Errorf("Keytab name is required")
+		}
+
+		if keytab.Principal == "" {
+			return nil, fmt.Errorf("Keytab %s is missing required principal", keytab.Name)
+		}
+
+		if len(keytab.Principal) < 3 {
+			return nil, fmt.Errorf("Keytab %s principal %s is to short", keytab.Name, keytab.Principal)
+		}
+
+		if len(keytab.Principal) > 254 {
+			return nil, fmt.Errorf("Keytab %s principal %s is to long", keytab.Name, keytab.Principal)
+		}
+
+		if !keytabRegex.MatchString(keytab.Principal) {
+			return nil, fmt.Errorf("Keytab %s principal %s is invalid", keytab.Name, keytab.Principal)
+		}
+
+		if keytab.Seed == "" {
+			return nil, fmt.Errorf("Keytab %s is missing required seed", keytab.Name)
+		}
+
+		seed := base32.StdEncoding.EncodeToString([]byte(keytab.Seed))
+
+		lifetime := defaultLifetime
+
+		if keytab.Lifetime > 0 {
+			lifetime = keytab.Lifetime
+		}
+
+		// Lifetime less then a minute requires to much resources and does not make much sense
+		if t.tickRate > lifetime {
+			return nil, fmt.Errorf("Keytab %s lifetime of %s less then tickrate of %s", keytab.Name, lifetime, t.tickRate)
+		}
+
+		if existing, ok := t.internal[keytab.Name]; ok {
+			if existing.principal == keytab.Principal && existing.seed == seed && existing.timePeriod.Duration == lifetime {
+				wrappers[keytab.Name] = existing
+				continue
+			}
+		}
+
+		wrappers[keytab.Name] = &keytabWrapper{
+			name:       keytab.Name,
+			principal:  keytab.Principal,
+			timePeriod: NewPeriod(lifetime),
+			seed:       seed,
+		}
+		zap.L().Debug(fmt.Sprintf("Loaded Keytab %s with lifetime of %s", keytab.Name, lifetime))
+	}
+
+	return wrappers, nil
+}
+
+// Load replaces the keytabs. New or changed keytabs are generated
+// immediately. If a keytab is invalid an error is returned and the existing
+// keytabs are not changed.
+func (t *KeytabCache) Load(keytabs []*libtokenmachine.Keytab, lifetime time.Duration) error {
+
+	if lifetime <= 0 {
+		lifetime = keytabDefaultLifetime
+	}
+
+	if t.tickRate > lifetime {
+		return fmt.Errorf("Lifetime may not be less then the tickRate")
+	}
+
+	wrappers, err := t.newWrappers(keytabs, lifetime)
+	if err != nil {
+		return err
+	}
+
+	t.mutex.Lock()
+	t.internal = wrappers
+	t.lifetime = lifetime
+	t.mutex.Unlock()
+
+	t.update(getTime())
+	return nil
+}
+
+func (t *KeytabCache) run() {
+
+	defer t.wg.Done()
+
+	// TimePeriod based on tick rate
+	timeperiod := NewPeriod(t.tickRate)
+	nowPeriod := timeperiod.From(getTime())
+	nextPeriod := nowPeriod.Next()
+
+	next := nextPeriod.Time()
+
+	// On start create Keytabs with the start of the current period
+	t.update(nowPeriod.Time())
+
+	for {
+		select {
+		case <-t.closeTimer:
+			t.ticker.Stop()
+			return
+		case <-t.ticker.C:
+			// This fires every second
+			now := getTime()
+			if now.Equal(next) || now.After(next) {
+				t.update(next)
+				next = timeperiod.From(now).Next().Time()
+			}
+		}
+	}
+
+}
+
+func (t *KeytabCache) update(now time.Time) {
+
+	zap.L().Debug("Running Keytab update")
+
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	for _, wrapper := range t.internal {
+		t.wg.Add(1)
+		go func(wrapper *keytabWrapper) {
+			defer t.wg.Done()
+			wrapper.update(now)
+		}(wrapper)
+	}
+
+	zap.L().Debug("Completed Keytab update")
+}
+
+func (t *keytabWrapper) update(now time.Time) {
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if now.Before(t.nextUpdate) {
+		return
+	}
+
+	zap.L().Debug(fmt.Sprintf("Keytab %s ready for new keytab", t.principal))
+
+	nowPeriod := t.timePeriod.From(now)
+	now = nowPeriod.Time()
+
+	otp, err := totp.GenerateCodeCustom(t.seed, now, totp.ValidateOpts{
+		Period:    30,
+		Skew:      1,
+		Digits:    otp.DigitsEight,
+		Algorithm: otp.AlgorithmSHA512,
+	})
+
+	if err != nil {
+		zap.L().Error(fmt.Sprintf("Unable to get create keytab %s ; err->%s", t.principal, err.Error()))
+		t.err = err
+		t.keytab = nil
+		return
+	}
+
+	hash := sha256.Sum256([]byte(otp + t.seed))
+
+	b := make([]byte, 28)
+	for i := range b {
+		b[i] = getChar(keytabPasswordCharset, hash[i])
+	}
+
+	password := string(b)
+
+	base64File, err := t.newKeytab(password)
+
+	if err != nil {
+		zap.L().Error(fmt.Sprintf("Unable to get create keytab %s ; err->%s", t.principal, err.Error()))
+		t.err = err
+		t.keytab = nil
+		return
+	}
+
+	t.nextUpdate = nowPeriod.Next().Time()
+	t.err = nil
+	t.keytab = &libtokenmachine.Keytab{
+		Name:       t.name,
+		Principal:  "HTTP/" + t.principal,
+		Base64File: base64File,
+		Exp:        t.nextUpdate.Unix(),
+	}
+
+	zap.L().Debug(fmt.Sprintf("Keytab %s generated with exp=%d", t.principal, t.keytab.Exp))
+}
+
+// GetKeytab Returns Keytab if keytab exist.
+func (t *KeytabCache) GetKeytab(name string) (*libtokenmachine.Keytab, error) {
+
+	if name == "" {
+		zap.L().Debug("Keytab name is empty")
+		return nil, libtokenmachine.ErrNotFound
+	}
+
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	if wrapper, exist := t.internal[name]; exist {
+
+		wrapper.mutex.RLock()
+		defer wrapper.mutex.RUnlock()
+
+		if wrapper.keytab == nil {
+			if wrapper.err == nil {
+				zap.L().Debug(fmt.Sprintf("Keytab %s has not been processed yet", name))
+				return nil, libtokenmachine.ErrNotFound
+			}
+			zap.L().Debug(fmt.Sprintf("Keytab %s not generated due to error; err->%s", name, wrapper.err.Error()))
+			return nil, libtokenmachine.ErrServerFail
+		}
+
+		// Export function; returning copy
+		return wrapper.keytab.Copy(), nil
+	}
+
+	zap.L().Debug(fmt.Sprintf("Keytab %s does not exist", name))
+	return nil, libtokenmachine.ErrNotFound
+}
+
+// Rotations returns the time of the next rotation for each keytab
+func (t *KeytabCache) Rotations() map[string]time.Time {
+
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	now := getTime()
+	rotations := make(map[string]time.Time)
+	for name, wrapper := range t.internal {
+		rotations[name] = wrapper.timePeriod.From(now).Next().Time()
+	}
+	return rotations
+}
+
+func (t *keytabWrapper) newKeytab(password string) (string, error) {
+	if runtime.GOOS == "windows" {
+		return t.windowsNewKeytab(password)
+	}
+	return t.unixNewKeytab(password)
+}
+
+// Windows Kerberos Implementation (Active Directory) allows for the creation
+// of principals that are mapped to a user account. Only one principal may be
+// mapped to a user account at a time. Once a keytab is created it will remain
+// valid until the principal is removed  or the password is changed or a new
+// keytab is created. The windows utility ktpass is used to create the keytabs.
+// The ktpass command is executed directly on the host. Therefore this should
+// be ran on a Windows system that is a member of the target domain. It must
+// also be ran with privileges to allow the creation of keytabs. Generally this
+// is a Domain Admin. If running as a service it is necessary that it be
+// configured to run as a domain admin or user with the privileges necessary
+// to create keytabs.
+//
+// Documentation: https://docs.microsoft.com/en-us/previous-versions/windows/it-pro/windows-server-2012-r2-and-2012/cc753771(v=ws.11)
+//
+// Testing on Windows Server 2019 reveals that if the user lacks the
+// privileges to create keytabs the ktpass utility does not create the
+// keytab but also still exits with 0 and nothing is sent to the stdout. For
+// this reason we return an error if the file does not exist.
+//
+// ktpass -mapUser bob@EXAMPLE.COM -pass ** -mapOp set -crypto AES256-SHA1 -ptype KRB5_NT_PRINCIPAL -princ HTTP/bob@EXAMPLE.COM -out keytab
+func (t *keytabWrapper) windowsNewKeytab(password string) (string, error) {
+
+	dir, err := ioutil.TempDir("", "kt")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "file.keytab")
+
+	exe := "C:\\Windows\\System32\\ktpass"
+	args := []string{
+		"-mapUser", t.principal,
+		"-pass", password,
+		"-mapOp", "set",
+		"-crypto", "AES256-SHA1",
+		"-ptype", "KRB5_NT_PRINCIPAL",
+		"-princ", "HTTP/" + t.principal,
+		"-kvno", "1",
+		"-out", filename,
+	}
+
+	cmd := exec.Command(exe, args...)
+	cmdOutput := &bytes.Buffer{}
+	cmd.Stdout = cmdOutput
+	err = cmd.Run()
+	if err != nil {
+		zap.L().Error(fmt.Sprintf("ktpass for principal %s failed", t.principal))
+		return "", err
+	}
+
+	zap.L().Debug(fmt.Sprintf("ktpass for principal %s output->%s", t.principal, cmdOutput.String()))
+
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(content), nil
+}
+
+func (t *keytabWrapper) unixNewKeytab(password string) (string, error) {
+	return "this is not a valid keytab, it is fake", nil
+}
+
+// Shutdown shutdown
+func (t *KeytabCache) Shutdown() {
+	zap.L().Debug("Stopping")
+	close(t.closeTimer)
+	t.wg.Wait()
+}
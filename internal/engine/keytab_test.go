@@ -0,0 +1,97 @@
+/*
+Copyright © 2020 Jody Scott <jody@thescottsweb.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package engine
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jodydadescott/libtokenmachine"
+)
+
+func TestKeytabConfig(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		keytab  *libtokenmachine.Keytab
+		invalid bool
+	}{
+		{"valid", &libtokenmachine.Keytab{Name: "bob", Principal: "bob@EXAMPLE.COM", Seed: "seed"}, false},
+		{"missing name", &libtokenmachine.Keytab{Principal: "bob@EXAMPLE.COM", Seed: "seed"}, true},
+		{"missing principal", &libtokenmachine.Keytab{Name: "bob", Seed: "seed"}, true},
+		{"short principal", &libtokenmachine.Keytab{Name: "bob", Principal: "b", Seed: "seed"}, true},
+		{"missing seed", &libtokenmachine.Keytab{Name: "bob", Principal: "bob@EXAMPLE.COM"}, true},
+		{"lifetime less than tick rate", &libtokenmachine.Keytab{Name: "bob", Principal: "bob@EXAMPLE.COM", Seed: "seed", Lifetime: time.Second}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			keytabs, err := (&KeytabConfig{
+				Keytabs: []*libtokenmachine.Keytab{test.keytab},
+			}).Build()
+
+			if (err != nil) != test.invalid {
+				t.Fatalf("err is %v; want invalid=%t", err, test.invalid)
+			}
+
+			if err == nil {
+				keytabs.Shutdown()
+			}
+		})
+	}
+}
+
+func TestGetKeytab(t *testing.T) {
+
+	keytabs, err := (&KeytabConfig{
+		Keytabs: []*libtokenmachine.Keytab{
+			{Name: "bob", Principal: "bob@EXAMPLE.COM", Seed: "seed"},
+		},
+		Lifetime: time.Hour,
+	}).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer keytabs.Shutdown()
+
+	var keytab *libtokenmachine.Keytab
+	for i := 0; i < 50 && keytab == nil; i++ {
+		keytab, _ = keytabs.GetKeytab("bob")
+		if keytab == nil {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	if keytab == nil {
+		t.Fatal("keytab was not generated")
+	}
+
+	if keytab.Principal != "HTTP/bob@EXAMPLE.COM" || keytab.Base64File == "" {
+		t.Errorf("unexpected keytab %s", keytab.JSON())
+	}
+
+	if keytab.Exp <= time.Now().Unix() || keytab.Exp%int64(time.Hour.Seconds()) != 0 {
+		t.Errorf("exp %d is not the end of the current period", keytab.Exp)
+	}
+
+	_, err = keytabs.GetKeytab("invalid")
+	if !errors.Is(err, libtokenmachine.ErrNotFound) {
+		t.Errorf("err is %v; want ErrNotFound", err)
+	}
+}
@@ -0,0 +1,485 @@
+/*
+Copyright © 2020 Jody Scott <jody@thescottsweb.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package engine
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/jodydadescott/libtokenmachine"
+	"go.uber.org/zap"
+)
+
+// ErrNonceSubjectMismatch is returned when a token contains a nonce that was
+// issued to a different subject
+var ErrNonceSubjectMismatch = fmt.Errorf("%w; nonce was issued to a different subject", libtokenmachine.ErrDenied)
+
+// ErrNonceSubjectRequired is returned when a nonce is requested with a token
+// without a sub claim. The nonce could not be told apart from the nonces of
+// other tokens of the issuer without a sub.
+var ErrNonceSubjectRequired = fmt.Errorf("%w; token has no sub to bind the nonce to", libtokenmachine.ErrDenied)
+
+// NonceRequiredError is returned by GetSecret and GetKeytab when nonce
+// challenges are enabled and the token does not contain a nonce. Nonce is a
+// new nonce for the subject of the token.
+type NonceRequiredError struct {
+	Nonce *libtokenmachine.Nonce
+}
+
+func (t *NonceRequiredError) Error() string {
+	return "Nonce required"
+}
+
+// Min length of the cluster key used for stateless nonces
+const minNonceKeyLength = 32
+
+// Stateless nonces are the base64url encoding of exp, random, the subject
+// binding and the HMAC of all three
+const (
+	statelessNonceRandomSize  = 16
+	statelessNonceBindingSize = 16
+	statelessNonceDataSize    = 8 + statelessNonceRandomSize + statelessNonceBindingSize
+	statelessNonceSize        = statelessNonceDataSize + sha256.Size
+)
+
+// NonceConfig Config
+type NonceConfig struct {
+	CacheRefreshInterval, Lifetime time.Duration
+	Key                            string // Optional cluster key for stateless nonces
+}
+
+// NonceInfo describes a nonce presented in a token and the subject (iss and
+// sub of the token used to get the nonce) it was issued to. Stateless nonces
+// only carry a hash of the subject so Iss and Sub are only known when they
+// match the token the nonce was presented in.
+type NonceInfo struct {
+	Value        string `json:"value,omitempty" yaml:"value,omitempty"`
+	Exp          int64  `json:"exp,omitempty" yaml:"exp,omitempty"`
+	Iss          string `json:"iss,omitempty" yaml:"iss,omitempty"`
+	Sub          string `json:"sub,omitempty" yaml:"sub,omitempty"`
+	SubjectMatch bool   `json:"subjectMatch" yaml:"subjectMatch"`
+}
+
+type nonceEntry struct {
+	nonce    *libtokenmachine.Nonce
+	iss, sub string
+}
+
+// NonceCache Manages nonces. For our purposes a nonce is defined as a random
+// string with an expiration time. Upon request a new nonce is generated
+// and returned along with the expiration time to the caller. This allows
+// the caller to hand the nonce to a remote party. The remote party can then
+// present the nonce back in the future (before the expiration time is reached)
+// and the nonce can be validated that it originated with us.
+//
+// If a cluster key is set nonces are stateless. The nonce carries its own
+// expiration and is authenticated with an HMAC derived from the key so that
+// any instance with the same key can validate it.
+//
+// Each nonce is bound to the subject (iss and sub) of the token used to get
+// it.
+type NonceCache struct {
+	mutex    sync.RWMutex
+	internal map[string]*nonceEntry
+	closed   chan struct{}
+	ticker   *time.Ticker
+	wg       sync.WaitGroup
+	lifetime time.Duration
+	keys     [][]byte // Current key first followed by the previous key
+}
+
+// Build Returns a new Cache
+func (config *NonceConfig) Build() (*NonceCache, error) {
+
+	zap.L().Debug("Starting")
+
+	cacheRefreshInterval := defaultCacheRefreshInterval
+	lifetime := nonceDefaultLifetime
+
+	if config.CacheRefreshInterval > 0 {
+		cacheRefreshInterval = config.CacheRefreshInterval
+	}
+
+	if config.Lifetime > 0 {
+		lifetime = config.Lifetime
+	}
+
+	t := &NonceCache{
+		internal: make(map[string]*nonceEntry),
+		closed:   make(chan struct{}),
+		ticker:   time.NewTicker(cacheRefreshInterval),
+		lifetime: lifetime,
+	}
+
+	err := t.SetKey(config.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	t.wg.Add(1)
+	go t.run()
+	return t, nil
+}
+
+func (t *NonceCache) run() {
+	defer t.wg.Done()
+	for {
+		select {
+		case <-t.closed:
+			t.ticker.Stop()
+			return
+		case <-t.ticker.C:
+			t.cleanup()
+		}
+	}
+}
+
+func (t *NonceCache) cleanup() {
+
+	zap.L().Debug("Running Nonce cleanup")
+
+	var removes []string
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for key, e := range t.internal {
+		if time.Now().Unix() > e.nonce.Exp {
+			removes = append(removes, key)
+			zap.L().Debug(fmt.Sprintf("Ejecting Nonce with exp %d", e.nonce.Exp))
+		}
+	}
+
+	for _, key := range removes {
+		delete(t.internal, key)
+	}
+
+	zap.L().Debug("Completed Nonce cleanup")
+}
+
+// NewNonce Returns a new nonce bound to the subject iss and sub
+func (t *NonceCache) NewNonce(iss, sub string) (*libtokenmachine.Nonce, error) {
+
+	t.mutex.RLock()
+	keys := t.keys
+	lifetime := t.lifetime
+	t.mutex.RUnlock()
+
+	if len(keys) > 0 {
+		return newStatelessNonce(keys[0], time.Now().Unix()+int64(lifetime.Seconds()), iss, sub)
+	}
+
+	b := make([]byte, 64)
+	max := big.NewInt(int64(len(nonceCharset)))
+	for i := range b {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			zap.L().Error(fmt.Sprintf("Unable to read random; err->%s", err))
+			return nil, libtokenmachine.ErrServerFail
+		}
+		b[i] = nonceCharset[n.Int64()]
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	nonce := &libtokenmachine.Nonce{
+		Exp:   time.Now().Unix() + int64(t.lifetime.Seconds()),
+		Value: string(b),
+	}
+
+	t.internal[nonce.Value] = &nonceEntry{
+		nonce: nonce,
+		iss:   iss,
+		sub:   sub,
+	}
+
+	// Func is exported. Return clone to untrusted outsiders
+	return nonce.Copy(), nil
+}
+
+// put adds value as a nonce issued to the subject iss and sub that expires
+// after the lifetime
+func (t *NonceCache) put(value, iss, sub string) {
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.internal[value] = &nonceEntry{
+		nonce: &libtokenmachine.Nonce{
+			Exp:   time.Now().Unix() + int64(t.lifetime.Seconds()),
+			Value: value,
+		},
+		iss: iss,
+		sub: sub,
+	}
+}
+
+func newStatelessNonce(key []byte, exp int64, iss, sub string) (*libtokenmachine.Nonce, error) {
+
+	b := make([]byte, statelessNonceDataSize, statelessNonceSize)
+	binary.BigEndian.PutUint64(b, uint64(exp))
+
+	_, err := rand.Read(b[8 : 8+statelessNonceRandomSize])
+	if err != nil {
+		zap.L().Error(fmt.Sprintf("Unable to read random; err->%s", err))
+		return nil, libtokenmachine.ErrServerFail
+	}
+
+	copy(b[8+statelessNonceRandomSize:], getSubjectBinding(key, iss, sub))
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(b)
+	b = mac.Sum(b)
+
+	return &libtokenmachine.Nonce{
+		Exp:   exp,
+		Value: base64.RawURLEncoding.EncodeToString(b),
+	}, nil
+}
+
+// getSubjectBinding returns the truncated HMAC of iss and sub
+func getSubjectBinding(key []byte, iss, sub string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("subject\x00" + iss + "\x00" + sub))
+	return mac.Sum(nil)[:statelessNonceBindingSize]
+}
+
+// validStatelessNonce returns true if value was created with one of keys and
+// has not expired
+func validStatelessNonce(keys [][]byte, value string) bool {
+	exp, _, _ := parseStatelessNonce(keys, value)
+	return exp > 0
+}
+
+// parseStatelessNonce returns the exp, subject binding and key of value if it
+// was created with one of keys and has not expired, otherwise exp is 0
+func parseStatelessNonce(keys [][]byte, value string) (int64, []byte, []byte) {
+
+	b, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || len(b) != statelessNonceSize {
+		return 0, nil, nil
+	}
+
+	data := b[:statelessNonceDataSize]
+
+	for _, key := range keys {
+		mac := hmac.New(sha256.New, key)
+		mac.Write(data)
+		if hmac.Equal(mac.Sum(nil), b[len(data):]) {
+			exp := int64(binary.BigEndian.Uint64(b))
+			if time.Now().Unix() < exp {
+				return exp, data[8+statelessNonceRandomSize:], key
+			}
+			return 0, nil, nil
+		}
+	}
+
+	return 0, nil, nil
+}
+
+func validateNonceKey(clusterKey string) error {
+	if clusterKey != "" && len(clusterKey) < minNonceKeyLength {
+		return fmt.Errorf("Nonce key must be at least %d characters", minNonceKeyLength)
+	}
+	return nil
+}
+
+// deriveNonceKey derives the HMAC key for nonces from the cluster key so that
+// the cluster key may be used for other purposes
+func deriveNonceKey(clusterKey string) []byte {
+	mac := hmac.New(sha256.New, []byte(clusterKey))
+	mac.Write([]byte("tokenmachine nonce v1"))
+	return mac.Sum(nil)
+}
+
+// GetNonceValues returns slice of all valid nonce values
+func (t *NonceCache) GetNonceValues() []string {
+
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	var nonces []string
+	for _, e := range t.internal {
+		if time.Now().Unix() < e.nonce.Exp {
+			nonces = append(nonces, e.nonce.Value)
+		}
+	}
+
+	return nonces
+}
+
+// GetValidNonceValues returns the valid nonce values for the policy input. This
+// is all of the nonce values held in memory and any of candidates that are
+// valid stateless nonces. Stateless nonces can not be listed so the
+// candidates should be the audiences of the token.
+func (t *NonceCache) GetValidNonceValues(candidates []string) []string {
+
+	nonces := t.GetNonceValues()
+
+	t.mutex.RLock()
+	keys := t.keys
+	t.mutex.RUnlock()
+
+	if len(keys) == 0 {
+		return nonces
+	}
+
+	for _, candidate := range candidates {
+		if validStatelessNonce(keys, candidate) {
+			nonces = append(nonces, candidate)
+		}
+	}
+
+	return nonces
+}
+
+// Valid returns true if value is a nonce issued by us (or another instance
+// with the same cluster key) that has not expired
+func (t *NonceCache) Valid(value string) bool {
+	return t.GetExp(value) > 0
+}
+
+// GetExp returns the exp of value if it is a valid nonce, otherwise 0
+func (t *NonceCache) GetExp(value string) int64 {
+
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	e, ok := t.internal[value]
+	if ok {
+		if time.Now().Unix() < e.nonce.Exp {
+			return e.nonce.Exp
+		}
+		return 0
+	}
+
+	if len(t.keys) > 0 {
+		exp, _, _ := parseStatelessNonce(t.keys, value)
+		return exp
+	}
+
+	return 0
+}
+
+// GetNonceInfo returns the NonceInfo of value if it is a valid nonce,
+// otherwise nil. SubjectMatch is true if the nonce was issued to iss and sub.
+func (t *NonceCache) GetNonceInfo(value, iss, sub string) *NonceInfo {
+
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	e, ok := t.internal[value]
+	if ok {
+		if time.Now().Unix() >= e.nonce.Exp {
+			return nil
+		}
+		return &NonceInfo{
+			Value:        value,
+			Exp:          e.nonce.Exp,
+			Iss:          e.iss,
+			Sub:          e.sub,
+			SubjectMatch: e.iss == iss && e.sub == sub,
+		}
+	}
+
+	if len(t.keys) == 0 {
+		return nil
+	}
+
+	exp, binding, key := parseStatelessNonce(t.keys, value)
+	if exp == 0 {
+		return nil
+	}
+
+	info := &NonceInfo{
+		Value: value,
+		Exp:   exp,
+	}
+
+	if hmac.Equal(binding, getSubjectBinding(key, iss, sub)) {
+		info.Iss = iss
+		info.Sub = sub
+		info.SubjectMatch = true
+	}
+
+	return info
+}
+
+// SetKey sets the cluster key for stateless nonces. Nonces created with the
+// previous key remain valid until they expire. If key is empty nonces are
+// stored in memory and stateless nonces are no longer accepted.
+func (t *NonceCache) SetKey(clusterKey string) error {
+
+	err := validateNonceKey(clusterKey)
+	if err != nil {
+		return err
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if clusterKey == "" {
+		t.keys = nil
+		return nil
+	}
+
+	key := deriveNonceKey(clusterKey)
+
+	if len(t.keys) > 0 {
+		if hmac.Equal(t.keys[0], key) {
+			return nil
+		}
+		t.keys = [][]byte{key, t.keys[0]}
+		return nil
+	}
+
+	t.keys = [][]byte{key}
+	return nil
+}
+
+// SetLifetime sets the lifetime of new nonces. Existing nonces keep their
+// expiration. If lifetime is 0 the default is used.
+func (t *NonceCache) SetLifetime(lifetime time.Duration) {
+
+	if lifetime <= 0 {
+		lifetime = nonceDefaultLifetime
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.lifetime = lifetime
+}
+
+// Count returns the number of valid nonces held in memory. Stateless nonces
+// are not counted.
+func (t *NonceCache) Count() int {
+	return len(t.GetNonceValues())
+}
+
+// Shutdown shutdowns the cache map
+func (t *NonceCache) Shutdown() {
+	zap.L().Debug("Stopping")
+	close(t.closed)
+	t.wg.Wait()
+}
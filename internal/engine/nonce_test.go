@@ -0,0 +1,288 @@
+/*
+Copyright © 2020 Jody Scott <jody@thescottsweb.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package engine
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testNonceKey      = "0123456789abcdef0123456789abcdef"
+	testNonceKeyOther = "fedcba9876543210fedcba9876543210"
+)
+
+// newTestNonceCache returns a NonceCache with the cluster key key that is
+// shutdown at the end of the test
+func newTestNonceCache(t *testing.T, key string) *NonceCache {
+
+	nonces, err := (&NonceConfig{Key: key}).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(nonces.Shutdown)
+	return nonces
+}
+
+// tamper returns value with the byte at index flipped
+func tamper(t *testing.T, value string, index int) string {
+
+	b, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if index < 0 {
+		index += len(b)
+	}
+
+	b[index] ^= 0xff
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func TestNewNonce(t *testing.T) {
+
+	nonces, err := (&NonceConfig{
+		Lifetime: 4 * time.Second,
+	}).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nonces.Shutdown()
+
+	seen := make(map[string]bool)
+
+	for i := 0; i < 3; i++ {
+
+		nonce, err := nonces.NewNonce("https://issuer", "bob")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if seen[nonce.Value] {
+			t.Fatalf("nonce %s was issued twice", nonce.Value)
+		}
+		seen[nonce.Value] = true
+
+		if !nonces.Valid(nonce.Value) {
+			t.Errorf("nonce %s is not valid", nonce.Value)
+		}
+
+		if nonce.Exp <= time.Now().Unix() || nonce.Exp > time.Now().Unix()+4 {
+			t.Errorf("exp %d does not match the lifetime", nonce.Exp)
+		}
+	}
+
+	if nonces.Count() != 3 {
+		t.Errorf("count is %d; want 3", nonces.Count())
+	}
+
+	if nonces.Valid("not a nonce") {
+		t.Errorf("unknown nonce is valid")
+	}
+}
+
+func TestStatelessNonce(t *testing.T) {
+
+	const iss, sub = "https://issuer", "bob"
+
+	tests := []struct {
+		name string
+		// nonce returns the nonce to validate with the cache the nonce was
+		// issued from
+		nonce        func(t *testing.T, nonces *NonceCache) string
+		valid        bool
+		subjectMatch bool
+	}{
+		{"valid", func(t *testing.T, nonces *NonceCache) string {
+			nonce, _ := nonces.NewNonce(iss, sub)
+			return nonce.Value
+		}, true, true},
+		{"tampered mac", func(t *testing.T, nonces *NonceCache) string {
+			nonce, _ := nonces.NewNonce(iss, sub)
+			return tamper(t, nonce.Value, -1)
+		}, false, false},
+		{"tampered exp", func(t *testing.T, nonces *NonceCache) string {
+			nonce, _ := nonces.NewNonce(iss, sub)
+			return tamper(t, nonce.Value, 7)
+		}, false, false},
+		{"tampered binding", func(t *testing.T, nonces *NonceCache) string {
+			nonce, _ := nonces.NewNonce(iss, sub)
+			return tamper(t, nonce.Value, statelessNonceDataSize-1)
+		}, false, false},
+		{"truncated", func(t *testing.T, nonces *NonceCache) string {
+			nonce, _ := nonces.NewNonce(iss, sub)
+			return nonce.Value[:len(nonce.Value)-4]
+		}, false, false},
+		{"not base64", func(t *testing.T, nonces *NonceCache) string {
+			return strings.Repeat("!", 96)
+		}, false, false},
+		{"expired", func(t *testing.T, nonces *NonceCache) string {
+			nonce, _ := newStatelessNonce(nonces.keys[0], time.Now().Unix()-1, iss, sub)
+			return nonce.Value
+		}, false, false},
+		{"expires now", func(t *testing.T, nonces *NonceCache) string {
+			nonce, _ := newStatelessNonce(nonces.keys[0], time.Now().Unix(), iss, sub)
+			return nonce.Value
+		}, false, false},
+		{"wrong subject", func(t *testing.T, nonces *NonceCache) string {
+			nonce, _ := nonces.NewNonce(iss, "alice")
+			return nonce.Value
+		}, true, false},
+		{"wrong issuer", func(t *testing.T, nonces *NonceCache) string {
+			nonce, _ := nonces.NewNonce("https://other", sub)
+			return nonce.Value
+		}, true, false},
+		{"other key", func(t *testing.T, nonces *NonceCache) string {
+			nonce, _ := newTestNonceCache(t, testNonceKeyOther).NewNonce(iss, sub)
+			return nonce.Value
+		}, false, false},
+		{"issued before key rotation", func(t *testing.T, nonces *NonceCache) string {
+			nonce, _ := nonces.NewNonce(iss, sub)
+			if err := nonces.SetKey(testNonceKeyOther); err != nil {
+				t.Fatal(err)
+			}
+			return nonce.Value
+		}, true, true},
+		{"issued after key rotation", func(t *testing.T, nonces *NonceCache) string {
+			if err := nonces.SetKey(testNonceKeyOther); err != nil {
+				t.Fatal(err)
+			}
+			nonce, _ := nonces.NewNonce(iss, sub)
+			return nonce.Value
+		}, true, true},
+		{"issued two key rotations ago", func(t *testing.T, nonces *NonceCache) string {
+			nonce, _ := nonces.NewNonce(iss, sub)
+			nonces.SetKey(testNonceKeyOther)
+			nonces.SetKey(testNonceKey + "0")
+			return nonce.Value
+		}, false, false},
+		{"same key set again", func(t *testing.T, nonces *NonceCache) string {
+			nonce, _ := nonces.NewNonce(iss, sub)
+			nonces.SetKey(testNonceKeyOther)
+			nonces.SetKey(testNonceKeyOther)
+			return nonce.Value
+		}, true, true},
+		{"key removed", func(t *testing.T, nonces *NonceCache) string {
+			nonce, _ := nonces.NewNonce(iss, sub)
+			nonces.SetKey("")
+			return nonce.Value
+		}, false, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			nonces := newTestNonceCache(t, testNonceKey)
+			value := test.nonce(t, nonces)
+
+			if valid := nonces.Valid(value); valid != test.valid {
+				t.Errorf("valid is %t; want %t", valid, test.valid)
+			}
+
+			info := nonces.GetNonceInfo(value, iss, sub)
+			if (info != nil) != test.valid {
+				t.Fatalf("info is %v; want valid %t", info, test.valid)
+			}
+
+			if info != nil && info.SubjectMatch != test.subjectMatch {
+				t.Errorf("subjectMatch is %t; want %t", info.SubjectMatch, test.subjectMatch)
+			}
+
+			if info != nil && info.SubjectMatch && (info.Iss != iss || info.Sub != sub) {
+				t.Errorf("subject is %s %s", info.Iss, info.Sub)
+			}
+
+			valid := false
+			for _, v := range nonces.GetValidNonceValues([]string{"other", value}) {
+				valid = valid || v == value
+			}
+
+			if valid != test.valid {
+				t.Errorf("nonce in policy input is %t; want %t", valid, test.valid)
+			}
+		})
+	}
+}
+
+func TestStatelessNonceIsPortable(t *testing.T) {
+
+	// Instances with the same key accept each other's nonces and do not
+	// hold them in memory
+	issuer := newTestNonceCache(t, testNonceKey)
+	replica := newTestNonceCache(t, testNonceKey)
+
+	nonce, err := issuer.NewNonce("https://issuer", "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !replica.Valid(nonce.Value) {
+		t.Errorf("nonce is not valid on a replica with the same key")
+	}
+
+	if exp := replica.GetExp(nonce.Value); exp != nonce.Exp {
+		t.Errorf("exp is %d; want %d", exp, nonce.Exp)
+	}
+
+	if issuer.Count() != 0 {
+		t.Errorf("stateless nonce is held in memory")
+	}
+}
+
+func TestNonceKey(t *testing.T) {
+
+	tests := []struct {
+		name string
+		key  string
+		err  bool
+	}{
+		{"none", "", false},
+		{"min length", strings.Repeat("k", minNonceKeyLength), false},
+		{"too short", strings.Repeat("k", minNonceKeyLength-1), true},
+		{"short", "secret", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			nonces, err := (&NonceConfig{Key: test.key}).Build()
+			if err == nil {
+				nonces.Shutdown()
+			}
+
+			if test.err != (err != nil) {
+				t.Errorf("Build err is %v; want error %t", err, test.err)
+			}
+
+			// A key that is too short does not replace the current key
+			nonces = newTestNonceCache(t, testNonceKey)
+			nonce, _ := nonces.NewNonce("https://issuer", "bob")
+
+			if err := nonces.SetKey(test.key); test.err != (err != nil) {
+				t.Errorf("SetKey err is %v; want error %t", err, test.err)
+			}
+
+			if test.err && !nonces.Valid(nonce.Value) {
+				t.Errorf("key was replaced by an invalid key")
+			}
+		})
+	}
+}
@@ -0,0 +1,277 @@
+/*
+Copyright © 2020 Jody Scott <jody@thescottsweb.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package engine
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jodydadescott/libtokenmachine"
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/bundle"
+	"github.com/open-policy-agent/opa/rego"
+	"github.com/open-policy-agent/opa/storage/inmem"
+	"github.com/open-policy-agent/opa/types"
+	"go.uber.org/zap"
+)
+
+// Rules that the policy must implement. Each is evaluated with Input and must
+// return a boolean.
+const (
+	RuleGetNonce  = "auth_get_nonce"
+	RuleGetKeytab = "auth_get_keytab"
+	RuleGetSecret = "auth_get_secret"
+
+	policyPackage     = "data.main"
+	policyPackageName = "main"
+	policyModuleName  = "kerberos.rego"
+
+	bundleModulePrefix = "bundle"
+)
+
+var requiredRules = []string{RuleGetNonce, RuleGetKeytab, RuleGetSecret}
+
+// Input is the input document provided to the policy
+type Input struct {
+	Claims interface{} `json:"claims,omitempty" yaml:"claims,omitempty"`
+	Nonces []string    `json:"nonces,omitempty" yaml:"nonces,omitempty"`
+	Name   string      `json:"name,omitempty" yaml:"name,omitempty"`
+	Nonce  *NonceInfo  `json:"nonce,omitempty" yaml:"nonce,omitempty"`
+
+	Certificate *ClientCertificate `json:"certificate,omitempty" yaml:"certificate,omitempty"`
+}
+
+// PolicyConfig config
+type PolicyConfig struct {
+	Policy   string            // Main module; compiled as kerberos.rego as in libtokenmachine
+	Modules  map[string]string // Optional additional modules by file name such as a shared library
+	Bundle   *bundle.Bundle    // Optional OPA bundle with modules and data
+	Data     []*DataDocument   // Optional documents merged with the bundle data
+	Observer Observer
+}
+
+// PolicyEngine evaluates the Rego policy
+type PolicyEngine struct {
+	queries  map[string]rego.PreparedEvalQuery
+	observer Observer
+}
+
+// Build ...
+func (config *PolicyConfig) Build() (*PolicyEngine, error) {
+
+	compiler, err := config.compile()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := config.data()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+
+	t := &PolicyEngine{
+		queries:  make(map[string]rego.PreparedEvalQuery),
+		observer: config.Observer,
+	}
+
+	for _, rule := range requiredRules {
+
+		query, err := rego.New(
+			rego.Query(policyPackage+"."+rule),
+			rego.Compiler(compiler),
+			rego.Store(inmem.NewFromObject(data)),
+		).PrepareForEval(ctx)
+
+		if err != nil {
+			return nil, err
+		}
+
+		t.queries[rule] = query
+	}
+
+	return t, nil
+}
+
+// data returns the bundle data merged with the data documents
+func (config *PolicyConfig) data() (map[string]interface{}, error) {
+
+	var data map[string]interface{}
+	if config.Bundle != nil {
+		data = config.Bundle.Data
+	}
+
+	data, err := mergeData(data, config.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, exist := data[policyPackageName]; exist {
+		return nil, fmt.Errorf("Data may not be provided under %s which holds the policy", policyPackage)
+	}
+
+	return data, nil
+}
+
+// parse parses the policy, modules and bundle modules. Parse errors include
+// the module name and line number.
+func (config *PolicyConfig) parse() (map[string]*ast.Module, error) {
+
+	parsed := make(map[string]*ast.Module)
+
+	if config.Bundle != nil {
+		for name, module := range config.Bundle.ParsedModules(bundleModulePrefix) {
+			parsed[name] = module
+		}
+	}
+
+	if config.Policy == "" && len(config.Modules) == 0 && len(parsed) == 0 {
+		return nil, fmt.Errorf("Policy is required")
+	}
+
+	modules := config.Modules
+
+	if config.Policy != "" {
+		modules = copyModules(modules)
+		if _, exist := modules[policyModuleName]; exist {
+			return nil, fmt.Errorf("Policy module %s is defined more than once", policyModuleName)
+		}
+		modules[policyModuleName] = config.Policy
+	}
+
+	for name, module := range modules {
+		m, err := ast.ParseModule(name, module)
+		if err != nil {
+			return nil, err
+		}
+		parsed[name] = m
+	}
+
+	return parsed, nil
+}
+
+// Validate compiles the policy, modules and bundle modules and verifies that
+// the required rules are implemented as Build does
+func (config *PolicyConfig) Validate() error {
+	_, err := config.compile()
+	return err
+}
+
+// compile compiles the policy, modules and bundle modules and verifies that
+// the required rules are implemented in package main and evaluate to
+// booleans. Compile errors include the module name and line number.
+func (config *PolicyConfig) compile() (*ast.Compiler, error) {
+
+	parsed, err := config.parse()
+	if err != nil {
+		return nil, err
+	}
+
+	compiler := ast.NewCompiler()
+	compiler.Compile(parsed)
+	if compiler.Failed() {
+		return nil, compiler.Errors
+	}
+
+	for _, rule := range requiredRules {
+		err := checkRule(compiler, rule)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return compiler, nil
+}
+
+// checkRule verifies that rule is a complete rule (not a function, partial set
+// or partial object) that may evaluate to a boolean. Rules whose type can not
+// be determined are checked when they are evaluated.
+func checkRule(compiler *ast.Compiler, rule string) error {
+
+	ref := ast.MustParseRef(policyPackage + "." + rule)
+
+	rules := compiler.GetRulesExact(ref)
+	if len(rules) == 0 {
+		return fmt.Errorf("Policy must implement the rule %s in package main", rule)
+	}
+
+	for _, r := range rules {
+		if len(r.Head.Args) > 0 || r.Head.Key != nil {
+			return fmt.Errorf("%s: rule %s must be a complete rule that returns a boolean", r.Location, rule)
+		}
+	}
+
+	tpe := compiler.TypeEnv.Get(ref)
+	if tpe != nil && !types.Contains(tpe, types.B) {
+		return fmt.Errorf("%s: rule %s must return a boolean; type is %s", rules[0].Location, rule, types.Sprint(tpe))
+	}
+
+	return nil
+}
+
+func copyModules(modules map[string]string) map[string]string {
+	clone := make(map[string]string, len(modules)+1)
+	for name, module := range modules {
+		clone[name] = module
+	}
+	return clone
+}
+
+// Eval evaluates rule with input and returns nil if authorized,
+// libtokenmachine.ErrDenied if not or if the rule is undefined for input, or
+// libtokenmachine.ErrServerFail if the policy did not return a boolean
+func (t *PolicyEngine) Eval(ctx context.Context, rule string, input *Input) error {
+	return t.eval(ctx, rule, input)
+}
+
+func (t *PolicyEngine) eval(ctx context.Context, rule string, input *Input, options ...rego.EvalOption) error {
+
+	query, ok := t.queries[rule]
+	if !ok {
+		zap.L().Error(fmt.Sprintf("Rule %s is not prepared", rule))
+		return libtokenmachine.ErrServerFail
+	}
+
+	start := time.Now()
+	results, err := query.Eval(ctx, append(options, rego.EvalInput(input))...)
+	if t.observer != nil {
+		t.observer.ObservePolicyEvaluation(rule, time.Since(start))
+	}
+
+	if err != nil {
+		zap.L().Error(fmt.Sprintf("Unexpected error on Rego policy execution; err->%s", err))
+		return libtokenmachine.ErrServerFail
+	}
+
+	// A rule without a default is undefined when none of its bodies match
+	if len(results) == 0 || len(results[0].Expressions) == 0 {
+		zap.L().Debug(fmt.Sprintf("Rule %s is undefined; denied", rule))
+		return libtokenmachine.ErrDenied
+	}
+
+	if auth, ok := results[0].Expressions[0].Value.(bool); ok {
+		if auth {
+			return nil
+		}
+		return libtokenmachine.ErrDenied
+	}
+
+	zap.L().Error(fmt.Sprintf("Unexpected error on Rego policy execution; unexpected result type"))
+	return libtokenmachine.ErrServerFail
+}
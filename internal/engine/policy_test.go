@@ -0,0 +1,190 @@
+/*
+Copyright © 2020 Jody Scott <jody@thescottsweb.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/jodydadescott/libtokenmachine"
+)
+
+const examplePolicy = `
+package main
+
+default auth_get_nonce = false
+default auth_get_keytab = false
+default auth_get_secret = false
+
+auth_base {
+   # Match Issuer
+   input.claims.iss == "abc123"
+}
+
+auth_get_nonce {
+   auth_base
+}
+
+auth_nonce {
+   # The input contains a set of all of the current valid nonces. For our
+   # example here we expect the claim audience to have a nonce that will match
+   # one of tne entries in the nonces set.
+   input.nonces[_] == input.claims.aud
+}
+
+auth_get_keytab {
+   auth_base
+   auth_nonce
+   split(input.claims.service.keytabs,":")[_] == input.name
+}
+
+auth_get_secret {
+   auth_base
+   auth_nonce
+   split(input.claims.service.secrets,":")[_] == input.name
+}
+`
+
+const exampleClaims = `
+{
+	"alg": "EC",
+	"kid": "donut",
+	"iss": "abc123",
+	"exp": 1599844897,
+	"aud": "daisy",
+	"service": {
+	  "keytabs": "user1:user2",
+	  "secrets": "secret1:secret2"
+	}
+}
+`
+
+func TestPolicyEval(t *testing.T) {
+
+	var claims map[string]interface{}
+	err := json.Unmarshal([]byte(exampleClaims), &claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	policy, err := (&PolicyConfig{Policy: examplePolicy}).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		rule  string
+		input *Input
+		err   error
+	}{
+		{"nonce", RuleGetNonce, &Input{Claims: claims}, nil},
+		{"keytab without nonce", RuleGetKeytab, &Input{Claims: claims, Nonces: []string{"none"}, Name: "user1"}, libtokenmachine.ErrDenied},
+		{"keytab", RuleGetKeytab, &Input{Claims: claims, Nonces: []string{"none", "daisy"}, Name: "user1"}, nil},
+		{"secret", RuleGetSecret, &Input{Claims: claims, Nonces: []string{"none", "daisy"}, Name: "secret1"}, nil},
+		{"secret not in claims", RuleGetSecret, &Input{Claims: claims, Nonces: []string{"none", "daisy"}, Name: "nosecret"}, libtokenmachine.ErrDenied},
+		{"unknown rule", "auth_other", &Input{Claims: claims}, libtokenmachine.ErrServerFail},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := policy.Eval(context.Background(), test.rule, test.input)
+			if !errors.Is(err, test.err) {
+				t.Errorf("err is %v; want %v", err, test.err)
+			}
+		})
+	}
+}
+
+// undefinedPolicy has no defaults so its rules are undefined unless a body
+// matches. auth_get_secret returns the input name.
+const undefinedPolicy = `
+package main
+
+auth_get_nonce {
+   input.claims.iss == "abc123"
+}
+
+auth_get_keytab = false {
+   input.name == "denied"
+}
+
+auth_get_secret = x {
+   x := input.name
+}
+`
+
+func TestPolicyEvalUndefined(t *testing.T) {
+
+	policy, err := (&PolicyConfig{Policy: undefinedPolicy}).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		rule  string
+		input *Input
+		err   error
+	}{
+		{"defined", RuleGetNonce, &Input{Claims: map[string]interface{}{"iss": "abc123"}}, nil},
+		{"undefined", RuleGetNonce, &Input{Claims: map[string]interface{}{"iss": "other"}}, libtokenmachine.ErrDenied},
+		{"no input", RuleGetNonce, &Input{}, libtokenmachine.ErrDenied},
+		{"false", RuleGetKeytab, &Input{Name: "denied"}, libtokenmachine.ErrDenied},
+		{"undefined false", RuleGetKeytab, &Input{Name: "other"}, libtokenmachine.ErrDenied},
+		{"not a boolean", RuleGetSecret, &Input{Name: "secret1"}, libtokenmachine.ErrServerFail},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := policy.Eval(context.Background(), test.rule, test.input)
+			if !errors.Is(err, test.err) {
+				t.Errorf("err is %v; want %v", err, test.err)
+			}
+		})
+	}
+}
+
+func TestPolicyValidate(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		policy string
+		ok     bool
+	}{
+		{"example", examplePolicy, true},
+		{"without defaults", undefinedPolicy, true},
+		{"empty", "", false},
+		{"parse error", "package main\n\nauth_get_nonce {", false},
+		{"wrong package", "package other\n\nauth_get_nonce = true\nauth_get_keytab = true\nauth_get_secret = true\n", false},
+		{"missing rule", "package main\n\nauth_get_nonce = true\nauth_get_keytab = true\n", false},
+		{"function", "package main\n\nauth_get_nonce(x) = true\nauth_get_keytab = true\nauth_get_secret = true\n", false},
+		{"partial set", "package main\n\nauth_get_nonce[x] { x := 1 }\nauth_get_keytab = true\nauth_get_secret = true\n", false},
+		{"string", "package main\n\nauth_get_nonce = \"yes\"\nauth_get_keytab = true\nauth_get_secret = true\n", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := (&PolicyConfig{Policy: test.policy}).Validate()
+			if (err == nil) != test.ok {
+				t.Errorf("err is %v; want ok %t", err, test.ok)
+			}
+		})
+	}
+}
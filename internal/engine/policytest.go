@@ -0,0 +1,250 @@
+/*
+Copyright © 2020 Jody Scott <jody@thescottsweb.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jodydadescott/libtokenmachine"
+	"github.com/open-policy-agent/opa/cover"
+	"github.com/open-policy-agent/opa/rego"
+	"github.com/open-policy-agent/opa/storage/inmem"
+	"github.com/open-policy-agent/opa/tester"
+	"github.com/open-policy-agent/opa/util"
+)
+
+// Actions that may be authorized by the policy
+const (
+	ActionGetNonce  = "get_nonce"
+	ActionGetKeytab = "get_keytab"
+	ActionGetSecret = "get_secret"
+)
+
+// GetRule returns the rule that authorizes action
+func GetRule(action string) (string, error) {
+
+	switch action {
+
+	case ActionGetNonce:
+		return RuleGetNonce, nil
+
+	case ActionGetKeytab:
+		return RuleGetKeytab, nil
+
+	case ActionGetSecret:
+		return RuleGetSecret, nil
+
+	}
+
+	return "", fmt.Errorf("Action %s is not valid; must be %s, %s or %s", action, ActionGetNonce, ActionGetKeytab, ActionGetSecret)
+}
+
+// PolicyFixture is a table driven test of the policy. The policy input is
+// built from Claims, Nonces, Nonce, Name and Certificate as it would be by the
+// server and Allow is the expected decision for Action.
+type PolicyFixture struct {
+	Description string                 `json:"description,omitempty" yaml:"description,omitempty"`
+	Action      string                 `json:"action,omitempty" yaml:"action,omitempty"`
+	Name        string                 `json:"name,omitempty" yaml:"name,omitempty"`
+	Claims      map[string]interface{} `json:"claims,omitempty" yaml:"claims,omitempty"`
+	Nonces      []string               `json:"nonces,omitempty" yaml:"nonces,omitempty"`
+	Nonce       *NonceInfo             `json:"nonce,omitempty" yaml:"nonce,omitempty"`
+	Certificate *ClientCertificate     `json:"certificate,omitempty" yaml:"certificate,omitempty"`
+	Allow       bool                   `json:"allow" yaml:"allow"`
+
+	location string
+}
+
+// ParsePolicyFixtures parses the YAML or JSON fixtures file with the name
+// name. The file is an object with the list fixtures.
+func ParsePolicyFixtures(name string, data []byte) ([]*PolicyFixture, error) {
+
+	var file struct {
+		Fixtures []*PolicyFixture `json:"fixtures"`
+	}
+
+	err := util.Unmarshal(data, &file)
+	if err != nil {
+		return nil, fmt.Errorf("Fixtures %s are not valid YAML or JSON; err->%s", name, err)
+	}
+
+	for i, fixture := range file.Fixtures {
+
+		if fixture == nil {
+			return nil, fmt.Errorf("Fixture %s#%d is empty", name, i+1)
+		}
+
+		fixture.location = fmt.Sprintf("%s#%d", name, i+1)
+
+		_, err := GetRule(fixture.Action)
+		if err != nil {
+			return nil, fmt.Errorf("Fixture %s is not valid; err->%s", fixture.location, err)
+		}
+	}
+
+	return file.Fixtures, nil
+}
+
+// PolicyTestResult is the result of a test rule or fixture
+type PolicyTestResult struct {
+	Name     string // Package and rule of a test rule or the description of a fixture
+	Location string // File and row of a test rule or file and index of a fixture
+	Fail     bool   // The test rule was not true or the fixture decision was not expected
+	Err      error  // The test could not be evaluated
+	Duration time.Duration
+}
+
+// Pass returns true if the test passed
+func (t *PolicyTestResult) Pass() bool {
+	return !t.Fail && t.Err == nil
+}
+
+// PolicyTestReport is the result of Test
+type PolicyTestReport struct {
+	Results  []*PolicyTestResult
+	Coverage *cover.Report // Only if coverage is requested
+}
+
+// Failed returns the number of tests that did not pass
+func (t *PolicyTestReport) Failed() int {
+	failed := 0
+	for _, result := range t.Results {
+		if !result.Pass() {
+			failed++
+		}
+	}
+	return failed
+}
+
+// Test compiles the policy, runs the rules prefixed with test_ in every
+// module as opa test does and evaluates fixtures. If coverage is true the
+// coverage of both is reported.
+func (config *PolicyConfig) Test(ctx context.Context, fixtures []*PolicyFixture, coverage bool) (*PolicyTestReport, error) {
+
+	policy, err := config.Build()
+	if err != nil {
+		return nil, err
+	}
+
+	modules, err := config.parse()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := config.data()
+	if err != nil {
+		return nil, err
+	}
+
+	var cov *cover.Cover
+	runner := tester.NewRunner().SetStore(inmem.NewFromObject(data))
+
+	if coverage {
+		cov = cover.New()
+		runner.SetCoverageQueryTracer(cov)
+	}
+
+	results, err := runner.Run(ctx, modules)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &PolicyTestReport{}
+
+	for result := range results {
+		report.Results = append(report.Results, &PolicyTestResult{
+			Name:     result.Package + "." + result.Name,
+			Location: result.Location.String(),
+			Fail:     result.Fail,
+			Err:      result.Error,
+			Duration: result.Duration,
+		})
+	}
+
+	var options []rego.EvalOption
+	if coverage {
+		options = append(options, rego.EvalQueryTracer(cov))
+	}
+
+	for _, fixture := range fixtures {
+
+		name := fixture.Description
+		if name == "" {
+			name = fmt.Sprintf("%s %s", fixture.Action, fixture.Name)
+		}
+
+		result := &PolicyTestResult{
+			Name:     name,
+			Location: fixture.location,
+		}
+
+		rule, err := GetRule(fixture.Action)
+		if err != nil {
+			result.Err = err
+			report.Results = append(report.Results, result)
+			continue
+		}
+
+		start := time.Now()
+		err = policy.eval(ctx, rule, fixture.input(), options...)
+		result.Duration = time.Since(start)
+
+		switch {
+
+		case err == nil:
+			result.Fail = !fixture.Allow
+
+		case errors.Is(err, libtokenmachine.ErrDenied):
+			result.Fail = fixture.Allow
+
+		default:
+			result.Err = fmt.Errorf("Rule %s did not return a boolean", rule)
+		}
+
+		report.Results = append(report.Results, result)
+	}
+
+	if coverage {
+		r := cov.Report(modules)
+		report.Coverage = &r
+	}
+
+	return report, nil
+}
+
+// input returns the policy input of the fixture. As with the server the
+// nonces and name are only provided for keytabs and secrets.
+func (t *PolicyFixture) input() *Input {
+
+	if t.Action == ActionGetNonce {
+		return &Input{
+			Claims:      t.Claims,
+			Certificate: t.Certificate,
+		}
+	}
+
+	return &Input{
+		Claims:      t.Claims,
+		Nonces:      t.Nonces,
+		Name:        t.Name,
+		Nonce:       t.Nonce,
+		Certificate: t.Certificate,
+	}
+}
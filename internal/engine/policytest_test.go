@@ -0,0 +1,171 @@
+/*
+Copyright © 2020 Jody Scott <jody@thescottsweb.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package engine
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+const testedPolicy = `
+package main
+
+default auth_get_nonce = false
+default auth_get_keytab = false
+default auth_get_secret = false
+
+auth_get_nonce {
+   input.claims.iss == "abc123"
+}
+
+auth_get_secret {
+   input.nonces[_] == input.claims.aud
+   data.secrets[_] == input.name
+}
+`
+
+const testedPolicyTests = `
+package main
+
+test_nonce_allowed {
+   auth_get_nonce with input as {"claims": {"iss": "abc123"}}
+}
+
+test_nonce_denied_fails {
+   auth_get_nonce with input as {"claims": {"iss": "other"}}
+}
+`
+
+const testedPolicyFixtures = `
+fixtures:
+- description: secret with nonce
+  action: get_secret
+  name: db
+  claims:
+    aud: n1
+  nonces: [n1]
+  allow: true
+- description: secret without nonce
+  action: get_secret
+  name: db
+  claims:
+    aud: n1
+  allow: false
+- description: nonce with the wrong expectation
+  action: get_nonce
+  claims:
+    iss: abc123
+  allow: false
+`
+
+func TestParsePolicyFixtures(t *testing.T) {
+
+	tests := []struct {
+		name  string
+		data  string
+		count int
+		err   string
+	}{
+		{"yaml", testedPolicyFixtures, 3, ""},
+		{"json", `{"fixtures": [{"action": "get_keytab", "name": "web", "allow": true}]}`, 1, ""},
+		{"none", `{}`, 0, ""},
+		{"invalid", "{", 0, "not valid YAML or JSON"},
+		{"empty fixture", "fixtures:\n- \n", 0, "fixtures.yaml#1 is empty"},
+		{"invalid action", "fixtures:\n- action: get_nonce\n- action: delete\n", 0, "fixtures.yaml#2"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			fixtures, err := ParsePolicyFixtures("fixtures.yaml", []byte(test.data))
+
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("err is %v; want %s", err, test.err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(fixtures) != test.count {
+				t.Errorf("got %d fixtures; want %d", len(fixtures), test.count)
+			}
+		})
+	}
+}
+
+func TestPolicyTest(t *testing.T) {
+
+	fixtures, err := ParsePolicyFixtures("fixtures.yaml", []byte(testedPolicyFixtures))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &PolicyConfig{
+		Policy:  testedPolicy,
+		Modules: map[string]string{"policy_test.rego": testedPolicyTests},
+		Data:    []*DataDocument{{Path: "secrets", Value: []interface{}{"db"}}},
+	}
+
+	report, err := config.Test(context.Background(), fixtures, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]bool{
+		"data.main.test_nonce_allowed":      true,
+		"data.main.test_nonce_denied_fails": false,
+		"secret with nonce":                 true,
+		"secret without nonce":              true,
+		"nonce with the wrong expectation":  false,
+	}
+
+	if len(report.Results) != len(expected) {
+		t.Fatalf("got %d results; want %d", len(report.Results), len(expected))
+	}
+
+	for _, result := range report.Results {
+
+		pass, ok := expected[result.Name]
+		if !ok {
+			t.Errorf("unexpected result %s", result.Name)
+			continue
+		}
+
+		if result.Pass() != pass {
+			t.Errorf("%s at %s pass is %t; want %t; err->%v", result.Name, result.Location, result.Pass(), pass, result.Err)
+		}
+	}
+
+	if report.Failed() != 2 {
+		t.Errorf("failed is %d; want 2", report.Failed())
+	}
+
+	if report.Coverage == nil || report.Coverage.Coverage == 0 {
+		t.Errorf("coverage is not reported")
+	}
+
+	// The policy must compile to be tested
+	_, err = (&PolicyConfig{Policy: "package main\n\nauth_get_nonce {"}).Test(context.Background(), nil, false)
+	if err == nil {
+		t.Errorf("expected error")
+	}
+}
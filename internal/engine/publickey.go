@@ -0,0 +1,378 @@
+/*
+Copyright © 2020 Jody Scott <jody@thescottsweb.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package engine
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jodydadescott/libtokenmachine"
+	"go.uber.org/zap"
+)
+
+// PublicKey ...
+type PublicKey struct {
+	Key crypto.PublicKey `json:"-"`
+	Iss string
+	Kid string
+	Kty string
+	Exp int64
+}
+
+// JSON Return JSON String representation
+func (t *PublicKey) JSON() string {
+	j, _ := json.Marshal(t)
+	return string(j)
+}
+
+// PublicKeyConfig The config
+type PublicKeyConfig struct {
+	CacheRefreshInterval, RequestTimeout time.Duration
+	IdleConnections                      int
+}
+
+// PublicKeyCache fetches public keys by following the token issuer and caches
+// them
+type PublicKeyCache struct {
+	httpClient *http.Client
+	mutex      sync.RWMutex
+	internal   map[string]*PublicKey
+	closed     chan struct{}
+	ticker     *time.Ticker
+	wg         sync.WaitGroup
+}
+
+// Build Returns a new PublicKey Cache
+func (config *PublicKeyConfig) Build() (*PublicKeyCache, error) {
+
+	zap.L().Debug("Starting")
+
+	cacheRefreshInterval := defaultCacheRefreshInterval
+	requestTimeout := publicKeyDefaultRequestTimeout
+	idleConnections := publicKeyDefaultIdleConnections
+
+	if config.CacheRefreshInterval > 0 {
+		cacheRefreshInterval = config.CacheRefreshInterval
+	}
+
+	if config.RequestTimeout > 0 {
+		requestTimeout = config.RequestTimeout
+	}
+
+	if config.IdleConnections > 0 {
+		idleConnections = config.IdleConnections
+	}
+
+	t := &PublicKeyCache{
+		internal: make(map[string]*PublicKey),
+		closed:   make(chan struct{}),
+		ticker:   time.NewTicker(cacheRefreshInterval),
+		httpClient: &http.Client{
+			Transport: &http.Transport{
+				MaxIdleConnsPerHost: idleConnections,
+			},
+			Timeout: requestTimeout,
+		},
+	}
+
+	t.wg.Add(1)
+	go t.run()
+	return t, nil
+
+}
+
+func (t *PublicKeyCache) run() {
+	defer t.wg.Done()
+	for {
+		select {
+		case <-t.closed:
+			t.ticker.Stop()
+			return
+		case <-t.ticker.C:
+			t.cleanup()
+		}
+	}
+}
+
+func (t *PublicKeyCache) cleanup() {
+
+	zap.L().Debug("Running PublicKey cleanup")
+
+	var removes []string
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for key, e := range t.internal {
+		if time.Now().Unix() > e.Exp {
+			removes = append(removes, key)
+			zap.L().Info(fmt.Sprintf("Ejecting PublicKey->%s", e.JSON()))
+		}
+	}
+
+	for _, key := range removes {
+		delete(t.internal, key)
+	}
+
+	zap.L().Debug("Completed PublicKey cleanup")
+
+}
+
+// GetKey Returns PublicKey from cache if found. If not gets PublicKey from
+// validated issuer, stores in cache and returns
+func (t *PublicKeyCache) GetKey(iss, kid string) (*PublicKey, error) {
+
+	key := iss + ":" + kid
+
+	t.mutex.RLock()
+	publicKey, exist := t.internal[key]
+	t.mutex.RUnlock()
+
+	if exist {
+		return publicKey, nil
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	publicKey, exist = t.internal[key]
+	if exist {
+		return publicKey, nil
+	}
+
+	openIDConfiguration, err := t.getOpenIDConfiguration(iss)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, config := range *openIDConfiguration {
+
+		if !strings.HasPrefix(config.JwksURI, "https://") {
+			zap.L().Debug(fmt.Sprintf("JWKS URL %s malformed", config.JwksURI))
+			continue
+		}
+
+		jwks, err := t.getJWKs(config.JwksURI)
+		if err != nil {
+			zap.L().Error(err.Error())
+			continue
+		}
+
+		for _, jwk := range jwks.Keys {
+			if jwk.Kid == kid {
+				publicKey, err := newKey(&jwk)
+				if err != nil {
+					zap.L().Error(err.Error())
+					continue
+				}
+				publicKey.Iss = iss
+				t.internal[key] = publicKey
+				zap.L().Debug(fmt.Sprintf("key for iss %s and kid %s created and added to cache", iss, kid))
+				return publicKey, nil
+			}
+		}
+
+	}
+
+	return nil, libtokenmachine.ErrNotFound
+}
+
+func (t *PublicKeyCache) getOpenIDConfiguration(fqdn string) (*openIDConfiguration, error) {
+
+	resp, err := t.httpClient.Get(fqdn)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	return openIDConfigurationFromJSON(b)
+}
+
+func (t *PublicKeyCache) getJWKs(fqdn string) (*jwks, error) {
+
+	resp, err := t.httpClient.Get(fqdn)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var result jwks
+	err = json.Unmarshal(b, &result)
+	if err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+type openIDConfiguration []struct {
+	Issuer  string `json:"issuer,omitempty"`
+	JwksURI string `json:"jwks_uri,omitempty"`
+}
+
+func openIDConfigurationFromJSON(b []byte) (*openIDConfiguration, error) {
+
+	var t openIDConfiguration
+	err := json.Unmarshal(b, &t)
+	if err == nil {
+		return &t, nil
+	}
+
+	// Standard OpenID providers return a single object rather then an array
+	var single struct {
+		Issuer  string `json:"issuer,omitempty"`
+		JwksURI string `json:"jwks_uri,omitempty"`
+	}
+
+	err = json.Unmarshal(b, &single)
+	if err != nil {
+		return nil, err
+	}
+
+	t = append(t, single)
+	return &t, nil
+}
+
+type jwk struct {
+	Kty string `json:"kty,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	E   string `json:"e,omitempty"`
+	N   string `json:"n,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+type jwks struct {
+	Keys []jwk `json:"keys"`
+}
+
+func newKey(jwk *jwk) (*PublicKey, error) {
+
+	if jwk.Kty == "" {
+		return nil, fmt.Errorf("Kty is empty")
+	}
+
+	switch jwk.Kty {
+	case "EC":
+		return newKeyEC(jwk)
+	case "RSA":
+		return newKeyRSA(jwk)
+	}
+
+	return nil, fmt.Errorf("jwk kty type %s not supported", jwk.Kty)
+}
+
+func newKeyEC(jwk *jwk) (*PublicKey, error) {
+
+	var curve elliptic.Curve
+
+	curveName := jwk.Crv
+	if curveName == "" {
+		curveName = jwk.Alg
+	}
+
+	switch curveName {
+
+	case "ES224", "P-224":
+		curve = elliptic.P224()
+	case "ES256", "P-256":
+		curve = elliptic.P256()
+	case "ES384", "P-384":
+		curve = elliptic.P384()
+	case "ES512", "ES521", "P-521":
+		curve = elliptic.P521()
+
+	default:
+		return nil, fmt.Errorf("Curve %s not supported", curveName)
+	}
+
+	byteX, err := base64.RawURLEncoding.DecodeString(jwk.X)
+	if err != nil {
+		return nil, err
+	}
+
+	byteY, err := base64.RawURLEncoding.DecodeString(jwk.Y)
+	if err != nil {
+		return nil, err
+	}
+
+	return &PublicKey{
+		Key: &ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(byteX),
+			Y:     new(big.Int).SetBytes(byteY),
+		},
+		Exp: time.Now().Unix() + int64(publicKeyDefaultKeyLifetime),
+		Kid: jwk.Kid,
+		Kty: jwk.Kty,
+	}, nil
+
+}
+
+func newKeyRSA(jwk *jwk) (*PublicKey, error) {
+
+	byteN, err := base64.RawURLEncoding.DecodeString(jwk.N)
+	if err != nil {
+		return nil, err
+	}
+
+	byteE, err := base64.RawURLEncoding.DecodeString(jwk.E)
+	if err != nil {
+		return nil, err
+	}
+
+	return &PublicKey{
+		Key: &rsa.PublicKey{
+			N: new(big.Int).SetBytes(byteN),
+			E: int(new(big.Int).SetBytes(byteE).Int64()),
+		},
+		Exp: time.Now().Unix() + int64(publicKeyDefaultKeyLifetime),
+		Kid: jwk.Kid,
+		Kty: jwk.Kty,
+	}, nil
+}
+
+// Shutdown Cache
+func (t *PublicKeyCache) Shutdown() {
+	zap.L().Debug("Stopping")
+	close(t.closed)
+	t.wg.Wait()
+}
@@ -0,0 +1,131 @@
+/*
+Copyright © 2020 Jody Scott <jody@thescottsweb.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package engine
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"math/big"
+	"testing"
+)
+
+func TestNewKey(t *testing.T) {
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encode := func(b []byte) string {
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+
+	ecJWK := jwk{Kty: "EC", Kid: "ec", Crv: "P-256", X: encode(ecKey.X.Bytes()), Y: encode(ecKey.Y.Bytes())}
+	ecAlgJWK := jwk{Kty: "EC", Kid: "ec", Alg: "ES256", X: encode(ecKey.X.Bytes()), Y: encode(ecKey.Y.Bytes())}
+	rsaJWK := jwk{Kty: "RSA", Kid: "rsa", N: encode(rsaKey.N.Bytes()), E: encode(big.NewInt(int64(rsaKey.E)).Bytes())}
+
+	tests := []struct {
+		name    string
+		jwk     jwk
+		invalid bool
+	}{
+		{"ec", ecJWK, false},
+		{"ec alg", ecAlgJWK, false},
+		{"rsa", rsaJWK, false},
+		{"missing kty", jwk{Kid: "x"}, true},
+		{"unsupported kty", jwk{Kty: "oct", Kid: "x"}, true},
+		{"unsupported curve", jwk{Kty: "EC", Kid: "x", Crv: "P-999"}, true},
+		{"bad x", jwk{Kty: "EC", Kid: "x", Crv: "P-256", X: "!"}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			key, err := newKey(&test.jwk)
+			if (err != nil) != test.invalid {
+				t.Fatalf("err is %v; want invalid=%t", err, test.invalid)
+			}
+
+			if err != nil {
+				return
+			}
+
+			switch k := key.Key.(type) {
+			case *ecdsa.PublicKey:
+				if !k.Equal(ecKey.Public()) {
+					t.Errorf("EC key does not match")
+				}
+			case *rsa.PublicKey:
+				if !k.Equal(rsaKey.Public()) {
+					t.Errorf("RSA key does not match")
+				}
+			default:
+				t.Errorf("unexpected key type %T", key.Key)
+			}
+
+			if key.Kid != test.jwk.Kid || key.Kty != test.jwk.Kty {
+				t.Errorf("kid or kty not set")
+			}
+		})
+	}
+}
+
+func TestOpenIDConfigurationFromJSON(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		json    string
+		uris    []string
+		invalid bool
+	}{
+		{"object", `{"issuer":"https://a","jwks_uri":"https://a/keys"}`, []string{"https://a/keys"}, false},
+		{"array", `[{"issuer":"https://a","jwks_uri":"https://a/keys"},{"jwks_uri":"https://b/keys"}]`, []string{"https://a/keys", "https://b/keys"}, false},
+		{"invalid", `{`, nil, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			config, err := openIDConfigurationFromJSON([]byte(test.json))
+			if (err != nil) != test.invalid {
+				t.Fatalf("err is %v; want invalid=%t", err, test.invalid)
+			}
+
+			if err != nil {
+				return
+			}
+
+			if len(*config) != len(test.uris) {
+				t.Fatalf("got %d configurations; want %d", len(*config), len(test.uris))
+			}
+
+			for i, c := range *config {
+				if c.JwksURI != test.uris[i] {
+					t.Errorf("jwks_uri is %s; want %s", c.JwksURI, test.uris[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,170 @@
+/*
+Copyright © 2020 Jody Scott <jody@thescottsweb.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ErrNonceUsed is returned when single use nonces are enabled and the nonce or
+// token of the request has already been used
+var ErrNonceUsed = errors.New("Nonce already used")
+
+// ReplayConfig Config
+type ReplayConfig struct {
+	CacheRefreshInterval time.Duration
+	Size                 int // Max entries (default is 100000)
+}
+
+// ReplayCache records used nonces and token ids (jti) until they expire so
+// that they can only be used once. The cache is bounded; if it is full the
+// entries that expire soonest are evicted to make room.
+type ReplayCache struct {
+	mutex    sync.Mutex
+	internal map[string]int64
+	size     int
+	closed   chan struct{}
+	ticker   *time.Ticker
+	wg       sync.WaitGroup
+}
+
+// Build Returns a new Cache
+func (config *ReplayConfig) Build() (*ReplayCache, error) {
+
+	zap.L().Debug("Starting")
+
+	cacheRefreshInterval := defaultCacheRefreshInterval
+
+	if config.CacheRefreshInterval > 0 {
+		cacheRefreshInterval = config.CacheRefreshInterval
+	}
+
+	t := &ReplayCache{
+		internal: make(map[string]int64),
+		closed:   make(chan struct{}),
+		ticker:   time.NewTicker(cacheRefreshInterval),
+	}
+
+	t.SetSize(config.Size)
+
+	t.wg.Add(1)
+	go t.run()
+	return t, nil
+}
+
+func (t *ReplayCache) run() {
+	defer t.wg.Done()
+	for {
+		select {
+		case <-t.closed:
+			t.ticker.Stop()
+			return
+		case <-t.ticker.C:
+			t.mutex.Lock()
+			t.cleanup(time.Now().Unix())
+			t.mutex.Unlock()
+		}
+	}
+}
+
+// cleanup removes expired entries. Caller must hold the lock.
+func (t *ReplayCache) cleanup(now int64) {
+	for key, exp := range t.internal {
+		if now > exp {
+			delete(t.internal, key)
+		}
+	}
+}
+
+// Use records keys as used until exp. If any of the keys has already been
+// used ErrNonceUsed is returned and nothing is recorded.
+func (t *ReplayCache) Use(keys []string, exp int64) error {
+
+	now := time.Now().Unix()
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for _, key := range keys {
+		if used, ok := t.internal[key]; ok && now <= used {
+			return ErrNonceUsed
+		}
+	}
+
+	if len(t.internal)+len(keys) > t.size {
+		t.cleanup(now)
+		if len(t.internal)+len(keys) > t.size {
+			t.evict(len(t.internal) + len(keys) - t.size)
+		}
+	}
+
+	for _, key := range keys {
+		t.internal[key] = exp
+	}
+
+	return nil
+}
+
+// evict removes the n entries that expire soonest. These are the entries that
+// would be removed by cleanup next so the window in which an evicted nonce or
+// token can be used again is the shortest. Caller must hold the lock.
+func (t *ReplayCache) evict(n int) {
+
+	keys := make([]string, 0, len(t.internal))
+	for key := range t.internal {
+		keys = append(keys, key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return t.internal[keys[i]] < t.internal[keys[j]]
+	})
+
+	if n > len(keys) {
+		n = len(keys)
+	}
+
+	for _, key := range keys[:n] {
+		delete(t.internal, key)
+	}
+
+	zap.L().Warn(fmt.Sprintf("Replay cache is full with %d entries; evicted %d entries that expire soonest", t.size, n))
+}
+
+// SetSize sets the max entries. If size is 0 the default is used.
+func (t *ReplayCache) SetSize(size int) {
+
+	if size <= 0 {
+		size = replayDefaultSize
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.size = size
+}
+
+// Shutdown shutdowns the cache map
+func (t *ReplayCache) Shutdown() {
+	zap.L().Debug("Stopping")
+	close(t.closed)
+	t.wg.Wait()
+}
@@ -0,0 +1,198 @@
+/*
+Copyright © 2020 Jody Scott <jody@thescottsweb.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jodydadescott/libtokenmachine"
+)
+
+func newTestReplayCache(t *testing.T, size int) *ReplayCache {
+
+	replay, err := (&ReplayConfig{Size: size}).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(replay.Shutdown)
+	return replay
+}
+
+func TestReplayCacheUse(t *testing.T) {
+
+	now := time.Now().Unix()
+
+	type use struct {
+		keys []string
+		exp  int64
+		err  error
+	}
+
+	tests := []struct {
+		name string
+		size int
+		uses []use
+	}{
+		{"used once", 10, []use{
+			{[]string{"nonce:a", "jti:a"}, now + 60, nil},
+			{[]string{"nonce:a"}, now + 60, ErrNonceUsed},
+			{[]string{"jti:a"}, now + 60, ErrNonceUsed},
+			{[]string{"nonce:b", "jti:a"}, now + 60, ErrNonceUsed},
+			{[]string{"nonce:b"}, now + 60, nil},
+		}},
+		{"nothing recorded when refused", 10, []use{
+			{[]string{"nonce:a"}, now + 60, nil},
+			{[]string{"nonce:b", "nonce:a"}, now + 60, ErrNonceUsed},
+			{[]string{"nonce:b"}, now + 60, nil},
+		}},
+		{"expired", 10, []use{
+			{[]string{"nonce:a"}, now - 1, nil},
+			{[]string{"nonce:a"}, now + 60, nil},
+			{[]string{"nonce:a"}, now + 60, ErrNonceUsed},
+		}},
+		{"full of expired entries", 2, []use{
+			{[]string{"nonce:a", "nonce:b"}, now - 1, nil},
+			{[]string{"nonce:c", "nonce:d"}, now + 60, nil},
+			{[]string{"nonce:c"}, now + 60, ErrNonceUsed},
+		}},
+		{"full evicts entries that expire soonest", 3, []use{
+			{[]string{"nonce:a"}, now + 30, nil},
+			{[]string{"nonce:b"}, now + 10, nil},
+			{[]string{"nonce:c"}, now + 20, nil},
+			{[]string{"nonce:d"}, now + 60, nil},
+			{[]string{"nonce:a"}, now + 60, ErrNonceUsed},
+			{[]string{"nonce:c"}, now + 60, ErrNonceUsed},
+			{[]string{"nonce:d"}, now + 60, ErrNonceUsed},
+			{[]string{"nonce:b"}, now + 60, nil},
+		}},
+		{"full evicts for each key", 3, []use{
+			{[]string{"nonce:a", "nonce:b", "nonce:c"}, now + 60, nil},
+			{[]string{"nonce:d", "jti:d"}, now + 60, nil},
+			{[]string{"jti:d"}, now + 60, ErrNonceUsed},
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			replay := newTestReplayCache(t, test.size)
+
+			for i, use := range test.uses {
+
+				err := replay.Use(use.keys, use.exp)
+				if err != use.err {
+					t.Fatalf("use %d of %s is %v; want %v", i, strings.Join(use.keys, ","), err, use.err)
+				}
+
+				if len(replay.internal) > test.size {
+					t.Fatalf("cache has %d entries; max is %d", len(replay.internal), test.size)
+				}
+			}
+		})
+	}
+}
+
+func TestReplayCacheFullIsNotServerFail(t *testing.T) {
+
+	replay := newTestReplayCache(t, 100)
+	exp := time.Now().Unix() + 60
+
+	for i := 0; i < 1000; i++ {
+		err := replay.Use([]string{fmt.Sprintf("nonce:%d", i)}, exp)
+		if errors.Is(err, libtokenmachine.ErrServerFail) {
+			t.Fatalf("use %d failed with a full cache", i)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestUseNonce(t *testing.T) {
+
+	nonces := newTestNonceCache(t, "")
+	nonce, err := nonces.NewNonce("https://issuer", "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newEngine := func(singleUse bool) *Engine {
+		return &Engine{
+			nonce:          nonces,
+			replay:         newTestReplayCache(t, 10),
+			singleUseNonce: singleUse,
+		}
+	}
+
+	exp := time.Now().Unix() + 60
+
+	tests := []struct {
+		name      string
+		singleUse bool
+		tokens    []*libtokenmachine.Token
+		errs      []error
+	}{
+		{"disabled", false, []*libtokenmachine.Token{
+			{Iss: "https://issuer", Exp: exp, Claims: map[string]interface{}{"aud": nonce.Value}},
+			{Iss: "https://issuer", Exp: exp, Claims: map[string]interface{}{"aud": nonce.Value}},
+		}, []error{nil, nil}},
+		{"nonce in aud", true, []*libtokenmachine.Token{
+			{Iss: "https://issuer", Exp: exp, Claims: map[string]interface{}{"aud": nonce.Value}},
+			{Iss: "https://issuer", Exp: exp, Claims: map[string]interface{}{"aud": []interface{}{"api", nonce.Value}}},
+		}, []error{nil, ErrNonceUsed}},
+		{"jti", true, []*libtokenmachine.Token{
+			{Iss: "https://issuer", Exp: exp, Claims: map[string]interface{}{"jti": "1"}},
+			{Iss: "https://issuer", Exp: exp, Claims: map[string]interface{}{"jti": "1"}},
+			{Iss: "https://other", Exp: exp, Claims: map[string]interface{}{"jti": "1"}},
+		}, []error{nil, ErrNonceUsed, nil}},
+		{"nothing to record", true, []*libtokenmachine.Token{
+			{Iss: "https://issuer", Exp: exp, Claims: map[string]interface{}{"aud": "api"}},
+			{Iss: "https://issuer", Exp: exp, Claims: map[string]interface{}{"aud": "api"}},
+		}, []error{nil, nil}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			engine := newEngine(test.singleUse)
+
+			for i, token := range test.tokens {
+				if err := engine.useNonce(token); err != test.errs[i] {
+					t.Errorf("use %d is %v; want %v", i, err, test.errs[i])
+				}
+			}
+		})
+	}
+}
+
+func TestSingleUseNonceWithNonceKey(t *testing.T) {
+
+	_, err := (&Config{
+		Policy:         examplePolicy,
+		SingleUseNonce: true,
+		NonceKey:       testNonceKey,
+	}).Build()
+
+	if err == nil || !strings.Contains(err.Error(), "SingleUseNonce") {
+		t.Errorf("err is %v; want SingleUseNonce error", err)
+	}
+}
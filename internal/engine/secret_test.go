@@ -0,0 +1,107 @@
+/*
+Copyright © 2020 Jody Scott <jody@thescottsweb.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package engine
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jodydadescott/libtokenmachine"
+)
+
+func TestSecretConfig(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		config  *SecretConfig
+		invalid bool
+	}{
+		{"empty", &SecretConfig{}, false},
+		{"valid", &SecretConfig{Secrets: []*libtokenmachine.SharedSecret{{Name: "a", Seed: "seed"}}}, false},
+		{"missing name", &SecretConfig{Secrets: []*libtokenmachine.SharedSecret{{Seed: "seed"}}}, true},
+		{"missing seed", &SecretConfig{Secrets: []*libtokenmachine.SharedSecret{{Name: "a"}}}, true},
+		{"short lifetime", &SecretConfig{Lifetime: time.Second}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := test.config.Build()
+			if (err != nil) != test.invalid {
+				t.Errorf("err is %v; want invalid=%t", err, test.invalid)
+			}
+		})
+	}
+}
+
+func TestGetSecret(t *testing.T) {
+
+	secrets, err := (&SecretConfig{
+		Secrets: []*libtokenmachine.SharedSecret{
+			{Name: "a", Seed: "seed a"},
+			{Name: "b", Seed: "seed b"},
+			{Name: "short", Seed: "seed a", Lifetime: time.Minute},
+		},
+		Lifetime: time.Hour,
+	}).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a1, err := secrets.GetSecret("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a2, _ := secrets.GetSecret("a")
+	b, _ := secrets.GetSecret("b")
+	short, _ := secrets.GetSecret("short")
+
+	if a1.Secret == "" || a1.Secret != a2.Secret {
+		t.Errorf("secret is not stable within the period")
+	}
+
+	if a1.Secret == b.Secret {
+		t.Errorf("secrets with different seeds are the same")
+	}
+
+	now := time.Now().Unix()
+
+	// Exp is the start of the current period
+	if a1.Exp > now || a1.Exp <= now-int64(time.Hour.Seconds()) || a1.Exp%int64(time.Hour.Seconds()) != 0 {
+		t.Errorf("exp %d is not the start of the current period", a1.Exp)
+	}
+
+	if a1.Lifetime != time.Hour || short.Lifetime != time.Minute {
+		t.Errorf("lifetimes are %s and %s; want %s and %s", a1.Lifetime, short.Lifetime, time.Hour, time.Minute)
+	}
+
+	if short.Exp <= now-int64(time.Minute.Seconds()) {
+		t.Errorf("exp %d does not use the lifetime of the secret", short.Exp)
+	}
+
+	if a1.NextSecret != "" && a1.NextExp != a1.Exp+int64(time.Hour.Seconds()) {
+		t.Errorf("next exp %d is not the start of the next period", a1.NextExp)
+	}
+
+	for _, name := range []string{"", "missing"} {
+		_, err = secrets.GetSecret(name)
+		if !errors.Is(err, libtokenmachine.ErrNotFound) {
+			t.Errorf("GetSecret(%q) err is %v; want ErrNotFound", name, err)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+/*
+Copyright © 2020 Jody Scott <jody@thescottsweb.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package engine
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimePeriod(t *testing.T) {
+
+	tests := []struct {
+		name              string
+		duration          time.Duration
+		now               time.Time
+		prev, start, next time.Time
+	}{
+		{
+			"two minutes", 2 * time.Minute, time.Date(2020, 3, 12, 14, 10, 0, 0, time.UTC),
+			time.Date(2020, 3, 12, 14, 8, 0, 0, time.UTC), time.Date(2020, 3, 12, 14, 10, 0, 0, time.UTC), time.Date(2020, 3, 12, 14, 12, 0, 0, time.UTC),
+		},
+		{
+			"twelve minutes", 12 * time.Minute, time.Date(2022, 1, 12, 18, 10, 0, 0, time.UTC),
+			time.Date(2022, 1, 12, 17, 48, 0, 0, time.UTC), time.Date(2022, 1, 12, 18, 0, 0, 0, time.UTC), time.Date(2022, 1, 12, 18, 12, 0, 0, time.UTC),
+		},
+		{
+			"two hours", 2 * time.Hour, time.Date(2022, 1, 19, 18, 13, 0, 0, time.UTC),
+			time.Date(2022, 1, 19, 16, 0, 0, 0, time.UTC), time.Date(2022, 1, 19, 18, 0, 0, 0, time.UTC), time.Date(2022, 1, 19, 20, 0, 0, 0, time.UTC),
+		},
+		{
+			"epoch", time.Hour, time.Unix(60, 0),
+			time.Unix(0, 0), time.Unix(0, 0), time.Unix(3600, 0),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			period := NewPeriod(test.duration).From(test.now)
+
+			if !period.Time().Equal(test.start) {
+				t.Errorf("start is %s; want %s", period.Time().UTC(), test.start)
+			}
+
+			if !period.Next().Time().Equal(test.next) {
+				t.Errorf("next is %s; want %s", period.Next().Time().UTC(), test.next)
+			}
+
+			if !period.Prev().Time().Equal(test.prev) {
+				t.Errorf("prev is %s; want %s", period.Prev().Time().UTC(), test.prev)
+			}
+		})
+	}
+}
+
+func TestTimePeriodHalfLife(t *testing.T) {
+
+	period := NewPeriod(time.Hour).From(time.Date(2022, 1, 19, 18, 0, 0, 0, time.UTC))
+
+	tests := []struct {
+		now      time.Time
+		halfLife bool
+	}{
+		{time.Date(2022, 1, 19, 18, 27, 0, 0, time.UTC), false},
+		{time.Date(2022, 1, 19, 18, 30, 0, 0, time.UTC), false},
+		{time.Date(2022, 1, 19, 18, 44, 0, 0, time.UTC), true},
+	}
+
+	for _, test := range tests {
+		if got := period.HalfLife(test.now); got != test.halfLife {
+			t.Errorf("HalfLife(%s) is %t; want %t", test.now, got, test.halfLife)
+		}
+	}
+}
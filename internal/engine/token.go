@@ -0,0 +1,257 @@
+/*
+Copyright © 2020 Jody Scott <jody@thescottsweb.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package engine
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/jodydadescott/libtokenmachine"
+	"go.uber.org/zap"
+)
+
+// PublicKeyInterface PublicKeyCache
+type PublicKeyInterface interface {
+	GetKey(iss, kid string) (*PublicKey, error)
+}
+
+// TokenConfig The config
+type TokenConfig struct {
+	CacheRefreshInterval time.Duration
+	Trust                *TrustStore // Optional trusted issuers
+	PermitPublicKeyHTTP  bool        // Accept issuers with a http:// iss; default is https only as in libtokenmachine
+}
+
+// TokenCache Parses and verifies tokens by fetching public keys from the token
+// issuer and caching public keys for future use. Tokens that are verified are
+// also stored in the cache for quicker validation in the future.
+//
+// If a TrustStore is set only tokens from its issuers are accepted and they
+// are verified with the keys of the issuer rather than by following the
+// issuer.
+type TokenCache struct {
+	tokenMapMutex       sync.RWMutex
+	tokenMap            map[string]*libtokenmachine.Token
+	closed              chan struct{}
+	ticker              *time.Ticker
+	wg                  sync.WaitGroup
+	permitPublicKeyHTTP bool
+	publicKeyCache      PublicKeyInterface
+	trust               *TrustStore
+}
+
+// Build returns new instance of cache from config
+func (config *TokenConfig) Build(publicKeyCache PublicKeyInterface) (*TokenCache, error) {
+
+	zap.L().Debug("Starting")
+
+	cacheRefreshInterval := defaultCacheRefreshInterval
+
+	if config.CacheRefreshInterval > 0 {
+		cacheRefreshInterval = config.CacheRefreshInterval
+	}
+
+	t := &TokenCache{
+		tokenMap:            make(map[string]*libtokenmachine.Token),
+		closed:              make(chan struct{}),
+		ticker:              time.NewTicker(cacheRefreshInterval),
+		permitPublicKeyHTTP: config.PermitPublicKeyHTTP,
+		publicKeyCache:      publicKeyCache,
+		trust:               config.Trust,
+	}
+
+	t.wg.Add(1)
+	go t.run()
+	return t, nil
+}
+
+func (t *TokenCache) run() {
+	defer t.wg.Done()
+	for {
+		select {
+		case <-t.closed:
+			t.ticker.Stop()
+			return
+		case <-t.ticker.C:
+			t.cleanup()
+		}
+	}
+}
+
+func (t *TokenCache) mapGetToken(key string) *libtokenmachine.Token {
+	t.tokenMapMutex.RLock()
+	defer t.tokenMapMutex.RUnlock()
+	return t.tokenMap[key]
+}
+
+func (t *TokenCache) mapPutToken(key string, entity *libtokenmachine.Token) {
+	t.tokenMapMutex.Lock()
+	defer t.tokenMapMutex.Unlock()
+	t.tokenMap[key] = entity
+}
+
+// ParseToken parses and verifies the token
+func (t *TokenCache) ParseToken(tokenString string) (*libtokenmachine.Token, error) {
+
+	if tokenString == "" {
+		zap.L().Debug("tokenString is empty")
+		return nil, libtokenmachine.ErrTokenInvalid
+	}
+
+	t.tokenMapMutex.RLock()
+	trust := t.trust
+	t.tokenMapMutex.RUnlock()
+
+	token := t.mapGetToken(tokenString)
+
+	if token != nil {
+		if time.Now().Unix() > token.Exp {
+			zap.L().Debug("Cached token is expired")
+			return nil, libtokenmachine.ErrExpired
+		}
+		return token, nil
+	}
+
+	token, err := libtokenmachine.ParseToken(tokenString)
+	if err != nil {
+		zap.L().Debug("Unable to parse token")
+		return nil, libtokenmachine.ErrTokenInvalid
+	}
+
+	if token.Alg == "" {
+		zap.L().Debug("Token is missing required field alg")
+		return nil, libtokenmachine.ErrTokenInvalid
+	}
+
+	if trust != nil {
+		// Trusted tokens are not cached as the clock skew of the issuer
+		// applies to exp
+		err = trust.Verify(tokenString, token)
+		if err != nil {
+			return nil, err
+		}
+		return token, nil
+	}
+
+	if token.Kid == "" {
+		zap.L().Debug("Token is missing required field kid")
+		return nil, libtokenmachine.ErrTokenInvalid
+	}
+
+	if token.Typ == "" {
+		zap.L().Debug("Token is missing required field typ")
+		return nil, libtokenmachine.ErrTokenInvalid
+	}
+
+	if token.Iss == "" {
+		zap.L().Debug("Token is missing required field iss")
+		return nil, libtokenmachine.ErrTokenInvalid
+	}
+
+	if !strings.HasPrefix(token.Iss, "http") {
+		zap.L().Debug(fmt.Sprintf("Token has field iss but value %s is not expected", token.Iss))
+		return nil, libtokenmachine.ErrTokenInvalid
+	}
+
+	if !t.permitPublicKeyHTTP {
+		if !strings.HasPrefix(token.Iss, "https") {
+			zap.L().Debug(fmt.Sprintf("Token has field iss but value %s is not permitted as https is required", token.Iss))
+			return nil, libtokenmachine.ErrTokenInvalid
+		}
+	}
+
+	_, err = jwt.Parse(tokenString, func(jwtToken *jwt.Token) (interface{}, error) {
+
+		publicKey, err := t.publicKeyCache.GetKey(token.Iss, token.Kid)
+		if err != nil {
+			return nil, err
+		}
+
+		switch jwtToken.Method.(type) {
+		case *jwt.SigningMethodECDSA:
+			if publicKey.Kty != "EC" {
+				return nil, fmt.Errorf("Expected value for kty is EC not %s", publicKey.Kty)
+			}
+		case *jwt.SigningMethodRSA:
+			if publicKey.Kty != "RSA" {
+				return nil, fmt.Errorf("Expected value for kty is RSA not %s", publicKey.Kty)
+			}
+		default:
+			return nil, fmt.Errorf("Signing method %s unsupported", jwtToken.Method.Alg())
+		}
+
+		return publicKey.Key, nil
+	})
+
+	if err != nil {
+		if ve, ok := err.(*jwt.ValidationError); ok && ve.Errors&^(jwt.ValidationErrorExpired|jwt.ValidationErrorIssuedAt|jwt.ValidationErrorNotValidYet) == 0 {
+			// Time based errors only. We will be the judge of that
+		} else {
+			zap.L().Debug(fmt.Sprintf("Unable to verify signature for token; error=%s", err.Error()))
+			return nil, libtokenmachine.ErrTokenInvalid
+		}
+	}
+
+	if time.Now().Unix() > token.Exp {
+		zap.L().Debug("Token is expired")
+		return nil, libtokenmachine.ErrExpired
+	}
+
+	t.mapPutToken(tokenString, token)
+	return token, nil
+}
+
+func (t *TokenCache) cleanup() {
+
+	zap.L().Debug("Running Token cleanup")
+
+	var removes []string
+	t.tokenMapMutex.Lock()
+	defer t.tokenMapMutex.Unlock()
+
+	for key, e := range t.tokenMap {
+		if time.Now().Unix() > e.Exp {
+			removes = append(removes, key)
+		}
+	}
+
+	for _, key := range removes {
+		delete(t.tokenMap, key)
+	}
+
+	zap.L().Debug(fmt.Sprintf("Completed Token cleanup; ejected %d tokens", len(removes)))
+
+}
+
+// SetTrust replaces the TrustStore and removes all cached tokens as they
+// may not be trusted by the new TrustStore
+func (t *TokenCache) SetTrust(trust *TrustStore) {
+	t.tokenMapMutex.Lock()
+	defer t.tokenMapMutex.Unlock()
+	t.trust = trust
+	t.tokenMap = make(map[string]*libtokenmachine.Token)
+}
+
+// Shutdown Cache
+func (t *TokenCache) Shutdown() {
+	zap.L().Debug("Stopping")
+	close(t.closed)
+	t.wg.Wait()
+}
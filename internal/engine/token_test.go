@@ -0,0 +1,200 @@
+/*
+Copyright © 2020 Jody Scott <jody@thescottsweb.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package engine
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/jodydadescott/libtokenmachine"
+)
+
+// testPublicKeyCache is a PublicKeyInterface that holds the keys of the test
+// issuers so that no issuer is queried
+type testPublicKeyCache struct {
+	mutex    sync.Mutex
+	internal map[string]*PublicKey
+}
+
+func newTestPublicKeyCache(keys ...*PublicKey) *testPublicKeyCache {
+	t := &testPublicKeyCache{
+		internal: make(map[string]*PublicKey),
+	}
+	for _, key := range keys {
+		t.internal[key.Iss+":"+key.Kid] = key
+	}
+	return t
+}
+
+func (t *testPublicKeyCache) GetKey(iss, kid string) (*PublicKey, error) {
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	key, exist := t.internal[iss+":"+kid]
+	if exist {
+		return key, nil
+	}
+
+	return nil, libtokenmachine.ErrNotFound
+}
+
+func TestParseToken(t *testing.T) {
+
+	now := time.Now().Unix()
+
+	// The public keys of issuer a and b are in the cache; the junk key claims
+	// to be issuer a
+	privateKeyA, publicKeyA := generateKeypair(t, "https://issuer-a", "x")
+	privateKeyB, publicKeyB := generateKeypair(t, "https://issuer-b", "x")
+	junkKey, _ := generateKeypair(t, "https://issuer-a", "x")
+
+	tokens, err := (&TokenConfig{}).Build(newTestPublicKeyCache(publicKeyA, publicKeyB))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tokens.Shutdown()
+
+	tests := []struct {
+		name  string
+		token string
+		err   error
+	}{
+		{"valid issuer a", newToken(t, "https://issuer-a", "x", now+600, privateKeyA), nil},
+		{"valid issuer b", newToken(t, "https://issuer-b", "x", now+600, privateKeyB), nil},
+		{"expired issuer a", newToken(t, "https://issuer-a", "x", now-600, privateKeyA), libtokenmachine.ErrExpired},
+		{"expired issuer b", newToken(t, "https://issuer-b", "x", now-600, privateKeyB), libtokenmachine.ErrExpired},
+		{"wrong key", newToken(t, "https://issuer-a", "x", now+600, junkKey), libtokenmachine.ErrTokenInvalid},
+		{"unknown kid", newToken(t, "https://issuer-a", "y", now+600, privateKeyA), libtokenmachine.ErrTokenInvalid},
+		{"unknown issuer", newToken(t, "https://does-not-exist", "x", now+600, junkKey), libtokenmachine.ErrTokenInvalid},
+		{"http issuer", newToken(t, "http://issuer-a", "x", now+600, privateKeyA), libtokenmachine.ErrTokenInvalid},
+		{"empty", "", libtokenmachine.ErrTokenInvalid},
+		{"garbage", "not.a.token", libtokenmachine.ErrTokenInvalid},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			token, err := tokens.ParseToken(test.token)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("err is %v; want %v", err, test.err)
+			}
+
+			if err == nil && token.Iss == "" {
+				t.Errorf("iss is not set")
+			}
+		})
+	}
+}
+
+func TestParseTokenHTTPIssuer(t *testing.T) {
+
+	privateKey, publicKey := generateKeypair(t, "http://issuer-a", "x")
+	tokenString := newToken(t, "http://issuer-a", "x", time.Now().Unix()+600, privateKey)
+
+	tests := []struct {
+		name                string
+		permitPublicKeyHTTP bool
+		err                 error
+	}{
+		{"https required", false, libtokenmachine.ErrTokenInvalid},
+		{"http permitted", true, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			tokens, err := (&TokenConfig{PermitPublicKeyHTTP: test.permitPublicKeyHTTP}).Build(newTestPublicKeyCache(publicKey))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tokens.Shutdown()
+
+			if _, err := tokens.ParseToken(tokenString); !errors.Is(err, test.err) {
+				t.Errorf("err is %v; want %v", err, test.err)
+			}
+		})
+	}
+}
+
+func TestParseTokenCached(t *testing.T) {
+
+	privateKey, publicKey := generateKeypair(t, "https://issuer-a", "x")
+	keys := newTestPublicKeyCache(publicKey)
+
+	tokens, err := (&TokenConfig{}).Build(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tokens.Shutdown()
+
+	tokenString := newToken(t, "https://issuer-a", "x", time.Now().Unix()+600, privateKey)
+
+	_, err = tokens.ParseToken(tokenString)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The cached token is still valid after the key is gone
+	keys.mutex.Lock()
+	keys.internal = make(map[string]*PublicKey)
+	keys.mutex.Unlock()
+
+	_, err = tokens.ParseToken(tokenString)
+	if err != nil {
+		t.Fatalf("cached token err is %v", err)
+	}
+}
+
+func newToken(t *testing.T, iss, kid string, exp int64, key *ecdsa.PrivateKey) string {
+
+	claims := &jwt.StandardClaims{
+		ExpiresAt: exp,
+		Issuer:    iss,
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	token.Header["kid"] = kid
+	tokenString, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tokenString
+}
+
+func generateKeypair(t *testing.T, iss, kid string) (*ecdsa.PrivateKey, *PublicKey) {
+
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return privateKey, &PublicKey{
+		Key: privateKey.Public(),
+		Iss: iss,
+		Kid: kid,
+		Kty: "EC",
+		Exp: time.Now().Unix() + 3600,
+	}
+}
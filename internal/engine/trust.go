@@ -0,0 +1,529 @@
+/*
+Copyright © 2020 Jody Scott <jody@thescottsweb.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package engine
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/jodydadescott/libtokenmachine"
+	"go.uber.org/zap"
+)
+
+// ErrIssuerNotTrusted is returned when trusted issuers are configured and the
+// token is from an issuer that is not listed
+var ErrIssuerNotTrusted = fmt.Errorf("%w; issuer is not trusted", libtokenmachine.ErrTokenInvalid)
+
+// Issuer is a trusted token issuer. Keys are provided with one or more of
+// JWKS, PublicKeys and JWKSURL.
+type Issuer struct {
+	Issuer          string        // Value of the iss claim
+	JWKS            string        // Static JWKS (JSON)
+	PublicKeys      []string      // Static PEM public keys or certificates
+	JWKSURL         string        // JWKS fetched every RefreshInterval
+	RefreshInterval time.Duration // Default is 1 hour
+	CACert          string        // Optional PEM CAs used to verify JWKSURL instead of the system CAs
+	Algorithms      []string      // Allowed algorithms; default is RS256, RS384, RS512, ES256, ES384 and ES512
+	Audiences       []string      // Optional; if set the token must have one of these audiences
+	ClockSkew       time.Duration // Allowed clock skew for exp, nbf and iat
+}
+
+// TrustConfig Config
+type TrustConfig struct {
+	Issuers []*Issuer
+}
+
+// TrustStore holds the trusted issuers and their keys. Tokens from issuers
+// that are not in the store are rejected.
+type TrustStore struct {
+	issuers map[string]*trustedIssuer
+}
+
+type trustedIssuer struct {
+	config          Issuer
+	name            string
+	algorithms      map[string]bool
+	audiences       map[string]bool
+	clockSkew       time.Duration
+	staticKeys      []*PublicKey
+	jwksURL         string
+	refreshInterval time.Duration
+	httpClient      *http.Client
+	mutex           sync.RWMutex
+	fetchedKeys     []*PublicKey
+	lastFetch       time.Time
+	closed          chan struct{}
+	wg              sync.WaitGroup
+}
+
+// Build Returns a new TrustStore. If there are no issuers nil is returned.
+// Issuers with a JWKSURL are fetched once before returning; if the fetch
+// fails the error is logged and the fetch is retried.
+func (config *TrustConfig) Build() (*TrustStore, error) {
+	return config.rebuild(nil)
+}
+
+// rebuild returns a new TrustStore like Build. Issuers of current whose config
+// has not changed are shared with the new store, with their fetched keys,
+// rather than fetched again. Once the new store is in use the issuers of
+// current that are not shared must be stopped with shutdownUnused.
+func (config *TrustConfig) rebuild(current *TrustStore) (*TrustStore, error) {
+
+	if len(config.Issuers) == 0 {
+		return nil, nil
+	}
+
+	t := &TrustStore{
+		issuers: make(map[string]*trustedIssuer),
+	}
+
+	var started []*trustedIssuer
+
+	for _, issuer := range config.Issuers {
+
+		if _, exist := t.issuers[issuer.Issuer]; exist {
+			t.shutdownUnused(current)
+			return nil, fmt.Errorf("Issuer %s is listed more than once", issuer.Issuer)
+		}
+
+		if trusted := current.getIssuer(issuer); trusted != nil {
+			t.issuers[issuer.Issuer] = trusted
+			continue
+		}
+
+		trusted, err := newTrustedIssuer(issuer)
+		if err != nil {
+			t.shutdownUnused(current)
+			return nil, err
+		}
+
+		t.issuers[issuer.Issuer] = trusted
+		started = append(started, trusted)
+	}
+
+	for _, trusted := range started {
+		if trusted.jwksURL != "" {
+			trusted.refresh()
+			trusted.wg.Add(1)
+			go trusted.run()
+		}
+	}
+
+	return t, nil
+}
+
+// getIssuer returns the issuer with the same config as issuer or nil
+func (t *TrustStore) getIssuer(issuer *Issuer) *trustedIssuer {
+
+	if t == nil {
+		return nil
+	}
+
+	trusted, ok := t.issuers[issuer.Issuer]
+	if !ok || !reflect.DeepEqual(&trusted.config, issuer) {
+		return nil
+	}
+
+	return trusted
+}
+
+func newTrustedIssuer(issuer *Issuer) (*trustedIssuer, error) {
+
+	if issuer.Issuer == "" {
+		return nil, fmt.Errorf("Issuer is required")
+	}
+
+	if issuer.JWKS == "" && len(issuer.PublicKeys) == 0 && issuer.JWKSURL == "" {
+		return nil, fmt.Errorf("Issuer %s requires jwks, publicKeys or jwksURL", issuer.Issuer)
+	}
+
+	t := &trustedIssuer{
+		config:          *issuer,
+		name:            issuer.Issuer,
+		algorithms:      make(map[string]bool),
+		audiences:       make(map[string]bool),
+		clockSkew:       issuer.ClockSkew,
+		jwksURL:         issuer.JWKSURL,
+		refreshInterval: issuer.RefreshInterval,
+		closed:          make(chan struct{}),
+	}
+
+	algorithms := issuer.Algorithms
+	if len(algorithms) == 0 {
+		algorithms = trustDefaultAlgorithms
+	}
+
+	for _, alg := range algorithms {
+		if jwt.GetSigningMethod(alg) == nil || alg == "none" || strings.HasPrefix(alg, "HS") {
+			return nil, fmt.Errorf("Algorithm %s of issuer %s is not supported", alg, issuer.Issuer)
+		}
+		t.algorithms[alg] = true
+	}
+
+	for _, aud := range issuer.Audiences {
+		t.audiences[aud] = true
+	}
+
+	if issuer.JWKS != "" {
+		keys, err := parseJWKS([]byte(issuer.JWKS))
+		if err != nil {
+			return nil, fmt.Errorf("JWKS of issuer %s is not valid; err->%s", issuer.Issuer, err)
+		}
+		t.staticKeys = append(t.staticKeys, keys...)
+	}
+
+	for _, s := range issuer.PublicKeys {
+		keys, err := parsePEMPublicKeys([]byte(s))
+		if err != nil {
+			return nil, fmt.Errorf("Public key of issuer %s is not valid; err->%s", issuer.Issuer, err)
+		}
+		t.staticKeys = append(t.staticKeys, keys...)
+	}
+
+	if issuer.JWKSURL != "" {
+
+		if !strings.HasPrefix(issuer.JWKSURL, "https://") {
+			return nil, fmt.Errorf("JWKS URL %s of issuer %s must be https", issuer.JWKSURL, issuer.Issuer)
+		}
+
+		if t.refreshInterval <= 0 {
+			t.refreshInterval = trustDefaultRefreshInterval
+		}
+
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+
+		if issuer.CACert != "" {
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM([]byte(issuer.CACert)) {
+				return nil, fmt.Errorf("CA cert of issuer %s does not contain any PEM certificates", issuer.Issuer)
+			}
+			transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+		}
+
+		t.httpClient = &http.Client{
+			Transport: transport,
+			Timeout:   publicKeyDefaultRequestTimeout,
+		}
+	}
+
+	return t, nil
+}
+
+func (t *trustedIssuer) run() {
+
+	defer t.wg.Done()
+
+	ticker := time.NewTicker(t.refreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-t.closed:
+			return
+		case <-ticker.C:
+			t.refresh()
+		}
+	}
+}
+
+// refresh fetches the JWKS. On error the previous keys remain in use.
+func (t *trustedIssuer) refresh() {
+
+	t.mutex.Lock()
+	t.lastFetch = time.Now()
+	t.mutex.Unlock()
+
+	t.update()
+}
+
+// refreshIfDue refreshes the JWKS unless it was fetched within
+// trustMinRefreshInterval
+func (t *trustedIssuer) refreshIfDue() {
+
+	t.mutex.Lock()
+	if time.Since(t.lastFetch) < trustMinRefreshInterval {
+		t.mutex.Unlock()
+		return
+	}
+	t.lastFetch = time.Now()
+	t.mutex.Unlock()
+
+	t.update()
+}
+
+func (t *trustedIssuer) update() {
+
+	keys, err := t.fetch()
+	if err != nil {
+		zap.L().Error(fmt.Sprintf("Unable to fetch JWKS %s of issuer %s, using cached keys; err->%s", t.jwksURL, t.name, err))
+		return
+	}
+
+	t.mutex.Lock()
+	t.fetchedKeys = keys
+	t.mutex.Unlock()
+
+	zap.L().Debug(fmt.Sprintf("Fetched %d keys from JWKS %s of issuer %s", len(keys), t.jwksURL, t.name))
+}
+
+func (t *trustedIssuer) fetch() ([]*PublicKey, error) {
+
+	resp, err := t.httpClient.Get(t.jwksURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Unexpected status %s", resp.Status)
+	}
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseJWKS(b)
+}
+
+// getKeys returns the keys that may have signed a token with kid. Keys
+// without a kid (such as PEM keys) are always included. If no fetched key
+// matches kid the JWKS is fetched again as the issuer may have rotated its
+// keys; this is limited to once per trustMinRefreshInterval.
+func (t *trustedIssuer) getKeys(kid string) []*PublicKey {
+
+	keys := t.matchKeys(kid)
+
+	if t.jwksURL == "" || kid == "" {
+		return keys
+	}
+
+	for _, key := range keys {
+		if key.Kid == kid {
+			return keys
+		}
+	}
+
+	t.refreshIfDue()
+	return t.matchKeys(kid)
+}
+
+func (t *trustedIssuer) matchKeys(kid string) []*PublicKey {
+
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	var keys []*PublicKey
+	for _, key := range append(t.staticKeys[:len(t.staticKeys):len(t.staticKeys)], t.fetchedKeys...) {
+		if kid == "" || key.Kid == "" || key.Kid == kid {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys
+}
+
+// verify verifies the signature, algorithm, audience and times of token
+func (t *trustedIssuer) verify(tokenString string, token *libtokenmachine.Token) error {
+
+	if !t.algorithms[token.Alg] {
+		zap.L().Debug(fmt.Sprintf("Algorithm %s is not allowed for issuer %s", token.Alg, t.name))
+		return libtokenmachine.ErrTokenInvalid
+	}
+
+	parser := &jwt.Parser{
+		ValidMethods:         []string{token.Alg},
+		SkipClaimsValidation: true,
+	}
+
+	verified := false
+	for _, key := range t.getKeys(token.Kid) {
+		_, err := parser.Parse(tokenString, func(*jwt.Token) (interface{}, error) {
+			return key.Key, nil
+		})
+		if err == nil {
+			verified = true
+			break
+		}
+	}
+
+	if !verified {
+		zap.L().Debug(fmt.Sprintf("Unable to verify signature for token of issuer %s", t.name))
+		return libtokenmachine.ErrTokenInvalid
+	}
+
+	if len(t.audiences) > 0 {
+		match := false
+		for _, aud := range GetAudiences(token.Claims) {
+			if t.audiences[aud] {
+				match = true
+				break
+			}
+		}
+		if !match {
+			zap.L().Debug(fmt.Sprintf("Token does not have an allowed audience for issuer %s", t.name))
+			return libtokenmachine.ErrTokenInvalid
+		}
+	}
+
+	now := time.Now()
+	skew := int64(t.clockSkew.Seconds())
+
+	if now.Unix() > token.Exp+skew {
+		zap.L().Debug("Token is expired")
+		return libtokenmachine.ErrExpired
+	}
+
+	if nbf, ok := token.Claims["nbf"].(float64); ok && int64(nbf) > now.Unix()+skew {
+		zap.L().Debug("Token is not valid yet")
+		return libtokenmachine.ErrTokenInvalid
+	}
+
+	if iat, ok := token.Claims["iat"].(float64); ok && int64(iat) > now.Unix()+skew {
+		zap.L().Debug("Token is issued in the future")
+		return libtokenmachine.ErrTokenInvalid
+	}
+
+	return nil
+}
+
+// Verify verifies token if it is from a trusted issuer. ErrIssuerNotTrusted
+// is returned if it is not.
+func (t *TrustStore) Verify(tokenString string, token *libtokenmachine.Token) error {
+
+	issuer, ok := t.issuers[token.Iss]
+	if !ok {
+		zap.L().Debug(fmt.Sprintf("Issuer %s is not trusted", token.Iss))
+		return ErrIssuerNotTrusted
+	}
+
+	return issuer.verify(tokenString, token)
+}
+
+// Shutdown stops the JWKS refreshes
+func (t *TrustStore) Shutdown() {
+	t.shutdownUnused(nil)
+}
+
+// shutdownUnused stops the JWKS refreshes of the issuers that are not shared
+// with next
+func (t *TrustStore) shutdownUnused(next *TrustStore) {
+
+	if t == nil {
+		return
+	}
+
+	for name, issuer := range t.issuers {
+		if next != nil && next.issuers[name] == issuer {
+			continue
+		}
+		close(issuer.closed)
+		issuer.wg.Wait()
+	}
+}
+
+func parseJWKS(b []byte) ([]*PublicKey, error) {
+
+	var result jwks
+	err := json.Unmarshal(b, &result)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []*PublicKey
+	for i := range result.Keys {
+
+		// Keys for other uses such as encryption are ignored
+		if result.Keys[i].Use != "" && result.Keys[i].Use != "sig" {
+			continue
+		}
+
+		key, err := newKey(&result.Keys[i])
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("JWKS does not contain any signing keys")
+	}
+
+	return keys, nil
+}
+
+// parsePEMPublicKeys returns the public keys and certificate keys in data
+func parsePEMPublicKeys(data []byte) ([]*PublicKey, error) {
+
+	var keys []*PublicKey
+
+	for {
+
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+
+		key := &PublicKey{}
+
+		switch block.Type {
+
+		case "PUBLIC KEY":
+			publicKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			key.Key = publicKey
+
+		case "RSA PUBLIC KEY":
+			publicKey, err := x509.ParsePKCS1PublicKey(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			key.Key = publicKey
+
+		case "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			key.Key = cert.PublicKey
+
+		default:
+			return nil, fmt.Errorf("PEM type %s is not supported", block.Type)
+		}
+
+		keys = append(keys, key)
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("No PEM public keys found")
+	}
+
+	return keys, nil
+}
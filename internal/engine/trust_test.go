@@ -0,0 +1,443 @@
+/*
+Copyright © 2020 Jody Scott <jody@thescottsweb.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package engine
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/jodydadescott/libtokenmachine"
+)
+
+const testIssuer = "https://issuer.example.com"
+
+// ecJWK returns the JWK of the public key of key
+func ecJWK(kid string, key *ecdsa.PrivateKey) jwk {
+	return jwk{
+		Kty: "EC",
+		Kid: kid,
+		Use: "sig",
+		Crv: "P-256",
+		X:   base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+		Y:   base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+	}
+}
+
+func jwksJSON(t *testing.T, keys ...jwk) string {
+	b, err := json.Marshal(&jwks{Keys: keys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func newECKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// signToken returns claims signed with method and key. The iss and exp claims
+// are set unless present.
+func signToken(t *testing.T, method jwt.SigningMethod, kid string, key interface{}, claims jwt.MapClaims) string {
+
+	if _, ok := claims["iss"]; !ok {
+		claims["iss"] = testIssuer
+	}
+
+	if _, ok := claims["exp"]; !ok {
+		claims["exp"] = time.Now().Unix() + 60
+	}
+
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+
+	tokenString, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tokenString
+}
+
+// verifyToken parses and verifies tokenString with trust
+func verifyToken(t *testing.T, trust *TrustStore, tokenString string) error {
+
+	token, err := libtokenmachine.ParseToken(tokenString)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return trust.Verify(tokenString, token)
+}
+
+func TestTrustConfigInvalid(t *testing.T) {
+
+	key := newECKey(t)
+	keys := jwksJSON(t, ecJWK("k1", key))
+
+	tests := []struct {
+		name    string
+		issuers []*Issuer
+		err     string
+	}{
+		{"no issuer", []*Issuer{{JWKS: keys}}, "Issuer is required"},
+		{"no keys", []*Issuer{{Issuer: testIssuer}}, "requires jwks"},
+		{"hmac", []*Issuer{{Issuer: testIssuer, JWKS: keys, Algorithms: []string{"HS256"}}}, "HS256"},
+		{"none", []*Issuer{{Issuer: testIssuer, JWKS: keys, Algorithms: []string{"none"}}}, "none"},
+		{"unknown algorithm", []*Issuer{{Issuer: testIssuer, JWKS: keys, Algorithms: []string{"XS256"}}}, "XS256"},
+		{"invalid jwks", []*Issuer{{Issuer: testIssuer, JWKS: "{"}}, "JWKS"},
+		{"jwks without signing keys", []*Issuer{{Issuer: testIssuer, JWKS: `{"keys":[]}`}}, "JWKS"},
+		{"invalid public key", []*Issuer{{Issuer: testIssuer, PublicKeys: []string{"key"}}}, "Public key"},
+		{"http jwks url", []*Issuer{{Issuer: testIssuer, JWKSURL: "http://issuer.example.com/jwks"}}, "must be https"},
+		{"invalid ca", []*Issuer{{Issuer: testIssuer, JWKSURL: "https://issuer.example.com/jwks", CACert: "ca"}}, "CA cert"},
+		{"duplicate", []*Issuer{{Issuer: testIssuer, JWKS: keys}, {Issuer: testIssuer, JWKS: keys}}, "more than once"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			trust, err := (&TrustConfig{Issuers: test.issuers}).Build()
+			if err == nil {
+				trust.Shutdown()
+				t.Fatalf("expected error")
+			}
+
+			if !strings.Contains(err.Error(), test.err) {
+				t.Errorf("err is %s; want %s", err, test.err)
+			}
+		})
+	}
+}
+
+func TestTrustVerify(t *testing.T) {
+
+	key := newECKey(t)
+	otherKey := newECKey(t)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPEM := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+
+	now := time.Now().Unix()
+
+	trust, err := (&TrustConfig{Issuers: []*Issuer{
+		{
+			Issuer:     testIssuer,
+			JWKS:       jwksJSON(t, ecJWK("k1", key)),
+			PublicKeys: []string{rsaPEM},
+			Audiences:  []string{"api"},
+			ClockSkew:  30 * time.Second,
+		},
+		{
+			Issuer:     "https://rsa-only.example.com",
+			PublicKeys: []string{rsaPEM},
+			JWKS:       jwksJSON(t, ecJWK("k1", key)),
+			Algorithms: []string{"RS256"},
+		},
+	}}).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer trust.Shutdown()
+
+	none, err := jwt.NewWithClaims(jwt.SigningMethodNone, jwt.MapClaims{"iss": testIssuer, "aud": "api", "exp": now + 60}).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		err   error
+	}{
+		{"es256", signToken(t, jwt.SigningMethodES256, "k1", key, jwt.MapClaims{"aud": "api"}), nil},
+		{"rs256 pem key without kid", signToken(t, jwt.SigningMethodRS256, "", rsaKey, jwt.MapClaims{"aud": "api"}), nil},
+		{"audience list", signToken(t, jwt.SigningMethodES256, "k1", key, jwt.MapClaims{"aud": []string{"other", "api"}}), nil},
+		{"untrusted issuer", signToken(t, jwt.SigningMethodES256, "k1", key, jwt.MapClaims{"iss": "https://other.example.com"}), ErrIssuerNotTrusted},
+		{"wrong key", signToken(t, jwt.SigningMethodES256, "k1", otherKey, jwt.MapClaims{"aud": "api"}), libtokenmachine.ErrTokenInvalid},
+		{"hs256 with public key as secret", signToken(t, jwt.SigningMethodHS256, "", []byte(rsaPEM), jwt.MapClaims{"aud": "api"}), libtokenmachine.ErrTokenInvalid},
+		{"none", none, libtokenmachine.ErrTokenInvalid},
+		{"algorithm not allowed", signToken(t, jwt.SigningMethodES256, "k1", key, jwt.MapClaims{"iss": "https://rsa-only.example.com"}), libtokenmachine.ErrTokenInvalid},
+		{"algorithm allowed", signToken(t, jwt.SigningMethodRS256, "", rsaKey, jwt.MapClaims{"iss": "https://rsa-only.example.com"}), nil},
+		{"no audience", signToken(t, jwt.SigningMethodES256, "k1", key, jwt.MapClaims{}), libtokenmachine.ErrTokenInvalid},
+		{"wrong audience", signToken(t, jwt.SigningMethodES256, "k1", key, jwt.MapClaims{"aud": "other"}), libtokenmachine.ErrTokenInvalid},
+		{"expired within skew", signToken(t, jwt.SigningMethodES256, "k1", key, jwt.MapClaims{"aud": "api", "exp": now - 10}), nil},
+		{"expired", signToken(t, jwt.SigningMethodES256, "k1", key, jwt.MapClaims{"aud": "api", "exp": now - 60}), libtokenmachine.ErrExpired},
+		{"nbf within skew", signToken(t, jwt.SigningMethodES256, "k1", key, jwt.MapClaims{"aud": "api", "nbf": now + 10}), nil},
+		{"not valid yet", signToken(t, jwt.SigningMethodES256, "k1", key, jwt.MapClaims{"aud": "api", "nbf": now + 60}), libtokenmachine.ErrTokenInvalid},
+		{"iat within skew", signToken(t, jwt.SigningMethodES256, "k1", key, jwt.MapClaims{"aud": "api", "iat": now + 10}), nil},
+		{"issued in the future", signToken(t, jwt.SigningMethodES256, "k1", key, jwt.MapClaims{"aud": "api", "iat": now + 60}), libtokenmachine.ErrTokenInvalid},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := verifyToken(t, trust, test.token); !errors.Is(err, test.err) || (test.err == nil && err != nil) {
+				t.Errorf("err is %v; want %v", err, test.err)
+			}
+		})
+	}
+}
+
+// testJWKSServer serves a JWKS over TLS and counts the fetches
+type testJWKSServer struct {
+	*httptest.Server
+	mutex   sync.Mutex
+	jwks    string
+	fail    bool
+	fetches int
+}
+
+func newTestJWKSServer(t *testing.T, jwks string) *testJWKSServer {
+
+	server := &testJWKSServer{jwks: jwks}
+
+	server.Server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		server.mutex.Lock()
+		defer server.mutex.Unlock()
+		server.fetches++
+		if server.fail {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(server.jwks))
+	}))
+
+	t.Cleanup(server.Close)
+	return server
+}
+
+func (t *testJWKSServer) set(jwks string, fail bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.jwks = jwks
+	t.fail = fail
+}
+
+func (t *testJWKSServer) count() int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.fetches
+}
+
+// issuer returns the trusted issuer config for the server
+func (t *testJWKSServer) issuer() *Issuer {
+	return &Issuer{
+		Issuer:  testIssuer,
+		JWKSURL: t.URL + "/jwks",
+		CACert:  string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: t.Certificate().Raw})),
+	}
+}
+
+func TestTrustJWKSURL(t *testing.T) {
+
+	key1 := newECKey(t)
+	key2 := newECKey(t)
+
+	server := newTestJWKSServer(t, jwksJSON(t, ecJWK("k1", key1)))
+
+	trust, err := (&TrustConfig{Issuers: []*Issuer{server.issuer()}}).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer trust.Shutdown()
+
+	if server.count() != 1 {
+		t.Fatalf("JWKS was fetched %d times on Build; want 1", server.count())
+	}
+
+	issuer := trust.issuers[testIssuer]
+
+	// A token with a known kid does not fetch the JWKS
+	if err := verifyToken(t, trust, signToken(t, jwt.SigningMethodES256, "k1", key1, jwt.MapClaims{})); err != nil {
+		t.Fatal(err)
+	}
+
+	if server.count() != 1 {
+		t.Errorf("JWKS was fetched for a known kid")
+	}
+
+	expire := func() {
+		issuer.mutex.Lock()
+		issuer.lastFetch = time.Now().Add(-trustMinRefreshInterval)
+		issuer.mutex.Unlock()
+	}
+
+	// An unknown kid does not fetch the JWKS within the min refresh interval
+	// of the last fetch and at most once after it
+	unknown := signToken(t, jwt.SigningMethodES256, "unknown", key2, jwt.MapClaims{})
+
+	for _, want := range []int{1, 2, 2} {
+		if err := verifyToken(t, trust, unknown); err == nil {
+			t.Errorf("token with an unknown kid was verified")
+		}
+
+		if server.count() != want {
+			t.Errorf("JWKS was fetched %d times for unknown kids; want %d", server.count(), want)
+		}
+
+		if want == 1 {
+			expire()
+		}
+	}
+
+	// A rotated key is fetched once the min refresh interval has passed
+	server.set(jwksJSON(t, ecJWK("k1", key1), ecJWK("k2", key2)), false)
+	expire()
+
+	if err := verifyToken(t, trust, signToken(t, jwt.SigningMethodES256, "k2", key2, jwt.MapClaims{})); err != nil {
+		t.Errorf("token with the rotated key was not verified; err->%s", err)
+	}
+
+	// The cached keys are kept if a fetch fails
+	server.set("", true)
+	issuer.refresh()
+
+	if server.count() != 4 {
+		t.Fatalf("JWKS was fetched %d times; want 4", server.count())
+	}
+
+	if err := verifyToken(t, trust, signToken(t, jwt.SigningMethodES256, "k2", key2, jwt.MapClaims{})); err != nil {
+		t.Errorf("cached key was dropped after a failed fetch; err->%s", err)
+	}
+
+	// The cached keys are replaced by a successful fetch
+	server.set(jwksJSON(t, ecJWK("k1", key1)), false)
+	issuer.refresh()
+
+	if err := verifyToken(t, trust, signToken(t, jwt.SigningMethodES256, "k2", key2, jwt.MapClaims{})); err == nil {
+		t.Errorf("removed key was verified")
+	}
+}
+
+func TestTrustJWKSURLUnavailable(t *testing.T) {
+
+	server := newTestJWKSServer(t, "")
+	server.set("", true)
+
+	// Build does not fail while the JWKS is unavailable
+	trust, err := (&TrustConfig{Issuers: []*Issuer{server.issuer()}}).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer trust.Shutdown()
+
+	key := newECKey(t)
+	tokenString := signToken(t, jwt.SigningMethodES256, "k1", key, jwt.MapClaims{})
+
+	if err := verifyToken(t, trust, tokenString); err == nil {
+		t.Errorf("token was verified without keys")
+	}
+}
+
+func TestTrustRebuild(t *testing.T) {
+
+	key := newECKey(t)
+	server := newTestJWKSServer(t, jwksJSON(t, ecJWK("k1", key)))
+	static := &Issuer{Issuer: "https://static.example.com", JWKS: jwksJSON(t, ecJWK("k1", key))}
+
+	current, err := (&TrustConfig{Issuers: []*Issuer{server.issuer(), static}}).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Unchanged issuers are shared and not fetched again
+	unchanged, err := (&TrustConfig{Issuers: []*Issuer{server.issuer(), static}}).rebuild(current)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if server.count() != 1 {
+		t.Errorf("JWKS was fetched %d times; want 1", server.count())
+	}
+
+	if unchanged.issuers[testIssuer] != current.issuers[testIssuer] {
+		t.Errorf("unchanged issuer was not shared")
+	}
+
+	current.shutdownUnused(unchanged)
+
+	select {
+	case <-unchanged.issuers[testIssuer].closed:
+		t.Fatalf("shared issuer was stopped")
+	default:
+	}
+
+	// A changed issuer is fetched again and the previous one is stopped
+	changedConfig := server.issuer()
+	changedConfig.Audiences = []string{"api"}
+
+	changed, err := (&TrustConfig{Issuers: []*Issuer{changedConfig}}).rebuild(unchanged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer changed.Shutdown()
+
+	if server.count() != 2 {
+		t.Errorf("JWKS was fetched %d times; want 2", server.count())
+	}
+
+	if changed.issuers[testIssuer] == unchanged.issuers[testIssuer] {
+		t.Errorf("changed issuer was shared")
+	}
+
+	previous := unchanged.issuers[testIssuer]
+	unchanged.shutdownUnused(changed)
+
+	select {
+	case <-previous.closed:
+	default:
+		t.Errorf("previous issuer was not stopped")
+	}
+
+	// A failed rebuild does not stop the current issuers
+	_, err = (&TrustConfig{Issuers: []*Issuer{changedConfig, {Issuer: "https://invalid.example.com"}}}).rebuild(changed)
+	if err == nil {
+		t.Fatalf("expected error")
+	}
+
+	select {
+	case <-changed.issuers[testIssuer].closed:
+		t.Errorf("current issuer was stopped by a failed rebuild")
+	default:
+	}
+}
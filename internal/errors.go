@@ -0,0 +1,205 @@
+/*
+Copyright © 2020 Jody Scott <jody@thescottsweb.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/jodydadescott/libtokenmachine"
+	"github.com/jodydadescott/tokenmachine/internal/engine"
+	"go.uber.org/zap"
+)
+
+// Error codes returned to clients in ErrorResponse.Code. These are part of the
+// API contract and must not change.
+const (
+	ErrCodeBadRequest       = "bad_request"
+	ErrCodeTokenRequired    = "token_required"
+	ErrCodeTokenInvalid     = "token_invalid"
+	ErrCodeTokenExpired     = "token_expired"
+	ErrCodeNonceUsed        = "nonce_used"
+	ErrCodeNonceRequired    = "nonce_required"
+	ErrCodeDenied           = "denied"
+	ErrCodeNotFound         = "not_found"
+	ErrCodeMethodNotAllowed = "method_not_allowed"
+	ErrCodeInternal         = "internal_error"
+)
+
+const (
+	requestIDHeader    = "X-Request-Id"
+	maxRequestIDLength = 128
+)
+
+// ErrorResponse is the body returned with every non 2xx response. The field
+// error holds the human readable message and is kept for compatibility with
+// clients that read it directly.
+type ErrorResponse struct {
+	Code      string `json:"code"`
+	Message   string `json:"error"`
+	RequestID string `json:"requestId,omitempty"`
+}
+
+// JSON Return JSON String representation
+func (t *ErrorResponse) JSON() string {
+	j, _ := json.Marshal(t)
+	return string(j)
+}
+
+// httpError is an error with the HTTP status and code that should be returned
+// to the client
+type httpError struct {
+	status    int
+	code      string
+	message   string
+	challenge string // WWW-Authenticate header of 401 responses; default is Bearer
+}
+
+func (t *httpError) Error() string {
+	return t.message
+}
+
+func newHTTPError(status int, code, message string) *httpError {
+	return &httpError{
+		status:  status,
+		code:    code,
+		message: message,
+	}
+}
+
+func newBadRequestError(message string) *httpError {
+	return newHTTPError(http.StatusBadRequest, ErrCodeBadRequest, message)
+}
+
+func newNotFoundError(message string) *httpError {
+	return newHTTPError(http.StatusNotFound, ErrCodeNotFound, message)
+}
+
+func newMethodNotAllowedError(method string) *httpError {
+	return newHTTPError(http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, fmt.Sprintf("Method %s not allowed", method))
+}
+
+// toHTTPError maps errors returned by libtokenmachine (and our own) to the
+// HTTP status and code. Anything we do not recognize is an internal error.
+func toHTTPError(err error) *httpError {
+
+	var e *httpError
+	if errors.As(err, &e) {
+		return e
+	}
+
+	var nonceRequired *engine.NonceRequiredError
+	if errors.As(err, &nonceRequired) {
+		e = newHTTPError(http.StatusUnauthorized, ErrCodeNonceRequired, err.Error())
+		e.challenge = fmt.Sprintf("Bearer error=\"%s\", nonce=\"%s\"", ErrCodeNonceRequired, nonceRequired.Nonce.Value)
+		return e
+	}
+
+	switch {
+
+	case errors.Is(err, engine.ErrNonceUsed):
+		return newHTTPError(http.StatusUnauthorized, ErrCodeNonceUsed, err.Error())
+
+	case errors.Is(err, libtokenmachine.ErrTokenInvalid):
+		return newHTTPError(http.StatusUnauthorized, ErrCodeTokenInvalid, err.Error())
+
+	case errors.Is(err, libtokenmachine.ErrExpired):
+		return newHTTPError(http.StatusUnauthorized, ErrCodeTokenExpired, err.Error())
+
+	case errors.Is(err, libtokenmachine.ErrDenied):
+		return newHTTPError(http.StatusForbidden, ErrCodeDenied, err.Error())
+
+	case errors.Is(err, libtokenmachine.ErrNotFound):
+		return newHTTPError(http.StatusNotFound, ErrCodeNotFound, err.Error())
+
+	case errors.Is(err, libtokenmachine.ErrServerFail):
+		return newHTTPError(http.StatusInternalServerError, ErrCodeInternal, err.Error())
+
+	}
+
+	// Do not leak unexpected errors to the client
+	return newHTTPError(http.StatusInternalServerError, ErrCodeInternal, libtokenmachine.ErrServerFail.Error())
+}
+
+func writeError(w http.ResponseWriter, requestID string, err error) {
+
+	e := toHTTPError(err)
+
+	if e.status >= http.StatusInternalServerError {
+		zap.L().Error(fmt.Sprintf("Request %s failed; err->%s", requestID, err))
+	}
+
+	if e.status == http.StatusUnauthorized {
+		if e.challenge != "" {
+			w.Header().Set("WWW-Authenticate", e.challenge)
+		} else {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+		}
+	}
+
+	response := &ErrorResponse{
+		Code:      e.code,
+		Message:   e.message,
+		RequestID: requestID,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(e.status)
+	fmt.Fprintln(w, response.JSON())
+}
+
+// getRequestID returns the request id provided by the client (or a proxy) or
+// generates a new one if it is missing or not valid
+func getRequestID(r *http.Request) string {
+
+	requestID := r.Header.Get(requestIDHeader)
+	if validRequestID(requestID) {
+		return requestID
+	}
+
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// validRequestID returns true if requestID is not empty, at most 128 bytes
+// and only has the characters A-Z, a-z, 0-9, '.', '_' and '-'. The request id
+// is echoed in the response and written to the audit log.
+func validRequestID(requestID string) bool {
+
+	if requestID == "" || len(requestID) > maxRequestIDLength {
+		return false
+	}
+
+	for _, c := range requestID {
+		switch {
+		case c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '.', c == '_', c == '-':
+		default:
+			return false
+		}
+	}
+
+	return true
+}
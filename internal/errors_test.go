@@ -0,0 +1,150 @@
+/*
+Copyright © 2020 Jody Scott <jody@thescottsweb.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jodydadescott/libtokenmachine"
+	"github.com/jodydadescott/tokenmachine/internal/engine"
+)
+
+func TestToHTTPError(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		err    error
+		status int
+		code   string
+	}{
+		{"bad request", newBadRequestError("bad"), http.StatusBadRequest, ErrCodeBadRequest},
+		{"not found path", newNotFoundError("missing"), http.StatusNotFound, ErrCodeNotFound},
+		{"method", newMethodNotAllowedError(http.MethodPut), http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed},
+		{"token invalid", libtokenmachine.ErrTokenInvalid, http.StatusUnauthorized, ErrCodeTokenInvalid},
+		{"issuer not trusted", engine.ErrIssuerNotTrusted, http.StatusUnauthorized, ErrCodeTokenInvalid},
+		{"expired", libtokenmachine.ErrExpired, http.StatusUnauthorized, ErrCodeTokenExpired},
+		{"nonce used", engine.ErrNonceUsed, http.StatusUnauthorized, ErrCodeNonceUsed},
+		{"denied", libtokenmachine.ErrDenied, http.StatusForbidden, ErrCodeDenied},
+		{"subject mismatch", engine.ErrNonceSubjectMismatch, http.StatusForbidden, ErrCodeDenied},
+		{"wrapped denied", fmt.Errorf("policy; %w", libtokenmachine.ErrDenied), http.StatusForbidden, ErrCodeDenied},
+		{"entity not found", libtokenmachine.ErrNotFound, http.StatusNotFound, ErrCodeNotFound},
+		{"server fail", libtokenmachine.ErrServerFail, http.StatusInternalServerError, ErrCodeInternal},
+		{"unknown", errors.New("secret detail"), http.StatusInternalServerError, ErrCodeInternal},
+		{"nonce required", &engine.NonceRequiredError{Nonce: &libtokenmachine.Nonce{Value: "abc"}}, http.StatusUnauthorized, ErrCodeNonceRequired},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := toHTTPError(test.err)
+			if e.status != test.status || e.code != test.code {
+				t.Errorf("got %d %s; want %d %s", e.status, e.code, test.status, test.code)
+			}
+		})
+	}
+}
+
+func TestWriteError(t *testing.T) {
+
+	tests := []struct {
+		name      string
+		err       error
+		challenge string
+		message   string
+	}{
+		{"denied", libtokenmachine.ErrDenied, "", libtokenmachine.ErrDenied.Error()},
+		{"token invalid", libtokenmachine.ErrTokenInvalid, "Bearer", libtokenmachine.ErrTokenInvalid.Error()},
+		{"nonce required", &engine.NonceRequiredError{Nonce: &libtokenmachine.Nonce{Value: "abc"}}, `Bearer error="nonce_required", nonce="abc"`, ""},
+		{"unknown is not leaked", errors.New("secret detail"), "", libtokenmachine.ErrServerFail.Error()},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			w := httptest.NewRecorder()
+			writeError(w, "id1", test.err)
+
+			if got := w.Header().Get("WWW-Authenticate"); got != test.challenge {
+				t.Errorf("WWW-Authenticate is %q; want %q", got, test.challenge)
+			}
+
+			if got := w.Header().Get("Content-Type"); got != "application/json" {
+				t.Errorf("Content-Type is %q", got)
+			}
+
+			response := &ErrorResponse{}
+			err := json.Unmarshal(w.Body.Bytes(), response)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if response.RequestID != "id1" || response.Code != toHTTPError(test.err).code {
+				t.Errorf("unexpected response %s", w.Body.String())
+			}
+
+			if test.message != "" && response.Message != test.message {
+				t.Errorf("message is %q; want %q", response.Message, test.message)
+			}
+		})
+	}
+}
+
+func TestGetRequestID(t *testing.T) {
+
+	tests := []struct {
+		name      string
+		requestID string
+		keep      bool
+	}{
+		{"valid", "abc-123_DEF.4", true},
+		{"max length", strings.Repeat("a", maxRequestIDLength), true},
+		{"missing", "", false},
+		{"too long", strings.Repeat("a", maxRequestIDLength+1), false},
+		{"space", "abc 123", false},
+		{"quote", `abc"}`, false},
+		{"newline", "abc\n123", false},
+		{"unicode", "abcé", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			r := httptest.NewRequest(http.MethodGet, "/v1/nonce", nil)
+			if test.requestID != "" {
+				r.Header[requestIDHeader] = []string{test.requestID}
+			}
+
+			got := getRequestID(r)
+
+			if test.keep {
+				if got != test.requestID {
+					t.Errorf("got %q; want %q", got, test.requestID)
+				}
+				return
+			}
+
+			if got == test.requestID || !validRequestID(got) {
+				t.Errorf("got %q; want a generated request id", got)
+			}
+		})
+	}
+}
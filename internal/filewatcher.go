@@ -0,0 +1,156 @@
+/*
+Copyright © 2020 Jody Scott <jody@thescottsweb.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
+)
+
+const defaultFileWatcherDelay = time.Second
+
+// FileWatcherConfig Config
+type FileWatcherConfig struct {
+	Files    []string
+	Delay    time.Duration // Wait for writes to settle before calling OnChange
+	OnChange func()
+}
+
+// FileWatcher calls OnChange when any of the watched files are written,
+// created, renamed or removed. The parent directories are watched rather than
+// the files themselves so that files replaced by rename (editors, Kubernetes
+// ConfigMaps and Secrets) continue to be watched. Events that occur within
+// Delay of each other result in a single call to OnChange.
+type FileWatcher struct {
+	watcher *fsnotify.Watcher
+	files   map[string]bool
+	delay   time.Duration
+	change  func()
+	closed  chan struct{}
+	wg      sync.WaitGroup
+}
+
+// Build Returns a new FileWatcher
+func (config *FileWatcherConfig) Build() (*FileWatcher, error) {
+
+	if len(config.Files) == 0 {
+		return nil, fmt.Errorf("Files is required")
+	}
+
+	if config.OnChange == nil {
+		return nil, fmt.Errorf("OnChange is required")
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	t := &FileWatcher{
+		watcher: watcher,
+		files:   make(map[string]bool),
+		delay:   defaultFileWatcherDelay,
+		change:  config.OnChange,
+		closed:  make(chan struct{}),
+	}
+
+	if config.Delay > 0 {
+		t.delay = config.Delay
+	}
+
+	dirs := make(map[string]bool)
+
+	for _, file := range config.Files {
+
+		file, err = filepath.Abs(file)
+		if err != nil {
+			watcher.Close()
+			return nil, err
+		}
+
+		t.files[file] = true
+		dirs[filepath.Dir(file)] = true
+	}
+
+	for dir := range dirs {
+		err = watcher.Add(dir)
+		if err != nil {
+			watcher.Close()
+			return nil, fmt.Errorf("Unable to watch %s; err->%s", dir, err)
+		}
+	}
+
+	t.wg.Add(1)
+	go t.run()
+	return t, nil
+}
+
+func (t *FileWatcher) run() {
+
+	defer t.wg.Done()
+
+	timer := time.NewTimer(t.delay)
+	timer.Stop()
+
+	for {
+		select {
+
+		case <-t.closed:
+			timer.Stop()
+			return
+
+		case event, ok := <-t.watcher.Events:
+			if !ok {
+				return
+			}
+			// Kubernetes updates mounted files by swapping a symlink in
+			// the directory so any change to the directory is of interest
+			// when the file is not matched directly
+			if !t.files[filepath.Clean(event.Name)] && !t.isDataLink(event.Name) {
+				continue
+			}
+			zap.L().Debug(fmt.Sprintf("File %s changed (%s)", event.Name, event.Op))
+			timer.Reset(t.delay)
+
+		case err, ok := <-t.watcher.Errors:
+			if !ok {
+				return
+			}
+			zap.L().Error(fmt.Sprintf("File watcher error; err->%s", err))
+
+		case <-timer.C:
+			t.change()
+
+		}
+	}
+}
+
+func (t *FileWatcher) isDataLink(name string) bool {
+	return filepath.Base(name) == "..data"
+}
+
+// Shutdown stops watching and waits for OnChange to return if it is running
+func (t *FileWatcher) Shutdown() {
+	close(t.closed)
+	t.wg.Wait()
+	t.watcher.Close()
+}
@@ -0,0 +1,144 @@
+/*
+Copyright © 2020 Jody Scott <jody@thescottsweb.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileWatcherConfigInvalid(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		config *FileWatcherConfig
+	}{
+		{"no files", &FileWatcherConfig{OnChange: func() {}}},
+		{"no callback", &FileWatcherConfig{Files: []string{"config.yaml"}}},
+		{"missing directory", &FileWatcherConfig{Files: []string{"/does/not/exist/config.yaml"}, OnChange: func() {}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			watcher, err := test.config.Build()
+			if err == nil {
+				watcher.Shutdown()
+				t.Fatalf("expected error")
+			}
+		})
+	}
+}
+
+func TestFileWatcher(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		change func(t *testing.T, dir, file string)
+		called bool
+	}{
+		{"write", func(t *testing.T, dir, file string) {
+			writeFile(t, file, "b")
+		}, true},
+		{"replace by rename", func(t *testing.T, dir, file string) {
+			tmp := filepath.Join(dir, "config.tmp")
+			writeFile(t, tmp, "b")
+			if err := os.Rename(tmp, file); err != nil {
+				t.Fatal(err)
+			}
+		}, true},
+		{"remove", func(t *testing.T, dir, file string) {
+			if err := os.Remove(file); err != nil {
+				t.Fatal(err)
+			}
+		}, true},
+		{"other file", func(t *testing.T, dir, file string) {
+			writeFile(t, filepath.Join(dir, "other.yaml"), "b")
+		}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			dir := t.TempDir()
+			file := filepath.Join(dir, "config.yaml")
+			writeFile(t, file, "a")
+
+			changes := make(chan struct{}, 10)
+			watcher, err := (&FileWatcherConfig{
+				Files:    []string{file},
+				Delay:    50 * time.Millisecond,
+				OnChange: func() { changes <- struct{}{} },
+			}).Build()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer watcher.Shutdown()
+
+			test.change(t, dir, file)
+
+			select {
+			case <-changes:
+				if !test.called {
+					t.Errorf("OnChange was called")
+				}
+			case <-time.After(time.Second):
+				if test.called {
+					t.Errorf("OnChange was not called")
+				}
+			}
+		})
+	}
+}
+
+func TestFileWatcherDelay(t *testing.T) {
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, "config.yaml")
+	writeFile(t, file, "a")
+
+	changes := make(chan struct{}, 10)
+	watcher, err := (&FileWatcherConfig{
+		Files:    []string{file},
+		Delay:    200 * time.Millisecond,
+		OnChange: func() { changes <- struct{}{} },
+	}).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Shutdown()
+
+	// Writes within the delay of each other result in a single call
+	for i := 0; i < 5; i++ {
+		writeFile(t, file, "b")
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	time.Sleep(500 * time.Millisecond)
+
+	if len(changes) != 1 {
+		t.Errorf("OnChange was called %d times; want 1", len(changes))
+	}
+}
+
+func writeFile(t *testing.T, name, data string) {
+	if err := ioutil.WriteFile(name, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,168 @@
+/*
+Copyright © 2020 Jody Scott <jody@thescottsweb.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"go.uber.org/zap"
+)
+
+// Version is the build version. It is set at build time with
+// -ldflags "-X github.com/jodydadescott/tokenmachine/internal.Version=..."
+var Version = "dev"
+
+const (
+	statusOK       = "ok"
+	statusNotReady = "not ready"
+)
+
+// HealthResponse is returned by /healthz and /readyz
+type HealthResponse struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+// JSON Return JSON String representation
+func (t *HealthResponse) JSON() string {
+	j, _ := json.Marshal(t)
+	return string(j)
+}
+
+// VersionResponse is returned by /version
+type VersionResponse struct {
+	Version        string `json:"version"`
+	APIVersion     string `json:"apiVersion,omitempty"`
+	ConfigHash     string `json:"configHash,omitempty"`
+	BundleRevision string `json:"bundleRevision,omitempty"`
+}
+
+// JSON Return JSON String representation
+func (t *VersionResponse) JSON() string {
+	j, _ := json.Marshal(t)
+	return string(j)
+}
+
+// serveUnauthenticated handles the probe endpoints that do not require a
+// token. Returns false if the path is not one of them.
+func (t *Server) serveUnauthenticated(w http.ResponseWriter, r *http.Request, requestID string) bool {
+
+	var result interface{ JSON() string }
+	status := http.StatusOK
+
+	switch r.URL.Path {
+
+	case "/healthz":
+		// If we can answer we are alive
+		result = &HealthResponse{Status: statusOK}
+
+	case "/readyz":
+		health := t.readiness()
+		if health.Status != statusOK {
+			status = http.StatusServiceUnavailable
+		}
+		result = health
+
+	case "/version":
+		t.stateMutex.RLock()
+		version := &VersionResponse{
+			Version:    Version,
+			APIVersion: t.apiVersion,
+			ConfigHash: t.configHash,
+		}
+		if t.tokenMachine != nil {
+			version.BundleRevision = t.tokenMachine.BundleRevision()
+		}
+		t.stateMutex.RUnlock()
+		result = version
+
+	default:
+		return false
+	}
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", http.MethodGet+", "+http.MethodHead)
+		writeError(w, requestID, newMethodNotAllowedError(r.Method))
+		return true
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if r.Method == http.MethodGet {
+		fmt.Fprintln(w, result.JSON())
+	}
+	return true
+}
+
+// readiness returns ok only if the server has been fully built, all listeners
+// are serving, the policy is compiled and we are not shutting down
+func (t *Server) readiness() *HealthResponse {
+
+	t.stateMutex.RLock()
+	defer t.stateMutex.RUnlock()
+
+	health := &HealthResponse{
+		Status: statusOK,
+		Checks: map[string]string{
+			"listeners": statusOK,
+			"policy":    statusOK,
+			"engine":    statusOK,
+			"shutdown":  statusOK,
+		},
+	}
+
+	if !t.started {
+		health.Status = statusNotReady
+		health.Checks["listeners"] = "starting"
+	}
+
+	if t.listenerErr != nil {
+		health.Status = statusNotReady
+		health.Checks["listeners"] = t.listenerErr.Error()
+	}
+
+	// The policy is compiled when the engine is created so if we have an
+	// engine we have a policy
+	if t.tokenMachine == nil {
+		health.Status = statusNotReady
+		health.Checks["policy"] = "not compiled"
+		health.Checks["engine"] = "not running"
+	}
+
+	if t.shuttingDown {
+		health.Status = statusNotReady
+		health.Checks["shutdown"] = "shutting down"
+	}
+
+	return health
+}
+
+func (t *Server) setListenerErr(err error) {
+
+	if err == nil || err == http.ErrServerClosed {
+		return
+	}
+
+	zap.L().Error(fmt.Sprintf("Listener failed; err->%s", err))
+
+	t.stateMutex.Lock()
+	defer t.stateMutex.Unlock()
+	t.listenerErr = err
+}
@@ -0,0 +1,99 @@
+/*
+Copyright © 2020 Jody Scott <jody@thescottsweb.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestServeUnauthenticated(t *testing.T) {
+
+	tests := []struct {
+		name, method, path string
+		server             *Server
+		handled            bool
+		status             int
+		body               string
+	}{
+		{"healthz", http.MethodGet, "/healthz", &Server{}, true, http.StatusOK, `{"status":"ok"}`},
+		{"healthz head", http.MethodHead, "/healthz", &Server{}, true, http.StatusOK, ""},
+		{"healthz post", http.MethodPost, "/healthz", &Server{}, true, http.StatusMethodNotAllowed, ""},
+		{"readyz starting", http.MethodGet, "/readyz", &Server{}, true, http.StatusServiceUnavailable, ""},
+		{"version", http.MethodGet, "/version", &Server{apiVersion: "V1", configHash: "abc"}, true, http.StatusOK, `{"version":"dev","apiVersion":"V1","configHash":"abc"}`},
+		{"not a probe", http.MethodGet, "/v1/nonce", &Server{}, false, 0, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(test.method, test.path, nil)
+
+			handled := test.server.serveUnauthenticated(w, r, "id1")
+			if handled != test.handled {
+				t.Fatalf("handled is %t; want %t", handled, test.handled)
+			}
+
+			if !handled {
+				return
+			}
+
+			if w.Code != test.status {
+				t.Errorf("status is %d; want %d", w.Code, test.status)
+			}
+
+			if test.body != "" && w.Body.String() != test.body+"\n" {
+				t.Errorf("body is %s; want %s", w.Body.String(), test.body)
+			}
+		})
+	}
+}
+
+func TestReadiness(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		server *Server
+		check  string
+		value  string
+	}{
+		{"starting", &Server{}, "listeners", "starting"},
+		{"listener failed", &Server{started: true, listenerErr: errors.New("bind failed")}, "listeners", "bind failed"},
+		{"no engine", &Server{started: true}, "engine", "not running"},
+		{"shutting down", &Server{started: true, shuttingDown: true}, "shutdown", "shutting down"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			health := test.server.readiness()
+
+			if health.Status != statusNotReady {
+				t.Errorf("status is %s; want %s", health.Status, statusNotReady)
+			}
+
+			if health.Checks[test.check] != test.value {
+				j, _ := json.Marshal(health)
+				t.Errorf("check %s is not %s; %s", test.check, test.value, j)
+			}
+		})
+	}
+}
@@ -0,0 +1,208 @@
+/*
+Copyright © 2020 Jody Scott <jody@thescottsweb.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"crypto/x509"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jodydadescott/tokenmachine/internal/engine"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	metricsNamespace = "tokenmachine"
+
+	outcomeGranted = "granted"
+	outcomeDenied  = "denied"
+	outcomeError   = "error"
+)
+
+// metrics holds the Prometheus collectors. Entity names are used as labels
+// but secret values are never exposed.
+type metrics struct {
+	registry              *prometheus.Registry
+	requests              *prometheus.CounterVec
+	operationDuration     *prometheus.HistogramVec
+	policyDuration        *prometheus.HistogramVec
+	certificateExpiry     prometheus.Gauge
+	certificateExpiring   prometheus.Gauge
+	certificateExpiryOnce sync.Once
+}
+
+func newMetrics() *metrics {
+
+	t := &metrics{
+		registry: prometheus.NewRegistry(),
+
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "requests_total",
+			Help:      "Requests by endpoint and outcome (granted, denied or error).",
+		}, []string{"endpoint", "outcome"}),
+
+		operationDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "operation_duration_seconds",
+			Help:      "Latency of GetNonce, GetSecret and GetKeytab.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"operation"}),
+
+		policyDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "policy_evaluation_duration_seconds",
+			Help:      "Duration of Rego policy evaluations by rule.",
+			Buckets:   []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1},
+		}, []string{"rule"}),
+
+		certificateExpiry: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "tls_certificate_expiry_timestamp_seconds",
+			Help:      "Expiry (NotAfter) of the HTTPS server certificate in UNIX epoch seconds.",
+		}),
+
+		certificateExpiring: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "tls_certificate_expiring",
+			Help:      "1 if the HTTPS server certificate is close to expiry, otherwise 0.",
+		}),
+	}
+
+	t.registry.MustRegister(
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		prometheus.NewGoCollector(),
+		t.requests,
+		t.operationDuration,
+		t.policyDuration,
+	)
+
+	return t
+}
+
+// register adds the collectors that read state from the engine
+func (t *metrics) register(tokenMachine *engine.Engine) {
+
+	t.registry.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "nonces",
+			Help:      "Number of live (unexpired) nonces.",
+		}, func() float64 {
+			return float64(tokenMachine.NonceCount())
+		}),
+		&rotationCollector{
+			tokenMachine: tokenMachine,
+			desc: prometheus.NewDesc(
+				prometheus.BuildFQName(metricsNamespace, "", "entity_rotation_seconds"),
+				"Seconds until the next secret or keytab rotation.",
+				[]string{"type", "name"}, nil,
+			),
+		},
+	)
+}
+
+func (t *metrics) handler() http.Handler {
+	return promhttp.HandlerFor(t.registry, promhttp.HandlerOpts{})
+}
+
+// ObservePolicyEvaluation implements engine.Observer
+func (t *metrics) ObservePolicyEvaluation(rule string, duration time.Duration) {
+	t.policyDuration.WithLabelValues(rule).Observe(duration.Seconds())
+}
+
+func (t *metrics) observeOperation(action string, duration time.Duration) {
+
+	operation := ""
+	switch action {
+	case actionNonce:
+		operation = "GetNonce"
+	case actionSecret:
+		operation = "GetSecret"
+	case actionKeytab:
+		operation = "GetKeytab"
+	default:
+		return
+	}
+
+	t.operationDuration.WithLabelValues(operation).Observe(duration.Seconds())
+}
+
+func (t *metrics) countRequest(action string, err error) {
+	t.requests.WithLabelValues(action, getOutcome(err)).Inc()
+}
+
+// setCertificateExpiry sets the expiry of the server certificate and if it is
+// close to expiry
+func (t *metrics) setCertificateExpiry(leaf *x509.Certificate, expiring bool) {
+
+	// Only registered once a certificate is loaded so that servers without
+	// HTTPS do not report an expiry of zero
+	t.certificateExpiryOnce.Do(func() {
+		t.registry.MustRegister(t.certificateExpiry, t.certificateExpiring)
+	})
+
+	t.certificateExpiry.Set(float64(leaf.NotAfter.Unix()))
+
+	if expiring {
+		t.certificateExpiring.Set(1)
+	} else {
+		t.certificateExpiring.Set(0)
+	}
+}
+
+func getOutcome(err error) string {
+
+	if err == nil {
+		return outcomeGranted
+	}
+
+	switch toHTTPError(err).status {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return outcomeDenied
+	}
+
+	return outcomeError
+}
+
+// rotationCollector reports the seconds until the next rotation of each
+// secret and keytab at the time of collection
+type rotationCollector struct {
+	tokenMachine *engine.Engine
+	desc         *prometheus.Desc
+}
+
+// Describe implements prometheus.Collector
+func (t *rotationCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- t.desc
+}
+
+// Collect implements prometheus.Collector
+func (t *rotationCollector) Collect(ch chan<- prometheus.Metric) {
+
+	now := time.Now()
+
+	for name, next := range t.tokenMachine.SecretRotations() {
+		ch <- prometheus.MustNewConstMetric(t.desc, prometheus.GaugeValue, next.Sub(now).Seconds(), "secret", name)
+	}
+
+	for name, next := range t.tokenMachine.KeytabRotations() {
+		ch <- prometheus.MustNewConstMetric(t.desc, prometheus.GaugeValue, next.Sub(now).Seconds(), "keytab", name)
+	}
+}
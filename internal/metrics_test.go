@@ -0,0 +1,79 @@
+/*
+Copyright © 2020 Jody Scott <jody@thescottsweb.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jodydadescott/libtokenmachine"
+	"github.com/jodydadescott/tokenmachine/internal/engine"
+)
+
+func TestGetOutcome(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		err     error
+		outcome string
+	}{
+		{"granted", nil, outcomeGranted},
+		{"denied", libtokenmachine.ErrDenied, outcomeDenied},
+		{"token invalid", libtokenmachine.ErrTokenInvalid, outcomeDenied},
+		{"nonce used", engine.ErrNonceUsed, outcomeDenied},
+		{"not found", libtokenmachine.ErrNotFound, outcomeError},
+		{"server fail", libtokenmachine.ErrServerFail, outcomeError},
+		{"unknown", errors.New("unknown"), outcomeError},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := getOutcome(test.err); got != test.outcome {
+				t.Errorf("outcome is %s; want %s", got, test.outcome)
+			}
+		})
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+
+	metrics := newMetrics()
+	metrics.countRequest(actionSecret, nil)
+	metrics.countRequest(actionSecret, libtokenmachine.ErrDenied)
+	metrics.observeOperation(actionSecret, time.Millisecond)
+	metrics.ObservePolicyEvaluation(engine.RuleGetSecret, time.Millisecond)
+
+	w := httptest.NewRecorder()
+	metrics.handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	body := w.Body.String()
+
+	for _, s := range []string{
+		`outcome="granted"`,
+		`outcome="denied"`,
+		`operation="GetSecret"`,
+		`rule="auth_get_secret"`,
+	} {
+		if !strings.Contains(body, s) {
+			t.Errorf("metrics do not contain %s", s)
+		}
+	}
+}
@@ -20,6 +20,7 @@ import (
 	"context"
 	"crypto/tls"
 	"fmt"
+	"net"
 	"net/http"
 	"strconv"
 	"strings"
@@ -27,26 +28,60 @@ import (
 	"time"
 
 	"github.com/jodydadescott/libtokenmachine"
-	"github.com/jodydadescott/libtokenmachine/serverlib"
+	"github.com/jodydadescott/tokenmachine/internal/engine"
 	"go.uber.org/zap"
 )
 
+const defaultShutdownTimeout = 30 * time.Second
+
 // Config ...
 type Config struct {
 	Policy                                              string
+	PolicyModules                                       map[string]string      // Optional additional Rego modules by file name
+	Bundle                                              *engine.BundleConfig   // Optional OPA bundle with policy modules and data
+	PolicyData                                          []*engine.DataDocument // Optional documents provided to the policy as data
 	NonceLifetime, KeytabLifetime, SharedSecretLifetime time.Duration
+	NonceKey                                            string // Optional cluster key for stateless nonces shared by replicas
+	SingleUseNonce                                      bool   // Nonces and tokens may only be used once
+	ReplayCacheSize                                     int
+	DisableNonceSubjectCheck                            bool             // Allow nonces in tokens of a different subject than the nonce was issued to
+	NonceChallenge                                      bool             // Answer secret and keytab requests without a nonce with a 401 nonce challenge
+	Issuers                                             []*engine.Issuer // Optional trusted issuers
 	SecretSecrets                                       []*libtokenmachine.SharedSecret
 	KeytabKeytabs                                       []*libtokenmachine.Keytab
 	Listen, TLSCert, TLSKey                             string
-	HTTPPort, HTTPSPort                                 int
+	HTTPPort, HTTPSPort, MetricsPort                    int
+	DisableQueryToken                                   bool
+	APIVersion, ConfigHash                              string
+	AuditOutputPaths                                    []string
+	ShutdownTimeout                                     time.Duration // Max time to drain in-flight requests
+	PreStopDelay                                        time.Duration // Time between reporting not ready and stopping the listeners
+	ClientCA, ClientAuth, TLSMinVersion                 string        // Optional mTLS; see ClientAuth constants
+	TLSCipherSuites                                     []string
+	TLSCertFile, TLSKeyFile, ClientCAFile               string // Alternatives to TLSCert, TLSKey and ClientCA; watched for changes
+	AdminToken                                          string // Optional; enables the admin endpoints
+	AdminPort                                           int    // TLS listener of the admin endpoints; required with AdminToken
 }
 
 // Server ...
 type Server struct {
-	closed                  chan struct{}
-	wg                      sync.WaitGroup
-	httpServer, httpsServer *http.Server
-	libTokenMachine         libtokenmachine.LibTokenMachine
+	errs                                   chan error
+	wg                                     sync.WaitGroup
+	shutdownOnce                           sync.Once
+	shutdownTimeout, preStopDelay          time.Duration
+	httpServer, httpsServer, metricsServer *http.Server
+	adminServer                            *http.Server
+	tokenMachine                           *engine.Engine
+	metrics                                *metrics
+	audit                                  *auditor
+	config                                 *Config
+	certificates                           *certificateManager
+	disableQueryToken                      bool
+	adminToken                             string
+	apiVersion, configHash                 string
+	stateMutex                             sync.RWMutex
+	started, shuttingDown                  bool
+	listenerErr                            error
 }
 
 // Build Returns a new Server
@@ -62,203 +97,410 @@ func (config *Config) Build() (*Server, error) {
 		return nil, fmt.Errorf("HTTPSPort must be 0 or greater")
 	}
 
+	if config.MetricsPort < 0 {
+		return nil, fmt.Errorf("MetricsPort must be 0 or greater")
+	}
+
+	if config.AdminPort < 0 {
+		return nil, fmt.Errorf("AdminPort must be 0 or greater")
+	}
+
+	// The admin endpoints explain decisions for any claims so they are only
+	// served on their own TLS listener
+	if (config.AdminPort > 0) != (config.AdminToken != "") {
+		return nil, fmt.Errorf("AdminToken and AdminPort must be set together")
+	}
+
+	if config.ShutdownTimeout < 0 {
+		return nil, fmt.Errorf("ShutdownTimeout must be 0 or greater")
+	}
+
+	if config.PreStopDelay < 0 {
+		return nil, fmt.Errorf("PreStopDelay must be 0 or greater")
+	}
+
 	if config.HTTPPort == 0 && config.HTTPSPort == 0 {
 		return nil, fmt.Errorf("Must enable http or https")
 	}
 
-	if config.Policy == "" {
+	if config.Policy == "" && len(config.PolicyModules) == 0 && config.Bundle == nil {
 		return nil, fmt.Errorf("Policy is required")
 	}
 
-	libTokenMachineConfig := &libtokenmachine.Config{
-		Policy:               config.Policy,
-		NonceLifetime:        config.NonceLifetime,
-		SecretSecrets:        config.SecretSecrets,
-		KeytabKeytabs:        config.KeytabKeytabs,
-		KeytabLifetime:       config.KeytabLifetime,
-		SharedSecretLifetime: config.SharedSecretLifetime,
-	}
+	metrics := newMetrics()
 
-	libTokenMachine, err := serverlib.NewInstance(libTokenMachineConfig)
-	if err != nil {
-		return nil, err
+	var certificates *certificateManager
+	var tlsConfig *tls.Config
+
+	if config.HTTPSPort > 0 || config.AdminPort > 0 {
+
+		var err error
+
+		certificates, err = newCertificateManager(config, metrics)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig, err = config.newTLSConfig(certificates)
+		if err != nil {
+			certificates.shutdown()
+			return nil, err
+		}
 	}
 
 	server := &Server{
-		closed:          make(chan struct{}),
-		libTokenMachine: libTokenMachine,
+		shutdownTimeout:   defaultShutdownTimeout,
+		preStopDelay:      config.PreStopDelay,
+		errs:              make(chan error, 4),
+		disableQueryToken: config.DisableQueryToken,
+		adminToken:        config.AdminToken,
+		apiVersion:        config.APIVersion,
+		configHash:        config.ConfigHash,
+		certificates:      certificates,
 	}
 
-	if config.HTTPPort > 0 {
-		listen := config.Listen
-		if strings.ToLower(listen) == "any" {
-			listen = ""
-		}
-		listener := listen + ":" + strconv.Itoa(config.HTTPPort)
-		zap.L().Debug("Starting HTTP")
-		server.httpServer = &http.Server{Addr: listener, Handler: server}
-		go func() {
-			server.httpServer.ListenAndServe()
-		}()
+	if config.ShutdownTimeout > 0 {
+		server.shutdownTimeout = config.ShutdownTimeout
 	}
 
-	if config.HTTPSPort > 0 {
-		listen := config.Listen
-		if strings.ToLower(listen) == "any" {
-			listen = ""
+	// Bind all of the listeners before anything else is started so that a
+	// port that is in use is returned to the caller
+	var httpListener, httpsListener, metricsListener, adminListener net.Listener
+	var err error
+
+	closeListeners := func() {
+		for _, listener := range []net.Listener{httpListener, httpsListener, metricsListener, adminListener} {
+			if listener != nil {
+				listener.Close()
+			}
 		}
-		listener := listen + ":" + strconv.Itoa(config.HTTPSPort)
+		certificates.shutdown()
+	}
 
-		zap.L().Debug("Starting HTTPS")
+	if config.HTTPPort > 0 {
+		zap.L().Debug("Binding HTTP")
+		httpListener, err = net.Listen("tcp", getListenAddr(config.Listen, config.HTTPPort))
+		if err != nil {
+			return nil, fmt.Errorf("Unable to bind HTTP listener; err->%s", err)
+		}
+	}
 
-		if config.TLSCert == "" {
-			return nil, fmt.Errorf("TLSCert is required when HTTPS port is set")
+	if config.HTTPSPort > 0 {
+		zap.L().Debug("Binding HTTPS")
+		httpsListener, err = net.Listen("tcp", getListenAddr(config.Listen, config.HTTPSPort))
+		if err != nil {
+			closeListeners()
+			return nil, fmt.Errorf("Unable to bind HTTPS listener; err->%s", err)
 		}
+	}
 
-		if config.TLSKey == "" {
-			return nil, fmt.Errorf("TLSKey is required when HTTPS port is set")
+	if config.MetricsPort > 0 {
+		zap.L().Debug("Binding Metrics")
+		metricsListener, err = net.Listen("tcp", getListenAddr(config.Listen, config.MetricsPort))
+		if err != nil {
+			closeListeners()
+			return nil, fmt.Errorf("Unable to bind Metrics listener; err->%s", err)
 		}
+	}
 
-		cert, err := tls.X509KeyPair([]byte(config.TLSCert), []byte(config.TLSKey))
+	if config.AdminPort > 0 {
+		zap.L().Debug("Binding Admin")
+		adminListener, err = net.Listen("tcp", getListenAddr(config.Listen, config.AdminPort))
 		if err != nil {
-			return nil, err
+			closeListeners()
+			return nil, fmt.Errorf("Unable to bind Admin listener; err->%s", err)
 		}
+	}
 
-		server.httpsServer = &http.Server{Addr: listener, Handler: server, TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}}}
+	audit, err := newAuditor(config.AuditOutputPaths)
+	if err != nil {
+		closeListeners()
+		return nil, err
+	}
 
-		go func() {
-			server.httpsServer.ListenAndServeTLS("", "")
-		}()
+	engineConfig := config.engineConfig()
+	engineConfig.Observer = metrics
 
+	tokenMachine, err := engineConfig.Build()
+	if err != nil {
+		closeListeners()
+		audit.shutdown()
+		return nil, err
 	}
 
-	go func() {
+	metrics.register(tokenMachine)
 
-		for {
-			select {
-			case <-server.closed:
-				zap.L().Debug("Shutting down")
+	server.config = config.Copy()
+	server.tokenMachine = tokenMachine
+	server.metrics = metrics
+	server.audit = audit
 
-				if server.httpServer != nil {
-					ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-					defer cancel()
-					server.httpServer.Shutdown(ctx)
-				}
+	if httpListener != nil {
+		zap.L().Debug("Starting HTTP")
+		server.httpServer = &http.Server{Handler: server}
+		server.wg.Add(1)
+		go server.serve(func() error {
+			return server.httpServer.Serve(httpListener)
+		})
+	}
 
-				if server.httpsServer != nil {
-					ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-					defer cancel()
-					server.httpsServer.Shutdown(ctx)
-				}
+	if httpsListener != nil {
+		zap.L().Debug("Starting HTTPS")
+		server.httpsServer = &http.Server{Handler: server, TLSConfig: tlsConfig}
+		server.wg.Add(1)
+		go server.serve(func() error {
+			return server.httpsServer.ServeTLS(httpsListener, "", "")
+		})
+	}
 
-			}
-		}
-	}()
+	if metricsListener != nil {
+		zap.L().Debug("Starting Metrics")
+		server.metricsServer = &http.Server{Handler: metrics.handler()}
+		server.wg.Add(1)
+		go server.serve(func() error {
+			return server.metricsServer.Serve(metricsListener)
+		})
+	}
+
+	if adminListener != nil {
+		zap.L().Debug("Starting Admin")
+		server.adminServer = &http.Server{Handler: http.HandlerFunc(server.serveAdmin), TLSConfig: tlsConfig}
+		server.wg.Add(1)
+		go server.serve(func() error {
+			return server.adminServer.ServeTLS(adminListener, "", "")
+		})
+	}
+
+	server.stateMutex.Lock()
+	server.started = true
+	server.stateMutex.Unlock()
 
 	return server, nil
 }
 
-// ServeHTTP HTTP/HTTPS Handler
-func (t *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+// Reload applies the policy, secrets, keytabs and lifetimes in config to the
+// running server. The config is validated before anything is changed; if an
+// error is returned the server continues with the existing config.
+// Outstanding nonces remain valid. Changes to the listeners, TLS and audit
+// require a restart and are ignored with a warning.
+func (t *Server) Reload(config *Config) error {
 
-	zap.L().Debug(fmt.Sprintf("Entering ServeHTTP path=%s method=%s", r.URL.Path, r.Method))
+	zap.L().Info(fmt.Sprintf("Reloading"))
 
-	defer zap.L().Debug(fmt.Sprintf("Exiting ServeHTTP path=%s method=%s", r.URL.Path, r.Method))
+	if config.Policy == "" && len(config.PolicyModules) == 0 && config.Bundle == nil {
+		return fmt.Errorf("Policy is required")
+	}
 
-	w.Header().Set("Content-Type", "application/json")
+	if (config.AdminPort > 0) != (config.AdminToken != "") {
+		return fmt.Errorf("AdminToken and AdminPort must be set together")
+	}
 
-	token := getBearerToken(r)
+	t.stateMutex.RLock()
+	current := t.config
+	t.stateMutex.RUnlock()
 
-	if token == "" {
-		http.Error(w, newErrorResponse("Token required")+"\n", http.StatusConflict)
-		return
+	for _, name := range current.restartRequired(config) {
+		zap.L().Warn(fmt.Sprintf("Change to %s requires a restart and is ignored", name))
 	}
 
-	switch r.URL.Path {
-	case "/getnonce":
-		nonce, err := t.libTokenMachine.GetNonce(r.Context(), token)
-		if handleERR(w, err) {
-			return
-		}
-		fmt.Fprintf(w, nonce.JSON()+"\n")
-		return
+	err := t.tokenMachine.Reload(config.engineConfig())
+	if err != nil {
+		return err
+	}
 
-	case "/getkeytab":
+	t.stateMutex.Lock()
+	t.config = config.Copy()
+	t.disableQueryToken = config.DisableQueryToken
+	t.adminToken = config.AdminToken
+	t.apiVersion = config.APIVersion
+	t.configHash = config.ConfigHash
+	t.stateMutex.Unlock()
 
-		name := getKey(r, "name")
-		if name == "" {
-			http.Error(w, newErrorResponse("Parameter 'name' required")+"\n", http.StatusConflict)
-			return
-		}
+	zap.L().Info(fmt.Sprintf("Reloaded config %s", config.ConfigHash))
+	return nil
+}
 
-		keytab, err := t.libTokenMachine.GetKeytab(r.Context(), token, name)
-		if handleERR(w, err) {
-			return
-		}
+// Copy returns a copy of the config
+func (config *Config) Copy() *Config {
+	clone := *config
+	return &clone
+}
 
-		fmt.Fprintf(w, keytab.JSON()+"\n")
-		return
+func (config *Config) engineConfig() *engine.Config {
+	return &engine.Config{
+		Policy:                   config.Policy,
+		PolicyModules:            config.PolicyModules,
+		Bundle:                   config.Bundle,
+		PolicyData:               config.PolicyData,
+		NonceLifetime:            config.NonceLifetime,
+		NonceKey:                 config.NonceKey,
+		SingleUseNonce:           config.SingleUseNonce,
+		ReplayCacheSize:          config.ReplayCacheSize,
+		DisableNonceSubjectCheck: config.DisableNonceSubjectCheck,
+		NonceChallenge:           config.NonceChallenge,
+		Issuers:                  config.Issuers,
+		SecretSecrets:            config.SecretSecrets,
+		KeytabKeytabs:            config.KeytabKeytabs,
+		KeytabLifetime:           config.KeytabLifetime,
+		SharedSecretLifetime:     config.SharedSecretLifetime,
+	}
+}
 
-	case "/getsecret":
-		name := getKey(r, "name")
-		if name == "" {
-			http.Error(w, newErrorResponse("Parameter 'name' required")+"\n", http.StatusConflict)
-			return
-		}
+// PolicyConfig returns the config of the policy with the bundle loaded. The
+// bundle is not polled.
+func (config *Config) PolicyConfig() (*engine.PolicyConfig, error) {
 
-		result, err := t.libTokenMachine.GetSecret(r.Context(), token, name)
-		if handleERR(w, err) {
-			return
-		}
-		fmt.Fprintf(w, result.JSON()+"\n")
-		return
+	bundleSource, err := config.Bundle.Build()
+	if err != nil {
+		return nil, err
+	}
+
+	return &engine.PolicyConfig{
+		Policy:  config.Policy,
+		Modules: config.PolicyModules,
+		Bundle:  bundleSource.Bundle(),
+		Data:    config.PolicyData,
+	}, nil
+}
+
+// restartRequired returns the names of the settings that differ between config
+// and update that can not be changed on a running server
+func (config *Config) restartRequired(update *Config) []string {
+
+	var names []string
+
+	if config.Listen != update.Listen {
+		names = append(names, "listen")
+	}
+
+	if config.HTTPPort != update.HTTPPort {
+		names = append(names, "httpPort")
+	}
+
+	if config.HTTPSPort != update.HTTPSPort {
+		names = append(names, "httpsPort")
+	}
+
+	if config.MetricsPort != update.MetricsPort {
+		names = append(names, "metricsPort")
+	}
+
+	if config.AdminPort != update.AdminPort {
+		names = append(names, "adminPort")
+	}
+
+	if config.TLSCert != update.TLSCert || config.TLSKey != update.TLSKey {
+		names = append(names, "tlsCert/tlsKey")
 	}
 
-	http.Error(w, newErrorResponse("Path "+r.URL.Path+" not mapped")+"\n", http.StatusConflict)
+	if config.TLSCertFile != update.TLSCertFile || config.TLSKeyFile != update.TLSKeyFile || config.ClientCAFile != update.ClientCAFile {
+		names = append(names, "tlsCertFile/tlsKeyFile/clientCAFile")
+	}
+
+	if config.ClientCA != update.ClientCA || config.ClientAuth != update.ClientAuth {
+		names = append(names, "clientCA/clientAuth")
+	}
+
+	if config.TLSMinVersion != update.TLSMinVersion || strings.Join(config.TLSCipherSuites, ",") != strings.Join(update.TLSCipherSuites, ",") {
+		names = append(names, "tlsMinVersion/tlsCipherSuites")
+	}
+
+	if config.ShutdownTimeout != update.ShutdownTimeout {
+		names = append(names, "shutdownTimeout")
+	}
+
+	if config.PreStopDelay != update.PreStopDelay {
+		names = append(names, "preStopDelay")
+	}
+
+	if strings.Join(config.AuditOutputPaths, ",") != strings.Join(update.AuditOutputPaths, ",") {
+		names = append(names, "audit")
+	}
 
-	zap.L().Debug(fmt.Sprintf("Exiting ServeHTTP"))
+	return names
 }
 
-func newErrorResponse(message string) string {
-	return "{\"error\":\"" + message + "\"}"
+// Err returns a channel that receives fatal errors from the listeners after
+// Build has returned. The server should be shutdown when an error is received.
+func (t *Server) Err() <-chan error {
+	return t.errs
 }
 
-func handleERR(w http.ResponseWriter, err error) bool {
-	if err == nil {
-		return false
+// serve runs fn until it returns. Errors other than http.ErrServerClosed are
+// fatal and are sent to the errs channel.
+func (t *Server) serve(fn func() error) {
+
+	defer t.wg.Done()
+
+	err := fn()
+	if err == nil || err == http.ErrServerClosed {
+		return
 	}
-	http.Error(w, newErrorResponse(err.Error())+"\n", http.StatusConflict)
-	return true
-}
 
-func getBearerToken(r *http.Request) string {
-	// If the Bearer token is present it may be in Authorization Header in the format 'Authorization: Bearer TOKEN' or as a parameter
-	token := r.Header.Get("Authorization")
-	if token != "" {
-		tokenSlice := strings.Split(token, " ")
-		if len(tokenSlice) > 1 {
-			if strings.ToLower(tokenSlice[0]) == "bearer" {
-				return tokenSlice[1]
-			}
-		}
+	t.setListenerErr(err)
+
+	select {
+	case t.errs <- err:
+	default:
 	}
-	return getKey(r, "bearertoken")
 }
 
-func getKey(r *http.Request, name string) string {
-	keys, ok := r.URL.Query()[name]
-	if !ok || len(keys[0]) < 1 {
-		return ""
+func getListenAddr(listen string, port int) string {
+	if strings.ToLower(listen) == "any" {
+		listen = ""
 	}
-	return string(keys[0])
+	return listen + ":" + strconv.Itoa(port)
 }
 
-// Shutdown Server
+// Shutdown Server. Readiness is set to not ready and after the pre-stop delay
+// the listeners stop accepting new connections and in-flight requests are
+// given up to the shutdown timeout to complete before their connections are
+// closed. The engine is then shutdown. Shutdown returns when all goroutines
+// have exited and may be called more than once.
 func (t *Server) Shutdown() {
+	t.shutdownOnce.Do(t.shutdown)
+}
+
+func (t *Server) shutdown() {
+
 	zap.L().Info(fmt.Sprintf("Stopping"))
-	t.libTokenMachine.Shutdown()
-	close(t.closed)
+
+	t.stateMutex.Lock()
+	t.shuttingDown = true
+	t.stateMutex.Unlock()
+
+	// Give load balancers polling /readyz time to stop sending new requests
+	if t.preStopDelay > 0 {
+		zap.L().Info(fmt.Sprintf("Waiting %s before stopping the listeners", t.preStopDelay))
+		time.Sleep(t.preStopDelay)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), t.shutdownTimeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, httpServer := range []*http.Server{t.httpServer, t.httpsServer, t.metricsServer, t.adminServer} {
+		if httpServer == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(httpServer *http.Server) {
+			defer wg.Done()
+			err := httpServer.Shutdown(ctx)
+			if err != nil {
+				zap.L().Warn(fmt.Sprintf("In-flight requests did not complete within %s; closing connections", t.shutdownTimeout))
+				httpServer.Close()
+			}
+		}(httpServer)
+	}
+	wg.Wait()
+
+	t.tokenMachine.Shutdown()
 	t.wg.Wait()
+	t.certificates.shutdown()
+	t.audit.shutdown()
+
+	zap.L().Info(fmt.Sprintf("Stopped"))
 }
 
 // StatusBadRequest                   = 400 // RFC 7231, 6.5.1
@@ -0,0 +1,311 @@
+/*
+Copyright © 2020 Jody Scott <jody@thescottsweb.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jodydadescott/tokenmachine/internal/engine"
+)
+
+const testPolicy = `
+package main
+
+default auth_get_nonce = true
+default auth_get_keytab = false
+default auth_get_secret = false
+`
+
+// freePort returns a port that was free when it was checked
+func freePort(t *testing.T) int {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// newTestConfig returns a config for a server that listens for HTTP on a
+// free port of the loopback interface
+func newTestConfig(t *testing.T) *Config {
+	return &Config{
+		Policy:   testPolicy,
+		Listen:   "127.0.0.1",
+		HTTPPort: freePort(t),
+	}
+}
+
+// newTestServer builds the server for config and shuts it down at the end of
+// the test
+func newTestServer(t *testing.T, config *Config) *Server {
+
+	server, err := config.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(server.Shutdown)
+	return server
+}
+
+func TestBuildInvalid(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		modify func(config *Config)
+		err    string
+	}{
+		{"negative http port", func(c *Config) { c.HTTPPort = -1 }, "HTTPPort"},
+		{"negative https port", func(c *Config) { c.HTTPSPort = -1 }, "HTTPSPort"},
+		{"negative metrics port", func(c *Config) { c.MetricsPort = -1 }, "MetricsPort"},
+		{"negative shutdown timeout", func(c *Config) { c.ShutdownTimeout = -1 }, "ShutdownTimeout"},
+		{"negative pre-stop delay", func(c *Config) { c.PreStopDelay = -1 }, "PreStopDelay"},
+		{"no listener", func(c *Config) { c.HTTPPort = 0 }, "Must enable http or https"},
+		{"no policy", func(c *Config) { c.Policy = "" }, "Policy is required"},
+		{"invalid policy", func(c *Config) { c.Policy = "package main\nauth_get_nonce {" }, "kerberos.rego"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			config := newTestConfig(t)
+			test.modify(config)
+
+			server, err := config.Build()
+			if err == nil {
+				server.Shutdown()
+				t.Fatalf("expected error")
+			}
+
+			if !strings.Contains(err.Error(), test.err) {
+				t.Errorf("err is %s; want %s", err, test.err)
+			}
+		})
+	}
+}
+
+func TestBuildPortInUse(t *testing.T) {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	config := newTestConfig(t)
+	config.MetricsPort = listener.Addr().(*net.TCPAddr).Port
+
+	server, err := config.Build()
+	if err == nil {
+		server.Shutdown()
+		t.Fatalf("expected bind error")
+	}
+
+	if !strings.Contains(err.Error(), "Unable to bind Metrics listener") {
+		t.Errorf("unexpected err %s", err)
+	}
+
+	// The HTTP listener that was bound before the failure is released
+	listener, err = net.Listen("tcp", getListenAddr(config.Listen, config.HTTPPort))
+	if err != nil {
+		t.Fatalf("HTTP port was not released; err->%s", err)
+	}
+	listener.Close()
+}
+
+func TestBuildServes(t *testing.T) {
+
+	config := newTestConfig(t)
+	server := newTestServer(t, config)
+
+	if health := server.readiness(); health.Status != statusOK {
+		t.Fatalf("server is not ready; %s", health.JSON())
+	}
+
+	resp, err := http.Get("http://" + getListenAddr(config.Listen, config.HTTPPort) + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status is %d", resp.StatusCode)
+	}
+
+	server.Shutdown()
+
+	select {
+	case err := <-server.Err():
+		t.Errorf("unexpected listener error %s", err)
+	default:
+	}
+}
+
+func TestPreStopDelay(t *testing.T) {
+
+	config := newTestConfig(t)
+	config.PreStopDelay = 2 * time.Second
+	server := newTestServer(t, config)
+
+	done := make(chan struct{})
+	go func() {
+		server.Shutdown()
+		close(done)
+	}()
+
+	// Wait for readiness to flip
+	for server.readiness().Status == statusOK {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The listener still serves during the delay and reports not ready
+	resp, err := http.Get("http://" + getListenAddr(config.Listen, config.HTTPPort) + "/readyz")
+	if err != nil {
+		t.Fatalf("listener stopped before the pre-stop delay; err->%s", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("status is %d; want %d", resp.StatusCode, http.StatusServiceUnavailable)
+	}
+
+	select {
+	case <-done:
+		t.Fatalf("shutdown returned before the pre-stop delay")
+	default:
+	}
+
+	<-done
+}
+
+func TestReload(t *testing.T) {
+
+	denyNonce := strings.Replace(testPolicy, "auth_get_nonce = true", "auth_get_nonce = false", 1)
+
+	tests := []struct {
+		name   string
+		modify func(config *Config)
+		err    bool
+		allow  bool
+	}{
+		{"unchanged", func(c *Config) {}, false, true},
+		{"policy", func(c *Config) { c.Policy = denyNonce }, false, false},
+		{"no policy", func(c *Config) { c.Policy = "" }, true, true},
+		{"invalid policy", func(c *Config) { c.Policy = "package main\nauth_get_nonce {" }, true, true},
+		{"restart required", func(c *Config) { c.MetricsPort = 1; c.Policy = denyNonce }, false, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			config := newTestConfig(t)
+			config.ConfigHash = "a"
+			server := newTestServer(t, config)
+
+			update := config.Copy()
+			update.ConfigHash = "b"
+			test.modify(update)
+
+			err := server.Reload(update)
+			if test.err != (err != nil) {
+				t.Fatalf("err is %v; want error %t", err, test.err)
+			}
+
+			// A failed reload leaves the existing config in place
+			hash := "b"
+			if test.err {
+				hash = "a"
+			}
+
+			if server.configHash != hash {
+				t.Errorf("configHash is %s; want %s", server.configHash, hash)
+			}
+
+			explanation, err := server.tokenMachine.ExplainClaims(context.Background(), map[string]interface{}{"sub": "a"}, engine.ActionGetNonce, "", engine.ExplainFails)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if explanation.Allow != test.allow {
+				t.Errorf("get_nonce allow is %t; want %t", explanation.Allow, test.allow)
+			}
+
+			if server.readiness().Status != statusOK {
+				t.Errorf("server is not ready after reload")
+			}
+		})
+	}
+}
+
+func TestRestartRequired(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		modify func(config *Config)
+		names  string
+	}{
+		{"unchanged", func(c *Config) {}, ""},
+		{"reloadable", func(c *Config) { c.Policy = "package main"; c.NonceLifetime = 5 }, ""},
+		{"listen", func(c *Config) { c.Listen = "any" }, "listen"},
+		{"ports", func(c *Config) { c.HTTPPort++; c.MetricsPort = 1 }, "httpPort,metricsPort"},
+		{"tls files", func(c *Config) { c.TLSCertFile = "cert.pem" }, "tlsCertFile/tlsKeyFile/clientCAFile"},
+		{"client auth", func(c *Config) { c.ClientAuth = "require" }, "clientCA/clientAuth"},
+		{"shutdown", func(c *Config) { c.ShutdownTimeout = 1; c.PreStopDelay = 1 }, "shutdownTimeout,preStopDelay"},
+		{"audit", func(c *Config) { c.AuditOutputPaths = []string{"stdout"} }, "audit"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			config := newTestConfig(t)
+			update := config.Copy()
+			test.modify(update)
+
+			if names := strings.Join(config.restartRequired(update), ","); names != test.names {
+				t.Errorf("restartRequired is %s; want %s", names, test.names)
+			}
+		})
+	}
+}
+
+func TestGetListenAddr(t *testing.T) {
+
+	tests := []struct {
+		listen string
+		port   int
+		addr   string
+	}{
+		{"", 80, ":80"},
+		{"any", 80, ":80"},
+		{"ANY", 80, ":80"},
+		{"127.0.0.1", 8080, "127.0.0.1:8080"},
+	}
+
+	for _, test := range tests {
+		if got := getListenAddr(test.listen, test.port); got != test.addr {
+			t.Errorf("getListenAddr(%s, %d) is %s; want %s", test.listen, test.port, got, test.addr)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+/*
+Copyright © 2020 Jody Scott <jody@thescottsweb.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/jodydadescott/tokenmachine/internal/engine"
+	"go.uber.org/zap"
+)
+
+// Client certificate modes
+const (
+	ClientAuthNone    = ""
+	ClientAuthRequest = "request" // Certificate is requested but optional; verified if presented
+	ClientAuthRequire = "require" // Certificate is required; verified by us and passed to policy only if valid
+	ClientAuthVerify  = "verify"  // Certificate is required and must be valid or the handshake fails
+)
+
+// newTLSConfig returns the TLS config for the HTTPS listener. The certificate
+// and client CAs are provided by certificates so that they can be replaced
+// without a restart.
+func (config *Config) newTLSConfig(certificates *certificateManager) (*tls.Config, error) {
+
+	tlsConfig := &tls.Config{
+		GetCertificate: certificates.getCertificate,
+	}
+
+	switch config.TLSMinVersion {
+
+	case "":
+		break
+
+	case "1.0":
+		tlsConfig.MinVersion = tls.VersionTLS10
+
+	case "1.1":
+		tlsConfig.MinVersion = tls.VersionTLS11
+
+	case "1.2":
+		tlsConfig.MinVersion = tls.VersionTLS12
+
+	case "1.3":
+		tlsConfig.MinVersion = tls.VersionTLS13
+
+	default:
+		return nil, fmt.Errorf("TLSMinVersion must be 1.0, 1.1, 1.2 or 1.3")
+	}
+
+	if len(config.TLSCipherSuites) > 0 {
+
+		suites := make(map[string]uint16)
+		for _, suite := range tls.CipherSuites() {
+			suites[suite.Name] = suite.ID
+		}
+
+		for _, name := range config.TLSCipherSuites {
+			id, ok := suites[strings.ToUpper(name)]
+			if !ok {
+				return nil, fmt.Errorf("TLS cipher suite %s is not supported or is insecure", name)
+			}
+			tlsConfig.CipherSuites = append(tlsConfig.CipherSuites, id)
+		}
+	}
+
+	switch config.ClientAuth {
+
+	case ClientAuthNone:
+		return tlsConfig, nil
+
+	case ClientAuthRequest:
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+
+	case ClientAuthRequire:
+		tlsConfig.ClientAuth = tls.RequireAnyClientCert
+
+	case ClientAuthVerify:
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+
+	default:
+		return nil, fmt.Errorf("ClientAuth must be request, require or verify")
+	}
+
+	// The client CAs may change so each handshake gets a config with the
+	// current CAs
+	tlsConfig.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		clone := tlsConfig.Clone()
+		clone.GetConfigForClient = nil
+		clone.ClientCAs = certificates.getClientCAs()
+		return clone, nil
+	}
+
+	return tlsConfig, nil
+}
+
+// getClientCertificate returns the client certificate of the request if it
+// was presented and is valid for the client CAs. Otherwise nil.
+func (t *Server) getClientCertificate(r *http.Request) *engine.ClientCertificate {
+
+	if t.certificates == nil || r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return nil
+	}
+
+	clientCAs := t.certificates.getClientCAs()
+	if clientCAs == nil {
+		return nil
+	}
+
+	if len(r.TLS.VerifiedChains) > 0 {
+		return engine.NewClientCertificate(r.TLS.VerifiedChains[0][0])
+	}
+
+	// The certificate was not verified in the handshake (require mode)
+	intermediates := x509.NewCertPool()
+	for _, cert := range r.TLS.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	_, err := r.TLS.PeerCertificates[0].Verify(x509.VerifyOptions{
+		Roots:         clientCAs,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		zap.L().Debug(fmt.Sprintf("Client certificate %s is not valid; err->%s", r.TLS.PeerCertificates[0].Subject, err))
+		return nil
+	}
+
+	return engine.NewClientCertificate(r.TLS.PeerCertificates[0])
+}
@@ -0,0 +1,315 @@
+/*
+Copyright © 2020 Jody Scott <jody@thescottsweb.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package internal
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCertificate is a certificate and key issued for tests
+type testCertificate struct {
+	cert            *x509.Certificate
+	key             *ecdsa.PrivateKey
+	certPEM, keyPEM string
+}
+
+// tlsCertificate returns the certificate for use by a TLS client or server
+func (t *testCertificate) tlsCertificate() tls.Certificate {
+	return tls.Certificate{
+		Certificate: [][]byte{t.cert.Raw},
+		PrivateKey:  t.key,
+		Leaf:        t.cert,
+	}
+}
+
+// newTestCertificate issues a certificate for name signed by parent. If parent
+// is nil the certificate is a self signed CA.
+func newTestCertificate(t *testing.T, name string, parent *testCertificate, usage x509.ExtKeyUsage) *testCertificate {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+	}
+
+	signer, signerKey := template, key
+
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		signer, signerKey = parent.cert, parent.key
+		template.KeyUsage = x509.KeyUsageDigitalSignature
+		template.ExtKeyUsage = []x509.ExtKeyUsage{usage}
+		if usage == x509.ExtKeyUsageServerAuth {
+			template.DNSNames = []string{name}
+		} else {
+			spiffe, _ := url.Parse("spiffe://example.com/" + name)
+			template.URIs = []*url.URL{spiffe}
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCertificate{
+		cert:    cert,
+		key:     key,
+		certPEM: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		keyPEM:  string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})),
+	}
+}
+
+func TestNewTLSConfig(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		modify func(config *Config)
+		err    string
+		check  func(t *testing.T, tlsConfig *tls.Config)
+	}{
+		{"defaults", func(c *Config) {}, "", func(t *testing.T, tlsConfig *tls.Config) {
+			if tlsConfig.ClientAuth != tls.NoClientCert || tlsConfig.GetConfigForClient != nil {
+				t.Errorf("client certificate is requested")
+			}
+		}},
+		{"min version", func(c *Config) { c.TLSMinVersion = "1.2" }, "", func(t *testing.T, tlsConfig *tls.Config) {
+			if tlsConfig.MinVersion != tls.VersionTLS12 {
+				t.Errorf("MinVersion is %x", tlsConfig.MinVersion)
+			}
+		}},
+		{"invalid min version", func(c *Config) { c.TLSMinVersion = "1.4" }, "TLSMinVersion", nil},
+		{"cipher suites", func(c *Config) {
+			c.TLSCipherSuites = []string{"tls_ecdhe_ecdsa_with_aes_128_gcm_sha256"}
+		}, "", func(t *testing.T, tlsConfig *tls.Config) {
+			if len(tlsConfig.CipherSuites) != 1 || tlsConfig.CipherSuites[0] != tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 {
+				t.Errorf("CipherSuites is %v", tlsConfig.CipherSuites)
+			}
+		}},
+		{"insecure cipher suite", func(c *Config) { c.TLSCipherSuites = []string{"TLS_RSA_WITH_RC4_128_SHA"} }, "not supported", nil},
+		{"request", func(c *Config) { c.ClientAuth = ClientAuthRequest }, "", func(t *testing.T, tlsConfig *tls.Config) {
+			if tlsConfig.ClientAuth != tls.VerifyClientCertIfGiven {
+				t.Errorf("ClientAuth is %s", tlsConfig.ClientAuth)
+			}
+		}},
+		{"require", func(c *Config) { c.ClientAuth = ClientAuthRequire }, "", func(t *testing.T, tlsConfig *tls.Config) {
+			if tlsConfig.ClientAuth != tls.RequireAnyClientCert {
+				t.Errorf("ClientAuth is %s", tlsConfig.ClientAuth)
+			}
+		}},
+		{"verify", func(c *Config) { c.ClientAuth = ClientAuthVerify }, "", func(t *testing.T, tlsConfig *tls.Config) {
+			if tlsConfig.ClientAuth != tls.RequireAndVerifyClientCert {
+				t.Errorf("ClientAuth is %s", tlsConfig.ClientAuth)
+			}
+			clone, err := tlsConfig.GetConfigForClient(nil)
+			if err != nil || clone.ClientCAs == nil {
+				t.Errorf("client CAs are not set per handshake")
+			}
+		}},
+		{"invalid client auth", func(c *Config) { c.ClientAuth = "optional" }, "ClientAuth", nil},
+	}
+
+	ca := newTestCertificate(t, "ca", nil, 0)
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			config := &Config{}
+			test.modify(config)
+
+			certificates := &certificateManager{clientCAs: x509.NewCertPool()}
+			certificates.clientCAs.AddCert(ca.cert)
+
+			tlsConfig, err := config.newTLSConfig(certificates)
+
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("err is %v; want %s", err, test.err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			test.check(t, tlsConfig)
+		})
+	}
+}
+
+func TestClientAuth(t *testing.T) {
+
+	ca := newTestCertificate(t, "ca", nil, 0)
+	otherCA := newTestCertificate(t, "other", nil, 0)
+	server := newTestCertificate(t, "localhost", ca, x509.ExtKeyUsageServerAuth)
+	client := newTestCertificate(t, "client", ca, x509.ExtKeyUsageClientAuth)
+	untrusted := newTestCertificate(t, "untrusted", otherCA, x509.ExtKeyUsageClientAuth)
+
+	tests := []struct {
+		clientAuth string
+		client     *testCertificate
+		handshake  bool
+	}{
+		{ClientAuthNone, nil, true},
+		{ClientAuthNone, client, true},
+		{ClientAuthRequest, nil, true},
+		{ClientAuthRequest, client, true},
+		{ClientAuthRequest, untrusted, false},
+		{ClientAuthRequire, nil, false},
+		{ClientAuthRequire, client, true},
+		{ClientAuthRequire, untrusted, true},
+		{ClientAuthVerify, nil, false},
+		{ClientAuthVerify, client, true},
+		{ClientAuthVerify, untrusted, false},
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	for _, test := range tests {
+
+		name := "none"
+		if test.client != nil {
+			name = test.client.cert.Subject.CommonName
+		}
+
+		t.Run(test.clientAuth+"/"+name, func(t *testing.T) {
+
+			config := newTestConfig(t)
+			config.HTTPPort = 0
+			config.HTTPSPort = freePort(t)
+			config.TLSCert = server.certPEM
+			config.TLSKey = server.keyPEM
+			config.ClientAuth = test.clientAuth
+			config.ClientCA = ca.certPEM
+			newTestServer(t, config)
+
+			tlsConfig := &tls.Config{RootCAs: roots, ServerName: "localhost"}
+			if test.client != nil {
+				// Sent even if it is not issued by a CA the server asks for
+				cert := test.client.tlsCertificate()
+				tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+					return &cert, nil
+				}
+			}
+
+			httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+			defer httpClient.CloseIdleConnections()
+
+			resp, err := httpClient.Get("https://" + getListenAddr(config.Listen, config.HTTPSPort) + "/healthz")
+			if err == nil {
+				resp.Body.Close()
+			}
+
+			if test.handshake != (err == nil) {
+				t.Errorf("err is %v; want handshake %t", err, test.handshake)
+			}
+		})
+	}
+}
+
+func TestGetClientCertificate(t *testing.T) {
+
+	ca := newTestCertificate(t, "ca", nil, 0)
+	otherCA := newTestCertificate(t, "other", nil, 0)
+	client := newTestCertificate(t, "client", ca, x509.ExtKeyUsageClientAuth)
+	untrusted := newTestCertificate(t, "untrusted", otherCA, x509.ExtKeyUsageClientAuth)
+	server := newTestCertificate(t, "localhost", ca, x509.ExtKeyUsageServerAuth)
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+
+	tests := []struct {
+		name      string
+		clientCAs *x509.CertPool
+		state     *tls.ConnectionState
+		spiffeID  string
+	}{
+		{"plain http", clientCAs, nil, ""},
+		{"no certificate", clientCAs, &tls.ConnectionState{}, ""},
+		{"no client auth", nil, &tls.ConnectionState{PeerCertificates: []*x509.Certificate{client.cert}}, ""},
+		{"verified in handshake", clientCAs, &tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{client.cert},
+			VerifiedChains:   [][]*x509.Certificate{{client.cert, ca.cert}},
+		}, "spiffe://example.com/client"},
+		{"verified by server", clientCAs, &tls.ConnectionState{PeerCertificates: []*x509.Certificate{client.cert}}, "spiffe://example.com/client"},
+		{"untrusted", clientCAs, &tls.ConnectionState{PeerCertificates: []*x509.Certificate{untrusted.cert}}, ""},
+		{"server certificate", clientCAs, &tls.ConnectionState{PeerCertificates: []*x509.Certificate{server.cert}}, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			s := &Server{certificates: &certificateManager{clientCAs: test.clientCAs}}
+			r := &http.Request{TLS: test.state}
+
+			cert := s.getClientCertificate(r)
+
+			if test.spiffeID == "" {
+				if cert != nil {
+					t.Errorf("certificate is %s; want none", cert.Subject)
+				}
+				return
+			}
+
+			if cert == nil {
+				t.Fatalf("certificate is nil")
+			}
+
+			if cert.SPIFFEID != test.spiffeID || cert.CommonName != "client" {
+				t.Errorf("certificate is %s %s", cert.CommonName, cert.SPIFFEID)
+			}
+		})
+	}
+}